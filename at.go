@@ -0,0 +1,58 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// LoadJSONAt loads any JSON value, not just an object, at path. Like other
+// loads an object is merged into an object already there, while any other
+// value replaces what is at path. A service given `["a", "b"]` as its whole
+// config can load it at "hosts" and read it back with Get.
+//
+// Only an object can be loaded at the root, the empty path.
+func (this *Settings) LoadJSONAt(path string, b []byte) error {
+	// Keep a copy for Reload, in case the caller reuses b.
+	b = append([]byte(nil), b...)
+
+	return this.load(&loader{
+		source: Source{Name: "LoadJSONAt"},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.logf(LogDebug, "Loading JSON (%d bytes) at %s", len(b), describePath(path))
+			this.readContent(b)
+			var value interface{}
+			if err := this.unmarshalJSON(b, &value); err != nil {
+				return nil, len(b), err
+			}
+			if this.reading != nil && this.reading.order != nil {
+				decoder := json.NewDecoder(bytes.NewReader(b))
+				decoder.UseNumber()
+				readJSONKeyOrder(this.pathSeparator(), path, decoder, this.reading.order, true)
+			}
+			newSettings, err := this.nestValue(path, value)
+			return newSettings, len(b), err
+		},
+	})
+}
+
+// nestValue returns the settings holding value at path. At the root value
+// must be an object, or nil for nothing.
+func (this Settings) nestValue(path string, value interface{}) (map[string]interface{}, error) {
+	if path == "" {
+		switch value := value.(type) {
+		case nil:
+			return nil, nil
+		case map[string]interface{}:
+			return value, nil
+		}
+		return nil, fmt.Errorf("Only an object can be loaded at the root, not %s; give a path to load it at instead", describeKind(value))
+	}
+
+	parent, key := "", path
+	if split := strings.LastIndex(path, this.pathSeparator()); split >= 0 {
+		parent, key = path[:split], path[split+len(this.pathSeparator()):]
+	}
+	return this.nestAt(parent, map[string]interface{}{key: value}), nil
+}
@@ -0,0 +1,129 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// BindOption changes how BindSection decodes a section.
+type BindOption func(config *bindConfig)
+
+type bindConfig struct {
+	optional    bool
+	weaklyTyped bool
+}
+
+// BindOptional allows the section to be missing, in which case the target only
+// gets its defaults.
+func BindOptional() BindOption {
+	return func(config *bindConfig) {
+		config.optional = true
+	}
+}
+
+// BindWeaklyTyped decodes the section as if SetWeaklyTyped(true) was called,
+// converting strings such as "8080" to numbers.
+func BindWeaklyTyped() BindOption {
+	return func(config *bindConfig) {
+		config.weaklyTyped = true
+	}
+}
+
+// Validator is implemented by targets of BindSection that check themselves
+// once decoded.
+type Validator interface {
+	Validate() error
+}
+
+// BindSection decodes the section at path into target, which must be a
+// pointer to a struct, in one go:
+//
+//  1. fields that are still zero get the value of their default tag, such as
+//     `default:"8080"` or `default:"5s"`
+//  2. the section is decoded over them like Get does, so keys that aren't set
+//     keep their defaults
+//  3. if target implements Validator, its Validate method is called
+//
+// A missing section is an error unless BindOptional is given. Every error is
+// prefixed with the path of the section.
+func (this Settings) BindSection(path string, target interface{}, options ...BindOption) error {
+	var config bindConfig
+	for _, option := range options {
+		option(&config)
+	}
+	if config.weaklyTyped {
+		this.weaklyTyped = true
+	}
+
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Could not bind %s: target must be a pointer to a struct, not %T", path, target)
+	}
+
+	if err := this.applyDefaults(path, v.Elem()); err != nil {
+		return fmt.Errorf("Could not bind %s: %s", path, err)
+	}
+
+	rawvalue, err := this.getTyped(path)
+	if err != nil && !(config.optional && errors.Is(err, ErrNotFound)) {
+		return fmt.Errorf("Could not bind %s: %s", path, err)
+	}
+	if err == nil {
+		if err := this.decode(path, rawvalue, target); err != nil {
+			return fmt.Errorf("Could not bind %s: %s", path, err)
+		}
+	}
+
+	if validator, ok := target.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("Could not bind %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// applyDefaults sets every zero field of the struct v, found at path, that
+// has a default tag to the value of the tag. Nested structs get their
+// defaults too. Fields are found at the path decode would decode them from,
+// shown in lower case unless a tag names them.
+func (this Settings) applyDefaults(path string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, squash, skip := decodedName(field)
+		if skip {
+			continue
+		}
+		if name == field.Name {
+			name = strings.ToLower(name)
+		}
+		fieldpath := this.joinPath(path, name)
+		if squash {
+			fieldpath = path
+		}
+		value := v.Field(i)
+
+		if tag, ok := field.Tag.Lookup("default"); ok && isZero(value) {
+			// The tag is a string, so always decode it weakly typed.
+			weak := this
+			weak.weaklyTyped = true
+			if err := weak.decode(fieldpath, tag, value.Addr().Interface()); err != nil {
+				return fmt.Errorf("invalid default for %s: %s", field.Name, err)
+			}
+		}
+
+		if value.Kind() == reflect.Struct && value.Type() != regexpType {
+			if err := this.applyDefaults(fieldpath, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isZero reports whether v is the zero value of its type.
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
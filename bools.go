@@ -0,0 +1,76 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// lenientBools maps the strings GetBoolLenient accepts, in lower case, to
+// their value.
+var lenientBools = map[string]bool{
+	"true": true, "false": false,
+	"on": true, "off": false,
+	"yes": true, "no": false,
+	"y": true, "n": false,
+	"enabled": true, "disabled": false,
+	"1": true, "0": false,
+}
+
+// lenientBoolSpellings lists the keys of lenientBools for error messages.
+const lenientBoolSpellings = "true/false, on/off, yes/no, y/n, enabled/disabled or 1/0"
+
+// GetBoolLenient is GetBool also accepting the strings true/false, on/off,
+// yes/no, y/n, enabled/disabled and 1/0 in any case, as ops-written configs
+// often use. Any other string is an error listing these. GetBool accepts them
+// too with SetWeaklyTyped, and so do bool fields decoded by Get.
+func (this Settings) GetBoolLenient(path string, defaultValue bool) (bool, error) {
+	value, err := this.getBoolLenient(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetBoolLenient", path, err)
+	}
+	return value, err
+}
+
+// getBoolLenient is GetBoolLenient without reporting misuse, see SetDevMode.
+func (this Settings) getBoolLenient(path string, defaultValue bool) (bool, error) {
+	rawvalue, err := this.getTyped(path)
+	if err != nil {
+		return defaultValue, err
+	}
+	return lenientBoolValue(path, rawvalue, defaultValue)
+}
+
+// lenientBoolValue returns rawvalue, found at path, as GetBoolLenient does.
+func lenientBoolValue(path string, rawvalue interface{}, defaultValue bool) (bool, error) {
+	switch value := rawvalue.(type) {
+	case bool:
+		return value, nil
+	case string:
+		parsed, err := parseLenientBool(value)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s: %s", path, err)
+		}
+		return parsed, nil
+	default:
+		return defaultValue, typeError(path, rawvalue, "a bool")
+	}
+}
+
+// parseLenientBool parses s as GetBoolLenient does.
+func parseLenientBool(s string) (bool, error) {
+	value, ok := lenientBools[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return false, fmt.Errorf("%q is not a bool, use %s", s, lenientBoolSpellings)
+	}
+	return value, nil
+}
+
+// lenientBoolHook is a mapstructure decode hook parsing strings stored in
+// bools as GetBoolLenient does, used when weakly typed.
+func lenientBoolHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to.Kind() != reflect.Bool || from.Kind() != reflect.String {
+		return data, nil
+	}
+	return parseLenientBool(reflect.ValueOf(data).String())
+}
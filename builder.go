@@ -0,0 +1,126 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"os"
+)
+
+// Builder records the steps needed to set up a Settings so they can be run in
+// order with Build:
+//
+//	settings, err := flexiconfig.New().
+//		WithDefaults(defaults).
+//		WithFile("/etc/app.json").
+//		WithOptionalFile("~/.app.lua").
+//		WithEnv("APP_").
+//		Build()
+//
+// A Builder can be built any number of times, each Build returns a new and
+// independent Settings.
+type Builder struct {
+	options []func(*Settings)
+	steps   []builderStep
+}
+
+// builderStep is a single recorded load.
+type builderStep struct {
+	description string
+	run         func(*Settings) error
+}
+
+// BuildError is returned by Build when one of the steps fails.
+type BuildError struct {
+	// Step is the index of the failed step, counting from 0.
+	Step int
+	// Description describes the failed step, for instance "file /etc/app.json".
+	Description string
+	// Err is the error returned by the step.
+	Err error
+}
+
+func (this *BuildError) Error() string {
+	return fmt.Sprintf("Step %d (%s) failed: %s", this.Step, this.Description, this.Err)
+}
+
+// Unwrap returns the error returned by the failed step.
+func (this *BuildError) Unwrap() error {
+	return this.Err
+}
+
+// New creates a new empty Builder.
+func New() *Builder {
+	return &Builder{}
+}
+
+// Configure records an option, such as SetStrictConditionals, to apply to the
+// Settings before any step runs.
+func (this *Builder) Configure(option func(s *Settings)) *Builder {
+	this.options = append(this.options, option)
+	return this
+}
+
+// WithStep records a custom step.
+func (this *Builder) WithStep(description string, step func(s *Settings) error) *Builder {
+	this.steps = append(this.steps, builderStep{description, step})
+	return this
+}
+
+// WithDefaults records setting the given map of settings as defaults, see
+// SetDefaults.
+func (this *Builder) WithDefaults(defaults map[string]interface{}) *Builder {
+	return this.WithStep("defaults", func(s *Settings) error {
+		return s.SetDefaults(defaults)
+	})
+}
+
+// WithFile records loading the file at path with LoadFile. A leading "~" is
+// expanded to the user's home directory.
+func (this *Builder) WithFile(path string) *Builder {
+	return this.WithStep("file "+path, func(s *Settings) error {
+		expanded, err := expandHome(path)
+		if err != nil {
+			return err
+		}
+		return s.LoadFile(expanded)
+	})
+}
+
+// WithOptionalFile is like WithFile, but the step is skipped if the file
+// doesn't exist.
+func (this *Builder) WithOptionalFile(path string) *Builder {
+	return this.WithStep("optional file "+path, func(s *Settings) error {
+		expanded, err := expandHome(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(expanded); os.IsNotExist(err) {
+			return nil
+		}
+		return s.LoadFile(expanded)
+	})
+}
+
+// WithEnv records loading the environment variables starting with prefix, see
+// LoadEnv.
+func (this *Builder) WithEnv(prefix string) *Builder {
+	return this.WithStep("env "+prefix, func(s *Settings) error {
+		return s.LoadEnv(prefix)
+	})
+}
+
+// Build creates a new Settings and runs every recorded step in order. The
+// first failing step stops the build and is reported as a *BuildError.
+func (this *Builder) Build() (Settings, error) {
+	settings := NewSettings()
+	for _, option := range this.options {
+		option(&settings)
+	}
+
+	for i, step := range this.steps {
+		if err := step.run(&settings); err != nil {
+			return settings, &BuildError{Step: i, Description: step.description, Err: err}
+		}
+	}
+
+	return settings, nil
+}
@@ -0,0 +1,128 @@
+//go:build go1.16
+// +build go1.16
+
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BundleOption changes how LoadBundleFS checks a bundle.
+type BundleOption int
+
+const (
+	// BundleRejectStrays makes config files of the bundle that its manifest
+	// doesn't list an error, rather than a logged warning.
+	BundleRejectStrays BundleOption = iota
+)
+
+// LoadBundleFS loads a bundle of configs from fsys, such as an embed.FS, in
+// the order given by the manifest file. The manifest is a JSON array of the
+// paths of the configs, relative to the directory of the manifest, in any
+// format known to LoadFileAs. Every config listed must exist, and config
+// files of fsys the manifest doesn't list are logged as warnings, or are an
+// error with BundleRejectStrays. All of this is checked before loading
+// anything.
+//
+// It requires Go 1.16 or later.
+func (this *Settings) LoadBundleFS(fsys fs.FS, manifest string, options ...BundleOption) error {
+	rejectStrays := false
+	for _, option := range options {
+		if option == BundleRejectStrays {
+			rejectStrays = true
+		}
+	}
+
+	b, err := fs.ReadFile(fsys, manifest)
+	if err != nil {
+		return fmt.Errorf("Could not read bundle manifest %s: %s", manifest, err)
+	}
+	var entries []string
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return fmt.Errorf("Invalid bundle manifest %s: it must be an array of paths: %s", manifest, err)
+	}
+
+	dir := path.Dir(manifest)
+	listed := make(map[string]bool, len(entries))
+	loaders := make([]*loader, len(entries))
+	for i, entry := range entries {
+		name := path.Join(dir, entry)
+		format := strings.TrimPrefix(path.Ext(name), ".")
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("Invalid bundle manifest %s: entry %q is outside of the bundle", manifest, entry)
+		}
+		if listed[name] {
+			return fmt.Errorf("Invalid bundle manifest %s: entry %q is listed twice", manifest, entry)
+		}
+		if !isFileFormat(format) {
+			return fmt.Errorf("Invalid bundle manifest %s: entry %q is not in a known config format", manifest, entry)
+		}
+		if info, err := fs.Stat(fsys, name); err != nil {
+			return fmt.Errorf("Invalid bundle manifest %s: entry %q: %s", manifest, entry, err)
+		} else if info.IsDir() {
+			return fmt.Errorf("Invalid bundle manifest %s: entry %q is a directory", manifest, entry)
+		}
+		listed[name] = true
+		loaders[i] = bundleLoader(fsys, name, format)
+	}
+
+	var strays []string
+	err = fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && name != manifest && !listed[name] && isFileFormat(strings.TrimPrefix(path.Ext(name), ".")) {
+			strays = append(strays, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Could not read bundle of %s: %s", manifest, err)
+	}
+	sort.Strings(strays)
+	for _, stray := range strays {
+		if rejectStrays {
+			return fmt.Errorf("Invalid bundle manifest %s: %s is not listed", manifest, stray)
+		}
+		this.logf(LogWarning, "Bundle manifest %s doesn't list %s", manifest, stray)
+	}
+
+	for i, l := range loaders {
+		if err := this.load(l); err != nil {
+			return fmt.Errorf("Could not load bundle %s: entry %q: %s", manifest, entries[i], err)
+		}
+	}
+	return nil
+}
+
+// bundleLoader returns the loader for the file name of fsys, in format.
+func bundleLoader(fsys fs.FS, name, format string) *loader {
+	return &loader{
+		source: Source{Name: name},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			content, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, 0, err
+			}
+			this.logf(LogDebug, "Loading %s (%d bytes)", name, len(content))
+			this.readContent(content)
+
+			newSettings, err := this.decodeContent(name, format, content)
+			return newSettings, len(content), err
+		},
+	}
+}
+
+// isFileFormat returns whether format is known to LoadFileAs.
+func isFileFormat(format string) bool {
+	fileFormatsLock.RLock()
+	defer fileFormatsLock.RUnlock()
+
+	_, ok := fileFormats[format]
+	return ok
+}
@@ -0,0 +1,96 @@
+//go:build go1.16
+// +build go1.16
+
+package flexiconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadBundleFS(t *testing.T) {
+	bundle := fstest.MapFS{
+		"config/manifest.json":     {Data: []byte(`["base.json", "env/prod.json", "../shared.json"]`)},
+		"config/base.json":         {Data: []byte(`{"port": 80, "name": "base", "db": {"host": "localhost"}}`)},
+		"config/env/prod.json":     {Data: []byte(`{"port": 443, "db": {"host": "db"}}`)},
+		"shared.json":              {Data: []byte(`{"name": "shared"}`)},
+		"config/README.md":         {Data: []byte(`not a config`)},
+		"config/env/staging.json":  {Data: []byte(`{"port": 8443}`)},
+		"config/manifest-old.json": {Data: []byte(`[]`)},
+	}
+
+	// Entries load in manifest order, relative to the manifest, and configs
+	// that aren't listed are logged.
+	settings := NewSettings()
+	var warnings []string
+	settings.SetLogger(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		if level == LogWarning {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}))
+	if err := settings.LoadBundleFS(bundle, "config/manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db"},"name":"shared","port":443}` {
+		t.Errorf("settings are %s", got)
+	}
+	var sources []string
+	for _, source := range settings.Sources() {
+		sources = append(sources, source.Name)
+	}
+	if got := strings.Join(sources, " "); got != "config/base.json config/env/prod.json shared.json" {
+		t.Errorf("sources are %s", got)
+	}
+	want := []string{
+		"Bundle manifest config/manifest.json doesn't list config/env/staging.json",
+		"Bundle manifest config/manifest.json doesn't list config/manifest-old.json",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+
+	// With BundleRejectStrays they are an error, before anything is loaded.
+	settings = NewSettings()
+	err := settings.LoadBundleFS(bundle, "config/manifest.json", BundleRejectStrays)
+	if err == nil || err.Error() != "Invalid bundle manifest config/manifest.json: config/env/staging.json is not listed" {
+		t.Errorf("LoadBundleFS with BundleRejectStrays = %v", err)
+	}
+	if got := string(settings.GetJSON()); got != `{}` {
+		t.Errorf("a rejected bundle loaded %s", got)
+	}
+
+	for manifest, message := range map[string]string{
+		`["a.json", "missing.json"]`: `entry "missing.json": open missing.json: file does not exist`,
+		`["a.json", "a.json"]`:       `entry "a.json" is listed twice`,
+		`["../a.json"]`:              `entry "../a.json" is outside of the bundle`,
+		`["a.txt"]`:                  `entry "a.txt" is not in a known config format`,
+		`["dir.json"]`:               `entry "dir.json" is a directory`,
+		`{"a": "a.json"}`:            "it must be an array of paths",
+	} {
+		settings := NewSettings()
+		fsys := fstest.MapFS{
+			"manifest.json":   {Data: []byte(manifest)},
+			"a.json":          {Data: []byte(`{"a": 1}`)},
+			"a.txt":           {Data: []byte(`a`)},
+			"dir.json/b.json": {Data: []byte(`{}`)},
+		}
+		err := settings.LoadBundleFS(fsys, "manifest.json")
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("manifest %s = %v, want an error containing %q", manifest, err, message)
+		}
+		if got := string(settings.GetJSON()); got != `{}` {
+			t.Errorf("manifest %s loaded %s", manifest, got)
+		}
+	}
+
+	settings = NewSettings()
+	if err := settings.LoadBundleFS(bundle, "missing.json"); err == nil || !strings.HasPrefix(err.Error(), "Could not read bundle manifest missing.json: ") {
+		t.Errorf("a missing manifest = %v", err)
+	}
+	bundle["config/env/prod.json"] = &fstest.MapFile{Data: []byte(`{"port": `)}
+	if err := settings.LoadBundleFS(bundle, "config/manifest.json"); err == nil || !strings.HasPrefix(err.Error(), `Could not load bundle config/manifest.json: entry "env/prod.json": `) {
+		t.Errorf("a broken entry = %v", err)
+	}
+}
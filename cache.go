@@ -0,0 +1,172 @@
+package flexiconfig
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolveCache memoizes resolved values, such as file references, by path.
+type resolveCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]resolvedEntry
+	// generation changes on every invalidation, so that a value resolved
+	// while the settings changed isn't stored.
+	generation uint64
+	// dependents maps paths to those of the values resolved from them, such
+	// as by ReferenceResolver.
+	dependents map[string][]string
+}
+
+type resolvedEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newResolveCache() *resolveCache {
+	return &resolveCache{entries: make(map[string]resolvedEntry)}
+}
+
+// SetResolveCacheTTL sets how long resolved values, such as the content of
+// file references, are cached. Cached values are always dropped when the
+// value at their path, or one of its parents or children, changes. With a TTL
+// of 0, the default, they are kept until then, a negative TTL disables the
+// cache.
+func (this *Settings) SetResolveCacheTTL(ttl time.Duration) {
+	this.lazyInit()
+
+	this.resolved.lock.Lock()
+	this.resolved.ttl = ttl
+	this.resolved.entries = make(map[string]resolvedEntry)
+	this.resolved.dependents = nil
+	this.resolved.generation++
+	this.resolved.lock.Unlock()
+}
+
+// InvalidateCache drops the cached resolved values at path, its parents and
+// its children, for instance after a referenced file changed. An empty path
+// drops everything.
+func (this Settings) InvalidateCache(path string) {
+	this.resolved.invalidate(path, this.pathSeparator())
+}
+
+// invalidate drops the entries at path, its parents and its children, along
+// with those of the values resolved from them.
+func (this *resolveCache) invalidate(path string, sep string) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.generation++
+	this.drop(path, sep)
+}
+
+// drop is invalidate without locking.
+func (this *resolveCache) drop(path string, sep string) {
+	for known := range this.entries {
+		if relatedPaths(path, known, sep) {
+			delete(this.entries, known)
+		}
+	}
+	for target, dependents := range this.dependents {
+		if !relatedPaths(path, target, sep) {
+			continue
+		}
+		delete(this.dependents, target)
+		for _, dependent := range dependents {
+			this.drop(dependent, sep)
+		}
+	}
+}
+
+// depend records that the value at path is resolved from the one at target,
+// so that invalidating target invalidates path too.
+func (this *resolveCache) depend(path string, target string) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, dependent := range this.dependents[target] {
+		if dependent == path {
+			return
+		}
+	}
+	if this.dependents == nil {
+		this.dependents = make(map[string][]string)
+	}
+	this.dependents[target] = append(this.dependents[target], path)
+}
+
+// relatedPaths returns whether known is path, one of its parents or one of its
+// children. Every path is related to the empty path.
+func relatedPaths(path string, known string, sep string) bool {
+	return path == "" || known == path || strings.HasPrefix(known, path+sep) || strings.HasPrefix(path, known+sep)
+}
+
+// lookup returns the cached value at path and whether there is one, as well as
+// the generation to pass to store.
+func (this *resolveCache) lookup(path string) (interface{}, bool, uint64) {
+	if this == nil {
+		return nil, false, 0
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[path]
+	if ok && !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(this.entries, path)
+		ok = false
+	}
+	return entry.value, ok, this.generation
+}
+
+// store caches value at path, unless something was invalidated since
+// generation was returned by lookup.
+func (this *resolveCache) store(path string, value interface{}, generation uint64) {
+	if this == nil {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.ttl < 0 || generation != this.generation {
+		return
+	}
+	entry := resolvedEntry{value: value}
+	if this.ttl > 0 {
+		entry.expires = time.Now().Add(this.ttl)
+	}
+	this.entries[path] = entry
+}
+
+// getResolved returns the value at path with the resolvers run on it, see
+// AddResolver, using the cache.
+func (this Settings) getResolved(path string) (interface{}, error) {
+	if len(this.resolvers) == 0 {
+		return this.RawGet(path)
+	}
+
+	value, ok, generation := this.resolved.lookup(path)
+	if ok {
+		return value, nil
+	}
+
+	raw, err := this.RawGet(path)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = this.resolve(path, raw); err != nil {
+		return nil, err
+	}
+	this.resolved.store(path, value, generation)
+	return value, nil
+}
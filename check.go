@@ -0,0 +1,313 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The categories of the problems found by Check.
+const (
+	CategoryRequired   = "required"
+	CategorySchema     = "schema"
+	CategoryType       = "type"
+	CategoryDeprecated = "deprecated"
+	CategoryUnused     = "unused"
+)
+
+// CheckOptions selects what Check checks. Every check left unset is skipped.
+type CheckOptions struct {
+	// Required lists the paths that must be set to something other than null.
+	Required []string
+	// Struct is validated like ValidateAgainstStruct does, and its problems
+	// are errors.
+	Struct interface{}
+	// ReportUnused makes keys that no field of Struct uses warnings. It is
+	// ignored without Struct.
+	ReportUnused bool
+	// Deprecated maps paths that shouldn't be used anymore to a message, such
+	// as what to use instead. Setting one of them is a warning.
+	Deprecated map[string]string
+	// Kinds maps paths to the kind their value must have, one of string,
+	// number, bool, array, object or null, as SetTypeStability names them.
+	// Paths that aren't set are skipped.
+	Kinds map[string]string
+}
+
+// Problem is something wrong with the settings found by Check.
+type Problem struct {
+	// Path is where the problem is, "" for the root.
+	Path string
+	// Category is what kind of check found the problem, such as
+	// CategoryRequired.
+	Category string
+	Message  string
+}
+
+// Report lists the problems found by Check, errors and warnings apart.
+type Report struct {
+	Errors   []Problem
+	Warnings []Problem
+}
+
+// Err returns a *ValidationError listing the errors of the report, or nil if
+// there are none. Warnings are never an error.
+func (this Report) Err() error {
+	if len(this.Errors) == 0 {
+		return nil
+	}
+	return newValidationError(this.Errors)
+}
+
+// String formats the report for logs, with a summary line followed by a line
+// for every problem.
+func (this Report) String() string {
+	if len(this.Errors) == 0 && len(this.Warnings) == 0 {
+		return "No problems found"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, %s", plural(len(this.Errors), "error"), plural(len(this.Warnings), "warning"))
+	for _, problem := range this.Errors {
+		fmt.Fprintf(&b, "\n  error: %s: %s", problem.Category, problem.Message)
+	}
+	for _, problem := range this.Warnings {
+		fmt.Fprintf(&b, "\n  warning: %s: %s", problem.Category, problem.Message)
+	}
+	return b.String()
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// requirement is a constraint between several paths registered with
+// RequireOneOf or RequireTogether.
+type requirement struct {
+	oneOf bool
+	paths []string
+}
+
+// RequireOneOf makes Check and Validate report an error unless exactly one of
+// paths is set, for settings that can be given in several exclusive ways such
+// as a token or a key file.
+func (this *Settings) RequireOneOf(paths ...string) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.requirements = append(this.requirements, requirement{oneOf: true, paths: paths})
+}
+
+// RequireTogether makes Check and Validate report an error if some of paths
+// are set but not all of them, for settings that only make sense together
+// such as a certificate and its key.
+func (this *Settings) RequireTogether(paths ...string) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.requirements = append(this.requirements, requirement{paths: paths})
+}
+
+// Validate runs the checks registered with RequireOneOf and RequireTogether,
+// and returns the errors found. It is Check(CheckOptions{}).Err().
+func (this Settings) Validate() error {
+	return this.Check(CheckOptions{}).Err()
+}
+
+// isSet returns whether path is set to something other than null, or an empty
+// value if SetEmptyIsMissing says so. The caller must hold the lock.
+func (this Settings) isSet(path string) bool {
+	value, err := this.rawGet(path)
+	return err == nil && !this.missingValue(value)
+}
+
+// check adds a problem to problems if the requirement isn't met. The caller
+// must hold the lock.
+func (this requirement) check(settings Settings, problems *[]Problem) {
+	var set, unset []string
+	for _, path := range this.paths {
+		if settings.isSet(path) {
+			set = append(set, path)
+		} else {
+			unset = append(unset, path)
+		}
+	}
+
+	all := strings.Join(this.paths, ", ")
+	switch {
+	case this.oneOf && len(set) == 0:
+		addProblem(problems, this.paths[0], CategoryRequired, "One of %s is required, none is set", all)
+	case this.oneOf && len(set) > 1:
+		addProblem(problems, set[1], CategoryRequired, "Only one of %s may be set, %s are", all, strings.Join(set, " and "))
+	case !this.oneOf && len(set) > 0 && len(unset) > 0:
+		verb := "is"
+		if len(unset) > 1 {
+			verb = "are"
+		}
+		addProblem(problems, unset[0], CategoryRequired, "%s must be set together, %s %s not", all, strings.Join(unset, " and "), verb)
+	}
+}
+
+// Check runs every check selected by opts, along with those registered with
+// RequireOneOf and RequireTogether, at once and returns all the problems
+// found, so that startup or CI needs a single call. Missing required keys,
+// schema problems and values of the wrong kind are errors, while deprecated
+// and unused keys are warnings.
+func (this Settings) Check(opts CheckOptions) Report {
+	this.rlock()
+	defer this.runlock()
+
+	var report Report
+	for _, path := range opts.Required {
+		if !this.isSet(path) {
+			addProblem(&report.Errors, path, CategoryRequired, "%s is required", path)
+		}
+	}
+	for _, requirement := range this.requirements {
+		if len(requirement.paths) > 0 {
+			requirement.check(this, &report.Errors)
+		}
+	}
+
+	if opts.Struct != nil {
+		t := reflect.TypeOf(opts.Struct)
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			addProblem(&report.Errors, "", CategorySchema, "Cannot validate against %T, it is not a struct", opts.Struct)
+		} else {
+			this.validateStruct("", t, this.settings, &report.Errors)
+			if opts.ReportUnused {
+				this.unusedKeys("", t, this.settings, &report.Warnings)
+			}
+		}
+	}
+
+	for _, path := range sortedPaths(opts.Kinds) {
+		value, err := this.rawGet(path)
+		if err != nil {
+			continue
+		}
+		if kind := jsonKind(value); kind != opts.Kinds[path] {
+			addProblem(&report.Errors, path, CategoryType, "%s is %s, it must be %s", path, kind, opts.Kinds[path])
+		}
+	}
+
+	for _, path := range sortedPaths(opts.Deprecated) {
+		if _, err := this.rawGet(path); err != nil {
+			continue
+		}
+		if message := opts.Deprecated[path]; message != "" {
+			addProblem(&report.Warnings, path, CategoryDeprecated, "%s is deprecated: %s", path, message)
+		} else {
+			addProblem(&report.Warnings, path, CategoryDeprecated, "%s is deprecated", path)
+		}
+	}
+	return report
+}
+
+// sortedPaths returns the keys of m sorted.
+func sortedPaths(m map[string]string) []string {
+	paths := make([]string, 0, len(m))
+	for path := range m {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// unusedKeys adds a problem for every key of m, found at path, that no field
+// of the struct type t uses.
+func (this Settings) unusedKeys(path string, t reflect.Type, m map[string]interface{}, problems *[]Problem) {
+	fields := make(map[string]reflect.Type)
+	structFields(t, fields)
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keypath := this.joinPath(path, key)
+		fieldType, ok := fields[key]
+		for name, ft := range fields {
+			if !ok && strings.EqualFold(name, key) {
+				fieldType, ok = ft, true
+			}
+		}
+		if !ok {
+			addProblem(problems, keypath, CategoryUnused, "%s is not used", keypath)
+			continue
+		}
+		this.unusedValue(keypath, fieldType, m[key], problems)
+	}
+}
+
+// unusedValue checks value, found at path, for unused keys against the type t.
+func (this Settings) unusedValue(path string, t reflect.Type, value interface{}, problems *[]Problem) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Struct && t != regexpType && t != reflect.TypeOf(time.Time{}) {
+			this.unusedKeys(path, t, v, problems)
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, element := range v {
+				this.unusedValue(fmt.Sprintf("%s[%d]", path, i), t.Elem(), element, problems)
+			}
+		}
+	}
+}
+
+// structFields adds the exported fields of the struct type t to fields, keyed
+// by the name they are decoded from, including those of squashed structs.
+func structFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, squash, skip := decodedName(field)
+		if skip {
+			continue
+		}
+		if squash {
+			structFields(field.Type, fields)
+			continue
+		}
+		fields[name] = field.Type
+	}
+}
+
+// decodedName returns the key the struct field is decoded from, which is
+// matched case insensitively, as mapstructure does: the name given by its
+// mapstructure tag or else its own. squash is true for a squashed struct,
+// whose fields are decoded from the map holding it, and skip for a field that
+// isn't decoded at all, such as an unexported one.
+func decodedName(field reflect.StructField) (name string, squash bool, skip bool) {
+	name = field.Name
+	if tag := field.Tag.Get("mapstructure"); tag != "" {
+		options := strings.Split(tag, ",")
+		if options[0] == "-" {
+			return "", false, true
+		}
+		if options[0] != "" {
+			name = options[0]
+		}
+		for _, option := range options[1:] {
+			squash = squash || option == "squash"
+		}
+	}
+	squash = squash && field.Type.Kind() == reflect.Struct
+	// The exported fields of an embedded struct can be decoded even if its
+	// type isn't exported.
+	return name, squash, field.PkgPath != "" && !(squash && field.Anonymous)
+}
@@ -0,0 +1,189 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ComputedAuto is the value that makes a path registered with
+// RegisterComputed be computed even though it is set.
+const ComputedAuto = "auto"
+
+// ComputedFunc computes the value at a registered path from a snapshot of the
+// settings.
+type ComputedFunc func(s Settings) (interface{}, error)
+
+// JSONOption changes what GetJSONWithOptions returns.
+type JSONOption int
+
+const (
+	// JSONMaterializeComputed replaces the values at paths registered with
+	// RegisterComputed by their computed values.
+	JSONMaterializeComputed JSONOption = iota
+)
+
+// RegisterComputed makes RawGet, and with it every getter, call fn whenever
+// path is not set or is set to ComputedAuto, and return its result instead.
+// fn is given a snapshot of the settings, so it can read any other value,
+// computed ones included, without holding up or deadlocking the settings.
+// Computed values that end up depending on themselves are an error.
+func (this *Settings) RegisterComputed(path string, fn ComputedFunc) {
+	this.wlock()
+	defer this.wunlock()
+
+	if this.computed == nil {
+		this.computed = make(map[string]ComputedFunc)
+	}
+	this.computed[path] = fn
+}
+
+// computes reports whether value, read with err, is to be replaced by the
+// result of fn.
+func computes(fn ComputedFunc, value interface{}, err error) bool {
+	if fn == nil {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, ErrNotFound)
+	}
+	return value == ComputedAuto
+}
+
+// compute calls fn for the value at path, given a snapshot. The snapshot must
+// have been taken by this.snapshot.
+func (this Settings) compute(path string, fn ComputedFunc, snapshot Settings) (interface{}, error) {
+	for i, computing := range this.computing {
+		if computing == path {
+			cycle := strings.Join(this.computing[i:], " -> ")
+			return nil, fmt.Errorf("Could not compute %s: it depends on itself (%s -> %s)", path, cycle, path)
+		}
+	}
+	snapshot.computing = append(append([]string(nil), this.computing...), path)
+
+	value, err := fn(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compute %s: %s", path, err)
+	}
+	return normalize(this.pathSeparator(), path, value, this.depthLimit())
+}
+
+// snapshot returns a copy of the settings that shares nothing that can be
+// changed with them. The caller must hold the lock.
+func (this Settings) snapshot() Settings {
+	snapshot := this
+	snapshot.settings = deepCopy(this.settings).(map[string]interface{})
+	snapshot.defaults = deepCopy(this.defaults).(map[string]interface{})
+	snapshot.secrets = append([]string(nil), this.secrets...)
+	snapshot.exportFilters = append([]exportFilter(nil), this.exportFilters...)
+	snapshot.resolvers = append([]Resolver(nil), this.resolvers...)
+	snapshot.provenance = this.provenance.copy()
+	snapshot.luaModules = nil
+	snapshot.lock = nil
+	snapshot.overlays = nil
+	snapshot.regexps = nil
+	snapshot.stats = nil
+	snapshot.urls = nil
+	snapshot.reloads = nil
+	snapshot.postLoad = nil
+	snapshot.history = nil
+	snapshot.hashes = nil
+	snapshot.pending = nil
+	snapshot.resolved = nil
+	snapshot.kinds = nil
+	snapshot.computed = nil
+	snapshot.results = nil
+	snapshot.order = this.order.copy()
+	snapshot.lazyInit()
+	*snapshot.results = *this.results
+
+	if this.kinds != nil {
+		snapshot.kinds = make(map[string]string, len(this.kinds))
+		for path, kind := range this.kinds {
+			snapshot.kinds[path] = kind
+		}
+	}
+
+	for name, loader := range this.luaModules {
+		snapshot.luaModules[name] = loader
+	}
+	if this.computed != nil {
+		snapshot.computed = make(map[string]ComputedFunc, len(this.computed))
+		for path, fn := range this.computed {
+			snapshot.computed[path] = fn
+		}
+	}
+	return snapshot
+}
+
+// capture takes a snapshot of the settings under the lock. Serializing the
+// snapshot rather than the settings can't be disturbed by a load merging into
+// them meanwhile, and doesn't hold the lock while encoding.
+func (this Settings) capture() Settings {
+	this.rlock()
+	defer this.runlock()
+	return this.snapshot()
+}
+
+// GetJSONWithOptions is GetJSON using the given options. Unlike GetJSON it
+// returns an error rather than panicking, as computing values can fail.
+func (this Settings) GetJSONWithOptions(options ...JSONOption) ([]byte, error) {
+	materialize := false
+	for _, option := range options {
+		if option == JSONMaterializeComputed {
+			materialize = true
+		}
+	}
+
+	snapshot := this.capture()
+	if !materialize || len(snapshot.computed) == 0 {
+		if err := checkStructure(snapshot.pathSeparator(), "", snapshot.settings, snapshot.depthLimit()); err != nil {
+			return nil, err
+		}
+		return json.Marshal(snapshot.jsonValue(snapshot.settings))
+	}
+
+	paths := make([]string, 0, len(snapshot.computed))
+	for path := range snapshot.computed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Compute every value before setting any, so that each is computed from
+	// the settings as they are.
+	values := make([]interface{}, len(paths))
+	for i, path := range paths {
+		value, err := snapshot.RawGet(path)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	for i, path := range paths {
+		if _, err := snapshot.RawSetMode(SetCreate, path, values[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkStructure(snapshot.pathSeparator(), "", snapshot.settings, snapshot.depthLimit()); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshot.jsonValue(snapshot.settings))
+}
+
+// GetPrettyJSONWithOptions is GetPrettyJSON using the given options. Like
+// GetJSONWithOptions it returns an error rather than panicking.
+func (this Settings) GetPrettyJSONWithOptions(prefix, indent string, options ...JSONOption) ([]byte, error) {
+	b, err := this.GetJSONWithOptions(options...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, prefix, indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,122 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Reserved keys used to mark a conditional section. A value that is a map
+// containing one of these keys is replaced, at merge time, by the child of
+// that key which matches the running platform, for instance:
+//
+//	{"cache_dir": {"$os": {"windows": "C:\\cache", "default": "/var/cache"}}}
+//
+// The "default" child is used when no entry matches.
+const (
+	ConditionalOS      = "$os"
+	ConditionalArch    = "$arch"
+	ConditionalDefault = "default"
+)
+
+// SetStrictConditionals controls what happens to a conditional section that
+// has neither an entry for the running platform nor a default. By default the
+// key is dropped, with strict set to true merging returns an error instead.
+func (this *Settings) SetStrictConditionals(strict bool) {
+	this.strictConditionals = strict
+}
+
+// resolveConditionals returns a copy of the given settings with every
+// conditional section replaced by its effective value.
+func (this Settings) resolveConditionals(m map[string]interface{}) (map[string]interface{}, error) {
+	resolved, _, err := this.resolveConditionalValue("", m)
+	if err != nil {
+		return nil, err
+	}
+	return resolved.(map[string]interface{}), nil
+}
+
+// resolveConditionalValue resolves a single value found at path. The returned
+// bool is false if the value should be dropped altogether.
+func (this Settings) resolveConditionalValue(path string, value interface{}) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v, true, nil
+		}
+		if key := conditionalKey(v); key != "" && path != "" {
+			choice, keep, err := this.chooseConditional(path, key, v)
+			if err != nil || !keep {
+				return nil, false, err
+			}
+			return this.resolveConditionalValue(path, choice)
+		}
+
+		newMap := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			resolved, keep, err := this.resolveConditionalValue(this.joinPath(path, key), child)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				newMap[key] = resolved
+			}
+		}
+		return newMap, true, nil
+	case []interface{}:
+		newSlice := make([]interface{}, 0, len(v))
+		for i, child := range v {
+			resolved, keep, err := this.resolveConditionalValue(fmt.Sprintf("%s[%d]", path, i), child)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				newSlice = append(newSlice, resolved)
+			}
+		}
+		return newSlice, true, nil
+	default:
+		return value, true, nil
+	}
+}
+
+// conditionalKey returns the reserved key m is conditional on, or an empty
+// string if m is a regular map.
+func conditionalKey(m map[string]interface{}) string {
+	if _, ok := m[ConditionalOS]; ok {
+		return ConditionalOS
+	}
+	if _, ok := m[ConditionalArch]; ok {
+		return ConditionalArch
+	}
+	return ""
+}
+
+// chooseConditional selects the value of the conditional section m for the
+// running platform. The returned bool is false if nothing matched and the key
+// should be dropped.
+func (this Settings) chooseConditional(path, key string, m map[string]interface{}) (interface{}, bool, error) {
+	want := runtime.GOOS
+	if key == ConditionalArch {
+		want = runtime.GOARCH
+	}
+
+	if len(m) != 1 {
+		return nil, false, fmt.Errorf("Conditional section %s must only contain %s", path, key)
+	}
+
+	choices, ok := m[key].(map[string]interface{})
+	if !ok {
+		return nil, false, fmt.Errorf("Conditional section %s is not a map", this.joinPath(path, key))
+	}
+
+	if value, ok := choices[want]; ok {
+		return value, true, nil
+	}
+	if value, ok := choices[ConditionalDefault]; ok {
+		return value, true, nil
+	}
+	if this.strictConditionals {
+		return nil, false, fmt.Errorf("Could not resolve %s (no %s entry for %s and no default)", path, key, want)
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,64 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// conventionFormats are the extensions LoadConvention looks for.
+var conventionFormats = []string{"json", "lua"}
+
+// LoadConvention loads the config files of dir named by the convention
+//
+//	<baseName>.json             shared by every environment
+//	<baseName>.<env>.json       for the environment env
+//	<baseName>.local.json       for the local machine, usually not committed
+//
+// in that order, skipping the files that don't exist, and the environment
+// file if env is empty. Each file can be a .lua file instead, but having both
+// for the same file is an error. The files are loaded with LoadAll, so either
+// all of them are merged or none are. The paths of the files loaded are
+// returned.
+func (this *Settings) LoadConvention(dir, baseName, env string) ([]string, error) {
+	dir, err := this.expandPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{baseName}
+	if env != "" {
+		names = append(names, baseName+"."+env)
+	}
+	names = append(names, baseName+".local")
+
+	var paths []string
+	for _, name := range names {
+		found := ""
+		for _, format := range conventionFormats {
+			path := filepath.Join(dir, name+"."+format)
+			stat, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if stat.IsDir() {
+				return nil, fmt.Errorf("%s is a directory", path)
+			}
+			if found != "" {
+				return nil, fmt.Errorf("Both %s and %s exist, only one of them can be loaded", found, path)
+			}
+			found = path
+		}
+		if found != "" {
+			paths = append(paths, found)
+		}
+	}
+
+	if err := this.loadAll(paths); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
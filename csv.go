@@ -0,0 +1,95 @@
+package flexiconfig
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+)
+
+// CSVOption changes how LoadCSVFile reads a file.
+type CSVOption int
+
+const (
+	// CSVInferTypes parses each cell like LoadKVPairs does, so numbers and
+	// booleans are stored as such instead of as strings.
+	CSVInferTypes CSVOption = iota
+)
+
+// LoadCSVFile loads a CSV file into an array of maps stored at targetPath. The
+// first row holds the column names and every following row becomes a map from
+// column name to cell. All rows must have as many cells as the header.
+func (this *Settings) LoadCSVFile(path string, targetPath string, options ...CSVOption) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
+	}
+
+	inferTypes := false
+	for _, option := range options {
+		if option == CSVInferTypes {
+			inferTypes = true
+		}
+	}
+
+	if targetPath == "" {
+		return fmt.Errorf("Could not load %s: a target path is required", path)
+	}
+
+	return this.load(&loader{
+		source: fileSource(path),
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			this.logFileLoad(path)
+			rows, err := this.readCSV(path, inferTypes)
+			if err != nil {
+				return nil, 0, err
+			}
+			this.readFileInfo(path)
+
+			newSettings, err := this.nestValue(targetPath, rows)
+			return newSettings, fileSize(path), err
+		},
+	})
+}
+
+// readCSV reads the CSV file at path into an array of maps, see LoadCSVFile.
+func (this Settings) readCSV(path string, inferTypes bool) ([]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load %s: %s", path, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Could not load %s: missing header row", path)
+	}
+
+	header := records[0]
+	for i, column := range header {
+		for _, previous := range header[:i] {
+			if column == previous {
+				return nil, fmt.Errorf("Could not load %s: duplicate column %q", path, column)
+			}
+		}
+	}
+
+	rows := make([]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, cell := range record {
+			if inferTypes {
+				row[header[i]] = this.inferValue(cell)
+			} else {
+				row[header[i]] = cell
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
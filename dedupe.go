@@ -0,0 +1,79 @@
+package flexiconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SetDeduplicateLoads makes loads skip merging settings that are exactly the
+// same, with the same merge options, as an earlier load, such as a file listed
+// both by a glob and explicitly. What is compared is what would be merged, so
+// the same content read from different paths is a duplicate too.
+//
+// A duplicate is only skipped while nothing changed the top-level keys it
+// sets since the earlier load was merged, whether another load, RawSet,
+// Delete or anything else, so that skipping it leaves the settings as merging
+// it would have. Skipped loads are listed by Sources and Stats with Duplicate
+// set. They don't call the post-load hooks and Reload doesn't run them again.
+func (this *Settings) SetDeduplicateLoads(dedupe bool) {
+	this.deduplicateLoads = dedupe
+}
+
+// loadHashes holds the hashes of the settings merged by loads, guarded by the
+// lock of the settings.
+type loadHashes struct {
+	// keys holds the top-level keys set by the load that merged each hash.
+	keys map[string][]string
+}
+
+// settingsHash returns the hash of the settings merged with options, or ""
+// if they can't be hashed.
+func settingsHash(settings map[string]interface{}, options []MergeOption) string {
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append(b, fmt.Sprint(options)...))
+	return hex.EncodeToString(sum[:])
+}
+
+// merged reports whether settings with hash were merged, and left alone
+// since.
+func (this *loadHashes) merged(hash string) bool {
+	_, ok := this.keys[hash]
+	return ok
+}
+
+// add records that the settings with hash, setting keys, were merged.
+func (this *loadHashes) add(hash string, keys []string) {
+	if this.keys == nil {
+		this.keys = make(map[string][]string)
+	}
+	this.keys[hash] = keys
+}
+
+// forget drops the hashes of the loads that set path, one of its parents or
+// one of its children. An empty path drops every hash.
+func (this *loadHashes) forget(path string, sep string) {
+	for hash, keys := range this.keys {
+		for _, key := range keys {
+			if path == "" || key == path || strings.HasPrefix(key, path+sep) || strings.HasPrefix(path, key+sep) {
+				delete(this.keys, hash)
+				break
+			}
+		}
+	}
+}
+
+// changed drops what was derived from the value at path, which changed, along
+// with its parents and children.
+func (this Settings) changed(path string) {
+	sep := this.pathSeparator()
+	this.resolved.invalidate(path, sep)
+	if this.hashes != nil {
+		this.hashes.forget(path, sep)
+	}
+}
@@ -0,0 +1,194 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SetDefault sets the default value at a specific path. Defaults never replace
+// a value that is already set, and any later load replaces them as usual. They
+// are also remembered separately, see Overrides.
+func (this *Settings) SetDefault(path string, value interface{}) error {
+	if err := this.checkPath(path); err != nil {
+		return err
+	}
+	parts := this.splitPath(path)
+	last := len(parts) - 1
+	parent := ""
+	if last > 0 {
+		parent = path[:len(path)-len(parts[last])-len(this.pathSeparator())]
+	}
+	return this.SetDefaults(this.nestAt(parent, map[string]interface{}{parts[last]: value}))
+}
+
+// SetDefaults sets the default values of every key in defaults, see
+// SetDefault.
+func (this *Settings) SetDefaults(defaults map[string]interface{}) error {
+	return this.setDefaults("SetDefaults", defaults, false)
+}
+
+// setDefaults is SetDefaults, with the defaults set so far cleared first if
+// replace is set, see ClearDefaults. name names the source of the defaults.
+func (this *Settings) setDefaults(name string, defaults map[string]interface{}, replace bool) error {
+	normalized, err := this.normalizeSettings(defaults)
+	if err != nil {
+		return err
+	}
+	renamed, err := this.normalizeKeys("", normalized)
+	if err != nil {
+		return err
+	}
+	normalized = renamed.(map[string]interface{})
+
+	this.wlock()
+	if replace {
+		this.clearDefaults()
+	}
+	copied := deepCopy(normalized).(map[string]interface{})
+	err = mergeMaps(this.defaults, copied, "", mergeConfig{separator: this.pathSeparator()})
+	this.wunlock()
+	if err != nil {
+		return err
+	}
+
+	return this.load(this.mapLoader(Source{Name: name, Default: true}, normalized, []MergeOption{MergeKeepExisting}))
+}
+
+// GetDefaultsJSON returns the json representation of the defaults alone, as
+// set by SetDefault, SetDefaults and LoadDefaultsJSON, whatever the settings
+// hold now. It is meant to document the defaults, or to compare them with
+// what is deployed.
+func (this Settings) GetDefaultsJSON() ([]byte, error) {
+	this.rlock()
+	defaults := deepCopy(this.defaults)
+	this.runlock()
+
+	b, err := json.Marshal(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode the defaults: %s", err)
+	}
+	return b, nil
+}
+
+// LoadDefaultsJSON replaces the defaults with those of the json object b, such
+// as written by GetDefaultsJSON. The defaults set before are cleared as by
+// ClearDefaults, and the new ones are then set as by SetDefaults. If b can't be
+// parsed the defaults are left alone.
+func (this *Settings) LoadDefaultsJSON(b []byte) error {
+	var defaults map[string]interface{}
+	if err := this.unmarshalJSON(b, &defaults); err != nil {
+		return fmt.Errorf("Could not parse the defaults: %s", err)
+	}
+	return this.setDefaults("LoadDefaultsJSON", defaults, true)
+}
+
+// ClearDefaults forgets every default. Values that are still their default
+// are removed from the settings, along with the maps left empty by removing
+// them, while values that were loaded or set over a default are kept. Reload
+// doesn't set the defaults again.
+func (this *Settings) ClearDefaults() {
+	this.wlock()
+	defer this.wunlock()
+
+	this.clearDefaults()
+}
+
+// clearDefaults is ClearDefaults without locking.
+func (this *Settings) clearDefaults() {
+	sep := this.pathSeparator()
+	var paths []string
+	for path, def := range flatten(sep, this.defaults) {
+		value, err := this.rawGet(path)
+		if err != nil && !errors.Is(err, ErrNullValue) || !sameValue(def, value) {
+			continue
+		}
+		if source, ok := this.provenance.lookup(path); !ok || !source.Default {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	mark := this.markHistory(paths...)
+	for _, path := range paths {
+		this.delete(path)
+		parts := this.splitPath(path)
+		for i := len(parts) - 1; i > 0; i-- {
+			parent := strings.Join(parts[:i], sep)
+			value, err := this.rawGet(parent)
+			if m, ok := value.(map[string]interface{}); err != nil || !ok || len(m) > 0 {
+				break
+			}
+			this.delete(parent)
+		}
+	}
+	this.recordHistory("ClearDefaults", mark)
+
+	for key := range this.defaults {
+		delete(this.defaults, key)
+	}
+
+	// Reload mustn't bring the defaults back.
+	var loads []*loader
+	for _, l := range this.provenance.loads {
+		if !l.source.Default {
+			loads = append(loads, l)
+		}
+	}
+	this.provenance.loads = loads
+}
+
+// Overrides returns every value that differs from its default, keyed by its
+// full path. Values that have no default at all are included, defaults that
+// weren't overridden are not. Arrays are compared as a whole.
+func (this Settings) Overrides() map[string]interface{} {
+	this.rlock()
+	defer this.runlock()
+
+	return this.overrides()
+}
+
+// overrides is Overrides without locking.
+func (this Settings) overrides() map[string]interface{} {
+	sep := this.pathSeparator()
+	defaults := flatten(sep, this.defaults)
+
+	overrides := make(map[string]interface{})
+	for path, value := range flatten(sep, this.settings) {
+		if def, ok := defaults[path]; !ok || !sameValue(def, value) {
+			overrides[path] = deepCopy(value)
+		}
+	}
+	return overrides
+}
+
+// PrintOverrides prints the result of Overrides as JSON, with values marked
+// with MarkSecret redacted. It is meant for startup logs.
+func (this Settings) PrintOverrides() {
+	this.rlock()
+	overrides := this.overrides()
+	for path := range overrides {
+		if this.isSecret(path) {
+			overrides[path] = redactedValue
+		}
+	}
+	this.runlock()
+
+	b, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(b))
+}
+
+// sameValue compares two values by their json representation, so that numbers
+// compare equal whatever type they are stored as.
+func sameValue(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
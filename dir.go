@@ -0,0 +1,163 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirOption changes how LoadDirectory and LoadGlob handle the files they load.
+type DirOption int
+
+const (
+	// ContinueOnError loads every file that can be loaded, rather than
+	// stopping at the first one that can't. The errors of the others are
+	// returned together as a *LoadErrors once every file was tried.
+	ContinueOnError DirOption = iota
+)
+
+// FileError is the error loading one of the files of a directory or glob, or
+// reading the file named by a setting with GetFileContents.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (this *FileError) Error() string {
+	return fmt.Sprintf("%s: %s", this.Path, this.Err)
+}
+
+func (this *FileError) Unwrap() error {
+	return this.Err
+}
+
+// LoadErrors lists the files a directory or glob load with ContinueOnError
+// couldn't load, in load order.
+type LoadErrors struct {
+	Errors []*FileError
+}
+
+func (this *LoadErrors) Error() string {
+	messages := make([]string, len(this.Errors))
+	for i, err := range this.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("Could not load %d files:\n  %s", len(this.Errors), strings.Join(messages, "\n  "))
+}
+
+// Unwrap returns the error of every file, so that errors.Is and errors.As
+// match any of them.
+func (this *LoadErrors) Unwrap() []error {
+	errs := make([]error, len(this.Errors))
+	for i, err := range this.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// LoadDirectory loads every file of dir with an extension known to LoadFile,
+// in the lexical order of their names, such as the files of a conf.d
+// directory. Dotfiles and subdirectories are skipped. It stops at the first
+// file that can't be loaded, keeping the files loaded before it, unless
+// ContinueOnError is given.
+func (this *Settings) LoadDirectory(dir string, options ...DirOption) error {
+	dir, err := this.expandPath(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Could not read directory %s: %s", dir, err)
+	}
+
+	fileFormatsLock.RLock()
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, ok := fileFormats[strings.TrimPrefix(filepath.Ext(entry.Name()), ".")]; !ok {
+			this.logf(LogDebug, "Skipping %s in %s, its extension is not known", entry.Name(), dir)
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	fileFormatsLock.RUnlock()
+
+	return this.loadFiles(paths, options)
+}
+
+// LoadGlob loads every file matching pattern, as filepath.Glob matches it, in
+// lexical order. Directories are skipped, while files with an extension not
+// known to LoadFile are an error. Errors are handled as LoadDirectory does.
+func (this *Settings) LoadGlob(pattern string, options ...DirOption) error {
+	pattern, err := this.expandPath(pattern)
+	if err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("Invalid glob pattern %s: %s", pattern, err)
+	}
+
+	paths := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			continue
+		}
+		paths = append(paths, match)
+	}
+	return this.loadFiles(paths, options)
+}
+
+// SkippedFiles returns the files the latest LoadDirectory or LoadGlob call
+// couldn't load, along with why.
+func (this Settings) SkippedFiles() []*FileError {
+	this.rlock()
+	defer this.runlock()
+
+	return append([]*FileError(nil), this.results.skippedFiles...)
+}
+
+// loadFiles loads the files at paths in order.
+func (this *Settings) loadFiles(paths []string, options []DirOption) error {
+	continueOnError := false
+	for _, option := range options {
+		if option == ContinueOnError {
+			continueOnError = true
+		}
+	}
+
+	var failed []*FileError
+	var err error
+	for _, path := range paths {
+		var l *loader
+		if l, err = this.fileLoader(path, nil); err == nil {
+			err = this.load(l)
+		}
+		if err == nil {
+			continue
+		}
+
+		failed = append(failed, &FileError{Path: path, Err: err})
+		if !continueOnError {
+			break
+		}
+		this.logf(LogWarning, "Skipped %s: %s", path, err)
+	}
+
+	this.wlock()
+	this.results.skippedFiles = failed
+	this.wunlock()
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case !continueOnError:
+		return err
+	default:
+		return &LoadErrors{failed}
+	}
+}
@@ -0,0 +1,140 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DirMapOption changes how LoadDirAsMap reads a directory.
+type DirMapOption int
+
+const (
+	// DirMapParseJSON parses file contents that look like a JSON object or
+	// array instead of storing them as a string. Contents that fail to parse
+	// are still stored as a string.
+	DirMapParseJSON DirMapOption = iota
+
+	// DirMapRecursive loads subdirectories as nested maps instead of skipping
+	// them.
+	DirMapRecursive
+)
+
+// LoadDirAsMap loads a directory where each file name is a key and the file's
+// content is its value, such as a mounted Kubernetes ConfigMap or Secret. The
+// keys are stored under the prefix path, or at the root if prefix is empty, so
+// a Secret mounted with the prefix "secrets" can be read with
+//
+//	settings.GetString("secrets:db-password", "")
+//
+// Contents are trimmed of surrounding whitespace. Dotfiles, which includes the
+// "..data" directory Kubernetes uses for atomic updates, are skipped, and so
+// are subdirectories unless DirMapRecursive is given.
+func (this *Settings) LoadDirAsMap(dir string, prefix string, options ...DirMapOption) error {
+	dir, err := this.expandPath(dir)
+	if err != nil {
+		return err
+	}
+
+	parseJSON, recursive := false, false
+	for _, option := range options {
+		switch option {
+		case DirMapParseJSON:
+			parseJSON = true
+		case DirMapRecursive:
+			recursive = true
+		}
+	}
+
+	source := Source{Name: dir}
+	if abs, err := filepath.Abs(dir); err == nil {
+		source.Dir = abs
+	}
+
+	return this.load(&loader{
+		source: source,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.logf(LogDebug, "Loading directory %s", dir)
+			values, err := readDirAsMap(dir, parseJSON, recursive, this.allowPath)
+			if err != nil {
+				return nil, 0, err
+			}
+			return this.nestAt(prefix, values), 0, nil
+		},
+	})
+}
+
+// readDirAsMap reads every regular file in dir into a map keyed by file name.
+// Paths for which allow returns an error are not read.
+func readDirAsMap(dir string, parseJSON, recursive bool, allow func(path string) error) (map[string]interface{}, error) {
+	if err := allow(dir); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		// Follow symlinks, mounted ConfigMaps are made of them.
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			if recursive {
+				if values[entry.Name()], err = readDirAsMap(path, parseJSON, recursive, allow); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := allow(path); err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		values[entry.Name()] = dirMapValue(strings.TrimSpace(string(content)), parseJSON)
+	}
+	return values, nil
+}
+
+// dirMapValue returns the value to store for a file's trimmed content.
+func dirMapValue(content string, parseJSON bool) interface{} {
+	if parseJSON && (strings.HasPrefix(content, "{") || strings.HasPrefix(content, "[")) {
+		var value interface{}
+		if err := json.Unmarshal([]byte(content), &value); err == nil {
+			return value
+		}
+	}
+	return content
+}
+
+// nestAt wraps value in maps so that it ends up at path when merged. An empty
+// path returns value itself.
+func (this Settings) nestAt(path string, value map[string]interface{}) map[string]interface{} {
+	if path == "" {
+		return value
+	}
+
+	parts := this.splitPath(path)
+	for i := len(parts) - 1; i >= 0; i-- {
+		value = map[string]interface{}{parts[i]: value}
+	}
+	return value
+}
@@ -0,0 +1,44 @@
+package flexiconfig
+
+import (
+	"fmt"
+)
+
+// SetEmptyIsMissing makes Get, the typed getters built on it and BindSection
+// treat empty strings, maps and arrays as if they weren't set, returning the
+// default value and an error matching ErrNotFound. This helps with generated
+// configs that emit "" for what they have nothing for. RawGet still returns
+// empty values, which are kept in the settings. Required keys, as checked by
+// Check, Validate and ValidateAgainstStruct, count empty values as missing too.
+func (this *Settings) SetEmptyIsMissing(missing bool) {
+	this.emptyIsMissing = missing
+}
+
+// isEmpty returns whether value is an empty string, map or array.
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return v == ""
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
+
+// missingValue returns whether value counts as missing given the options.
+func (this Settings) missingValue(value interface{}) bool {
+	return value == nil || this.emptyIsMissing && isEmpty(value)
+}
+
+// getTyped is getResolved for the typed getters, which treat empty values as
+// missing if SetEmptyIsMissing says so.
+func (this Settings) getTyped(path string) (interface{}, error) {
+	value, err := this.getResolved(path)
+	if err == nil && this.emptyIsMissing && isEmpty(value) {
+		return nil, &notFoundError{fmt.Sprintf("%s is empty", path)}
+	}
+	return value, err
+}
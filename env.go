@@ -0,0 +1,175 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// LoadEnv loads every environment variable whose name starts with prefix. The
+// prefix is stripped and the rest of the name becomes the path, with "__"
+// separating nested keys: APP_DB__HOST is stored at DB:HOST for the prefix
+// "APP_". Each key is matched case insensitively against the keys already
+// loaded so that it overrides them, keys that don't exist yet are lowercased.
+// Values are always stored as strings.
+func (this *Settings) LoadEnv(prefix string) error {
+	return this.load(&loader{
+		source: Source{Name: "LoadEnv"},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			return this.readEnv(prefix), 0, nil
+		},
+	})
+}
+
+// readEnv reads the environment variables loaded by LoadEnv.
+func (this *Settings) readEnv(prefix string) map[string]interface{} {
+	this.logf(LogDebug, "Loading environment variables starting with %q", prefix)
+	newSettings := make(map[string]interface{})
+
+	this.rlock()
+	for _, entry := range os.Environ() {
+		split := strings.Index(entry, "=")
+		if split < 0 || !strings.HasPrefix(entry[:split], prefix) {
+			continue
+		}
+		name, value := entry[len(prefix):split], entry[split+1:]
+		if name == "" {
+			continue
+		}
+
+		parts := strings.Split(name, "__")
+		existing, node := this.settings, newSettings
+		for i, part := range parts {
+			key := matchKey(existing, part)
+			existing, _ = existing[key].(map[string]interface{})
+
+			if i == len(parts)-1 {
+				node[key] = value
+				break
+			}
+			child, ok := node[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[key] = child
+			}
+			node = child
+		}
+	}
+	this.runlock()
+
+	return newSettings
+}
+
+// matchKey returns the key in m that equals name ignoring case, or name
+// lowercased if there is none.
+func matchKey(m map[string]interface{}, name string) string {
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// ToEnv returns the values below path as environment variables, in the form
+// taken by exec.Cmd.Env. It is the reverse of LoadEnv: names are the prefix
+// followed by the keys below path, uppercased and joined with "__", so
+// ToEnv("db", "APP_") turns db:host into APP_HOST. Characters other than
+// letters, digits and underscores become underscores. Strings are used as is,
+// other values are encoded as JSON, and null becomes an empty string. Keys
+// that end up with the same name are an error.
+func (this Settings) ToEnv(path string, prefix string) ([]string, error) {
+	var value interface{}
+	var err error
+	if path == "" {
+		this.rlock()
+		value = deepCopy(this.settings)
+		this.runlock()
+		value, err = this.resolve(path, value)
+	} else {
+		value, err = this.getResolved(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map", path)
+	}
+
+	sep := this.pathSeparator()
+	flat := flatten(sep, m)
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	paths := make(map[string]string)
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := flat[key]
+		name := prefix + envName(strings.Split(key, sep))
+		if other, ok := paths[name]; ok {
+			return nil, fmt.Errorf("%s and %s both map to %s", this.joinPath(path, other), this.joinPath(path, key), name)
+		}
+		paths[name] = key
+
+		encoded, err := envValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode %s: %s", this.joinPath(path, key), err)
+		}
+		env = append(env, name+"="+encoded)
+	}
+	return env, nil
+}
+
+// SetProcessEnv sets the environment variables returned by ToEnv in the
+// current process.
+func (this Settings) SetProcessEnv(path string, prefix string) error {
+	env, err := this.ToEnv(path, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range env {
+		split := strings.Index(entry, "=")
+		if err := os.Setenv(entry[:split], entry[split+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envName turns the keys of a path into an environment variable name.
+func envName(keys []string) string {
+	for i, key := range keys {
+		keys[i] = strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			default:
+				return '_'
+			}
+		}, key)
+	}
+	return strings.Join(keys, "__")
+}
+
+// envValue encodes value as the value of an environment variable.
+func envValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
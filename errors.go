@@ -0,0 +1,83 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is matched by the errors returned when a path doesn't exist, use
+// errors.Is(err, ErrNotFound) to tell them apart from other errors.
+var ErrNotFound = errors.New("Not found")
+
+// ErrNullValue is matched by the errors returned when getting a path set to
+// null. As null means unset, these errors match ErrNotFound too.
+var ErrNullValue = errors.New("Null value")
+
+// ErrInvalidPath is matched by the errors returned for paths with an empty
+// key, such as ":a", "a:" or "a::b", and for the empty path where it can't
+// stand for the root, such as when setting or deleting.
+var ErrInvalidPath = errors.New("Invalid path")
+
+// notFoundError is returned when a path doesn't exist.
+type notFoundError struct {
+	message string
+}
+
+func newNotFoundError(path, missing string) error {
+	return &notFoundError{fmt.Sprintf("Could not find %s (missing %s)", path, missing)}
+}
+
+func (this *notFoundError) Error() string {
+	return this.message
+}
+
+func (this *notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// nullValueError is returned when a path is set to null.
+type nullValueError struct {
+	path string
+}
+
+func (this *nullValueError) Error() string {
+	return fmt.Sprintf("%s is null", this.path)
+}
+
+func (this *nullValueError) Is(target error) bool {
+	return target == ErrNullValue || target == ErrNotFound
+}
+
+// invalidPathError is returned when a path can't be used.
+type invalidPathError struct {
+	path string
+}
+
+func (this *invalidPathError) Error() string {
+	if this.path == "" {
+		return "Invalid path: the path is empty"
+	}
+	return fmt.Sprintf("Invalid path %q: it has an empty key", this.path)
+}
+
+func (this *invalidPathError) Is(target error) bool {
+	return target == ErrInvalidPath
+}
+
+// typeError returns the error of a getter finding value, of the wrong type, at
+// path, where want was expected.
+func typeError(path string, value interface{}, want string) error {
+	return fmt.Errorf("%s is %s, not %s", path, describeKind(value), want)
+}
+
+// describeKind returns the JSON kind of value with its article, such as
+// "an array".
+func describeKind(value interface{}) string {
+	kind := jsonKind(value)
+	switch kind {
+	case "array", "object":
+		return "an " + kind
+	default:
+		return "a " + kind
+	}
+}
@@ -0,0 +1,51 @@
+// This example loads a config file and reloads it whenever the process gets
+// SIGHUP, printing what changed, until interrupted:
+//
+//	go run ./examples/reload -config examples/test.json &
+//	kill -HUP $!
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+func main() {
+	config := flag.String("config", "./test.json", "config file to load")
+	flag.Parse()
+
+	settings := flexiconfig.NewSettings()
+	if err := settings.LoadFile(*config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	settings.OnReload(func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Reload failed, keeping the old config:", err)
+		}
+	})
+	settings.OnChange(func(changes []flexiconfig.Change) {
+		for _, change := range changes {
+			fmt.Printf("%s %s: %v -> %v\n", change.Type, change.Path, change.Old, change.New)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := settings.ReloadOnSignal(ctx, syscall.SIGHUP); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Loaded %s, send SIGHUP to pid %d to reload it\n", *config, os.Getpid())
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
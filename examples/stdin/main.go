@@ -0,0 +1,32 @@
+// This example loads a config file and overrides it with config piped in on
+// stdin:
+//
+//	echo '{"three": "from stdin"}' | go run ./examples/stdin -config examples/test.json -
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+func main() {
+	config := flag.String("config", "./test.json", "config file to load first")
+	flag.Parse()
+
+	settings := flexiconfig.NewSettings()
+	settings.SetMaxSize(1 << 20)
+
+	// Every further argument is loaded on top, "-" being stdin.
+	for _, path := range append([]string{*config}, flag.Args()...) {
+		if err := settings.LoadFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	settings.Print()
+	fmt.Println(settings.GetString("three", "nonono"))
+}
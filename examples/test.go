@@ -1,9 +1,13 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
 package main
 
 import (
 	"fmt"
 
 	"github.com/wetdesertrock/flexiconfig"
+	"github.com/wetdesertrock/flexiconfig/lualoader"
 )
 
 type B struct {
@@ -23,7 +27,7 @@ type APIConf struct {
 func main() {
 	settings := flexiconfig.NewSettings()
 	fmt.Println(settings.LoadJSONFile("./test.json"))
-	fmt.Println(settings.LoadLuaFile("./test2.lua"))
+	fmt.Println(lualoader.LoadFile(&settings, "./test2.lua", nil))
 
 	settings.Print()
 	fmt.Println(settings.GetString("three", "nonono"))
@@ -0,0 +1,179 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// ExpandOption changes how environment variables are expanded.
+type ExpandOption int
+
+const (
+	// ExpandErrorOnUnset makes referring to an environment variable that
+	// isn't set an error, rather than expanding it to nothing.
+	ExpandErrorOnUnset ExpandOption = iota
+)
+
+// GetStringExpanded returns a string stored in the path with environment
+// variables expanded. Both $VAR and ${VAR} are replaced by the value of VAR,
+// while $$ stands for a literal $. Variables are looked up on every call, so
+// changes to the environment are picked up.
+// If the the path isn't defined it will return the defaultValue and an error.
+func (this Settings) GetStringExpanded(path string, defaultValue string, options ...ExpandOption) (string, error) {
+	value, err := this.GetString(path, defaultValue)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	strict := false
+	for _, option := range options {
+		if option == ExpandErrorOnUnset {
+			strict = true
+		}
+	}
+
+	expanded, err := expandEnv(value, strict)
+	if err != nil {
+		return defaultValue, fmt.Errorf("Could not expand %s: %s", path, err)
+	}
+	return expanded, nil
+}
+
+// expandEnv replaces $VAR and ${VAR} in s by the value of the environment
+// variable VAR, and $$ by $. A $ not followed by a name is kept as it is.
+// Variables that aren't set expand to nothing, or are an error if strict is
+// true.
+func expandEnv(s string, strict bool) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		var name string
+		switch next := s[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case next == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated ${ in %q", s)
+			}
+			name = s[i+2 : i+2+end]
+			if !isEnvName(name) {
+				return "", fmt.Errorf("Invalid environment variable name %q in %q", name, s)
+			}
+			i += 2 + end
+		default:
+			end := i + 1
+			for end < len(s) && isEnvNameByte(s[end]) {
+				end++
+			}
+			if end == i+1 {
+				b.WriteByte('$')
+				continue
+			}
+			name = s[i+1 : end]
+			i = end - 1
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok && strict {
+			return "", fmt.Errorf("Environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// expandEnvHook is a mapstructure decode hook expanding environment variables
+// in the strings decoded into struct fields tagged `expandenv:"true"`, or
+// `expandenv:"strict"` to make unset variables an error. Strings in a slice
+// field are expanded one by one.
+func expandEnvHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	m, ok := data.(map[string]interface{})
+	if !ok || to.Kind() != reflect.Struct {
+		return data, nil
+	}
+
+	var expanded map[string]interface{}
+	for i := 0; i < to.NumField(); i++ {
+		field := to.Field(i)
+		tag := field.Tag.Get("expandenv")
+		if tag != "true" && tag != "strict" {
+			continue
+		}
+
+		name, _, skip := decodedName(field)
+		if skip {
+			continue
+		}
+		key, ok := fieldKey(m, name)
+		if !ok {
+			continue
+		}
+
+		value, err := expandEnvValue(m[key], tag == "strict")
+		if err != nil {
+			return nil, fmt.Errorf("Could not expand %s: %s", key, err)
+		}
+		if expanded == nil {
+			// Never change the settings being decoded.
+			expanded = make(map[string]interface{}, len(m))
+			for k, v := range m {
+				expanded[k] = v
+			}
+		}
+		expanded[key] = value
+	}
+
+	if expanded == nil {
+		return data, nil
+	}
+	return expanded, nil
+}
+
+// expandEnvValue expands the environment variables in value if it is a string
+// or an array of strings.
+func expandEnvValue(value interface{}, strict bool) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return expandEnv(v, strict)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, element := range v {
+			var err error
+			if expanded[i], err = expandEnvValue(element, strict); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	default:
+		return value, nil
+	}
+}
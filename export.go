@@ -0,0 +1,57 @@
+package flexiconfig
+
+import (
+	"net/url"
+)
+
+// exportFilter is a transformation added with AddExportFilter.
+type exportFilter struct {
+	pattern string
+	fn      func(path string, value interface{}) interface{}
+}
+
+// AddExportFilter transforms the values at or below the paths matching
+// pattern in the output meant to be shown or shared: String, GetRedactedJSON,
+// GetJSONFiltered, Print and Fprint, and the values logged by SetLogValues.
+// The getters, GetJSON and GetPrettyJSON are never affected. Patterns are
+// those of MarkSecret, so "*" covers every value.
+//
+// fn is called with the path of every leaf value matching, that is any value
+// but a map, and returns what to output instead. It is given a copy it may
+// change. Filters run in the order they were added, each being given what the
+// previous one returned. Secret values are redacted before, so filters never
+// see them.
+func (this *Settings) AddExportFilter(pattern string, fn func(path string, value interface{}) interface{}) {
+	this.exportFilters = append(this.exportFilters, exportFilter{pattern, fn})
+}
+
+// exportValue returns the leaf value, found at p, with every export filter
+// matching p applied.
+func (this Settings) exportValue(p string, value interface{}) interface{} {
+	sep := this.pathSeparator()
+	for _, filter := range this.exportFilters {
+		if matchPathPrefix(sep, filter.pattern, p) {
+			value = filter.fn(p, value)
+		}
+	}
+	return value
+}
+
+// StripURLCredentials is an export filter, see AddExportFilter, removing the
+// password of URLs such as "postgres://user:pass@db/app". Other values are
+// returned as is.
+func StripURLCredentials(path string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.User == nil {
+		return value
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return value
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
@@ -0,0 +1,136 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultExtendsKey is the key ResolveExtends looks for when given "".
+const DefaultExtendsKey = "$extends"
+
+// ResolveExtends resolves inheritance between the maps found at rootPath, such
+// as named presets. A map whose key named key, "$extends" if it is "", holds
+// the name of a sibling gets a deep merge of that sibling's values, its own
+// values winning. Siblings may extend others in turn, while a cycle is an
+// error listing it. The key is removed once resolved, and an empty rootPath
+// resolves the top-level maps. Nothing is changed if an error is returned.
+//
+// For example, given
+//
+//	{"presets": {"base": {"port": 80, "debug": false}, "dev": {"$extends": "base", "debug": true}}}
+//
+// ResolveExtends("presets", "") sets presets:dev to {"port": 80, "debug": true}.
+func (this *Settings) ResolveExtends(rootPath string, key string) error {
+	if key == "" {
+		key = DefaultExtendsKey
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	root := this.settings
+	if rootPath != "" {
+		value, err := this.rawGet(rootPath)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if root, ok = value.(map[string]interface{}); !ok {
+			return fmt.Errorf("Could not resolve extends in %s: it is %s, not a map", rootPath, typeName(value))
+		}
+	}
+
+	names := make([]string, 0, len(root))
+	for name, value := range root {
+		if m, ok := value.(map[string]interface{}); ok {
+			if _, ok := m[key]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	resolver := extendsResolver{key: key, sep: this.pathSeparator(), root: root, resolved: make(map[string]map[string]interface{})}
+	for _, name := range names {
+		if _, err := resolver.resolve(name, nil); err != nil {
+			return fmt.Errorf("Could not resolve extends in %s: %s", describePath(rootPath), err)
+		}
+	}
+
+	for _, name := range names {
+		path := this.joinPath(rootPath, name)
+		if this.kinds != nil {
+			if err := this.checkSetKinds("ResolveExtends", path, resolver.resolved[name]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		path := this.joinPath(rootPath, name)
+		if _, err := this.rawSet(SetReplace, path, resolver.resolved[name]); err != nil {
+			return err
+		}
+		if this.kinds != nil {
+			this.recordSetKinds(path, resolver.resolved[name])
+		}
+	}
+	return nil
+}
+
+// extendsResolver resolves the extends of the maps in root, remembering those
+// already resolved.
+type extendsResolver struct {
+	key      string
+	sep      string
+	root     map[string]interface{}
+	resolved map[string]map[string]interface{}
+}
+
+// resolve returns a copy of the map named name merged with what it extends.
+// chain lists the maps being resolved that extend it.
+func (this extendsResolver) resolve(name string, chain []string) (map[string]interface{}, error) {
+	if resolved, ok := this.resolved[name]; ok {
+		return resolved, nil
+	}
+	for i, extending := range chain {
+		if extending == name {
+			return nil, fmt.Errorf("%s form a cycle", strings.Join(append(chain[i:], name), " -> "))
+		}
+	}
+
+	m, ok := this.root[name].(map[string]interface{})
+	if !ok {
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("%s is not a map", name)
+		}
+		return nil, fmt.Errorf("%s extends %s, which is not a map", chain[len(chain)-1], name)
+	}
+
+	own := deepCopy(m).(map[string]interface{})
+	parentName, ok := own[this.key]
+	if !ok {
+		this.resolved[name] = own
+		return own, nil
+	}
+	delete(own, this.key)
+
+	parent, ok := parentName.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s has a %s of %s, not the name of a sibling", name, this.key, typeName(parentName))
+	}
+	if _, ok := this.root[parent]; !ok {
+		return nil, fmt.Errorf("%s extends %s, which doesn't exist", name, parent)
+	}
+	inherited, err := this.resolve(parent, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+
+	merged := deepCopy(inherited).(map[string]interface{})
+	if err := mergeMaps(merged, own, "", mergeConfig{separator: this.sep}); err != nil {
+		return nil, err
+	}
+	this.resolved[name] = merged
+	return merged, nil
+}
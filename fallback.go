@@ -0,0 +1,117 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SetFallbackOnTypeMismatch controls what the Get*Any functions do with a
+// path that exists but holds the wrong type. By default that is reported as an
+// error straight away, with fallback set to true the next path is tried
+// instead, just like for a path that doesn't exist.
+func (this *Settings) SetFallbackOnTypeMismatch(fallback bool) {
+	this.fallbackOnTypeMismatch = fallback
+}
+
+// firstOf calls get with each path in turn until it succeeds.
+func (this Settings) firstOf(paths []string, get func(path string) error) error {
+	problems := make([]string, 0, len(paths))
+	allMissing := true
+
+	for _, path := range paths {
+		err := get(path)
+		if err == nil {
+			return nil
+		}
+
+		missing := errors.Is(err, ErrNotFound)
+		if !missing && !this.fallbackOnTypeMismatch {
+			return err
+		}
+		allMissing = allMissing && missing
+		problems = append(problems, err.Error())
+	}
+
+	message := fmt.Sprintf("Could not get any of %s (%s)", strings.Join(paths, ", "), strings.Join(problems, "; "))
+	if allMissing {
+		return &notFoundError{message}
+	}
+	return errors.New(message)
+}
+
+// GetStringAny returns the string stored in the first of paths that is set.
+// If none of the paths are defined it will return the defaultValue and an
+// error listing every path tried.
+func (this Settings) GetStringAny(defaultValue string, paths ...string) (string, error) {
+	var value string
+	err := this.firstOf(paths, func(path string) (err error) {
+		value, err = this.getString(path, defaultValue)
+		return err
+	})
+	if err != nil {
+		return defaultValue, err
+	}
+	return value, nil
+}
+
+// GetBoolAny returns the bool stored in the first of paths that is set.
+// If none of the paths are defined it will return the defaultValue and an
+// error listing every path tried.
+func (this Settings) GetBoolAny(defaultValue bool, paths ...string) (bool, error) {
+	var value bool
+	err := this.firstOf(paths, func(path string) (err error) {
+		value, err = this.getBool(path, defaultValue)
+		return err
+	})
+	if err != nil {
+		return defaultValue, err
+	}
+	return value, nil
+}
+
+// GetIntAny returns the int stored in the first of paths that is set.
+// If none of the paths are defined it will return the defaultValue and an
+// error listing every path tried.
+func (this Settings) GetIntAny(defaultValue int64, paths ...string) (int64, error) {
+	var value int64
+	err := this.firstOf(paths, func(path string) (err error) {
+		value, err = this.getInt(path, defaultValue)
+		return err
+	})
+	if err != nil {
+		return defaultValue, err
+	}
+	return value, nil
+}
+
+// GetFloatAny returns the float stored in the first of paths that is set.
+// If none of the paths are defined it will return the defaultValue and an
+// error listing every path tried.
+func (this Settings) GetFloatAny(defaultValue float64, paths ...string) (float64, error) {
+	var value float64
+	err := this.firstOf(paths, func(path string) (err error) {
+		value, err = this.getFloat(path, defaultValue)
+		return err
+	})
+	if err != nil {
+		return defaultValue, err
+	}
+	return value, nil
+}
+
+// GetDurationAny returns the duration stored in the first of paths that is set.
+// If none of the paths are defined it will return the defaultValue and an
+// error listing every path tried.
+func (this Settings) GetDurationAny(defaultValue time.Duration, paths ...string) (time.Duration, error) {
+	var value time.Duration
+	err := this.firstOf(paths, func(path string) (err error) {
+		value, err = this.getDuration(path, defaultValue)
+		return err
+	})
+	if err != nil {
+		return defaultValue, err
+	}
+	return value, nil
+}
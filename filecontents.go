@@ -0,0 +1,42 @@
+package flexiconfig
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// GetFileContents reads the value at path as a file name, resolved like
+// GetAbsPath does, and returns the content of that file. Files outside of the
+// roots set with SetAllowedRoots can't be read. If path doesn't exist the
+// error matches ErrNotFound, while errors reading the file are a *FileError,
+// so the two can be told apart. defaultValue is returned on any error.
+func (this Settings) GetFileContents(path string, defaultValue []byte) ([]byte, error) {
+	file, err := this.GetAbsPath(path, "")
+	if err != nil {
+		return defaultValue, err
+	}
+	if err := this.allowPath(file); err != nil {
+		return defaultValue, &FileError{file, err}
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return defaultValue, &FileError{file, err}
+	}
+	return content, nil
+}
+
+// GetFileContentsString is GetFileContents returning a string, minus a single
+// trailing newline.
+func (this Settings) GetFileContentsString(path string, defaultValue string) (string, error) {
+	content, err := this.GetFileContents(path, nil)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	text := string(content)
+	if strings.HasSuffix(text, "\r\n") {
+		return text[:len(text)-2], nil
+	}
+	return strings.TrimSuffix(text, "\n"), nil
+}
@@ -0,0 +1,118 @@
+package flexiconfig
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Prefixes marking a string value as a reference to a file, see
+// EnableFileRefs.
+const (
+	FileRefPrefix       = "@file:"
+	FileRefBase64Prefix = "@file+base64:"
+)
+
+// EnableFileRefs turns on file references. With them enabled GetString and Get
+// replace a string value such as "@file:/run/secrets/key.pem" by the content
+// of the file, minus a single trailing newline. A value starting with
+// "@file+base64:" is replaced by the base64 encoding of the file instead,
+// which keeps binary content intact. Relative file paths are resolved like
+// GetAbsPath does. RawGet and GetJSON always return the references as is.
+//
+// File references are resolved by FileRefResolver, which this adds to the end
+// of the resolvers or removes, see AddResolver.
+func (this *Settings) EnableFileRefs(enabled bool) {
+	var resolvers []Resolver
+	for _, r := range this.resolvers {
+		if r != FileRefResolver {
+			resolvers = append(resolvers, r)
+		}
+	}
+	if enabled {
+		resolvers = append(resolvers, FileRefResolver)
+	}
+	this.SetResolvers(resolvers...)
+}
+
+// SetFileRefRoots restricts file references to files inside the given
+// directories. With no roots set any file can be referenced.
+func (this *Settings) SetFileRefRoots(roots ...string) {
+	this.fileRefRoots = roots
+}
+
+// isFileRef returns whether value is a file reference.
+func isFileRef(value string) bool {
+	return strings.HasPrefix(value, FileRefPrefix) || strings.HasPrefix(value, FileRefBase64Prefix)
+}
+
+// resolveFileRef returns the content referenced by value, or value itself if
+// it isn't a file reference.
+func (this Settings) resolveFileRef(path, value string) (string, error) {
+	var file string
+	encode := false
+	if strings.HasPrefix(value, FileRefBase64Prefix) {
+		file, encode = value[len(FileRefBase64Prefix):], true
+	} else if strings.HasPrefix(value, FileRefPrefix) {
+		file = value[len(FileRefPrefix):]
+	} else {
+		return value, nil
+	}
+
+	file, err := this.fileRefPath(path, file)
+	if err != nil {
+		return "", fmt.Errorf("Could not read %s referenced by %s: %w", file, path, err)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Could not read %s referenced by %s: %w", file, path, err)
+	}
+
+	if encode {
+		return base64.StdEncoding.EncodeToString(content), nil
+	}
+	text := string(content)
+	if strings.HasSuffix(text, "\r\n") {
+		return text[:len(text)-2], nil
+	}
+	return strings.TrimSuffix(text, "\n"), nil
+}
+
+// fileRefPath makes file absolute and checks it against the allowed roots.
+func (this Settings) fileRefPath(path, file string) (string, error) {
+	file, err := expandHome(file)
+	if err != nil {
+		return file, err
+	}
+	if !filepath.IsAbs(file) {
+		base := ""
+		if source, ok := this.SourceOf(path); ok {
+			base = source.Dir
+		}
+		if file, err = filepath.Abs(filepath.Join(base, file)); err != nil {
+			return file, err
+		}
+	}
+	file = filepath.Clean(file)
+
+	if err := this.allowPath(file); err != nil {
+		return file, err
+	}
+	if len(this.fileRefRoots) == 0 {
+		return file, nil
+	}
+	for _, root := range this.fileRefRoots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if file == root || strings.HasPrefix(file, root+string(filepath.Separator)) {
+			return file, nil
+		}
+	}
+	return file, errors.New("file is outside of the allowed roots")
+}
@@ -0,0 +1,89 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// GetJSONAt returns the json representation of the value at path, which may
+// be a whole section or a single leaf. It returns an error if the path isn't
+// defined.
+func (this Settings) GetJSONAt(path string) ([]byte, error) {
+	snapshot := this.capture()
+	value, err := snapshot.rawGet(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStructure(snapshot.pathSeparator(), path, value, snapshot.depthLimit()); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshot.jsonValueAt(path, value))
+}
+
+// GetJSONFiltered returns the json representation of the settings pruned to
+// the values below the include prefixes, or all of them if include is empty,
+// minus the values below the exclude prefixes. Exclusion always wins over
+// inclusion, however specific the include prefix. Prefixes use the patterns
+// of MarkSecret, so "*:debug" excludes the debug key of every section. As the
+// output is meant to be shared, secret values are redacted like GetRedactedJSON
+// does.
+func (this Settings) GetJSONFiltered(include []string, exclude []string) ([]byte, error) {
+	snapshot := this.capture()
+	filtered := make(map[string]interface{})
+	for key, value := range snapshot.redactedCopy() {
+		if kept, ok := snapshot.filterValue(key, value, include, exclude); ok {
+			filtered[key] = kept
+		}
+	}
+	return json.Marshal(snapshot.jsonValue(filtered))
+}
+
+// filterValue returns value, found at p, pruned as GetJSONFiltered does, and
+// whether anything of it is kept.
+func (this Settings) filterValue(p string, value interface{}, include, exclude []string) (interface{}, bool) {
+	sep := this.pathSeparator()
+	for _, pattern := range exclude {
+		if matchPathPrefix(sep, pattern, p) {
+			return nil, false
+		}
+	}
+
+	included := len(include) == 0
+	below := false
+	for _, pattern := range include {
+		if matchPathPrefix(sep, pattern, p) {
+			included = true
+		} else if matchPathParent(sep, pattern, p) {
+			below = true
+		}
+	}
+
+	m, isMap := value.(map[string]interface{})
+	if !isMap {
+		return value, included
+	}
+	if !included && !below {
+		return nil, false
+	}
+
+	filtered := make(map[string]interface{}, len(m))
+	for key, child := range m {
+		if kept, ok := this.filterValue(this.joinPath(p, key), child, include, exclude); ok {
+			filtered[key] = kept
+		}
+	}
+	// Keep included maps even if they end up empty, but not the maps that
+	// only lead to included values.
+	return filtered, included || len(filtered) > 0
+}
+
+// matchPathParent returns whether p matches a parent of what pattern matches,
+// both being separated by sep.
+func matchPathParent(sep, pattern, p string) bool {
+	patternParts := strings.Split(pattern, sep)
+	parts := strings.Split(p, sep)
+	if len(parts) >= len(patternParts) {
+		return false
+	}
+	return matchPathPrefix(sep, strings.Join(patternParts[:len(parts)], sep), p)
+}
@@ -8,51 +8,223 @@
 //
 // A core part of this package is the ability to load lua files. This
 // gives you the ability to run a sub program in order to generate your
-// config.
+// config. Lua configs are run with gopher-lua, unless the package is built
+// with the flexiconfig_nolua tag so that programs that only load JSON don't
+// depend on a lua interpreter. The lualoader package holds the preferred
+// functions to load them.
 package flexiconfig
 
 import (
-	"encoding/json"
+	"expvar"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
-
-	lua "github.com/yuin/gopher-lua"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
-	luajson "layeh.com/gopher-json"
 )
 
-// LuaLoader is the type representing the function signature used to
-// load custom lua modules.
-type LuaLoader func(L *lua.LState) int
-
 // Settings is the main type that holds the config and loads new
-// configuration files.
+// configuration files. The zero value is empty settings ready to use.
 type Settings struct {
 	settings   map[string]interface{}
-	luaModules map[string]lua.LGFunction
+	defaults   map[string]interface{}
+	luaModules map[string]interface{}
+	luaOutput  io.Writer
+	luaEngine  LuaEngine
+	sharedLua  *sharedLuaState
+	provenance *provenance
+	secrets    []string
+	lock       *sync.RWMutex
+	overlays   *overlays
+	separator  string
+	logger     Logger
+	regexps    *regexpCache
+	stats      *loadStats
+	resolved   *resolveCache
+	kinds      map[string]string
+	computed   map[string]ComputedFunc
+	migrations map[int]MigrationFunc
+	order      keyOrder
+	// reading collects what a loader learns about its source, see
+	// Settings.read.
+	reading *readInfo
+	// results holds what the latest loads reported.
+	results *loadResults
+	// requirements are checked by Check, see RequireOneOf.
+	requirements []requirement
+	// migrationHook is called for every migration Migrate runs.
+	migrationHook func(fromVersion, toVersion int)
+	// computing lists the paths being computed, for snapshots given to a
+	// ComputedFunc.
+	computing []string
+	// exportFilters transform redacted output, see AddExportFilter.
+	exportFilters []exportFilter
+	// resolvers transform the values got, see AddResolver.
+	resolvers []Resolver
+	// resolving lists the paths being resolved by ReferenceResolver.
+	resolving []string
+	// validators check values before they are set, see AddValidator.
+	validators []pathValidator
+	// urls holds the configs fetched by LoadURL with WithHTTPCache.
+	urls *urlCache
+	// reloads holds what is called after Reload, see OnReload.
+	reloads *reloadHooks
+	// postLoad holds the hooks added with AddPostLoadHook.
+	postLoad *postLoadHooks
+	// keyNormalizer renames loaded keys, see SetKeyNormalizer.
+	keyNormalizer func(key string) string
+	// keyDenormalizer renames keys in JSON output, see SetKeyDenormalizer.
+	keyDenormalizer func(key string) string
+	// history holds the previous values of paths, see EnableHistory.
+	history *valueHistory
+	// hashes holds the hashes of what loads merged, see SetDeduplicateLoads.
+	hashes *loadHashes
+	// misuse collects what the typed getters report, see SetDevMode.
+	misuse *misuseLog
+	// pending holds the values GetOrSet is computing.
+	pending *pendingSets
+
+	strictConditionals     bool
+	fallbackOnTypeMismatch bool
+	preserveNumbers        bool
+	strictJSON             bool
+	expandPathEnv          bool
+	deduplicateLoads       bool
+	devMode                bool
+	weaklyTyped            bool
+	fileRefRoots           []string
+	allowedRoots           []string
+	logValues              bool
+	luaGoStackTrace        bool
+	luaStrictGlobals       bool
+	mergeReports           bool
+	overrideWarning        int
+	maxDepth               int
+	maxSize                int64
+	maxKeys                int
+	maxValueBytes          int
+	emptyIsMissing         bool
 }
 
 // NewSettings creates a new empty settings struct.
 func NewSettings() Settings {
 	settings := Settings{}
-	settings.settings = make(map[string]interface{})
-	settings.luaModules = make(map[string]lua.LGFunction)
+	settings.lazyInit()
 
 	return settings
 }
 
-// Print is a utility function to print out the settings as JSON
+// lazyInit creates whatever a zero value is missing, so that a zero value
+// Settings works just like one made by NewSettings. Like any other map, a zero
+// value must be used by one goroutine until its first method call returns.
+func (this *Settings) lazyInit() {
+	if this.lock == nil {
+		this.lock = &sync.RWMutex{}
+	}
+	if this.settings == nil {
+		this.settings = make(map[string]interface{})
+	}
+	if this.defaults == nil {
+		this.defaults = make(map[string]interface{})
+	}
+	if this.luaModules == nil {
+		this.luaModules = make(map[string]interface{})
+	}
+	if this.provenance == nil {
+		this.provenance = newProvenance()
+		if this.separator != "" {
+			this.provenance.separator = this.separator
+		}
+	}
+	if this.regexps == nil {
+		this.regexps = newRegexpCache()
+	}
+	if this.stats == nil {
+		this.stats = &loadStats{}
+	}
+	if this.resolved == nil {
+		this.resolved = newResolveCache()
+	}
+	if this.urls == nil {
+		this.urls = &urlCache{}
+	}
+	if this.reloads == nil {
+		this.reloads = &reloadHooks{}
+	}
+	if this.postLoad == nil {
+		this.postLoad = &postLoadHooks{}
+	}
+	if this.history == nil {
+		this.history = &valueHistory{}
+	}
+	if this.hashes == nil {
+		this.hashes = &loadHashes{}
+	}
+	if this.misuse == nil {
+		this.misuse = &misuseLog{}
+	}
+	if this.pending == nil {
+		this.pending = &pendingSets{}
+	}
+	if this.results == nil {
+		this.results = &loadResults{}
+	}
+}
+
+// rlock acquires the read lock, first initializing a zero value. Called on
+// the receiver of a value method, this only initializes that method's copy,
+// which is enough to read from.
+func (this *Settings) rlock() {
+	this.lazyInit()
+	this.lock.RLock()
+}
+
+// runlock releases the read lock.
+func (this Settings) runlock() {
+	this.lock.RUnlock()
+}
+
+// wlock acquires the write lock, first initializing a zero value.
+func (this *Settings) wlock() {
+	this.lazyInit()
+	this.lock.Lock()
+}
+
+// wunlock releases the write lock.
+func (this Settings) wunlock() {
+	this.lock.Unlock()
+}
+
+// Print is a utility function to print out the settings as JSON. Values marked
+// with MarkSecret are redacted. Use Fprint for more control.
 func (this Settings) Print() {
-	b := this.GetPrettyJSON("", "  ")
-	fmt.Println(string(b))
+	if err := this.Fprint(os.Stdout, PrintOptions{}); err != nil {
+		panic(err)
+	}
+}
+
+// String returns the compact json representation of the current config with
+// secrets redacted. Together with Publish this makes Settings an expvar.Var.
+func (this Settings) String() string {
+	return string(this.GetRedactedJSON())
 }
 
-// GetPrettyJSON returns a pretty formatted json of the current config
+// Publish registers the settings with the expvar package under name, making
+// the redacted config visible at /debug/vars. Like expvar.Publish it panics
+// if name is already registered.
+func (this *Settings) Publish(name string) {
+	expvar.Publish(name, this)
+}
+
+// GetPrettyJSON returns a pretty formatted json of the current config. It
+// panics if the settings can't be encoded, see GetPrettyJSONWithOptions.
 func (this Settings) GetPrettyJSON(prefix, indent string) []byte {
-	b, err := json.MarshalIndent(this.settings, prefix, indent)
+	b, err := this.GetPrettyJSONWithOptions(prefix, indent)
 	if err != nil {
 		panic(err)
 	}
@@ -61,123 +233,237 @@ func (this Settings) GetPrettyJSON(prefix, indent string) []byte {
 
 // GetJSON returns the json representation of the current config. This is useful
 // to retain a static copy of the settings for later.
+// Like every function serializing the settings, it encodes a copy taken
+// under the lock, so loads running meanwhile can't disturb it. It panics if
+// the settings can't be encoded, such as when they are nested deeper than
+// SetMaxDepth allows since it was lowered; GetJSONWithOptions returns why.
 func (this Settings) GetJSON() []byte {
-	b, err := json.Marshal(this.settings)
+	b, err := this.GetJSONWithOptions()
 	if err != nil {
 		panic(err)
 	}
 	return b
 }
 
-// AddLuaLoader can be used to add a custom lua module to each lua-state that is
-// used. Note that flexiconfig currently creates a new lua instance for every
-// lua config file loaded.
-func (this *Settings) AddLuaLoader(name string, loader lua.LGFunction) {
-	this.luaModules[name] = loader
+// LoadJSON takes a byte slice, dejsonifys it, then stores the contents in the
+// Settings object.
+func (this *Settings) LoadJSON(b []byte) error {
+	return this.LoadJSONWithOptions(b)
 }
 
-// LoadLuaString is used to load a config file from a lua string.
-func (this *Settings) LoadLuaString(code string) error {
-	L := lua.NewState()
-	luajson.Preload(L)
-	defer L.Close()
+// LoadJSONWithOptions is LoadJSON using the given merge options.
+func (this *Settings) LoadJSONWithOptions(b []byte, options ...MergeOption) error {
+	// Keep a copy for Reload, in case the caller reuses b.
+	b = append([]byte(nil), b...)
+
+	return this.load(&loader{
+		source:  Source{Name: "LoadJSON"},
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.logf(LogDebug, "Loading JSON (%d bytes)", len(b))
+			this.readContent(b)
+			newSettings, err := this.parseJSON(b)
+			return newSettings, len(b), err
+		},
+	})
+}
 
-	for moduleName, loader := range this.luaModules {
-		L.PreloadModule(moduleName, loader)
-	}
-	if err := L.DoString(code); err != nil {
-		return err
+// parseJSON dejsonifys the byte slice.
+func (this *Settings) parseJSON(b []byte) (map[string]interface{}, error) {
+	var newSettings map[string]interface{}
+	err := this.unmarshalJSON(b, &newSettings)
+	if err == nil && this.reading != nil && this.reading.order != nil {
+		jsonKeyOrder(this.pathSeparator(), b, this.reading.order)
 	}
-
-	return this.loadLuaState(L.Get(-1))
+	return newSettings, err
 }
 
-// LoadLuaFile is used to load a lua config file from a specified path
-func (this *Settings) LoadLuaFile(path string) error {
-	L := lua.NewState()
-	luajson.Preload(L)
-	defer L.Close()
+// LoadJSON takes a path to a .json file and loads it into the Settings object.
+func (this *Settings) LoadJSONFile(path string) error {
+	return this.LoadJSONFileWithOptions(path)
+}
 
-	for moduleName, loader := range this.luaModules {
-		L.PreloadModule(moduleName, loader)
+// LoadJSONFileWithOptions is LoadJSONFile using the given merge options.
+func (this *Settings) LoadJSONFileWithOptions(path string, options ...MergeOption) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
 	}
+	return this.load(jsonFileLoader(path, options))
+}
 
-	if err := L.DoFile(path); err != nil {
-		return err
+// jsonFileLoader returns the loader for the .json file at path.
+func jsonFileLoader(path string, options []MergeOption) *loader {
+	return &loader{
+		source:  fileSource(path),
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			// Just a bit of silly. No more than a bit
+			javascriptobjectnotation, err := this.readFile(path)
+			if err != nil {
+				return nil, 0, err
+			}
+			this.logf(LogDebug, "Loading %s (%d bytes)", path, len(javascriptobjectnotation))
+
+			newSettings, err := this.parseJSON(javascriptobjectnotation)
+			return newSettings, len(javascriptobjectnotation), err
+		},
 	}
+}
 
-	return this.loadLuaState(L.Get(-1))
+// LoadFile takes a path and attempts to load it with the proper loader based on extension.
+//
+// A file whose extension isn't a known format, such as config.conf, can name
+// its format on its first line instead, with a marker such as
+//
+//	#!flexiconfig:lua
+//	// flexiconfig: json
+//
+// that is a comment starting with "#!", "#", "//" or "--" followed by
+// "flexiconfig:" and the name of a format LoadFileAs accepts. The marker line
+// is removed before the content is decoded, so that it works for JSON too.
+//
+// A leading "~/" in path stands for the home directory, as it does for every
+// file loader, see SetExpandPathEnv.
+func (this *Settings) LoadFile(path string) error {
+	return this.LoadFileWithOptions(path)
 }
 
-// loadLuaState is used to load the lua value into the current settings.
-func (this *Settings) loadLuaState(lv lua.LValue) error {
-	jsonSettings, err := luajson.Encode(lv)
+// LoadFileWithOptions is LoadFile using the given merge options.
+func (this *Settings) LoadFileWithOptions(path string, options ...MergeOption) error {
+	path, err := this.expandPath(path)
 	if err != nil {
 		return err
 	}
-
-	return this.LoadJSON(jsonSettings)
-}
-
-// LoadJSON takes a byte slice, dejsonifys it, then stores the contents in the
-// Settings object.
-func (this *Settings) LoadJSON(b []byte) error {
-	var newSettings map[string]interface{}
-	err := json.Unmarshal(b, &newSettings)
-
+	l, err := this.fileLoader(path, options)
 	if err != nil {
 		return err
 	}
+	return this.load(l)
+}
 
-	return this.MergeSettings(newSettings)
+// LoadFileAs loads the file at path in the given format, "json" or "lua",
+// whatever its extension. This allows loading files without an extension.
+func (this *Settings) LoadFileAs(path string, format string) error {
+	return this.LoadFileAsWithOptions(path, format)
 }
 
-// LoadJSON takes a path to a .json file and loads it into the Settings object.
-func (this *Settings) LoadJSONFile(path string) error {
-	// Just a bit of silly. No more than a bit
-	javascriptobjectnotation, err := ioutil.ReadFile(path)
+// LoadFileAsWithOptions is LoadFileAs using the given merge options.
+func (this *Settings) LoadFileAsWithOptions(path string, format string, options ...MergeOption) error {
+	path, err := this.expandPath(path)
 	if err != nil {
 		return err
 	}
+	l, err := formatLoader(path, format, options)
+	if err != nil {
+		return err
+	}
+	return this.load(l)
+}
 
-	return this.LoadJSON(javascriptobjectnotation)
+// MergeSettings takes a new map[string]interface{} of settings and merges it into
+// the existing one recursively. Conditional sections (see ConditionalOS) are
+// resolved before anything is merged.
+func (this *Settings) MergeSettings(newSettings map[string]interface{}) error {
+	return this.MergeSettingsWithOptions(newSettings)
 }
 
-// LoadFile takes a path and attempts to load it with the proper loader based on extension.
-func (this *Settings) LoadFile(path string) error {
-	switch ext := filepath.Ext(path); ext {
-	case ".json":
-		return this.LoadJSONFile(path)
-	case ".lua":
-		return this.LoadLuaFile(path)
-	default:
-		return fmt.Errorf("Unable to determine config file type for path %s", path)
+// MergeSettingsWithOptions is MergeSettings using the given merge options.
+func (this *Settings) MergeSettingsWithOptions(newSettings map[string]interface{}, options ...MergeOption) error {
+	return this.load(this.mapLoader(Source{Name: "MergeSettings"}, newSettings, options))
+}
+
+// mapLoader returns a loader for settings that are already in memory. A copy
+// is kept so that the caller can reuse the map.
+func (this Settings) mapLoader(source Source, newSettings map[string]interface{}, options []MergeOption) *loader {
+	copied, err := this.normalizeSettings(newSettings)
+	return &loader{
+		source:  source,
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err != nil {
+				return nil, 0, err
+			}
+			return deepCopy(copied).(map[string]interface{}), 0, nil
+		},
 	}
 }
 
-// MergeSettings takes a new map[string]interface{} of settings and merges it into
-// the existing one recursively.
-func (this *Settings) MergeSettings(newSettings map[string]interface{}) error {
-	return mergeMaps(&this.settings, &newSettings)
+// normalizeSettings checks newSettings for cycles and converts it to the forms
+// used by the settings tree, see normalize, making sure it is within the limits
+// of SetMaxKeys and SetMaxValueBytes.
+func (this Settings) normalizeSettings(newSettings map[string]interface{}) (map[string]interface{}, error) {
+	if err := checkStructure(this.pathSeparator(), "", newSettings, this.depthLimit()); err != nil {
+		return nil, err
+	}
+
+	normalized, err := normalize(this.pathSeparator(), "", newSettings, this.depthLimit())
+	if err != nil {
+		return nil, err
+	}
+	if err := this.checkLimits("", normalized); err != nil {
+		return nil, err
+	}
+	return normalized.(map[string]interface{}), nil
 }
 
 // mergeMaps takes two maps and combines them, preferring the keys in the newer
-// map.
-func mergeMaps(existing, new *map[string]interface{}) error {
-	existingmap := *existing
-	newmap := *new
-
-	for key, value := range newmap {
-		if newvalue, ok := value.(map[string]interface{}); ok {
-			if existingvalue, ok := existingmap[key].(map[string]interface{}); ok {
-				mergeMaps(&existingvalue, &newvalue)
-			} else {
-				existingvalue = make(map[string]interface{})
-				existingmap[key] = existingvalue
-				mergeMaps(&existingvalue, &newvalue)
+// map. Every leaf written is passed to config.record along with its full path.
+// A map replacing a value that isn't one, or the other way around, is a
+// conflict which is passed to config.conflict, if set, and stops the merge if
+// that returns an error.
+func mergeMaps(existing, new map[string]interface{}, path string, config mergeConfig) error {
+	for key, value := range new {
+		keypath := joinPathWith(config.separator, path, key)
+		existingvalue, exists := existing[key]
+		if exists && config.keepExisting {
+			if existingmap, ok := existingvalue.(map[string]interface{}); ok {
+				if newmap, ok := value.(map[string]interface{}); ok {
+					if err := mergeMaps(existingmap, newmap, keypath, config); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		existingmap, existingIsMap := existingvalue.(map[string]interface{})
+		newmap, newIsMap := value.(map[string]interface{})
+		if exists && existingIsMap != newIsMap && config.conflict != nil {
+			if err := config.conflict(keypath, existingvalue, value); err != nil {
+				return fmt.Errorf("Conflict at %s: %s", keypath, err)
+			}
+		}
+
+		if !newIsMap {
+			switch {
+			case !exists:
+				config.report.added(keypath)
+			case existingIsMap:
+				config.report.replaced(keypath)
+			default:
+				config.report.overridden(keypath, existingvalue, value)
+			}
+
+			existing[key] = value
+			if config.record != nil {
+				config.record(keypath)
+			}
+			continue
+		}
+
+		if !existingIsMap {
+			if exists {
+				config.report.replaced(keypath)
 			}
-		} else {
-			existingmap[key] = value
+			existingmap = make(map[string]interface{})
+			existing[key] = existingmap
+		}
+		if err := mergeMaps(existingmap, newmap, keypath, config); err != nil {
+			return err
 		}
 	}
 
@@ -185,26 +471,67 @@ func mergeMaps(existing, new *map[string]interface{}) error {
 }
 
 // RawGet will return the interface{} of the value at a specific path, and
-// error if the value cannot be found.
+// error if the value cannot be found. Paths registered with RegisterComputed
+// return their computed value. An empty path returns a copy of the whole
+// tree, while a path with an empty key, such as ":a", "a:" or "a::b", is an
+// error matching ErrInvalidPath. Every function taking a path treats paths
+// the same way, except that setting or deleting the empty path is an error as
+// well.
 func (this Settings) RawGet(path string) (interface{}, error) {
-	parts := strings.Split(path, ":")
-	finalpart := parts[len(parts)-1]
-	parts = parts[:len(parts)-1]
+	this.rlock()
+	if path == "" {
+		defer this.runlock()
+		return deepCopy(this.settings), nil
+	}
+	value, err := this.rawGet(path)
+	fn := this.computed[path]
+	if !computes(fn, value, err) {
+		this.runlock()
+		return value, err
+	}
+	snapshot := this.snapshot()
+	this.runlock()
+
+	return this.compute(path, fn, snapshot)
+}
 
+// rawGet is RawGet without locking. It walks the path in place rather than
+// splitting it, so that getting a value allocates nothing. The empty path is
+// the settings themselves.
+func (this Settings) rawGet(path string) (interface{}, error) {
+	if path == "" {
+		return this.settings, nil
+	}
+	if err := this.checkPath(path); err != nil {
+		return nil, err
+	}
+	path = this.normalizePath(path)
+	sep := this.pathSeparator()
 	node := this.settings
+	finalpart := path
+
+	for {
+		i := strings.Index(finalpart, sep)
+		if i < 0 {
+			break
+		}
+		part := finalpart[:i]
+		finalpart = finalpart[i+len(sep):]
 
-	for _, part := range parts {
 		var ok bool
 		if node, ok = node[part].(map[string]interface{}); !ok {
-			return nil, fmt.Errorf("Could not find %s (missing %s)", path, part)
+			return nil, newNotFoundError(path, part)
 		}
 	}
 
-	if finalpart, ok := node[finalpart].(interface{}); !ok {
-		return nil, fmt.Errorf("Could not find %s (missing %s)", path, finalpart)
-	} else {
-		return finalpart, nil
+	value, ok := node[finalpart]
+	if !ok {
+		return nil, newNotFoundError(path, finalpart)
 	}
+	if value == nil {
+		return nil, &nullValueError{path}
+	}
+	return value, nil
 }
 
 // RawSet will set the value of the config at a specific path. "timid" is used
@@ -216,62 +543,293 @@ func (this Settings) RawGet(path string) (interface{}, error) {
 // timid == 0 will replace "itermediate" with the required map
 // timid == 1 will instead throw an error claiming  to not be able to find the
 // path.
-func (this Settings) RawSet(timid bool, path string, value interface{}) error {
-	parts := strings.Split(path, ":")
+// See RawSetMode for more control.
+func (this *Settings) RawSet(timid bool, path string, value interface{}) error {
+	mode := SetReplace
+	if timid {
+		mode = SetCreate
+	}
+	_, err := this.RawSetMode(mode, path, value)
+	return err
+}
+
+// RawSetMode sets the value of the config at a specific path, using mode to
+// decide what to do with the parts of the path that aren't maps. With
+// SetReplace the values that had to be replaced by maps are returned, keyed by
+// their path, and logged as warnings.
+func (this *Settings) RawSetMode(mode SetMode, path string, value interface{}) (map[string]interface{}, error) {
+	path, value, err := this.prepareSet(path, value)
+	if err != nil {
+		return nil, err
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	return this.setPrepared("RawSet", mode, path, value)
+}
+
+// prepareSet returns path and value normalized to be set, once value passed
+// the validators.
+func (this Settings) prepareSet(path string, value interface{}) (string, interface{}, error) {
+	if err := this.checkPath(path); err != nil {
+		return "", nil, err
+	}
+	if err := checkStructure(this.pathSeparator(), path, value, this.depthLimit()); err != nil {
+		return "", nil, err
+	}
+	path = this.normalizePath(path)
+	value, err := normalize(this.pathSeparator(), path, value, this.depthLimit())
+	if err == nil {
+		value, err = this.normalizeKeys(path, value)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if err := this.checkValidators(path, value); err != nil {
+		return "", nil, err
+	}
+	return path, value, nil
+}
+
+// setPrepared sets value, prepared by prepareSet, at path on behalf of the
+// function called name. The caller must hold the write lock.
+func (this Settings) setPrepared(name string, mode SetMode, path string, value interface{}) (map[string]interface{}, error) {
+	if this.kinds != nil {
+		if err := this.checkSetKinds(name, path, value); err != nil {
+			return nil, err
+		}
+	}
+
+	mark := this.markHistory(path)
+	replaced, err := this.rawSet(mode, path, value)
+	if err == nil && this.kinds != nil {
+		this.recordSetKinds(path, value)
+	}
+	if err == nil && mark != nil {
+		this.recordHistory(name, mark)
+		for partPath, old := range replaced {
+			this.recordChanges(name, []Change{{Path: partPath, Type: ChangeRemoved, Old: old}})
+		}
+	}
+	return replaced, err
+}
+
+// rawSet is RawSetMode without locking.
+func (this Settings) rawSet(mode SetMode, path string, value interface{}) (map[string]interface{}, error) {
+	if err := this.checkPath(path); err != nil {
+		return nil, err
+	}
+	path = this.normalizePath(path)
+	parts := this.splitPath(path)
 	finalpart := parts[len(parts)-1]
 	parts = parts[:len(parts)-1]
 
 	node := this.settings
+	var replaced map[string]interface{}
 
-	for _, part := range parts {
+	for i, part := range parts {
+		nodePart, exists := node[part]
+		if next, ok := nodePart.(map[string]interface{}); ok {
+			node = next
+			continue
+		}
 
-		// Check if this part exists
-		if nodePart, ok := node[part]; ok {
-			// Make sure this part isn't anything but another map
-			if node, ok = nodePart.(map[string]interface{}); !ok {
-				// If timid is true don't overwrite the invalid key
-				if timid {
-					return fmt.Errorf("Could not find %s (missing %s)", path, part)
-				} else {
-					// Create empty map for this part
-					newMap := make(map[string]interface{})
-					node[part] = newMap
-					node = newMap
-				}
+		switch {
+		case !exists && mode == SetExisting:
+			return nil, newNotFoundError(path, part)
+		case exists && mode != SetReplace:
+			return nil, fmt.Errorf("Could not find %s (missing %s)", path, part)
+		case exists:
+			partPath := strings.Join(parts[:i+1], this.pathSeparator())
+			if replaced == nil {
+				replaced = make(map[string]interface{})
 			}
-		} else {
-			// Create empty map for this part
-			newMap := make(map[string]interface{})
-			node[part] = newMap
-			node = newMap
+			replaced[partPath] = nodePart
+			this.logf(LogWarning, "Setting %s replaced the %s at %s", path, typeName(nodePart), partPath)
 		}
+
+		// Create empty map for this part
+		newMap := make(map[string]interface{})
+		node[part] = newMap
+		node = newMap
 	}
 
 	node[finalpart] = value
+	if this.order != nil {
+		this.order.set(this.pathSeparator(), append(parts, finalpart), this.settings)
+	}
+	this.provenance.forget(path)
+	this.changed(path)
+	return replaced, nil
+}
+
+// Delete removes the value at a specific path. It returns an error if the path
+// can't be found.
+func (this *Settings) Delete(path string) error {
+	this.wlock()
+	defer this.wunlock()
+
+	mark := this.markHistory(this.normalizePath(path))
+	if err := this.delete(path); err != nil {
+		return err
+	}
+	this.recordHistory("Delete", mark)
+	return nil
+}
+
+// delete is Delete without locking.
+func (this Settings) delete(path string) error {
+	if err := this.checkPath(path); err != nil {
+		return err
+	}
+	path = this.normalizePath(path)
+	parts := this.splitPath(path)
+	finalpart := parts[len(parts)-1]
+	parts = parts[:len(parts)-1]
+
+	node := this.settings
+
+	for _, part := range parts {
+		var ok bool
+		if node, ok = node[part].(map[string]interface{}); !ok {
+			return newNotFoundError(path, part)
+		}
+	}
+
+	if _, ok := node[finalpart]; !ok {
+		return newNotFoundError(path, finalpart)
+	}
+	delete(node, finalpart)
+	if this.kinds != nil {
+		this.forgetKinds(path)
+	}
+	if this.order != nil {
+		this.order.remove(this.pathSeparator(), append(parts, finalpart))
+	}
+	this.provenance.forget(path)
+	this.changed(path)
+	return nil
+}
+
+// Append adds values to the end of the array at a specific path, creating the
+// array if the path isn't set. It returns an error if the path holds something
+// other than an array.
+func (this *Settings) Append(path string, values ...interface{}) error {
+	if err := this.checkPath(path); err != nil {
+		return err
+	}
+	path = this.normalizePath(path)
+	for i, value := range values {
+		if err := checkStructure(this.pathSeparator(), path, value, this.depthLimit()); err != nil {
+			return err
+		}
+		normalized, err := normalize(this.pathSeparator(), path, value, this.depthLimit())
+		if err == nil {
+			normalized, err = this.normalizeKeys(path, normalized)
+		}
+		if err != nil {
+			return err
+		}
+		values[i] = normalized
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	var array []interface{}
+	if existing, err := this.rawGet(path); err == nil {
+		var ok bool
+		if array, ok = existing.([]interface{}); !ok {
+			return fmt.Errorf("%s is not an array", path)
+		}
+	}
+
+	newArray := make([]interface{}, 0, len(array)+len(values))
+	newArray = append(append(newArray, array...), values...)
+	mark := this.markHistory(path)
+	if _, err := this.rawSet(SetReplace, path, newArray); err != nil {
+		return err
+	}
+	this.recordHistory("Append", mark)
 	return nil
 }
 
 // Get will retrieve the path and store it inside the interface the best it can.
 func (this Settings) Get(path string, target interface{}) error {
-	rawvalue, err := this.RawGet(path)
+	rawvalue, err := this.getTyped(path)
 	if err != nil {
 		return err
 	}
 
-	err = mapstructure.Decode(rawvalue, target)
-	return err
+	return this.decode(path, rawvalue, target)
+}
+
+// decode stores rawvalue, found at path, inside target using mapstructure.
+func (this Settings) decode(path string, rawvalue interface{}, target interface{}) error {
+	hooks := []mapstructure.DecodeHookFunc{
+		jsonNumberHook,
+		integerHook(this.weaklyTyped),
+		regexpHook,
+		expandEnvHook,
+		mapKeyHook,
+		mapstructure.StringToTimeDurationHookFunc(),
+	}
+	if this.weaklyTyped {
+		hooks = append(hooks, lenientBoolHook)
+	}
+	hook := mapstructure.ComposeDecodeHookFunc(hooks...)
+
+	// mapstructure only runs hooks with a useful error message for nested
+	// values, so run them here for the top-level value.
+	if t := reflect.TypeOf(target); t != nil && t.Kind() == reflect.Ptr && rawvalue != nil {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		converted, err := mapstructure.DecodeHookExec(hook, reflect.TypeOf(rawvalue), t, rawvalue)
+		if err != nil {
+			return fmt.Errorf("Could not decode %s: %s", path, err)
+		}
+		rawvalue = converted
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       hook,
+		WeaklyTypedInput: this.weaklyTyped,
+		Result:           target,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := decoder.Decode(rawvalue); err != nil {
+		return fmt.Errorf("Could not decode %s: %s", path, err)
+	}
+	return nil
 }
 
 // GetBool returns a bool stored in the path.
 // If the the path isn't defined it will return the defaultValue and an error.
 func (this Settings) GetBool(path string, defaultValue bool) (bool, error) {
-	rawvalue, err := this.RawGet(path)
+	value, err := this.getBool(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetBool", path, err)
+	}
+	return value, err
+}
+
+// getBool is GetBool without reporting misuse, see SetDevMode.
+func (this Settings) getBool(path string, defaultValue bool) (bool, error) {
+	if this.weaklyTyped {
+		return this.getBoolLenient(path, defaultValue)
+	}
+	rawvalue, err := this.getTyped(path)
 	if err != nil {
 		return defaultValue, err
 	}
 
 	if value, ok := rawvalue.(bool); !ok {
-		return defaultValue, fmt.Errorf("%s is not a bool", path)
+		return defaultValue, typeError(path, rawvalue, "a bool")
 	} else {
 		return value, nil
 	}
@@ -280,24 +838,67 @@ func (this Settings) GetBool(path string, defaultValue bool) (bool, error) {
 // GetString returns a string stored in the path.
 // If the the path isn't defined it will return the defaultValue and an error.
 func (this Settings) GetString(path string, defaultValue string) (string, error) {
-	rawvalue, err := this.RawGet(path)
+	value, err := this.getString(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetString", path, err)
+	}
+	return value, err
+}
+
+// getString is GetString without reporting misuse, see SetDevMode.
+func (this Settings) getString(path string, defaultValue string) (string, error) {
+	rawvalue, err := this.getTyped(path)
 	if err != nil {
 		return defaultValue, err
 	}
 
 	if value, ok := rawvalue.(string); !ok {
-		return defaultValue, fmt.Errorf("%s is not a string", path)
+		return defaultValue, typeError(path, rawvalue, "a string")
 	} else {
 		return value, nil
 	}
 }
 
-// GetInt returns a int stored in the path.
+// GetInt returns a int stored in the path. Like the other getters it returns
+// an error naming the type stored if it can't be converted, see
+// SetWeaklyTyped, and an error matching ErrNullValue if it is null.
 // If the the path isn't defined it will return the defaultValue and an error.
 func (this Settings) GetInt(path string, defaultValue int64) (int64, error) {
+	value, err := this.getInt(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetInt", path, err)
+	}
+	return value, err
+}
+
+// getInt is GetInt without reporting misuse, see SetDevMode.
+func (this Settings) getInt(path string, defaultValue int64) (int64, error) {
 	var target int64
 
-	err := this.Get(path, &target)
+	err := this.getNumber(path, &target)
+	if err != nil {
+		return defaultValue, err
+	} else {
+		return target, nil
+	}
+}
+
+// GetUint returns an unsigned int stored in the path. Negative numbers are an
+// error.
+// If the the path isn't defined it will return the defaultValue and an error.
+func (this Settings) GetUint(path string, defaultValue uint64) (uint64, error) {
+	value, err := this.getUint(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetUint", path, err)
+	}
+	return value, err
+}
+
+// getUint is GetUint without reporting misuse, see SetDevMode.
+func (this Settings) getUint(path string, defaultValue uint64) (uint64, error) {
+	var target uint64
+
+	err := this.getNumber(path, &target)
 	if err != nil {
 		return defaultValue, err
 	} else {
@@ -308,12 +909,86 @@ func (this Settings) GetInt(path string, defaultValue int64) (int64, error) {
 // GetFloat returns a float stored in the path.
 // If the the path isn't defined it will return the defaultValue and an error.
 func (this Settings) GetFloat(path string, defaultValue float64) (float64, error) {
+	value, err := this.getFloat(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetFloat", path, err)
+	}
+	return value, err
+}
+
+// getFloat is GetFloat without reporting misuse, see SetDevMode.
+func (this Settings) getFloat(path string, defaultValue float64) (float64, error) {
 	var target float64
 
-	err := this.Get(path, &target)
+	err := this.getNumber(path, &target)
+	if err != nil {
+		return defaultValue, err
+	} else {
+		return target, nil
+	}
+}
+
+// GetDuration returns a duration stored in the path. Strings are parsed with
+// time.ParseDuration, numbers are taken as nanoseconds.
+// If the the path isn't defined it will return the defaultValue and an error.
+func (this Settings) GetDuration(path string, defaultValue time.Duration) (time.Duration, error) {
+	value, err := this.getDuration(path, defaultValue)
+	if err != nil && this.devMode {
+		this.noteMisuse("GetDuration", path, err)
+	}
+	return value, err
+}
+
+// getDuration is GetDuration without reporting misuse, see SetDevMode.
+func (this Settings) getDuration(path string, defaultValue time.Duration) (time.Duration, error) {
+	var target time.Duration
+
+	err := this.getNumber(path, &target)
 	if err != nil {
 		return defaultValue, err
 	} else {
 		return target, nil
 	}
 }
+
+// GetAbsPath returns a file path stored in the path. Relative values are
+// resolved against the directory of the config file that set them, or the
+// current working directory for values that didn't come from a file. A
+// leading "~" is expanded to the user's home directory.
+// If the the path isn't defined it will return the defaultValue and an error.
+func (this Settings) GetAbsPath(path string, defaultValue string) (string, error) {
+	value, err := this.GetString(path, defaultValue)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	if value, err = expandHome(value); err != nil {
+		return defaultValue, err
+	}
+	if filepath.IsAbs(value) {
+		return filepath.Clean(value), nil
+	}
+
+	if source, ok := this.SourceOf(path); ok && source.Dir != "" {
+		return filepath.Join(source.Dir, value), nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return defaultValue, err
+	}
+	return filepath.Join(cwd, value), nil
+}
+
+// expandHome replaces a leading "~" in path with the user's home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
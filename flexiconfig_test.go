@@ -1,3 +1,6053 @@
 package flexiconfig
 
-// todo: this file.
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPreserveNumbers(t *testing.T) {
+	settings := NewSettings()
+	settings.SetPreserveNumbers(true)
+
+	// Both are above 2^53 and can't be represented exactly by a float64.
+	err := settings.LoadJSON([]byte(`{"id": 823761298371298312, "nested": {"id": 9007199254740993}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := settings.GetInt("id", 0); err != nil || id != 823761298371298312 {
+		t.Errorf("GetInt(id) = %d, %v", id, err)
+	}
+
+	var nested struct {
+		ID uint64
+	}
+	if err := settings.Get("nested", &nested); err != nil || nested.ID != 9007199254740993 {
+		t.Errorf("Get(nested) = %d, %v", nested.ID, err)
+	}
+
+	want := `{"id":823761298371298312,"nested":{"id":9007199254740993}}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("GetJSON() = %s, want %s", got, want)
+	}
+
+	// A json.Number can replace a float64 and the other way around.
+	settings.SetPreserveNumbers(false)
+	if err := settings.LoadJSON([]byte(`{"id": 1.5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := settings.GetFloat("id", 0); err != nil || f != 1.5 {
+		t.Errorf("GetFloat(id) = %f, %v", f, err)
+	}
+	settings.SetPreserveNumbers(true)
+	if err := settings.LoadJSON([]byte(`{"id": 823761298371298313}`)); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := settings.GetInt("id", 0); err != nil || id != 823761298371298313 {
+		t.Errorf("GetInt(id) = %d, %v", id, err)
+	}
+	if f, err := settings.GetFloat("nested:id", 0); err != nil || f != 9007199254740992 {
+		t.Errorf("GetFloat(nested:id) = %f, %v", f, err)
+	}
+}
+
+func TestSubWriter(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"plugin": {"name": "p", "tags": ["a"]}, "db": {"password": "secret"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := settings.SubWriter("plugin:state")
+	if writer.Prefix() != "plugin:state" {
+		t.Errorf("Prefix() = %q", writer.Prefix())
+	}
+	if err := writer.Set("runs", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Set("last:ok", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Append("seen", "x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Append("seen", "z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Delete("last"); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"db":{"password":"secret"},"plugin":{"name":"p","state":{"runs":1,"seen":["x","y","z"]},"tags":["a"]}}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings = %s, want %s", got, want)
+	}
+	if err := writer.Append("runs", 2); err == nil {
+		t.Error("Append to a value that isn't an array should fail")
+	}
+	if err := writer.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete(missing) = %v, want ErrNotFound", err)
+	}
+
+	// Paths that could leave the prefix are rejected before anything
+	// changes.
+	for _, path := range []string{"", "..", "..:db:password", "a::b", ":a", "a:", ".", "a:.:b", "a:..:..:db"} {
+		for name, write := range map[string]func() error{
+			"Set":    func() error { return writer.Set(path, "x") },
+			"Delete": func() error { return writer.Delete(path) },
+			"Append": func() error { return writer.Append(path, "x") },
+		} {
+			if err := write(); err == nil || !strings.HasPrefix(err.Error(), "Invalid path ") {
+				t.Errorf("%s(%q) = %v, want an invalid path error", name, path, err)
+			}
+		}
+	}
+	for _, prefix := range []string{"", "..", "plugin:..", "plugin::state", ":plugin"} {
+		if err := settings.SubWriter(prefix).Set("a", "x"); err == nil || !strings.HasPrefix(err.Error(), "Invalid writer prefix ") {
+			t.Errorf("SubWriter(%q).Set = %v, want an invalid prefix error", prefix, err)
+		}
+	}
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("rejected writes changed the settings to %s", got)
+	}
+
+	// Segments are split with the separator of the settings.
+	settings = NewSettings()
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	writer = settings.SubWriter("plugin.state")
+	if err := writer.Set("host:port", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Set("a..b", 1); err == nil {
+		t.Error("Set(a..b) with the separator \".\" should fail")
+	}
+	if got := string(settings.GetJSON()); got != `{"plugin":{"state":{"host:port":1}}}` {
+		t.Errorf("settings = %s", got)
+	}
+}
+
+func TestLoadCSVFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	users := write("users.csv", "name,age,admin,note\nann,31,true,\"likes, commas\"\nbob,7,false,\"two\nlines\"\n")
+	settings := NewSettings()
+	if err := settings.LoadCSVFile(users, "data:users"); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"data":{"users":[{"admin":"true","age":"31","name":"ann","note":"likes, commas"},{"admin":"false","age":"7","name":"bob","note":"two\nlines"}]}}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("LoadCSVFile = %s, want %s", got, want)
+	}
+	if source, ok := settings.SourceOf("data:users"); !ok || source.Name != users {
+		t.Errorf("SourceOf(data:users) = %v, %v", source, ok)
+	}
+
+	settings = NewSettings()
+	if err := settings.LoadCSVFile(users, "users", CSVInferTypes); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"users":[{"admin":true,"age":31,"name":"ann","note":"likes, commas"},{"admin":false,"age":7,"name":"bob","note":"two\nlines"}]}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("LoadCSVFile with CSVInferTypes = %s, want %s", got, want)
+	}
+
+	// A file with only a header loads as an empty array.
+	settings = NewSettings()
+	if err := settings.LoadCSVFile(write("header.csv", "name,age\n"), "rows"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"rows":[]}` {
+		t.Errorf("LoadCSVFile(header only) = %s", got)
+	}
+
+	for name, test := range map[string]struct {
+		content string
+		target  string
+		message string
+	}{
+		"empty.csv":     {"", "rows", "missing header row"},
+		"duplicate.csv": {"a,b,a\n1,2,3\n", "rows", `duplicate column "a"`},
+		"short.csv":     {"a,b\n1,2\n3\n", "rows", "wrong number of fields"},
+		"long.csv":      {"a,b\n1,2,3\n", "rows", "wrong number of fields"},
+		"quote.csv":     {"a,b\n\"1,2\n", "rows", "Could not load"},
+		"target.csv":    {"a\n1\n", "", "a target path is required"},
+	} {
+		settings := NewSettings()
+		err := settings.LoadCSVFile(write(name, test.content), test.target)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("LoadCSVFile(%s) = %v, want an error containing %q", name, err, test.message)
+		}
+		if got := string(settings.GetJSON()); got != `{}` {
+			t.Errorf("LoadCSVFile(%s) changed the settings to %s", name, got)
+		}
+	}
+	if err := settings.LoadCSVFile(filepath.Join(dir, "missing.csv"), "rows"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadCSVFile(missing) = %v", err)
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	for config, message := range map[string]string{
+		`{"a": 1, "a": 2}`:                                          "Duplicate key a on line 1",
+		`{"a": {"b": 1, "c": {"d": 1}, "b": 2}}`:                    "Duplicate key a:b on line 1",
+		"{\n\"a\": {\n\"b\": {\"c\": 1,\n\"c\": 2}}}":               "Duplicate key a:b:c on line 4",
+		`{"list": [{"a": 1}, {"a": 1, "b": 2, "a": 3}]}`:            "Duplicate key list[1]:a on line 1",
+		`{"list": [[1, 2], [{"x": {"y": 1, "y": 2}}]]}`:             "Duplicate key list[1][0]:x:y on line 1",
+		`{"list": [1, "a", null, true, {}, []], "list": []}`:        "Duplicate key list on line 1",
+		`{"a": {"x": 1}, "b": {"x": 1}, "c": [{"x": 1}, {"x": 1}]}`: "",
+		`{"a": 1, "A": 2, "nested": {"a": 1}}`:                      "",
+	} {
+		settings := NewSettings()
+		settings.SetStrictJSON(true)
+		err := settings.LoadJSON([]byte(config))
+		if message == "" {
+			if err != nil {
+				t.Errorf("LoadJSON(%s) = %s", config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("LoadJSON(%s) = %v, want %q", config, err, message)
+		}
+		if got := string(settings.GetJSON()); got != `{}` {
+			t.Errorf("LoadJSON(%s) changed the settings to %s", config, got)
+		}
+
+		// Without strict mode the last key wins.
+		settings.SetStrictJSON(false)
+		if err := settings.LoadJSON([]byte(config)); err != nil {
+			t.Errorf("LoadJSON(%s) without strict mode = %s", config, err)
+		}
+	}
+
+	settings := NewSettings()
+	settings.SetStrictJSON(true)
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	err := settings.LoadJSON([]byte(`{"a": [{"b": {"c": 1, "c": 2}}]}`))
+	if err == nil || !strings.Contains(err.Error(), "Duplicate key a[0].b.c") {
+		t.Errorf("LoadJSON with the separator \".\" = %v", err)
+	}
+}
+
+func TestMergeNormalizesMaps(t *testing.T) {
+	settings := NewSettings()
+	err := settings.MergeSettings(map[string]interface{}{
+		"yaml": map[interface{}]interface{}{
+			"name":    "server",
+			"enabled": true,
+			"timeout": "5s",
+			"nested": map[interface{}]interface{}{
+				"ratio": 0.5,
+			},
+			8080: "port key",
+		},
+		"labels": map[string]string{"env": "prod"},
+		"hosts":  []string{"a", "b"},
+		"ports":  []map[string]int{{"port": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := settings.GetString("yaml:name", ""); err != nil || value != "server" {
+		t.Errorf("GetString(yaml:name) = %q, %v", value, err)
+	}
+	if value, err := settings.GetBool("yaml:enabled", false); err != nil || !value {
+		t.Errorf("GetBool(yaml:enabled) = %t, %v", value, err)
+	}
+	if value, err := settings.GetDuration("yaml:timeout", 0); err != nil || value.Seconds() != 5 {
+		t.Errorf("GetDuration(yaml:timeout) = %s, %v", value, err)
+	}
+	if value, err := settings.GetFloat("yaml:nested:ratio", 0); err != nil || value != 0.5 {
+		t.Errorf("GetFloat(yaml:nested:ratio) = %f, %v", value, err)
+	}
+	if value, err := settings.GetString("yaml:8080", ""); err != nil || value != "port key" {
+		t.Errorf("GetString(yaml:8080) = %q, %v", value, err)
+	}
+	if value, err := settings.GetString("labels:env", ""); err != nil || value != "prod" {
+		t.Errorf("GetString(labels:env) = %q, %v", value, err)
+	}
+
+	var hosts []string
+	if err := settings.Get("hosts", &hosts); err != nil || len(hosts) != 2 {
+		t.Errorf("Get(hosts) = %v, %v", hosts, err)
+	}
+	raw, _ := settings.RawGet("ports")
+	if ports, ok := raw.([]interface{}); !ok || len(ports) != 1 {
+		t.Fatalf("RawGet(ports) = %#v", raw)
+	} else if _, ok := ports[0].(map[string]interface{}); !ok {
+		t.Errorf("RawGet(ports)[0] = %#v", ports[0])
+	}
+
+	err = settings.MergeSettings(map[string]interface{}{
+		"bad": map[interface{}]interface{}{1.5: "float key"},
+	})
+	if err == nil {
+		t.Error("merging a float key should fail")
+	}
+	err = settings.MergeSettings(map[string]interface{}{
+		"bad": map[interface{}]interface{}{1: "int", "1": "string"},
+	})
+	if err == nil {
+		t.Error("merging keys that both convert to \"1\" should fail")
+	}
+}
+
+func TestFileRefs(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"conf/app.json":       `{"key": "@file:secrets/key", "crlf": "@file:secrets/crlf", "twice": "@file:secrets/twice", "binary": "@file+base64:secrets/binary", "missing": "@file:secrets/missing", "plain": "file:secrets/key"}`,
+		"conf/secrets/key":    "relative\n",
+		"conf/secrets/crlf":   "windows\r\n",
+		"conf/secrets/twice":  "two\n\n",
+		"conf/secrets/binary": "\x00\xff\n",
+		"other/key":           "other",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settings := NewSettings()
+	if err := settings.LoadFile(filepath.Join(dir, "conf", "app.json")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := settings.GetString("key", ""); err != nil || got != "@file:secrets/key" {
+		t.Errorf("GetString(key) without file refs = %q, %v", got, err)
+	}
+
+	settings.EnableFileRefs(true)
+	for path, want := range map[string]string{
+		"key":    "relative",
+		"crlf":   "windows",
+		"twice":  "two\n",
+		"binary": "AP8K",
+		"plain":  "file:secrets/key",
+	} {
+		if got, err := settings.GetString(path, ""); err != nil || got != want {
+			t.Errorf("GetString(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	var target string
+	if err := settings.Get("key", &target); err != nil || target != "relative" {
+		t.Errorf("Get(key) = %q, %v", target, err)
+	}
+	if got, err := settings.RawGet("key"); err != nil || got != "@file:secrets/key" {
+		t.Errorf("RawGet(key) = %v, %v, want the reference", got, err)
+	}
+	if !strings.Contains(string(settings.GetJSON()), `"key":"@file:secrets/key"`) {
+		t.Errorf("GetJSON = %s, want the reference", settings.GetJSON())
+	}
+
+	got, err := settings.GetString("missing", "default")
+	if got != "default" || !errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetString(missing) = %q, %v, want the default and os.ErrNotExist", got, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "referenced by missing") {
+		t.Errorf("GetString(missing) error = %v, want it to name the path", err)
+	}
+
+	// Values that didn't come from a file are resolved against the working
+	// directory, absolute ones as is.
+	if err := settings.RawSet(false, "absolute", "@file:"+filepath.Join(dir, "other", "key")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := settings.GetString("absolute", ""); err != nil || got != "other" {
+		t.Errorf("GetString(absolute) = %q, %v", got, err)
+	}
+
+	// Roots restrict which files can be referenced.
+	settings.SetFileRefRoots(filepath.Join(dir, "conf", "secrets"))
+	settings.InvalidateCache("")
+	if got, err := settings.GetString("key", ""); err != nil || got != "relative" {
+		t.Errorf("GetString(key) inside the roots = %q, %v", got, err)
+	}
+	if _, err := settings.GetString("absolute", ""); err == nil || !strings.Contains(err.Error(), "outside of the allowed roots") {
+		t.Errorf("GetString(absolute) outside the roots = %v", err)
+	}
+	if err := settings.RawSet(false, "escape", "@file:secrets/../../../other/key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.GetString("escape", ""); err == nil || !strings.Contains(err.Error(), "outside of the allowed roots") {
+		t.Errorf("GetString(escape) = %v", err)
+	}
+
+	settings.EnableFileRefs(false)
+	if got, err := settings.GetString("key", ""); err != nil || got != "@file:secrets/key" {
+		t.Errorf("GetString(key) after disabling file refs = %q, %v", got, err)
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	settings := NewSettings()
+	err := settings.MergeSettings(map[string]interface{}{
+		"fraction":   4.7,
+		"half":       -2.5,
+		"whole":      4.0,
+		"negative":   -1,
+		"zero":       0,
+		"min64":      -math.Pow(2, 63),
+		"max64":      math.Pow(2, 63),
+		"maxuint64":  math.Pow(2, 64),
+		"bigfloat":   1.5e19,
+		"int8max":    127,
+		"int8over":   128,
+		"int8min":    -128,
+		"int8under":  -129,
+		"uint8max":   255,
+		"uint8over":  256,
+		"int32max":   math.MaxInt32,
+		"int32over":  int64(math.MaxInt32) + 1,
+		"uint32max":  uint64(math.MaxUint32),
+		"uint32over": uint64(math.MaxUint32) + 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(name string, got, want interface{}, err error) {
+		t.Helper()
+		if err != nil || got != want {
+			t.Errorf("%s = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	fails := func(name string, err error, message string) {
+		t.Helper()
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s = %v, want an error containing %q", name, err, message)
+		}
+	}
+
+	got, err := settings.GetInt("whole", 0)
+	ok("GetInt(whole)", got, int64(4), err)
+	got, err = settings.GetInt("min64", 0)
+	ok("GetInt(min64)", got, int64(math.MinInt64), err)
+	for _, path := range []string{"fraction", "half"} {
+		got, err := settings.GetInt(path, 9)
+		fails("GetInt("+path+")", err, "is not an integer")
+		if got != 9 {
+			t.Errorf("GetInt(%s) = %d, want the default", path, got)
+		}
+	}
+	_, err = settings.GetInt("max64", 0)
+	fails("GetInt(max64)", err, "does not fit in int64")
+
+	u, err := settings.GetUint("zero", 1)
+	ok("GetUint(zero)", u, uint64(0), err)
+	u, err = settings.GetUint("bigfloat", 0)
+	ok("GetUint(bigfloat)", u, uint64(15000000000000000000), err)
+	u, err = settings.GetUint("max64", 0)
+	ok("GetUint(max64)", u, uint64(1)<<63, err)
+	_, err = settings.GetUint("negative", 0)
+	fails("GetUint(negative)", err, "does not fit in uint64")
+	_, err = settings.GetUint("maxuint64", 0)
+	fails("GetUint(maxuint64)", err, "does not fit in uint64")
+	_, err = settings.GetUint("fraction", 0)
+	fails("GetUint(fraction)", err, "is not an integer")
+
+	// Smaller integer types are checked against their own range.
+	var i8 int8
+	var u8 uint8
+	var i32 int32
+	var u32 uint32
+	for _, test := range []struct {
+		path    string
+		target  interface{}
+		message string
+	}{
+		{"int8max", &i8, ""},
+		{"int8min", &i8, ""},
+		{"int8over", &i8, "does not fit in int8"},
+		{"int8under", &i8, "does not fit in int8"},
+		{"uint8max", &u8, ""},
+		{"uint8over", &u8, "does not fit in uint8"},
+		{"negative", &u8, "does not fit in uint8"},
+		{"int32max", &i32, ""},
+		{"int32over", &i32, "does not fit in int32"},
+		{"uint32max", &u32, ""},
+		{"uint32over", &u32, "does not fit in uint32"},
+		{"fraction", &i8, "is not an integer"},
+	} {
+		err := settings.Get(test.path, test.target)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("Get(%s) into %T = %s", test.path, test.target, err)
+			}
+			continue
+		}
+		fails(fmt.Sprintf("Get(%s) into %T", test.path, test.target), err, test.message)
+	}
+	if i8 != -128 || u8 != 255 || i32 != math.MaxInt32 || u32 != math.MaxUint32 {
+		t.Errorf("Get stored %d, %d, %d, %d", i8, u8, i32, u32)
+	}
+
+	// Weakly typed, fractions are rounded to the nearest integer but the
+	// range is still checked.
+	settings.SetWeaklyTyped(true)
+	got, err = settings.GetInt("fraction", 0)
+	ok("GetInt(fraction) weakly typed", got, int64(5), err)
+	got, err = settings.GetInt("half", 0)
+	ok("GetInt(half) weakly typed", got, int64(-3), err)
+	_, err = settings.GetUint("negative", 0)
+	fails("GetUint(negative) weakly typed", err, "does not fit in uint64")
+	if err := settings.RawSet(false, "almost", 255.6); err != nil {
+		t.Fatal(err)
+	}
+	fails("Get(almost) into uint8 weakly typed", settings.Get("almost", &u8), "does not fit in uint8")
+
+	// Preserved numbers keep integers beyond 2^53 exact, up to the limits.
+	settings = NewSettings()
+	settings.SetPreserveNumbers(true)
+	err = settings.LoadJSON([]byte(`{"maxint": 9223372036854775807, "overint": 9223372036854775808, "maxuint": 18446744073709551615, "overuint": 18446744073709551616, "fraction": 1.5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = settings.GetInt("maxint", 0)
+	ok("GetInt(maxint)", got, int64(math.MaxInt64), err)
+	_, err = settings.GetInt("overint", 0)
+	fails("GetInt(overint)", err, "")
+	u, err = settings.GetUint("overint", 0)
+	ok("GetUint(overint)", u, uint64(1)<<63, err)
+	u, err = settings.GetUint("maxuint", 0)
+	ok("GetUint(maxuint)", u, uint64(math.MaxUint64), err)
+	_, err = settings.GetUint("overuint", 0)
+	fails("GetUint(overuint)", err, "")
+	_, err = settings.GetInt("fraction", 0)
+	fails("GetInt(fraction) preserved", err, "")
+}
+
+func TestPathSeparator(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	settings.MarkSecret("db.password")
+
+	err := settings.LoadJSON([]byte(`{"hosts": {"localhost:8080": {"weight": 2}}, "db": {"password": "hunter2"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if weight, err := settings.GetInt("hosts.localhost:8080.weight", 0); err != nil || weight != 2 {
+		t.Errorf("GetInt(hosts.localhost:8080.weight) = %d, %v", weight, err)
+	}
+	if source, ok := settings.SourceOf("hosts.localhost:8080.weight"); !ok || source.Name != "LoadJSON" {
+		t.Errorf("SourceOf(hosts.localhost:8080.weight) = %v, %v", source, ok)
+	}
+
+	if err := settings.RawSet(false, "hosts.backup:443.weight", 1.0); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Delete("hosts.localhost:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.RawGet("hosts.localhost:8080.weight"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RawGet after Delete = %v, want ErrNotFound", err)
+	}
+	if weight, err := settings.GetInt("hosts.backup:443.weight", 0); err != nil || weight != 1 {
+		t.Errorf("GetInt(hosts.backup:443.weight) = %d, %v", weight, err)
+	}
+
+	if got, want := string(settings.GetRedactedJSON()), `{"db":{"password":"[redacted]"},"hosts":{"backup:443":{"weight":1}}}`; got != want {
+		t.Errorf("GetRedactedJSON() = %s, want %s", got, want)
+	}
+
+	if err := settings.SetPathSeparator("/"); err == nil {
+		t.Error("SetPathSeparator succeeded after loading settings")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	var logged []string
+	logger := LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		logged = append(logged, level.String()+": "+fmt.Sprintf(format, args...))
+	})
+	has := func(want string) bool {
+		for _, line := range logged {
+			if line == want {
+				return true
+			}
+		}
+		return false
+	}
+
+	settings := NewSettings()
+	settings.SetLogger(logger)
+	config := `{"db": {"host": "a", "password": "x"}, "port": 80, "name": "app"}`
+	if err := settings.LoadJSON([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if !has(fmt.Sprintf("debug: Loading JSON (%d bytes)", len(config))) {
+		t.Errorf("the load wasn't logged: %q", logged)
+	}
+
+	// Replacing a top-level value logs the types, merging maps logs nothing,
+	// and neither does keeping existing values.
+	logged = nil
+	if err := settings.MergeSettings(map[string]interface{}{"db": map[string]interface{}{"host": "b"}, "port": "eighty"}); err != nil {
+		t.Fatal(err)
+	}
+	if !has("debug: MergeSettings replaced port: float64 -> string") {
+		t.Errorf("the replaced value wasn't logged: %q", logged)
+	}
+	for _, line := range logged {
+		if strings.Contains(line, "replaced db") {
+			t.Errorf("merging maps was logged: %q", line)
+		}
+	}
+	logged = nil
+	if err := settings.MergeSettingsWithOptions(map[string]interface{}{"name": "kept"}, MergeKeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range logged {
+		if strings.Contains(line, "replaced") {
+			t.Errorf("MergeKeepExisting logged %q", line)
+		}
+	}
+
+	// With SetLogValues the values are logged, secrets redacted.
+	settings.SetLogValues(true)
+	settings.MarkSecret("db")
+	logged = nil
+	if err := settings.MergeSettings(map[string]interface{}{"db": "plain", "name": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if !has("debug: MergeSettings replaced name: app -> new") || !has("debug: MergeSettings replaced db: [redacted] -> [redacted]") {
+		t.Errorf("the replaced values weren't logged: %q", logged)
+	}
+
+	// Rejected settings and sets replacing values are logged too.
+	logged = nil
+	if err := settings.LoadJSON([]byte(`{"a": {"b": {"c": 1}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetMaxDepth(1)
+	if err := settings.LoadJSON([]byte(`{"x": {"y": {"z": 1}}}`)); err == nil {
+		t.Fatal("settings deeper than the maximum were loaded")
+	}
+	settings.SetMaxDepth(0)
+	found := false
+	for _, line := range logged {
+		found = found || strings.HasPrefix(line, "debug: Rejected settings from LoadJSON: ")
+	}
+	if !found {
+		t.Errorf("the rejected settings weren't logged: %q", logged)
+	}
+	logged = nil
+	if err := settings.RawSet(false, "name:first", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if !has("warning: Setting name:first replaced the string at name") {
+		t.Errorf("the replaced value wasn't logged: %q", logged)
+	}
+
+	// Files log their size.
+	path := filepath.Join(t.TempDir(), "app.json")
+	if err := ioutil.WriteFile(path, []byte(`{"file": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logged = nil
+	if err := settings.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if !has(fmt.Sprintf("debug: Loading %s (14 bytes)", path)) {
+		t.Errorf("the file load wasn't logged: %q", logged)
+	}
+
+	logged = nil
+	settings.SetLogger(nil)
+	if err := settings.LoadJSON([]byte(`{"port": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 0 {
+		t.Errorf("removing the logger still logged %q", logged)
+	}
+
+	for level, want := range map[LogLevel]string{LogDebug: "debug", LogInfo: "info", LogWarning: "warning", LogError: "error", LogLevel(9): "LogLevel(9)"} {
+		if level.String() != want {
+			t.Errorf("LogLevel(%d).String() = %q, want %q", int(level), level.String(), want)
+		}
+	}
+}
+
+func TestGetRegexp(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"route": "(?i)^/api/v(\\d+)/", "bad": "a(b", "number": 5}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	re, err := settings.GetRegexp("route", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match := re.FindStringSubmatch("/API/v2/users"); len(match) != 2 || match[1] != "2" {
+		t.Errorf("%s matched %q", re, match)
+	}
+	if again, _ := settings.GetRegexp("route", nil); again != re {
+		t.Error("GetRegexp compiled an unchanged pattern again")
+	}
+	if err := settings.RawSet(false, "route", "^/v2/"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := settings.GetRegexp("route", nil); err != nil || changed.String() != "^/v2/" {
+		t.Errorf("GetRegexp after a change = %v, %v", changed, err)
+	}
+
+	def := regexp.MustCompile("default")
+	got, err := settings.GetRegexp("bad", def)
+	if got != def || err == nil || !strings.HasPrefix(err.Error(), "bad is not a valid regular expression: ") {
+		t.Errorf("GetRegexp(bad) = %v, %v, want the default and an error", got, err)
+	}
+	if got, err := settings.GetRegexp("missing", def); got != def || !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRegexp(missing) = %v, %v, want the default and ErrNotFound", got, err)
+	}
+	if got, err := settings.GetRegexp("number", def); got != def || err == nil {
+		t.Errorf("GetRegexp(number) = %v, %v, want the default and an error", got, err)
+	}
+
+	// Struct fields are compiled when decoding.
+	var config struct {
+		Route  *regexp.Regexp
+		Ignore []*regexp.Regexp
+	}
+	if err := settings.LoadJSON([]byte(`{"config": {"route": "^/users/\\d+$", "ignore": ["^/health$", "\\.png$"]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Get("config", &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Route == nil || !config.Route.MatchString("/users/42") || config.Route.MatchString("/users/x") {
+		t.Errorf("Route = %v", config.Route)
+	}
+	if len(config.Ignore) != 2 || !config.Ignore[1].MatchString("logo.png") {
+		t.Errorf("Ignore = %v", config.Ignore)
+	}
+
+	if err := settings.RawSet(false, "config:ignore", []interface{}{"ok", "[z-a]"}); err != nil {
+		t.Fatal(err)
+	}
+	err = settings.Get("config", &config)
+	if err == nil || !strings.Contains(err.Error(), `"[z-a]" is not a valid regular expression: `) {
+		t.Errorf("Get with an invalid pattern = %v", err)
+	}
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	f()
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestOverrides(t *testing.T) {
+	settings := NewSettings()
+	err := settings.SetDefaults(map[string]interface{}{
+		"db":    map[string]interface{}{"host": "localhost", "port": 5432, "password": "default"},
+		"tags":  []interface{}{"a", "b"},
+		"debug": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := settings.Overrides(); len(got) != 0 {
+		t.Errorf("Overrides with only defaults = %v", got)
+	}
+
+	// Numbers compare by value and arrays as a whole.
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "db", "port": 5432.0, "password": "hunter2"}, "tags": ["a"], "extra": {"x": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"db:host":     "db",
+		"db:password": "hunter2",
+		"tags":        []interface{}{"a"},
+		"extra:x":     float64(1),
+	}
+	overrides := settings.Overrides()
+	if !reflect.DeepEqual(overrides, want) {
+		t.Errorf("Overrides = %v, want %v", overrides, want)
+	}
+	overrides["tags"].([]interface{})[0] = "changed"
+	if tags, _ := settings.RawGet("tags"); tags.([]interface{})[0] != "a" {
+		t.Error("changing the result of Overrides changed the settings")
+	}
+
+	// Setting a value back to its default removes the override.
+	if err := settings.RawSet(false, "tags", []interface{}{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := settings.Overrides()["tags"]; ok {
+		t.Error("a value equal to its default is reported as an override")
+	}
+
+	settings.MarkSecret("db:password")
+	out := captureStdout(t, settings.PrintOverrides)
+	wantOut := "{\n  \"db:host\": \"db\",\n  \"db:password\": \"[redacted]\",\n  \"extra:x\": 1\n}\n"
+	if out != wantOut {
+		t.Errorf("PrintOverrides printed %q, want %q", out, wantOut)
+	}
+	if got, _ := settings.GetString("db:password", ""); got != "hunter2" {
+		t.Errorf("PrintOverrides changed the secret to %q", got)
+	}
+
+	if got := captureStdout(t, NewSettings().PrintOverrides); got != "{}\n" {
+		t.Errorf("PrintOverrides without settings printed %q", got)
+	}
+}
+
+func TestMergeMaps(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     string
+		new          string
+		keepExisting bool
+		strict       bool
+		want         string
+		recorded     []string
+		err          string
+	}{
+		{
+			name:     "deep merge",
+			existing: `{"server": {"tls": {"cert": "a.pem", "key": "a.key"}, "port": 80}}`,
+			new:      `{"server": {"tls": {"cert": "b.pem"}, "host": "example"}}`,
+			want:     `{"server":{"host":"example","port":80,"tls":{"cert":"b.pem","key":"a.key"}}}`,
+			recorded: []string{"server:host", "server:tls:cert"},
+		},
+		{
+			name:     "map replaces scalar",
+			existing: `{"server": 80}`,
+			new:      `{"server": {"port": 443}}`,
+			want:     `{"server":{"port":443}}`,
+			recorded: []string{"server:port"},
+		},
+		{
+			name:     "scalar replaces map",
+			existing: `{"server": {"port": 443}}`,
+			new:      `{"server": "off"}`,
+			want:     `{"server":"off"}`,
+			recorded: []string{"server"},
+		},
+		{
+			name:     "arrays are replaced",
+			existing: `{"hosts": ["a", "b"]}`,
+			new:      `{"hosts": ["c"]}`,
+			want:     `{"hosts":["c"]}`,
+			recorded: []string{"hosts"},
+		},
+		{
+			name:     "empty incoming map",
+			existing: `{"server": {"port": 443}}`,
+			new:      `{"server": {}, "extra": {}}`,
+			want:     `{"extra":{},"server":{"port":443}}`,
+		},
+		{
+			name:         "keep existing",
+			existing:     `{"server": {"port": 443, "tls": null}, "hosts": ["a"]}`,
+			new:          `{"server": {"port": 80, "host": "example", "tls": {"cert": "b.pem"}}, "hosts": ["b"]}`,
+			keepExisting: true,
+			want:         `{"hosts":["a"],"server":{"host":"example","port":443,"tls":null}}`,
+			recorded:     []string{"server:host"},
+		},
+		{
+			name:     "conflict",
+			existing: `{"server": {"tls": {"cert": {"path": "a.pem"}}}}`,
+			new:      `{"server": {"tls": {"cert": "b.pem"}}}`,
+			strict:   true,
+			err:      "Conflict at server:tls:cert: map replaced by string",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var existing, new map[string]interface{}
+			if err := json.Unmarshal([]byte(test.existing), &existing); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.new), &new); err != nil {
+				t.Fatal(err)
+			}
+
+			var recorded []string
+			config := mergeConfig{
+				keepExisting: test.keepExisting,
+				separator:    DefaultPathSeparator,
+				record: func(path string) {
+					recorded = append(recorded, path)
+				},
+			}
+			if test.strict {
+				config.conflict = func(path string, existing, new interface{}) error {
+					return fmt.Errorf("%s replaced by %s", typeName(existing), typeName(new))
+				}
+			}
+
+			err := mergeMaps(existing, new, "", config)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("err = %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := json.Marshal(existing); string(got) != test.want {
+				t.Errorf("merged = %s, want %s", got, test.want)
+			}
+			sort.Strings(recorded)
+			if !reflect.DeepEqual(recorded, test.recorded) {
+				t.Errorf("recorded = %v, want %v", recorded, test.recorded)
+			}
+		})
+	}
+}
+
+func TestToEnv(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{"db": {"host": "db", "port": 5432, "tls": {"enabled": true}, "replicas": ["a", "b"], "user-name": "app", "password": null}, "name": "x=y"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := settings.ToEnv("db", "APP_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"APP_HOST=db", "APP_PASSWORD=", "APP_PORT=5432", `APP_REPLICAS=["a","b"]`, "APP_TLS__ENABLED=true", "APP_USER_NAME=app"}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("ToEnv(db) = %q, want %q", env, want)
+	}
+
+	env, err = settings.ToEnv("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 7 || env[0] != "DB__HOST=db" || env[6] != "NAME=x=y" {
+		t.Errorf("ToEnv() = %q", env)
+	}
+
+	// LoadEnv reads back what ToEnv writes.
+	for _, entry := range env {
+		split := strings.Index(entry, "=")
+		t.Setenv("FLEXICONFIG_ROUNDTRIP_"+entry[:split], entry[split+1:])
+	}
+	loaded := NewSettings()
+	if err := loaded.LoadEnv("FLEXICONFIG_ROUNDTRIP_"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := loaded.GetString("db:tls:enabled", ""); got != "true" {
+		t.Errorf("db:tls:enabled read back as %q", got)
+	}
+	if got, _ := loaded.GetString("name", ""); got != "x=y" {
+		t.Errorf("name read back as %q", got)
+	}
+
+	if _, err := settings.ToEnv("name", "APP_"); err == nil || err.Error() != "name is not a map" {
+		t.Errorf("ToEnv(name) = %v", err)
+	}
+	if _, err := settings.ToEnv("missing", "APP_"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ToEnv(missing) = %v, want ErrNotFound", err)
+	}
+	if err := settings.RawSet(false, "db:user_name", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.ToEnv("db", "APP_"); err == nil || err.Error() != "db:user-name and db:user_name both map to APP_USER_NAME" {
+		t.Errorf("ToEnv with colliding names = %v", err)
+	}
+}
+
+func TestSetProcessEnv(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"app": {"host": "h", "port": 80, "nested": {"on": false}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Register the variables so that they are restored after the test.
+	for _, name := range []string{"FLEXICONFIG_PROCESS_HOST", "FLEXICONFIG_PROCESS_PORT", "FLEXICONFIG_PROCESS_NESTED__ON"} {
+		t.Setenv(name, "old")
+	}
+
+	if err := settings.SetProcessEnv("app", "FLEXICONFIG_PROCESS_"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"FLEXICONFIG_PROCESS_HOST":       "h",
+		"FLEXICONFIG_PROCESS_PORT":       "80",
+		"FLEXICONFIG_PROCESS_NESTED__ON": "false",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// Nothing is set when ToEnv fails.
+	if err := settings.RawSet(false, "app:HOST", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "app:port", 81); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.SetProcessEnv("app", "FLEXICONFIG_PROCESS_"); err == nil {
+		t.Error("SetProcessEnv with colliding names should fail")
+	}
+	if got := os.Getenv("FLEXICONFIG_PROCESS_PORT"); got != "80" {
+		t.Errorf("a failed SetProcessEnv set FLEXICONFIG_PROCESS_PORT to %q", got)
+	}
+}
+
+func TestRawSetMode(t *testing.T) {
+	intermediates := map[string]string{
+		"missing": `{}`,
+		"scalar":  `{"root": {"intermediate": 22}}`,
+		"map":     `{"root": {"intermediate": {"other": 1}}}`,
+		"array":   `{"root": {"intermediate": [1, 2]}}`,
+	}
+	tests := []struct {
+		intermediate string
+		mode         SetMode
+		want         string
+		replaced     interface{}
+		err          bool
+	}{
+		{"missing", SetReplace, `{"root":{"intermediate":{"value":"x"}}}`, nil, false},
+		{"missing", SetCreate, `{"root":{"intermediate":{"value":"x"}}}`, nil, false},
+		{"missing", SetExisting, `{}`, nil, true},
+		{"scalar", SetReplace, `{"root":{"intermediate":{"value":"x"}}}`, 22.0, false},
+		{"scalar", SetCreate, `{"root":{"intermediate":22}}`, nil, true},
+		{"scalar", SetExisting, `{"root":{"intermediate":22}}`, nil, true},
+		{"map", SetReplace, `{"root":{"intermediate":{"other":1,"value":"x"}}}`, nil, false},
+		{"map", SetCreate, `{"root":{"intermediate":{"other":1,"value":"x"}}}`, nil, false},
+		{"map", SetExisting, `{"root":{"intermediate":{"other":1,"value":"x"}}}`, nil, false},
+		{"array", SetReplace, `{"root":{"intermediate":{"value":"x"}}}`, []interface{}{1.0, 2.0}, false},
+		{"array", SetCreate, `{"root":{"intermediate":[1,2]}}`, nil, true},
+		{"array", SetExisting, `{"root":{"intermediate":[1,2]}}`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%d", test.intermediate, test.mode), func(t *testing.T) {
+			settings := NewSettings()
+			if err := settings.LoadJSON([]byte(intermediates[test.intermediate])); err != nil {
+				t.Fatal(err)
+			}
+
+			replaced, err := settings.RawSetMode(test.mode, "root:intermediate:value", "x")
+			if (err != nil) != test.err {
+				t.Fatalf("err = %v, want error: %t", err, test.err)
+			}
+			if got := string(settings.GetJSON()); got != test.want {
+				t.Errorf("settings = %s, want %s", got, test.want)
+			}
+
+			var want map[string]interface{}
+			if test.replaced != nil {
+				want = map[string]interface{}{"root:intermediate": test.replaced}
+			}
+			if !reflect.DeepEqual(replaced, want) {
+				t.Errorf("replaced = %v, want %v", replaced, want)
+			}
+		})
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"a": "first\n", "b": "second\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := NewSettings()
+	settings.EnableFileRefs(true)
+	check := func(path, want string) {
+		t.Helper()
+		if got, err := settings.GetString(path, ""); err != nil || got != want {
+			t.Errorf("GetString(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	if err := settings.RawSet(false, "secret:key", "@file:"+filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	check("secret:key", "first")
+
+	// Every kind of change must drop the cached content.
+	if err := settings.RawSet(false, "secret:key", "@file:"+filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	check("secret:key", "second")
+	if err := settings.RawSet(false, "secret", map[string]interface{}{"key": "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	check("secret:key", "plain")
+	if err := settings.MergeSettings(map[string]interface{}{"secret": map[string]interface{}{"key": "@file:" + filepath.Join(dir, "a")}}); err != nil {
+		t.Fatal(err)
+	}
+	check("secret:key", "first")
+
+	// The cache hides changes to the file until it is invalidated.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte("rotated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	check("secret:key", "first")
+	settings.InvalidateCache("secret")
+	check("secret:key", "rotated")
+
+	if err := settings.Delete("secret:key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.GetString("secret:key", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetString after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestTypeStability(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": 1, "db": {"host": "h", "port": 5432, "opts": {}}, "tags": ["x"], "n": null}`)); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetTypeStability(true)
+	want := string(settings.GetJSON())
+
+	// Rejected changes name the path, both kinds and their sources, maps
+	// having none, and leave every value alone, including those merged
+	// before the change.
+	for name, change := range map[string]struct {
+		change  func() error
+		message string
+	}{
+		"LoadJSON": {
+			func() error {
+				return settings.LoadJSON([]byte(`{"new": 1, "db": {"host": "x", "port": "5432"}, "tags": ["y"]}`))
+			},
+			"db:port would change from number (set by LoadJSON) to string (set by LoadJSON)",
+		},
+		"MergeSettings": {
+			func() error {
+				return settings.MergeSettings(map[string]interface{}{"a": 2, "db": "db"})
+			},
+			"db would change from object to string (set by MergeSettings)",
+		},
+		"nested MergeSettings": {
+			func() error {
+				return settings.MergeSettings(map[string]interface{}{"db": map[string]interface{}{"opts": []interface{}{}}})
+			},
+			"db:opts would change from object to array (set by MergeSettings)",
+		},
+		"RawSet": {
+			func() error { return settings.RawSet(false, "tags", "x") },
+			"tags would change from array (set by LoadJSON) to string (set by RawSet)",
+		},
+		"RawSet through a value": {
+			func() error { return settings.RawSet(false, "a:b", 1) },
+			"a would change from number (set by LoadJSON) to object (set by RawSet)",
+		},
+		"RawSet of a map": {
+			func() error {
+				return settings.RawSet(false, "db", map[string]interface{}{"host": "x", "port": true})
+			},
+			"db:port would change from number (set by LoadJSON) to bool (set by RawSet)",
+		},
+	} {
+		err := change.change()
+		if err == nil || err.Error() != change.message {
+			t.Errorf("%s = %v, want %q", name, err, change.message)
+		}
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("%s changed the settings to %s", name, got)
+		}
+	}
+
+	// Same kinds, new keys and null are allowed, and a null can then take
+	// any kind.
+	if err := settings.LoadJSON([]byte(`{"a": 2.5, "db": {"host": "x", "opts": {"ssl": true}}, "tags": [1], "n": "set", "new": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "a", "now a string"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "a", 1); err == nil {
+		t.Error("the kind set after null wasn't fixed")
+	}
+
+	// Kept values don't change, so MergeKeepExisting isn't checked for them.
+	if err := settings.MergeSettingsWithOptions(map[string]interface{}{"db": map[string]interface{}{"port": "x", "user": "u"}}, MergeKeepExisting); err != nil {
+		t.Errorf("MergeKeepExisting = %v", err)
+	}
+	if err := settings.RawSet(false, "db:user", 1); err == nil {
+		t.Error("the kind of a key filled by MergeKeepExisting wasn't fixed")
+	}
+
+	// A deleted value can come back as any kind.
+	if err := settings.Delete("db:port"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "db:port", "5432"); err != nil {
+		t.Errorf("setting a deleted value = %v", err)
+	}
+
+	settings.SetTypeStability(false)
+	if err := settings.RawSet(false, "db", "anything"); err != nil {
+		t.Errorf("RawSet without type stability = %v", err)
+	}
+}
+
+func TestGetFileContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json":     `{"key": "secrets/key.pem", "missing": "secrets/none", "outside": "/etc/hostname"}`,
+		"secrets/key.pem": "KEY\r\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadJSONFile(filepath.Join(dir, "config.json")); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetAllowedRoots(dir)
+
+	// The file is found relative to the config that named it.
+	if got, err := settings.GetFileContents("key", nil); err != nil || string(got) != "KEY\r\n" {
+		t.Errorf("GetFileContents(key) = %q, %v", got, err)
+	}
+	if got, err := settings.GetFileContentsString("key", ""); err != nil || got != "KEY" {
+		t.Errorf("GetFileContentsString(key) = %q, %v", got, err)
+	}
+
+	var fileErr *FileError
+	if got, err := settings.GetFileContentsString("nokey", "def"); got != "def" || !errors.Is(err, ErrNotFound) || errors.As(err, &fileErr) {
+		t.Errorf("GetFileContentsString(nokey) = %q, %v, want ErrNotFound", got, err)
+	}
+	if _, err := settings.GetFileContents("missing", nil); !errors.As(err, &fileErr) || !os.IsNotExist(fileErr.Err) || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFileContents(missing) = %v, want a *FileError for a missing file", err)
+	}
+	if _, err := settings.GetFileContents("outside", nil); !errors.As(err, &fileErr) || !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("GetFileContents(outside) = %v, want ErrPathNotAllowed", err)
+	}
+}
+
+func TestFormatMarkerAllowedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"allowed", "other"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allowed := filepath.Join(dir, "allowed", "app.conf")
+	if err := ioutil.WriteFile(allowed, []byte("// flexiconfig: json\n{\"a\": 1}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The format is unknown, so only reading the marker could tell.
+	other := filepath.Join(dir, "other", "app.conf")
+	if err := ioutil.WriteFile(other, []byte("# flexiconfig: toml\na = 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	settings.SetAllowedRoots(filepath.Join(dir, "allowed"))
+	if err := settings.LoadFile(allowed); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := settings.GetInt("a", 0); got != 1 {
+		t.Errorf("a = %d, want 1", got)
+	}
+	err = settings.LoadFile(other)
+	if !errors.Is(err, ErrPathNotAllowed) || strings.Contains(err.Error(), "toml") {
+		t.Errorf("LoadFile(%s) = %v, want ErrPathNotAllowed before reading the marker", other, err)
+	}
+	if _, err := settings.PreviewFile(other); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("PreviewFile(%s) = %v, want ErrPathNotAllowed", other, err)
+	}
+}
+
+func TestAllowedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	files := map[string]string{
+		"root/app.json":         `{"key": "@file:secrets/key", "stolen": "@file:../outside/secret", "include": ["extra.json"]}`,
+		"root/extra.json":       `{"extra": true}`,
+		"root/secrets/key":      "KEY",
+		"root/data.csv":         "name,port\nweb,80\n",
+		"root/conf/port":        "80",
+		"root/conf/db/host":     "localhost",
+		"outside/secret.json":   `{"secret": true}`,
+		"outside/secret":        "SECRET",
+		"outside/data.csv":      "name\nsecret\n",
+		"outside/conf/password": "hunter2",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"root/link.json":    "outside/secret.json",
+		"root/link.csv":     "outside/data.csv",
+		"root/linked/conf":  "outside/conf",
+		"root/escape/token": "outside/secret",
+	} {
+		link = filepath.Join(dir, filepath.FromSlash(link))
+		if err := os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(dir, filepath.FromSlash(target)), link); err != nil {
+			t.Skipf("Symlinks aren't supported: %s", err)
+		}
+	}
+
+	settings := NewSettings()
+	settings.SetAllowedRoots(root)
+	notAllowed := func(name string, err error) {
+		t.Helper()
+		if !errors.Is(err, ErrPathNotAllowed) {
+			t.Errorf("%s = %v, want ErrPathNotAllowed", name, err)
+		}
+	}
+
+	// Files inside the root load, including through a relative path.
+	if err := settings.LoadFile(filepath.Join(root, "app.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ProcessIncludes("include", root); err != nil {
+		t.Error(err)
+	}
+	if err := settings.LoadCSVFile(filepath.Join(root, "data.csv"), "rows"); err != nil {
+		t.Error(err)
+	}
+	if err := settings.LoadDirAsMap(filepath.Join(root, "conf"), "conf", DirMapRecursive); err != nil {
+		t.Error(err)
+	}
+	want := `{"conf":{"db":{"host":"localhost"},"port":"80"},"extra":true,"key":"@file:secrets/key","rows":[{"name":"web","port":"80"}],"stolen":"@file:../outside/secret"}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings are %s, want %s", got, want)
+	}
+
+	// Files outside of it don't, whether named directly, through .. or
+	// through a symlink inside the root.
+	notAllowed("LoadFile(outside)", settings.LoadFile(filepath.Join(outside, "secret.json")))
+	notAllowed("LoadFile(..)", settings.LoadFile(filepath.Join(root, "..", "outside", "secret.json")))
+	notAllowed("LoadFile(symlink)", settings.LoadFile(filepath.Join(root, "link.json")))
+	notAllowed("LoadJSONFile(symlink)", settings.LoadJSONFile(filepath.Join(root, "link.json")))
+	notAllowed("LoadAll(symlink)", settings.LoadAll(filepath.Join(root, "extra.json"), filepath.Join(root, "link.json")))
+	notAllowed("LoadCSVFile(outside)", settings.LoadCSVFile(filepath.Join(outside, "data.csv"), "rows"))
+	notAllowed("LoadCSVFile(symlink)", settings.LoadCSVFile(filepath.Join(root, "link.csv"), "rows"))
+	notAllowed("LoadDirAsMap(outside)", settings.LoadDirAsMap(filepath.Join(outside, "conf"), "conf"))
+	notAllowed("LoadDirAsMap(symlinked directory)", settings.LoadDirAsMap(filepath.Join(root, "linked"), "conf", DirMapRecursive))
+	notAllowed("LoadDirAsMap(symlinked file)", settings.LoadDirAsMap(filepath.Join(root, "escape"), "conf"))
+
+	if err := settings.RawSet(false, "include", []interface{}{"../outside/secret.json"}); err != nil {
+		t.Fatal(err)
+	}
+	notAllowed("ProcessIncludes(outside)", settings.ProcessIncludes("include", root))
+
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("loading outside of the root changed the settings to %s", got)
+	}
+
+	// File references are resolved relative to the config and checked too.
+	settings.EnableFileRefs(true)
+	if got, err := settings.GetString("key", ""); err != nil || got != "KEY" {
+		t.Errorf("GetString(key) = %q, %v", got, err)
+	}
+	_, err = settings.GetString("stolen", "")
+	notAllowed("GetString(stolen)", err)
+	if err := settings.RawSet(false, "stolen", "@file:"+filepath.Join(root, "escape", "token")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = settings.GetString("stolen", "")
+	notAllowed("GetString(symlink)", err)
+
+	// Without roots everything can be read again.
+	settings.SetAllowedRoots()
+	if err := settings.LoadFile(filepath.Join(root, "link.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFprint(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"b": {"c": {"d": 1, "e": 2}, "f": [1, "x"]}, "a": "secret", "g": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	settings.MarkSecret("a")
+
+	// The defaults match GetPrettyJSON, with secrets redacted.
+	var buf bytes.Buffer
+	if err := settings.Fprint(&buf, PrintOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(string(settings.GetPrettyJSON("", "  ")), `"secret"`, `"[redacted]"`, 1) + "\n"
+	if buf.String() != want {
+		t.Errorf("Fprint = %s, want %s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := settings.Fprint(&buf, PrintOptions{Indent: "\t", MaxDepth: 2, ShowSecrets: true}); err != nil {
+		t.Fatal(err)
+	}
+	want = "{\n\t\"a\": \"secret\",\n\t\"b\": {\n\t\t\"c\": {...} (2 keys),\n\t\t\"f\": [...] (2 items)\n\t},\n\t\"g\": {}\n}\n"
+	if buf.String() != want {
+		t.Errorf("Fprint with MaxDepth = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := settings.Fprint(&buf, PrintOptions{MaxDepth: 1, Color: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\x1b[34m\"b\"\x1b[0m: {...} (2 keys)") {
+		t.Errorf("Fprint with Color = %q", buf.String())
+	}
+}
+
+func TestExportFilters(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"db": {"url": "postgres://app:hunter2@db/app", "password": "x"}, "motd": "a very long message"}`)); err != nil {
+		t.Fatal(err)
+	}
+	settings.MarkSecret("db:password")
+	settings.AddExportFilter("*", StripURLCredentials)
+	settings.AddExportFilter("motd", func(path string, value interface{}) interface{} {
+		return value.(string)[:6] + "..."
+	})
+	settings.AddExportFilter("motd", func(path string, value interface{}) interface{} {
+		return strings.ToUpper(value.(string))
+	})
+
+	want := `{"db":{"password":"[redacted]","url":"postgres://app@db/app"},"motd":"A VERY..."}`
+	if got := string(settings.GetRedactedJSON()); got != want {
+		t.Errorf("GetRedactedJSON = %s, want %s", got, want)
+	}
+	var buf bytes.Buffer
+	if err := settings.Fprint(&buf, PrintOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"postgres://app@db/app"`) || !strings.Contains(buf.String(), `"A VERY..."`) {
+		t.Errorf("Fprint = %s, want filtered values", buf.String())
+	}
+
+	// The getters and GetJSON are left alone.
+	if got, _ := settings.GetString("db:url", ""); got != "postgres://app:hunter2@db/app" {
+		t.Errorf("GetString(db:url) = %q", got)
+	}
+	if !strings.Contains(string(settings.GetJSON()), "hunter2") {
+		t.Errorf("GetJSON = %s, want the password kept", settings.GetJSON())
+	}
+
+	for value, want := range map[interface{}]interface{}{
+		"https://user@host/x":  "https://user@host/x",
+		"user:pass@host":       "user:pass@host",
+		"redis://:secret@host": "redis://@host",
+		1.5:                    1.5,
+	} {
+		if got := StripURLCredentials("", value); got != want {
+			t.Errorf("StripURLCredentials(%v) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestAddValidator(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"server": {"port": 80, "host": "a"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	settings.AddValidator("*:port", func(path string, value interface{}) error {
+		seen = append(seen, path)
+		if port, ok := value.(float64); !ok || port < 0 {
+			return fmt.Errorf("must be a positive number")
+		}
+		return nil
+	})
+	check := func(host string, port int64) {
+		t.Helper()
+		if got, _ := settings.GetString("server:host", ""); got != host {
+			t.Errorf("server:host = %q, want %q", got, host)
+		}
+		if got, _ := settings.GetInt("server:port", 0); got != port {
+			t.Errorf("server:port = %d, want %d", got, port)
+		}
+	}
+
+	// The whole load is rejected, not only the invalid value.
+	err := settings.LoadJSON([]byte(`{"server": {"port": -1, "host": "b"}}`))
+	if err == nil || !strings.Contains(err.Error(), "server:port") {
+		t.Errorf("LoadJSON with a negative port = %v, want an error", err)
+	}
+	check("a", 80)
+
+	if err := settings.RawSet(false, "server", map[string]interface{}{"port": -2}); err == nil {
+		t.Error("RawSet with a negative port succeeded")
+	}
+	if err := settings.LoadKVPairs([]string{"server:host=c", "server:port=-3"}); err == nil {
+		t.Error("LoadKVPairs with a negative port succeeded")
+	}
+	check("a", 80)
+
+	if err := settings.LoadJSON([]byte(`{"server": {"port": 8080}, "other": {"port": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	check("a", 8080)
+	if want := []string{"server:port", "server:port", "server:port", "other:port", "server:port"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("Validated %v, want %v", seen, want)
+	}
+}
+
+func TestLoadURLCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.json")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"a": 1}`))
+	}))
+	defer server.Close()
+
+	settings := NewSettings()
+	check := func(want int64, content ContentStatus) {
+		t.Helper()
+		if got, err := settings.GetInt("a", 0); err != nil || got != want {
+			t.Errorf("a = %d, %v, want %d", got, err, want)
+		}
+		stats := settings.Stats()
+		if stat := stats[len(stats)-1]; stat.Err != nil || stat.Content != content {
+			t.Errorf("Last load was %v, %v, want %v", stat.Content, stat.Err, content)
+		}
+	}
+
+	if err := settings.LoadURL(context.Background(), server.URL, WithCacheFile(cacheFile)); err != nil {
+		t.Fatal(err)
+	}
+	check(1, ContentFresh)
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Errorf("The cache file wasn't saved: %v", err)
+	}
+
+	// An unchanged config isn't merged again.
+	if err := settings.RawSet(false, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadURL(context.Background(), server.URL, WithCacheFile(cacheFile)); err != nil {
+		t.Fatal(err)
+	}
+	check(2, ContentUnchanged)
+
+	// Reload still has the content to rebuild the settings from.
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(1, ContentUnchanged)
+	if requests != 3 {
+		t.Errorf("The server got %d requests, want 3", requests)
+	}
+
+	// The cache file stands in for a server that is down.
+	server.Close()
+	settings = NewSettings()
+	if err := settings.LoadURL(context.Background(), server.URL, WithCacheFile(cacheFile)); err != nil {
+		t.Fatal(err)
+	}
+	check(1, ContentCached)
+	settings = NewSettings()
+	if err := settings.LoadURL(context.Background(), server.URL, WithHTTPCache()); err == nil {
+		t.Error("LoadURL of a server that is down succeeded without a cache file")
+	}
+}
+
+func TestTypedMaps(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"limits": {"read": "50ms", "write": "200ms"}, "quotas": {"a": 1, "b": 2.5}, "bad": {"b": "x", "a": "y", "c": "1s"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	durations, err := settings.GetDurationMap("limits", nil)
+	if want := map[string]time.Duration{"read": 50 * time.Millisecond, "write": 200 * time.Millisecond}; err != nil || !reflect.DeepEqual(durations, want) {
+		t.Errorf("GetDurationMap = %v, %v, want %v", durations, err, want)
+	}
+	floats, err := settings.GetFloatMap("quotas", nil)
+	if want := map[string]float64{"a": 1, "b": 2.5}; err != nil || !reflect.DeepEqual(floats, want) {
+		t.Errorf("GetFloatMap = %v, %v, want %v", floats, err, want)
+	}
+	if ints, err := settings.GetIntMap("quotas", nil); err == nil || !strings.Contains(err.Error(), "quotas:b") {
+		t.Errorf("GetIntMap with a fraction = %v, %v, want an error naming quotas:b", ints, err)
+	}
+
+	def := map[string]time.Duration{}
+	if got, err := settings.GetDurationMap("bad", def); err == nil || !strings.Contains(err.Error(), "bad:a") || got == nil || len(got) != 0 {
+		t.Errorf("GetDurationMap(bad) = %v, %v, want the default and an error naming bad:a", got, err)
+	}
+	if got, err := settings.GetIntMap("missing", nil); got != nil || !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIntMap(missing) = %v, %v, want nil and ErrNotFound", got, err)
+	}
+	if _, err := settings.GetFloatMap("limits:read", nil); err == nil {
+		t.Error("GetFloatMap of a string succeeded")
+	}
+
+	// The maps returned are copies.
+	durations["read"] = 0
+	if again, _ := settings.GetDurationMap("limits", nil); again["read"] != 50*time.Millisecond {
+		t.Errorf("Changing the map returned changed the settings")
+	}
+}
+
+func TestGetterTypes(t *testing.T) {
+	type wantErr string
+	getters := []struct {
+		name string
+		def  interface{}
+		get  func(s Settings, path string) (interface{}, error)
+	}{
+		{"GetInt", int64(-7), func(s Settings, path string) (interface{}, error) { return s.GetInt(path, -7) }},
+		{"GetUint", uint64(7), func(s Settings, path string) (interface{}, error) { return s.GetUint(path, 7) }},
+		{"GetFloat", -7.5, func(s Settings, path string) (interface{}, error) { return s.GetFloat(path, -7.5) }},
+		{"GetBool", false, func(s Settings, path string) (interface{}, error) { return s.GetBool(path, false) }},
+		{"GetString", "def", func(s Settings, path string) (interface{}, error) { return s.GetString(path, "def") }},
+		{"GetDuration", time.Duration(7), func(s Settings, path string) (interface{}, error) { return s.GetDuration(path, 7) }},
+	}
+
+	// The results of every getter, in the order above, for every type stored.
+	strict := map[string][]interface{}{
+		"b":   {wantErr("b is a bool, not a number"), wantErr("b is a bool, not a number"), wantErr("b is a bool, not a number"), true, wantErr("b is a bool, not a string"), wantErr("b is a bool, not a duration")},
+		"n":   {wantErr("n is null"), wantErr("n is null"), wantErr("n is null"), wantErr("n is null"), wantErr("n is null"), wantErr("n is null")},
+		"s":   {wantErr("s is a string, not a number"), wantErr("s is a string, not a number"), wantErr("s is a string, not a number"), wantErr("s is a string, not a bool"), "5", wantErr(`Could not decode s: time: missing unit in duration "5"`)},
+		"i":   {int64(5), uint64(5), 5.0, wantErr("i is a number, not a bool"), wantErr("i is a number, not a string"), time.Duration(5)},
+		"f":   {wantErr("Could not decode f: 5.5 is not an integer"), wantErr("Could not decode f: 5.5 is not an integer"), 5.5, wantErr("f is a number, not a bool"), wantErr("f is a number, not a string"), wantErr("Could not decode f: 5.5 is not an integer")},
+		"m":   {wantErr("m is an object, not a number"), wantErr("m is an object, not a number"), wantErr("m is an object, not a number"), wantErr("m is an object, not a bool"), wantErr("m is an object, not a string"), wantErr("m is an object, not a duration")},
+		"a":   {wantErr("a is an array, not a number"), wantErr("a is an array, not a number"), wantErr("a is an array, not a number"), wantErr("a is an array, not a bool"), wantErr("a is an array, not a string"), wantErr("a is an array, not a duration")},
+		"neg": {int64(-1), wantErr("Could not decode neg: -1 does not fit in uint64"), -1.0, wantErr("neg is a number, not a bool"), wantErr("neg is a number, not a string"), time.Duration(-1)},
+		"x":   {wantErr("Could not find x (missing x)"), wantErr("Could not find x (missing x)"), wantErr("Could not find x (missing x)"), wantErr("Could not find x (missing x)"), wantErr("Could not find x (missing x)"), wantErr("Could not find x (missing x)")},
+	}
+	// Weak typing only changes the results of the numeric getters, and of
+	// GetBool for strings.
+	weak := map[string][]interface{}{
+		"b": {int64(1), uint64(1), 1.0, true, wantErr("b is a bool, not a string"), time.Duration(1)},
+		"s": {int64(5), uint64(5), 5.0, wantErr(`s: "5" is not a bool, use true/false, on/off, yes/no, y/n, enabled/disabled or 1/0`), "5", wantErr(`Could not decode s: time: missing unit in duration "5"`)},
+		"f": {int64(6), uint64(6), 5.5, wantErr("f is a number, not a bool"), wantErr("f is a number, not a string"), time.Duration(6)},
+	}
+	for path, results := range strict {
+		if _, ok := weak[path]; !ok {
+			weak[path] = results
+		}
+	}
+
+	for _, weaklyTyped := range []bool{false, true} {
+		settings := NewSettings()
+		settings.SetWeaklyTyped(weaklyTyped)
+		if err := settings.LoadJSON([]byte(`{"b": true, "n": null, "s": "5", "i": 5, "f": 5.5, "m": {"a": 1}, "a": [1], "neg": -1}`)); err != nil {
+			t.Fatal(err)
+		}
+		matrix := strict
+		if weaklyTyped {
+			matrix = weak
+		}
+
+		for path, results := range matrix {
+			for i, getter := range getters {
+				got, err := getter.get(settings, path)
+				name := fmt.Sprintf("%s(%s) weak=%v", getter.name, path, weaklyTyped)
+				switch want := results[i].(type) {
+				case wantErr:
+					if err == nil || err.Error() != string(want) || got != getter.def {
+						t.Errorf("%s = %v, %v, want the default and %q", name, got, err, want)
+					}
+				default:
+					if err != nil || got != want {
+						t.Errorf("%s = %v, %v, want %v", name, got, err, want)
+					}
+				}
+				if path == "n" && !(errors.Is(err, ErrNullValue) && errors.Is(err, ErrNotFound)) {
+					t.Errorf("%s = %v, want ErrNullValue and ErrNotFound", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.SetDefaults(map[string]interface{}{"db": map[string]interface{}{"port": 5432, "host": "localhost"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "db", "password": "x", "replicas": ["a", "b"]}, "debug": true, "empty": {}}`)); err != nil {
+		t.Fatal(err)
+	}
+	settings.MarkSecret("db:password")
+
+	want := "db:host     = \"db\"\ndb:password = \"[redacted]\"\ndb:replicas = [\"a\",\"b\"]\ndebug       = true\nempty       = {}\n"
+	if got := FormatList(settings.List(ListOptions{}), true); got != want {
+		t.Errorf("FormatList(List) =\n%s\nwant\n%s", got, want)
+	}
+
+	entries := settings.List(ListOptions{Prefix: "db", IncludeDefaults: true, ShowSecrets: true})
+	if len(entries) != 4 {
+		t.Fatalf("List with defaults = %+v, want 4 entries", entries)
+	}
+	if port := entries[2]; port.Path != "db:port" || !port.IsDefault || port.Source != "SetDefaults" || port.Rendered != "5432" {
+		t.Errorf("db:port = %+v, want the default", port)
+	}
+	if host := entries[0]; host.IsDefault || host.Source != "LoadJSON" || host.Value != "db" {
+		t.Errorf("db:host = %+v, want the loaded value", host)
+	}
+	if password := entries[1]; password.Value != "x" {
+		t.Errorf("db:password = %+v, want it shown", password)
+	}
+	if got := FormatList(entries[:1], false); got != "db:host = \"db\"\n" {
+		t.Errorf("FormatList not aligned = %q", got)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"a": 1, "b": 2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan error, 10)
+	settings.OnReload(func(err error) {
+		reloads <- err
+	})
+	changed := make(chan []Change, 10)
+	settings.OnChange(func(changes []Change) {
+		changed <- changes
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := settings.ReloadOnSignal(ctx, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ReloadOnSignal(ctx, syscall.SIGHUP); err == nil {
+		t.Error("A second ReloadOnSignal should fail")
+	}
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signal := func() error {
+		t.Helper()
+		if err := process.Signal(syscall.SIGHUP); err != nil {
+			t.Skip("Can't send SIGHUP:", err)
+		}
+		select {
+		case err := <-reloads:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("No reload after SIGHUP")
+		}
+		return nil
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"a": 1, "b": 3, "c": 4}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := signal(); err != nil {
+		t.Fatal(err)
+	}
+	changes := <-changed
+	expected := []Change{
+		{Path: "b", Type: ChangeModified, Old: float64(2), New: float64(3)},
+		{Path: "c", Type: ChangeAdded, New: float64(4)},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Changes are %+v, expected %+v", changes, expected)
+	}
+
+	// A reload without changes, or a failed one, isn't a change.
+	if err := signal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"a": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := signal(); err == nil {
+		t.Error("Reloading broken JSON should fail")
+	}
+	if value, _ := settings.GetInt("b", 0); value != 3 {
+		t.Errorf("b is %d after a failed reload, expected 3", value)
+	}
+	select {
+	case changes := <-changed:
+		t.Errorf("Unexpected changes %+v", changes)
+	default:
+	}
+
+	// Once cancelled it can run again.
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := settings.ReloadOnSignal(ctx, syscall.SIGHUP)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoadJSONAt(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"hosts": {"a": 1}, "db": {"name": "x", "port": 5432}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := settings.LoadJSONAt("hosts", []byte(`["a", "b", "c"]`)); err != nil {
+		t.Fatal(err)
+	}
+	var hosts []string
+	err := settings.Get("hosts", &hosts)
+	if err != nil || !reflect.DeepEqual(hosts, []string{"a", "b", "c"}) {
+		t.Errorf("hosts is %v (%v), expected [a b c]", hosts, err)
+	}
+
+	if err := settings.LoadJSONAt("db", []byte(`{"port": 6543}`)); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.GetString("db:name", ""); name != "x" {
+		t.Errorf("db:name is %q after merging into db, expected x", name)
+	}
+	if port, _ := settings.GetInt("db:port", 0); port != 6543 {
+		t.Errorf("db:port is %d, expected 6543", port)
+	}
+
+	if err := settings.LoadJSONAt("db:port", []byte(`7000`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSONAt("new:nested", []byte(`"value"`)); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("db:port", 0); port != 7000 {
+		t.Errorf("db:port is %d, expected 7000", port)
+	}
+	if value, _ := settings.GetString("new:nested", ""); value != "value" {
+		t.Errorf("new:nested is %q, expected value", value)
+	}
+
+	if err := settings.LoadJSONAt("", []byte(`{"root": true}`)); err != nil {
+		t.Error(err)
+	}
+	err = settings.LoadJSONAt("", []byte(`["a"]`))
+	if err == nil || !strings.Contains(err.Error(), "not an array; give a path") {
+		t.Errorf("Loading an array at the root returned %v", err)
+	}
+	if err := settings.LoadJSONAt("broken", []byte(`[1,`)); err == nil {
+		t.Error("Broken JSON should fail to load")
+	}
+
+	// Reload loads it at the same path again.
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("db:port", 0); port != 7000 {
+		t.Errorf("db:port is %d after Reload, expected 7000", port)
+	}
+}
+
+func TestKeyNormalizer(t *testing.T) {
+	names := map[string]string{
+		"maxConnections": "max_connections",
+		"HTTPServer":     "http_server",
+		"userID":         "user_id",
+		"maxConn2":       "max_conn2",
+		"already_snake":  "already_snake",
+		"Name":           "name",
+	}
+	for key, expected := range names {
+		if snake := SnakeCaseKey(key); snake != expected {
+			t.Errorf("SnakeCaseKey(%q) is %q, expected %q", key, snake, expected)
+		}
+		if again := SnakeCaseKey(expected); again != expected {
+			t.Errorf("SnakeCaseKey(%q) is %q, expected it unchanged", expected, again)
+		}
+	}
+	if camel := CamelCaseKey("max_connections"); camel != "maxConnections" {
+		t.Errorf("CamelCaseKey is %q, expected maxConnections", camel)
+	}
+
+	settings := NewSettings()
+	settings.SetKeyNormalizer(SnakeCaseKey)
+	if err := settings.LoadJSON([]byte(`{"db": {"maxConnections": 10, "hosts": [{"hostName": "a"}]}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSON([]byte(`{"db": {"max_connections": 20}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"db:max_connections", "db:maxConnections", "Db:MaxConnections"} {
+		if value, err := settings.GetInt(path, 0); err != nil || value != 20 {
+			t.Errorf("%s is %d (%v), expected 20", path, value, err)
+		}
+	}
+	expected := `{"db":{"hosts":[{"host_name":"a"}],"max_connections":20}}`
+	if b := settings.GetJSON(); string(b) != expected {
+		t.Errorf("GetJSON is %s, expected %s", b, expected)
+	}
+
+	if err := settings.RawSet(true, "db:retryCount", map[string]interface{}{"maxTries": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := settings.GetInt("db:retry_count:max_tries", 0); err != nil || value != 3 {
+		t.Errorf("db:retry_count:max_tries is %d (%v), expected 3", value, err)
+	}
+	if err := settings.Delete("db:retryCount"); err != nil {
+		t.Error(err)
+	}
+
+	err := settings.LoadJSON([]byte(`{"a": {"maxConn": 1, "max_conn": 2}}`))
+	if err == nil || !strings.Contains(err.Error(), `Keys "maxConn" and "max_conn" in a both normalize to "max_conn"`) {
+		t.Errorf("Colliding keys returned %v", err)
+	}
+
+	settings.SetKeyDenormalizer(CamelCaseKey)
+	expected = `{"db":{"hosts":[{"hostName":"a"}],"maxConnections":20}}`
+	if b := settings.GetJSON(); string(b) != expected {
+		t.Errorf("Denormalized GetJSON is %s, expected %s", b, expected)
+	}
+
+	// The order of keys survives renaming.
+	ordered := NewSettings()
+	ordered.SetOrderedKeys(true)
+	ordered.SetKeyNormalizer(LowerCaseKey)
+	if err := ordered.LoadJSON([]byte(`{"Zeta": 1, "Alpha": {"Beta": 2, "Aa": 3}}`)); err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"zeta":1,"alpha":{"beta":2,"aa":3}}`
+	if b := ordered.GetJSON(); string(b) != expected {
+		t.Errorf("Ordered GetJSON is %s, expected %s", b, expected)
+	}
+}
+
+func TestOrderedKeys(t *testing.T) {
+	settings := NewSettings()
+	settings.SetOrderedKeys(true)
+	check := func(step, want string) {
+		t.Helper()
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("%s: GetJSON is %s, want %s", step, got, want)
+		}
+	}
+
+	if err := settings.LoadJSON([]byte(`{"z": 1, "a": {"y": 1, "b": 2}, "m": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	check("load", `{"z":1,"a":{"y":1,"b":2},"m":3}`)
+
+	// Overridden keys keep their place, new ones go at the end in the order
+	// of the source, or sorted for sources without one.
+	if err := settings.LoadJSON([]byte(`{"new": true, "a": {"x": 1, "b": 5}, "z": 9}`)); err != nil {
+		t.Fatal(err)
+	}
+	check("override", `{"z":9,"a":{"y":1,"b":5,"x":1},"m":3,"new":true}`)
+	if err := settings.MergeSettings(map[string]interface{}{"q": 1, "c": 2, "m": 4}); err != nil {
+		t.Fatal(err)
+	}
+	check("merge", `{"z":9,"a":{"y":1,"b":5,"x":1},"m":4,"new":true,"c":2,"q":1}`)
+
+	// RawSet works the same way, even when it replaces a value by a map.
+	if err := settings.RawSet(false, "m:k", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "a:b", 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "d", 1); err != nil {
+		t.Fatal(err)
+	}
+	check("RawSet", `{"z":9,"a":{"y":1,"b":6,"x":1},"m":{"k":1},"new":true,"c":2,"q":1,"d":1}`)
+
+	// A deleted key goes at the end when it is set again.
+	if err := settings.Delete("a:y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Delete("z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "a:y", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.MergeSettings(map[string]interface{}{"z": 1}); err != nil {
+		t.Fatal(err)
+	}
+	check("Delete", `{"a":{"b":6,"x":1,"y":2},"m":{"k":1},"new":true,"c":2,"q":1,"d":1,"z":1}`)
+
+	want := "{\n> \"a\": {\n>  \"b\": 6,\n>  \"x\": 1,\n>  \"y\": 2\n> },\n> \"m\": {\n>  \"k\": 1\n> },\n> \"new\": true,\n" +
+		"> \"c\": 2,\n> \"q\": 1,\n> \"d\": 1,\n> \"z\": 1\n>}"
+	if got := string(settings.GetPrettyJSON(">", " ")); got != want {
+		t.Errorf("GetPrettyJSON is\n%s\nwant\n%s", got, want)
+	}
+
+	// Reload replays the loads, losing what RawSet and Delete did.
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("Reload", `{"z":1,"a":{"y":1,"b":5,"x":1},"m":4,"new":true,"c":2,"q":1}`)
+
+	settings.SetOrderedKeys(false)
+	check("unordered", `{"a":{"b":5,"x":1,"y":1},"c":2,"m":4,"new":true,"q":1,"z":1}`)
+}
+
+// pipeStdin makes stdin read content through a pipe, as if it was piped into
+// the process, and returns a function restoring it.
+func pipeStdin(t *testing.T, content string) func() {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write([]byte(content))
+		w.Close()
+	}()
+
+	stdin.Lock()
+	old := stdin.r
+	stdin.r, stdin.read = r, false
+	stdin.Unlock()
+	return func() {
+		r.Close()
+		stdin.Lock()
+		stdin.r, stdin.read = old, false
+		stdin.Unlock()
+	}
+}
+
+func TestLoadStdin(t *testing.T) {
+	restore := pipeStdin(t, `{"a": 1, "b": {"c": true}}`)
+	settings := NewSettings()
+	if err := settings.LoadFile("-"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":1,"b":{"c":true}}` {
+		t.Errorf("settings are %s", got)
+	}
+	if source, _ := settings.SourceOf("a"); source.Name != "stdin" {
+		t.Errorf("a came from %q, want stdin", source.Name)
+	}
+
+	// Stdin is gone once read, by any settings, but Reload merges what was
+	// read again.
+	for name, load := range map[string]func(s *Settings) error{
+		"LoadFile":             func(s *Settings) error { return s.LoadFile("-") },
+		"LoadStdin":            func(s *Settings) error { return s.LoadStdin("json") },
+		"other":                func(s *Settings) error { other := NewSettings(); return other.LoadStdin("") },
+		"LoadFileAs":           func(s *Settings) error { return s.LoadFileAs("-", "json") },
+		"LoadStdinWithOptions": func(s *Settings) error { return s.LoadStdinWithOptions("", MergeKeepExisting) },
+	} {
+		if err := load(&settings); err == nil || !strings.Contains(err.Error(), "it was already read, so it can only be loaded once") {
+			t.Errorf("%s after reading stdin returned %v", name, err)
+		}
+	}
+	if err := settings.RawSet(false, "a", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := settings.GetInt("a", 0); got != 1 {
+		t.Errorf("a is %d after Reload, want 1", got)
+	}
+	restore()
+
+	// The format comes from the argument, a marker or a guess.
+	for format, content := range map[string]string{
+		"json": `{"a": 1}`,
+		"":     "// flexiconfig: json\n{\"a\": 1}",
+		"JSON": ` {"a": 1}`,
+	} {
+		restore := pipeStdin(t, content)
+		settings := NewSettings()
+		if err := settings.LoadStdin(format); err != nil {
+			t.Errorf("LoadStdin(%q) of %q: %s", format, content, err)
+		} else if got, _ := settings.GetInt("a", 0); got != 1 {
+			t.Errorf("LoadStdin(%q) of %q set a to %d", format, content, got)
+		}
+		restore()
+	}
+
+	restore = pipeStdin(t, "# flexiconfig: toml\na = 1")
+	if err := settings.LoadStdin(""); err == nil || !strings.Contains(err.Error(), "Unknown config file format toml") {
+		t.Errorf("an unknown marker returned %v", err)
+	}
+	restore()
+
+	restore = pipeStdin(t, `{"a": "0123456789"}`)
+	defer restore()
+	limited := NewSettings()
+	limited.SetMaxSize(8)
+	if err := limited.LoadStdin("json"); err == nil {
+		t.Errorf("reading more than the maximum size succeeded")
+	}
+}
+
+type bindCommon struct {
+	Name string `default:"app"`
+}
+
+type bindTLS struct {
+	Enabled bool   `default:"true"`
+	Cert    string `mapstructure:"cert_file" default:"server.pem"`
+}
+
+type bindServer struct {
+	bindCommon `mapstructure:",squash"`
+	Host       string        `default:"localhost"`
+	Port       int           `default:"8080"`
+	Timeout    time.Duration `default:"5s"`
+	TLS        bindTLS
+	Ignored    string `mapstructure:"-"`
+}
+
+func (this *bindServer) Validate() error {
+	if this.Port == 1 {
+		return errors.New("port 1 is reserved")
+	}
+	return nil
+}
+
+func TestBindSection(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"server": {"name": "web", "port": 9000, "tls": {"cert_file": "web.pem"}},
+		"weak": {"port": "9001", "timeout": "1m", "tls": {"enabled": "false"}},
+		"reserved": {"port": 1},
+		"bad": {"port": "x"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys that are set override the defaults, in nested and squashed structs
+	// too, and fields set beforehand keep their value.
+	server := bindServer{Host: "preset"}
+	if err := settings.BindSection("server", &server); err != nil {
+		t.Fatal(err)
+	}
+	want := bindServer{bindCommon: bindCommon{Name: "web"}, Host: "preset", Port: 9000, Timeout: 5 * time.Second, TLS: bindTLS{Enabled: true, Cert: "web.pem"}}
+	if !reflect.DeepEqual(server, want) {
+		t.Errorf("BindSection(server) = %+v, want %+v", server, want)
+	}
+
+	// A missing section is only allowed with BindOptional, which leaves the
+	// defaults.
+	server = bindServer{}
+	if err := settings.BindSection("missing", &server); err == nil || !strings.HasPrefix(err.Error(), "Could not bind missing: ") {
+		t.Errorf("binding a missing section returned %v", err)
+	}
+	server = bindServer{}
+	if err := settings.BindSection("missing", &server, BindOptional()); err != nil {
+		t.Fatal(err)
+	}
+	want = bindServer{bindCommon: bindCommon{Name: "app"}, Host: "localhost", Port: 8080, Timeout: 5 * time.Second, TLS: bindTLS{Enabled: true, Cert: "server.pem"}}
+	if !reflect.DeepEqual(server, want) {
+		t.Errorf("BindSection(missing) = %+v, want %+v", server, want)
+	}
+
+	// Strings are converted with BindWeaklyTyped only.
+	if err := settings.BindSection("weak", &bindServer{}); err == nil {
+		t.Error("binding strings to numbers succeeded without BindWeaklyTyped")
+	}
+	server = bindServer{}
+	if err := settings.BindSection("weak", &server, BindWeaklyTyped()); err != nil {
+		t.Fatal(err)
+	}
+	if server.Port != 9001 || server.Timeout != time.Minute || server.TLS.Enabled {
+		t.Errorf("BindSection(weak) = %+v", server)
+	}
+	if settings.weaklyTyped {
+		t.Error("BindWeaklyTyped changed the settings")
+	}
+
+	for path, message := range map[string]string{
+		"reserved": "Could not bind reserved: port 1 is reserved",
+		"bad":      "Could not bind bad: Could not decode bad: 1 error(s) decoding:\n\n* 'Port' expected type 'int', got unconvertible type 'string'",
+	} {
+		if err := settings.BindSection(path, &bindServer{}); err == nil || err.Error() != message {
+			t.Errorf("BindSection(%s) = %v, want %q", path, err, message)
+		}
+	}
+
+	// Invalid defaults name the path the field is decoded from.
+	var invalid struct {
+		TLS struct {
+			MaxCount int `mapstructure:"max_count" default:"many"`
+		}
+	}
+	err = settings.BindSection("server", &invalid)
+	if err == nil || !strings.Contains(err.Error(), "invalid default for MaxCount: Could not decode server:tls:max_count") {
+		t.Errorf("an invalid default returned %v", err)
+	}
+	if err := settings.BindSection("server", bindServer{}); err == nil || !strings.Contains(err.Error(), "target must be a pointer to a struct") {
+		t.Errorf("binding to a struct value returned %v", err)
+	}
+}
+
+func TestGetStringExpanded(t *testing.T) {
+	t.Setenv("FLEXICONFIG_TEST_HOST", "example.com")
+	t.Setenv("FLEXICONFIG_TEST_EMPTY", "")
+	// Setenv first so that the variable is restored afterwards.
+	t.Setenv("FLEXICONFIG_TEST_UNSET", "")
+	os.Unsetenv("FLEXICONFIG_TEST_UNSET")
+
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"url": "https://${FLEXICONFIG_TEST_HOST}:$FLEXICONFIG_TEST_PORT/$$path",
+		"empty": "a${FLEXICONFIG_TEST_EMPTY}b",
+		"unset": "a${FLEXICONFIG_TEST_UNSET}b",
+		"plain": "100$ and $",
+		"unterminated": "${FLEXICONFIG_TEST_HOST",
+		"invalid": "${FLEXICONFIG-TEST}",
+		"number": 1,
+		"server": {"host": "$FLEXICONFIG_TEST_HOST", "raw": "$FLEXICONFIG_TEST_HOST", "unset": "x$FLEXICONFIG_TEST_UNSET",
+			"list": ["$FLEXICONFIG_TEST_HOST", "b"]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables are looked up on every call.
+	t.Setenv("FLEXICONFIG_TEST_PORT", "80")
+	for path, want := range map[string]string{
+		"url":   "https://example.com:80/$path",
+		"empty": "ab",
+		"unset": "ab",
+		"plain": "100$ and $",
+	} {
+		if got, err := settings.GetStringExpanded(path, "default"); err != nil || got != want {
+			t.Errorf("GetStringExpanded(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	t.Setenv("FLEXICONFIG_TEST_PORT", "8080")
+	if got, _ := settings.GetStringExpanded("url", ""); got != "https://example.com:8080/$path" {
+		t.Errorf("GetStringExpanded(url) = %q after the port changed", got)
+	}
+
+	// Unset variables are an error with ExpandErrorOnUnset, empty ones aren't.
+	if got, err := settings.GetStringExpanded("empty", "default", ExpandErrorOnUnset); err != nil || got != "ab" {
+		t.Errorf("GetStringExpanded(empty, ExpandErrorOnUnset) = %q, %v", got, err)
+	}
+	for path, message := range map[string]string{
+		"unset":        "Could not expand unset: Environment variable FLEXICONFIG_TEST_UNSET is not set",
+		"unterminated": "Could not expand unterminated: Unterminated ${ in \"${FLEXICONFIG_TEST_HOST\"",
+		"invalid":      "Could not expand invalid: Invalid environment variable name \"FLEXICONFIG-TEST\" in \"${FLEXICONFIG-TEST}\"",
+	} {
+		got, err := settings.GetStringExpanded(path, "default", ExpandErrorOnUnset)
+		if got != "default" || err == nil || err.Error() != message {
+			t.Errorf("GetStringExpanded(%s) = %q, %v, want %q", path, got, err, message)
+		}
+	}
+	if got, err := settings.GetStringExpanded("missing", "default"); got != "default" || !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetStringExpanded(missing) = %q, %v", got, err)
+	}
+	if got, err := settings.GetStringExpanded("number", "default"); got != "default" || err == nil {
+		t.Errorf("GetStringExpanded(number) = %q, %v", got, err)
+	}
+
+	// Only tagged fields are expanded when decoding, strings in arrays too.
+	var server struct {
+		Host  string `expandenv:"true"`
+		Raw   string
+		Unset string   `expandenv:"true"`
+		List  []string `mapstructure:"list" expandenv:"true"`
+	}
+	if err := settings.Get("server", &server); err != nil {
+		t.Fatal(err)
+	}
+	if server.Host != "example.com" || server.Raw != "$FLEXICONFIG_TEST_HOST" || server.Unset != "x" ||
+		!reflect.DeepEqual(server.List, []string{"example.com", "b"}) {
+		t.Errorf("Get(server) = %+v", server)
+	}
+	if raw, _ := settings.RawGet("server:host"); raw != "$FLEXICONFIG_TEST_HOST" {
+		t.Errorf("decoding changed the settings to %v", raw)
+	}
+
+	var strict struct {
+		Unset string `expandenv:"strict"`
+	}
+	err = settings.Get("server", &strict)
+	if err == nil || !strings.Contains(err.Error(), "Could not expand unset: Environment variable FLEXICONFIG_TEST_UNSET is not set") {
+		t.Errorf("decoding an unset variable with expandenv:\"strict\" returned %v", err)
+	}
+}
+
+func TestSourceFileInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.json")
+	other := filepath.Join(dir, "other.json")
+	write := func(path, content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(step string, source Source, content string, modTime time.Time) {
+		t.Helper()
+		sum := sha256.Sum256([]byte(content))
+		if source.Size != len(content) || source.Hash != hex.EncodeToString(sum[:]) || !source.ModTime.Equal(modTime) {
+			t.Errorf("%s: the source is %+v, want size %d, hash %x and modification time %s", step, source, len(content), sum, modTime)
+		}
+		if source.LoadedAt.IsZero() || !source.LoadedAt.Equal(source.LoadedAt.Truncate(time.Millisecond)) {
+			t.Errorf("%s: the source was loaded at %s", step, source.LoadedAt)
+		}
+	}
+
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	write(path, `{"a": 1}`, first)
+	write(other, `{"b": 1}`, first)
+	settings := NewSettings()
+	if err := settings.LoadAll(path, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSON([]byte(`{"c": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	sources := settings.Sources()
+	check("load", sources[0], `{"a": 1}`, first)
+	check("LoadJSON", sources[2], `{"c": 1}`, time.Time{})
+
+	// Reloading reads the file again, while the sources that weren't
+	// reloaded keep what they had.
+	second := first.Add(time.Hour)
+	write(path, `{"a": 22}`, second)
+	write(other, `{"b": 22}`, second)
+	time.Sleep(2 * time.Millisecond)
+	if err := settings.ReloadPath(path); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := settings.Sources()
+	check("reload", reloaded[0], `{"a": 22}`, second)
+	check("not reloaded", reloaded[1], `{"b": 1}`, first)
+	if !reloaded[0].LoadedAt.After(sources[0].LoadedAt) || !reloaded[1].LoadedAt.Equal(sources[1].LoadedAt) {
+		t.Errorf("the sources were loaded at %s and %s, then at %s and %s", sources[0].LoadedAt, sources[1].LoadedAt, reloaded[0].LoadedAt, reloaded[1].LoadedAt)
+	}
+
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("Reload", settings.Sources()[1], `{"b": 22}`, second)
+}
+
+func TestCheck(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"name": "app",
+		"port": "80",
+		"workers": 0,
+		"old": true,
+		"extra": 1,
+		"db": {"host": "x", "pool": 5}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.RequireTogether("tls:cert", "tls:key", "name")
+
+	var schema struct {
+		Name    string
+		Port    int
+		Workers int `min:"1"`
+		Old     bool
+		DB      struct {
+			Host string
+			User string `required:"true"`
+		} `mapstructure:"db"`
+	}
+	report := settings.Check(CheckOptions{
+		Required:     []string{"name", "token"},
+		Struct:       &schema,
+		ReportUnused: true,
+		Deprecated:   map[string]string{"old": "use new instead", "gone": "never set"},
+		Kinds:        map[string]string{"name": "string", "workers": "string", "missing": "number"},
+	})
+
+	type problem struct{ path, category string }
+	collect := func(problems []Problem) []problem {
+		var collected []problem
+		for _, p := range problems {
+			collected = append(collected, problem{p.Path, p.Category})
+		}
+		sort.Slice(collected, func(i, j int) bool {
+			return collected[i].category+collected[i].path < collected[j].category+collected[j].path
+		})
+		return collected
+	}
+	wantErrors := []problem{
+		{"db:User", CategoryRequired},
+		{"tls:cert", CategoryRequired},
+		{"token", CategoryRequired},
+		{"port", CategorySchema},
+		{"workers", CategorySchema},
+		{"workers", CategoryType},
+	}
+	wantWarnings := []problem{
+		{"old", CategoryDeprecated},
+		{"db:pool", CategoryUnused},
+		{"extra", CategoryUnused},
+	}
+	if got := collect(report.Errors); !reflect.DeepEqual(got, wantErrors) {
+		t.Errorf("the errors are %v, want %v\n%s", got, wantErrors, report)
+	}
+	if got := collect(report.Warnings); !reflect.DeepEqual(got, wantWarnings) {
+		t.Errorf("the warnings are %v, want %v\n%s", got, wantWarnings, report)
+	}
+	for _, p := range report.Warnings {
+		if p.Category == CategoryDeprecated && p.Message != "old is deprecated: use new instead" {
+			t.Errorf("the deprecation message is %q", p.Message)
+		}
+	}
+
+	var validationErr *ValidationError
+	if err := report.Err(); !errors.As(err, &validationErr) || len(validationErr.Problems) != len(wantErrors) {
+		t.Errorf("Err() = %v, want a *ValidationError with %d problems", err, len(wantErrors))
+	}
+	if !strings.HasPrefix(report.String(), "6 errors, 3 warnings\n  error: ") {
+		t.Errorf("String() = %q", report.String())
+	}
+
+	// Warnings alone aren't an error, and an empty report says so.
+	settings = NewSettings()
+	if err := settings.LoadJSON([]byte(`{"old": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	report = settings.Check(CheckOptions{Deprecated: map[string]string{"old": ""}})
+	if report.Err() != nil || len(report.Warnings) != 1 || report.Warnings[0].Message != "old is deprecated" {
+		t.Errorf("Check with a deprecated key returned %+v", report)
+	}
+	if report := NewSettings().Check(CheckOptions{Struct: 1}); len(report.Errors) != 1 || report.Errors[0].Category != CategorySchema {
+		t.Errorf("checking against a non-struct returned %+v", report)
+	}
+	if got := NewSettings().Check(CheckOptions{}).String(); got != "No problems found" {
+		t.Errorf("an empty report is %q", got)
+	}
+}
+
+func TestResolveExtends(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{"presets": {
+		"base": {"port": 80, "debug": false, "db": {"host": "db", "pool": 5}, "tags": ["a"]},
+		"dev": {"$extends": "base", "debug": true, "db": {"host": "localhost"}},
+		"local": {"$extends": "dev", "db": {"pool": 1}, "tags": ["b"]},
+		"other": {"port": 81}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ResolveExtends("presets", ""); err != nil {
+		t.Fatal(err)
+	}
+	presets, _ := settings.GetJSONAt("presets")
+	want := `{"base":{"db":{"host":"db","pool":5},"debug":false,"port":80,"tags":["a"]},` +
+		`"dev":{"db":{"host":"localhost","pool":5},"debug":true,"port":80,"tags":["a"]},` +
+		`"local":{"db":{"host":"localhost","pool":1},"debug":true,"port":80,"tags":["b"]},` +
+		`"other":{"port":81}}`
+	if string(presets) != want {
+		t.Errorf("the presets are %s, want %s", presets, want)
+	}
+
+	// A custom key at the top level.
+	settings = NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": {"x": 1}, "b": {"inherits": "a", "y": 2}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ResolveExtends("", "inherits"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":{"x":1},"b":{"x":1,"y":2}}` {
+		t.Errorf("settings are %s", got)
+	}
+
+	for presets, message := range map[string]string{
+		`{"a": {"$extends": "b"}, "b": {"$extends": "c"}, "c": {"$extends": "a"}}`: "Could not resolve extends in presets: a -> b -> c -> a form a cycle",
+		`{"a": {"$extends": "a"}}`:         "Could not resolve extends in presets: a -> a form a cycle",
+		`{"a": {"$extends": "missing"}}`:   "Could not resolve extends in presets: a extends missing, which doesn't exist",
+		`{"a": {"$extends": "b"}, "b": 1}`: "Could not resolve extends in presets: a extends b, which is not a map",
+		`{"a": {"$extends": 1}}`:           "Could not resolve extends in presets: a has a $extends of float64, not the name of a sibling",
+		`{"ok": {"$extends": "base"}, "base": {}, "a": {"$extends": "missing"}}`: "Could not resolve extends in presets: a extends missing, which doesn't exist",
+	} {
+		settings := NewSettings()
+		if err := settings.LoadJSON([]byte(`{"presets": ` + presets + `}`)); err != nil {
+			t.Fatal(err)
+		}
+		before := string(settings.GetJSON())
+		if err := settings.ResolveExtends("presets", ""); err == nil || err.Error() != message {
+			t.Errorf("resolving %s returned %v, want %q", presets, err, message)
+		}
+		if after := string(settings.GetJSON()); after != before {
+			t.Errorf("a failed ResolveExtends changed the settings to %s", after)
+		}
+	}
+
+	if err := settings.ResolveExtends("a:x", ""); err == nil || err.Error() != "Could not resolve extends in a:x: it is float64, not a map" {
+		t.Errorf("resolving extends in a number returned %v", err)
+	}
+	if err := settings.ResolveExtends("missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("resolving extends in a missing path returned %v", err)
+	}
+}
+
+func TestRequirements(t *testing.T) {
+	cases := []struct {
+		settings string
+		problems []string
+	}{
+		{`{"token": "x", "tls": {"cert": "c", "key": "k", "ca": "a"}}`, nil},
+		{`{"keyfile": "f"}`, nil},
+		{`{}`, []string{"One of token, keyfile is required, none is set"}},
+		{`{"token": null, "tls": {}}`, []string{"One of token, keyfile is required, none is set"}},
+		{`{"token": "x", "keyfile": "f"}`, []string{"Only one of token, keyfile may be set, token and keyfile are"}},
+		{`{"token": "x", "tls": {"cert": "c"}}`, []string{"tls:cert, tls:key, tls:ca must be set together, tls:key and tls:ca are not"}},
+		{`{"keyfile": "f", "tls": {"ca": "a", "cert": "c"}}`, []string{"tls:cert, tls:key, tls:ca must be set together, tls:key is not"}},
+		{`{"token": "x", "keyfile": "f", "tls": {"key": null, "ca": "a"}}`, []string{
+			"Only one of token, keyfile may be set, token and keyfile are",
+			"tls:cert, tls:key, tls:ca must be set together, tls:cert and tls:key are not",
+		}},
+	}
+	for _, c := range cases {
+		settings := NewSettings()
+		settings.RequireOneOf("token", "keyfile")
+		settings.RequireTogether("tls:cert", "tls:key", "tls:ca")
+		if err := settings.LoadJSON([]byte(c.settings)); err != nil {
+			t.Fatal(err)
+		}
+
+		report := settings.Check(CheckOptions{})
+		var problems []string
+		for _, problem := range report.Errors {
+			if problem.Category != CategoryRequired {
+				t.Errorf("%s: the problem %q is in category %s", c.settings, problem.Message, problem.Category)
+			}
+			problems = append(problems, problem.Message)
+		}
+		if !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("%s: Check found %q, want %q", c.settings, problems, c.problems)
+		}
+		if err := settings.Validate(); (err != nil) != (len(c.problems) > 0) {
+			t.Errorf("%s: Validate() = %v", c.settings, err)
+		}
+	}
+
+	// Empty values count as unset with SetEmptyIsMissing.
+	settings := NewSettings()
+	settings.RequireOneOf("token", "keyfile")
+	if err := settings.LoadJSON([]byte(`{"token": "", "keyfile": "f"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Validate(); err == nil {
+		t.Error("an empty token should count as set")
+	}
+	settings.SetEmptyIsMissing(true)
+	if err := settings.Validate(); err != nil {
+		t.Errorf("an empty token should count as missing: %s", err)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	settings := NewSettings()
+	settings.SetMaxKeys(5)
+	if err := settings.LoadJSON([]byte(`{"a": {"b": 1, "c": 2}, "d": [{"e": 3}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := settings.LoadJSON([]byte(`{"a": {"b": 1, "c": 2}, "d": [{"e": 3, "f": 4}]}`))
+	if err == nil || !strings.Contains(err.Error(), "more than the maximum of 5 keys") {
+		t.Errorf("Too many keys returned %v", err)
+	}
+	err = settings.MergeSettings(map[string]interface{}{"x": map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}})
+	if err == nil || !strings.Contains(err.Error(), "reached at x") {
+		t.Errorf("Merging too many keys returned %v", err)
+	}
+	if value, _ := settings.GetInt("d:e", 0); value != 0 {
+		t.Error("A rejected load should change nothing")
+	}
+
+	settings.SetMaxKeys(0)
+	settings.SetMaxValueBytes(5)
+	if err := settings.LoadJSON([]byte(`{"short": "12345"}`)); err != nil {
+		t.Error(err)
+	}
+	err = settings.LoadJSON([]byte(`{"list": ["ok", "too long"]}`))
+	if err == nil || err.Error() != "Value at list[1] is 8 bytes long, more than the maximum of 5" {
+		t.Errorf("Too long a value returned %v", err)
+	}
+
+	settings.SetMaxDepth(2)
+	err = settings.LoadJSON([]byte(`{"a": {"b": {"c": {}}}}`))
+	if err == nil || !strings.Contains(err.Error(), "nested deeper than the maximum of 2") {
+		t.Errorf("Too deep a value returned %v", err)
+	}
+}
+
+func TestPostLoadHooks(t *testing.T) {
+	settings := NewSettings()
+	var calls []string
+	first := settings.AddPostLoadHook(func(s *Settings) error {
+		calls = append(calls, "first")
+		host, _ := s.GetString("db:host", "")
+		return s.RawSet(false, "db:url", "postgres://"+strings.ToLower(host))
+	})
+	settings.AddPostLoadHook(func(s *Settings) error {
+		calls = append(calls, "second")
+		if fail, _ := s.GetBool("fail", false); fail {
+			return errors.New("Hook failed")
+		}
+		return nil
+	})
+
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "DB.local"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := settings.GetString("db:url", ""); url != "postgres://db.local" {
+		t.Errorf("db:url is %q, expected postgres://db.local", url)
+	}
+	if !reflect.DeepEqual(calls, []string{"first", "second"}) {
+		t.Errorf("Hooks were called as %v", calls)
+	}
+
+	// The merge stays applied when a hook fails.
+	calls = nil
+	err := settings.MergeSettings(map[string]interface{}{"fail": true, "db": map[string]interface{}{"host": "other"}})
+	if err == nil || err.Error() != "Hook failed" {
+		t.Errorf("MergeSettings returned %v, expected the hook's error", err)
+	}
+	if url, _ := settings.GetString("db:url", ""); url != "postgres://other" {
+		t.Errorf("db:url is %q after a failed hook, expected postgres://other", url)
+	}
+
+	// Reload calls the hooks again, setting db:url again, though the second
+	// fails again as fail is merged again.
+	if err := settings.Reload(); err == nil {
+		t.Error("Reload should fail as the failing merge is replayed")
+	}
+	if url, _ := settings.GetString("db:url", ""); url != "postgres://other" {
+		t.Errorf("db:url is %q after Reload, expected postgres://other", url)
+	}
+
+	calls = nil
+	settings.RemovePostLoadHook(first)
+	settings.RemovePostLoadHook(first)
+	if err := settings.LoadJSON([]byte(`{"fail": true}`)); err == nil {
+		t.Error("The remaining hook should still fail")
+	}
+	if !reflect.DeepEqual(calls, []string{"second"}) {
+		t.Errorf("Hooks were called as %v after removing one", calls)
+	}
+}
+
+func TestGetKeyed(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"servers": [
+			{"name": "primary", "host": "a", "port": 80},
+			{"name": "backup", "host": "b", "port": 8080}
+		],
+		"missing": [{"name": "a"}, {"host": "b"}],
+		"duplicate": [{"name": "a"}, {"name": "b"}, {"name": "a"}],
+		"numbers": [{"name": 1}],
+		"scalars": [{"name": "a"}, "b"],
+		"object": {"name": "a"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyed, err := settings.GetKeyed("servers", "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyed) != 2 || keyed["backup"]["host"] != "b" {
+		t.Errorf("GetKeyed returned %v", keyed)
+	}
+	keyed["primary"]["host"] = "changed"
+	if again, _ := settings.GetKeyed("servers", "name"); again["primary"]["host"] != "a" {
+		t.Error("GetKeyed should return copies")
+	}
+
+	failures := map[string]string{
+		"missing":   "missing[1] has no name",
+		"duplicate": `duplicate[2] has the same name as duplicate[0], "a"`,
+		"numbers":   "numbers[0]:name is a number, not a string",
+		"scalars":   "scalars[1] is a string, not an object",
+		"object":    "object is an object, not an array",
+	}
+	for path, expected := range failures {
+		if _, err := settings.GetKeyed(path, "name"); err == nil || err.Error() != expected {
+			t.Errorf("GetKeyed(%q) returned %v, expected %s", path, err, expected)
+		}
+	}
+
+	var server struct {
+		Host string
+		Port int
+	}
+	if err := settings.GetByKey("servers", "name", "backup", &server); err != nil {
+		t.Fatal(err)
+	}
+	if server.Host != "b" || server.Port != 8080 {
+		t.Errorf("GetByKey decoded %+v", server)
+	}
+	if err := settings.GetByKey("servers", "name", "other", &server); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByKey of a missing key returned %v", err)
+	}
+	if err := settings.GetByKey("nothing", "name", "a", &server); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByKey of a missing path returned %v", err)
+	}
+}
+
+func TestLoadJSONStreamArray(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+	content := `{"name": "router", "rules": [{"from": "/a", "to": 1}, {"from": "/b", "to": 2}], "limits": {"max": 3}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type rule struct {
+		From string
+		To   int
+	}
+	var rules []rule
+	settings := NewSettings()
+	err = settings.LoadJSONStreamArray(path, "rules", func(index int, elem json.RawMessage) error {
+		var r rule
+		if err := json.Unmarshal(elem, &r); err != nil {
+			return err
+		}
+		if index != len(rules) {
+			t.Errorf("Element %d came as %d", len(rules), index)
+		}
+		rules = append(rules, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rules, []rule{{"/a", 1}, {"/b", 2}}) {
+		t.Errorf("Streamed %v", rules)
+	}
+	if name, _ := settings.GetString("name", ""); name != "router" {
+		t.Errorf("name is %q, expected router", name)
+	}
+	if max, _ := settings.GetInt("limits:max", 0); max != 3 {
+		t.Errorf("limits:max is %d, expected 3", max)
+	}
+	if _, err := settings.RawGet("rules"); !errors.Is(err, ErrNotFound) {
+		t.Error("The streamed array shouldn't be stored")
+	}
+
+	other := NewSettings()
+	err = other.LoadJSONStreamArray(path, "rules", func(index int, elem json.RawMessage) error {
+		if index == 1 {
+			return errors.New("Bad rule")
+		}
+		return nil
+	})
+	if err == nil || !strings.HasSuffix(err.Error(), "Element 1 of rules: Bad rule") {
+		t.Errorf("A failing callback returned %v", err)
+	}
+	if len(other.Sources()) != 0 {
+		t.Error("Nothing should be merged when the callback fails")
+	}
+
+	if err := other.LoadJSONStreamArray(path, "name", func(int, json.RawMessage) error { return nil }); err == nil {
+		t.Error("Streaming a string should fail")
+	}
+}
+
+func TestLenientBools(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"a": "on", "b": "OFF", "c": "Yes", "d": "n", "e": "Enabled", "f": "disabled",
+		"g": true, "maybe": "maybe", "number": 1,
+		"feature": {"enabled": "yes", "verbose": "off"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{"a": true, "b": false, "c": true, "d": false, "e": true, "f": false, "g": true}
+	for path, want := range expected {
+		if value, err := settings.GetBoolLenient(path, !want); err != nil || value != want {
+			t.Errorf("GetBoolLenient(%q) is %v (%v), expected %v", path, value, err, want)
+		}
+		if _, err := settings.GetBool(path, false); err == nil && path != "g" {
+			t.Errorf("GetBool(%q) should be strict by default", path)
+		}
+	}
+
+	_, err = settings.GetBoolLenient("maybe", false)
+	if err == nil || err.Error() != `maybe: "maybe" is not a bool, use true/false, on/off, yes/no, y/n, enabled/disabled or 1/0` {
+		t.Errorf("GetBoolLenient of maybe returned %v", err)
+	}
+	if _, err := settings.GetBoolLenient("number", false); err == nil || err.Error() != "number is a number, not a bool" {
+		t.Errorf("GetBoolLenient of a number returned %v", err)
+	}
+
+	var feature struct {
+		Enabled bool
+		Verbose bool
+	}
+	if err := settings.Get("feature", &feature); err == nil {
+		t.Error("Decoding on into a bool should fail unless weakly typed")
+	}
+
+	settings.SetWeaklyTyped(true)
+	if value, err := settings.GetBool("a", false); err != nil || !value {
+		t.Errorf("Weakly typed GetBool(a) is %v (%v), expected true", value, err)
+	}
+	if err := settings.Get("feature", &feature); err != nil || !feature.Enabled || feature.Verbose {
+		t.Errorf("Decoded %+v (%v)", feature, err)
+	}
+	if err := settings.Get("maybe", &feature.Enabled); err == nil || !strings.Contains(err.Error(), "on/off") {
+		t.Errorf("Decoding maybe into a bool returned %v", err)
+	}
+}
+
+func TestReloadSource(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.json")
+	tenantPath := filepath.Join(dir, "tenant.json")
+	if err := ioutil.WriteFile(basePath, []byte(`{"name": "base", "port": 80}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tenantPath, []byte(`{"port": 8080}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadAll(basePath, tenantPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.MergeSettings(map[string]interface{}{"debug": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tenant file is read again, the base file keeps what it had.
+	if err := ioutil.WriteFile(basePath, []byte(`{"name": "changed", "port": 81}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tenantPath, []byte(`{"port": 9090}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var changes []Change
+	settings.OnChange(func(c []Change) {
+		changes = c
+	})
+	if err := settings.ReloadSource(1); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.GetString("name", ""); name != "base" {
+		t.Errorf("name is %q, the base file should not have been read again", name)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 9090 {
+		t.Errorf("port is %d, expected 9090", port)
+	}
+	if debug, _ := settings.GetBool("debug", false); !debug {
+		t.Error("Merged settings should be kept")
+	}
+	if len(changes) != 1 || changes[0].Path != "port" {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+
+	// By path, the base file is read again, and the tenant file still wins.
+	if err := settings.ReloadPath(basePath); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.GetString("name", ""); name != "changed" {
+		t.Errorf("name is %q, expected changed", name)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 9090 {
+		t.Errorf("port is %d, expected 9090", port)
+	}
+
+	// A failing reload changes nothing.
+	if err := ioutil.WriteFile(tenantPath, []byte(`{"port": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ReloadPath(tenantPath); err == nil {
+		t.Error("Reloading broken JSON should fail")
+	}
+	if port, _ := settings.GetInt("port", 0); port != 9090 {
+		t.Errorf("port is %d after a failed reload, expected 9090", port)
+	}
+
+	if err := settings.ReloadSource(5); err == nil {
+		t.Error("Reloading a source that doesn't exist should fail")
+	}
+	if err := settings.ReloadPath(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Reloading a path that wasn't loaded should fail")
+	}
+}
+
+func TestReadWhileLoading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"a.json": `{"dir": true}`, "b.json": `{`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := NewSettings()
+	settings.SetMergeReports(true)
+	if err := settings.LoadJSON([]byte(`{"name": "a", "port": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var err error
+			switch n % 20 {
+			case 9:
+				if err = settings.LoadDirectory(dir, ContinueOnError); err != nil {
+					var failed *LoadErrors
+					if !errors.As(err, &failed) {
+						t.Error(err)
+						return
+					}
+					err = nil
+				}
+			case 19:
+				err = settings.Reload()
+			default:
+				err = settings.LoadJSON([]byte(fmt.Sprintf(`{"port": %d}`, n)))
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	readers := []func(){
+		func() { settings.GetString("name", "") },
+		func() { settings.GetInt("port", 0) },
+		func() { settings.LastWarnings() },
+		func() { settings.LastMergeReport() },
+		func() { settings.SkippedFiles() },
+	}
+	var reading sync.WaitGroup
+	for _, read := range readers {
+		reading.Add(1)
+		go func(read func()) {
+			defer reading.Done()
+			for n := 0; n < 200; n++ {
+				read()
+			}
+		}(read)
+	}
+	reading.Wait()
+	close(stop)
+	wg.Wait()
+}
+
+func TestDefaultSettings(t *testing.T) {
+	defer SetDefaultSettings(nil)
+
+	if _, err := GetString("name", "none"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Getting from empty default settings should fail with ErrNotFound, got %v", err)
+	}
+
+	SetDefaultSettings(&Settings{})
+	if err := LoadJSON([]byte(`{"name": "a", "port": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var err error
+			if n%20 == 19 {
+				err = DefaultSettings().Reload()
+			} else {
+				err = MergeSettings(map[string]interface{}{"port": n})
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	readers := []func(){
+		func() { GetString("name", "") },
+		func() { GetInt("port", 0) },
+		func() { RawGet("") },
+		func() { DefaultSettings().GetJSON() },
+	}
+	var reading sync.WaitGroup
+	for _, read := range readers {
+		reading.Add(1)
+		go func(read func()) {
+			defer reading.Done()
+			for n := 0; n < 200; n++ {
+				read()
+			}
+		}(read)
+	}
+	reading.Wait()
+	close(stop)
+	wg.Wait()
+
+	if name, err := GetString("name", ""); err != nil || name != "a" {
+		t.Errorf("name is %q (%v), expected a", name, err)
+	}
+	SetDefaultSettings(nil)
+	if DefaultSettings().Has("name") {
+		t.Error("SetDefaultSettings(nil) should leave empty settings")
+	}
+}
+
+func TestSerializeWhileLoading(t *testing.T) {
+	settings := NewSettings()
+	settings.MarkSecret("db:password")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 0; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			document := fmt.Sprintf(`{"db": {"password": "p%d", "pool": {"size": %d}}, "key%d": [%d]}`, n, n, n%10, n)
+			if err := settings.LoadJSON([]byte(document)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	serializers := []func(){
+		func() { settings.GetJSON() },
+		func() { settings.GetPrettyJSON("", "  ") },
+		func() { settings.GetRedactedJSON() },
+		func() { settings.Fprint(ioutil.Discard, PrintOptions{}) },
+		func() { settings.GetJSONAt("db") },
+		func() { settings.GetJSONFiltered(nil, []string{"db:pool"}) },
+	}
+	var serializing sync.WaitGroup
+	for _, serialize := range serializers {
+		serializing.Add(1)
+		go func(serialize func()) {
+			defer serializing.Done()
+			for n := 0; n < 200; n++ {
+				serialize()
+			}
+		}(serialize)
+	}
+	serializing.Wait()
+	close(stop)
+	wg.Wait()
+
+	password, err := settings.GetString("db:password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(settings.GetRedactedJSON()), password) {
+		t.Error("The password should be redacted")
+	}
+}
+
+func TestValueHistory(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"rate_limit": 10, "db": {"host": "a", "port": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if history := settings.History("rate_limit"); len(history) != 0 {
+		t.Errorf("Nothing should be remembered before EnableHistory, got %+v", history)
+	}
+
+	settings.EnableHistory(2)
+	for _, limit := range []int{20, 30, 40} {
+		if err := settings.MergeSettings(map[string]interface{}{"rate_limit": limit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history := settings.History("rate_limit")
+	if len(history) != 2 {
+		t.Fatalf("Expected the last 2 revisions, got %+v", history)
+	}
+	if !sameValue(history[0].Old, 20) || !sameValue(history[1].Old, 30) {
+		t.Errorf("Unexpected revisions %+v", history)
+	}
+	if history[1].Source != "MergeSettings" || history[1].Time.IsZero() {
+		t.Errorf("Unexpected revision %+v", history[1])
+	}
+
+	if err := settings.RawSet(false, "db:port", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Delete("db"); err != nil {
+		t.Fatal(err)
+	}
+	history = settings.History("db:port")
+	if len(history) != 2 || history[0].Source != "RawSet" || !sameValue(history[0].Old, 1) ||
+		history[1].Source != "Delete" || !sameValue(history[1].Old, 2) {
+		t.Errorf("Unexpected revisions of db:port %+v", history)
+	}
+	if history := settings.History("db:host"); len(history) != 1 || history[0].Old != "a" {
+		t.Errorf("Removing a map should remember its leaves, got %+v", history)
+	}
+	if history := settings.History("db"); len(history) != 0 {
+		t.Errorf("Maps should be remembered leaf by leaf, got %+v", history)
+	}
+
+	// The oldest revisions are evicted past the overall maximum.
+	settings.SetMaxHistory(3)
+	if history := settings.History("rate_limit"); len(history) != 0 {
+		t.Errorf("The revisions of rate_limit should have been evicted, got %+v", history)
+	}
+	if history := settings.History("db:port"); len(history) != 2 {
+		t.Errorf("Expected 2 revisions of db:port, got %+v", history)
+	}
+
+	settings.EnableHistory(0)
+	if history := settings.History("db:port"); len(history) != 0 {
+		t.Errorf("Disabling the history should forget it, got %+v", history)
+	}
+}
+
+func TestValueHistoryReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"rate_limit": 10}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := NewSettings()
+	settings.EnableHistory(5)
+	if err := settings.LoadJSONFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"rate_limit": 5}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var changes []Change
+	settings.OnChange(func(c []Change) {
+		changes = c
+	})
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	history := settings.History("rate_limit")
+	if len(history) != 1 || history[0].Source != "Reload" || !sameValue(history[0].Old, 10) {
+		t.Errorf("Unexpected revisions %+v", history)
+	}
+	if len(changes) != 1 || !sameValue(changes[0].Old, 10) {
+		t.Errorf("OnChange should be given the previous value, got %+v", changes)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("APP_CONFIG_DIR", filepath.Join(home, "configs"))
+	if err := os.Mkdir(filepath.Join(home, "configs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "configs", "app.json"), []byte(`{"name": "app"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadFile("~/configs/../configs/app.json"); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.GetString("name", ""); name != "app" {
+		t.Errorf("name is %q, expected app", name)
+	}
+	if sources := settings.Sources(); sources[0].Name != filepath.Join(home, "configs", "app.json") {
+		t.Errorf("The source should be named by the expanded path, got %s", sources[0].Name)
+	}
+
+	// Environment variables are only expanded when asked to.
+	if err := settings.LoadJSONFile("$APP_CONFIG_DIR/app.json"); err == nil {
+		t.Error("$APP_CONFIG_DIR should not be expanded by default")
+	}
+	settings.SetExpandPathEnv(true)
+	if err := settings.LoadJSONFile("${APP_CONFIG_DIR}/app.json"); err != nil {
+		t.Error(err)
+	}
+	if err := settings.LoadDirectory("$APP_CONFIG_DIR"); err != nil {
+		t.Error(err)
+	}
+
+	// The allowed roots are checked against the expanded path.
+	settings.SetAllowedRoots(filepath.Join(home, "other"))
+	if err := settings.LoadFile("~/configs/app.json"); !errors.Is(err, ErrPathNotAllowed) {
+		t.Errorf("Expected ErrPathNotAllowed, got %v", err)
+	}
+	settings.SetAllowedRoots(home)
+	if err := settings.LoadFile("~/configs/app.json"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeduplicateLoads(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.json")
+	second := filepath.Join(dir, "copy.json")
+	other := filepath.Join(dir, "other.json")
+	for path, content := range map[string]string{
+		first:  `{"port": 80, "name": "a"}`,
+		second: `{"port": 80, "name": "a"}`,
+		other:  `{"debug": true}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := NewSettings()
+	settings.SetDeduplicateLoads(true)
+	if err := settings.LoadAll(first, other, second); err != nil {
+		t.Fatal(err)
+	}
+	sources := settings.Sources()
+	if len(sources) != 3 || sources[0].Duplicate || sources[1].Duplicate || !sources[2].Duplicate {
+		t.Fatalf("The copy should be a skipped duplicate, got %+v", sources)
+	}
+	if source, _ := settings.SourceOf("port"); source.Name != first {
+		t.Errorf("port should still come from %s, got %s", first, source.Name)
+	}
+	stats := settings.Stats()
+	if !stats[len(stats)-1].Duplicate || stats[len(stats)-1].Keys != 0 {
+		t.Errorf("The stats should report the duplicate, got %+v", stats[len(stats)-1])
+	}
+	if !strings.Contains(string(settings.SourcesJSON()), `"duplicate": true`) {
+		t.Errorf("SourcesJSON should report the duplicate:\n%s", settings.SourcesJSON())
+	}
+
+	// Once port changed, merging the copy again changes it back, so it isn't
+	// skipped.
+	if err := settings.RawSet(false, "port", 81); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSONFile(second); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 80 {
+		t.Errorf("port is %d, the copy should have been merged", port)
+	}
+	if sources := settings.Sources(); sources[len(sources)-1].Duplicate {
+		t.Error("The copy should have been merged after port changed")
+	}
+
+	// The same happens when a load changes one of its keys.
+	if err := settings.MergeSettings(map[string]interface{}{"name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSONFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := settings.GetString("name", ""); name != "a" {
+		t.Errorf("name is %q, the file should have been merged", name)
+	}
+
+	// Without deduplication everything is merged.
+	settings = NewSettings()
+	if err := settings.LoadAll(first, second); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range settings.Sources() {
+		if source.Duplicate {
+			t.Errorf("%s should have been merged", source.Name)
+		}
+	}
+}
+
+func TestLoadAllStaging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := write("base.json", `{"a": 1, "b": "x"}`)
+	first := write("first.json", `{"a": 2, "c": true}`)
+	changed := write("changed.json", `{"a": "two"}`)
+	broken := write("broken.json", `{"a": `)
+
+	settings := NewSettings()
+	if err := settings.LoadFile(base); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetTypeStability(true)
+	want := string(settings.GetJSON())
+	sources := len(settings.Sources())
+
+	// A file that can't be read, or can't be merged after another one was,
+	// leaves the settings as they were.
+	for _, paths := range [][]string{{first, broken}, {first, changed}} {
+		err := settings.LoadAll(paths...)
+		if err == nil || !strings.Contains(err.Error(), paths[1]) {
+			t.Errorf("LoadAll(%v) = %v, want an error naming %s", paths, err, paths[1])
+		}
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("LoadAll(%v) changed the settings to %s", paths, got)
+		}
+		if got := len(settings.Sources()); got != sources {
+			t.Errorf("LoadAll(%v) recorded %d sources, want %d", paths, got, sources)
+		}
+	}
+
+	if err := settings.LoadAll(first); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"a":2,"b":"x","c":true}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings are %s, want %s", got, want)
+	}
+
+	// Reload keeps the settings when a file no longer reads or no longer
+	// merges.
+	for _, content := range []string{`{"a": `, `{"a": "two"}`} {
+		write("first.json", content)
+		if err := settings.Reload(); err == nil {
+			t.Errorf("Reload with %s succeeded", content)
+		}
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("Reload with %s changed the settings to %s", content, got)
+		}
+	}
+	write("first.json", `{"a": 3}`)
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":3,"b":"x"}` {
+		t.Errorf("settings are %s after reloading", got)
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	settings := NewSettings()
+	err := settings.MergeSettings(map[string]interface{}{
+		"os":   map[string]interface{}{"$os": map[string]interface{}{runtime.GOOS: "this", "default": "other"}},
+		"arch": map[string]interface{}{"$arch": map[string]interface{}{runtime.GOARCH: "this", "default": "other"}},
+		"fallback": map[string]interface{}{"$os": map[string]interface{}{"plan10": "plan10", "default": map[string]interface{}{
+			"nested": map[string]interface{}{"$arch": map[string]interface{}{runtime.GOARCH: "this"}},
+		}}},
+		"dropped": map[string]interface{}{"$os": map[string]interface{}{"plan10": "plan10"}},
+		"list":    []interface{}{map[string]interface{}{"$os": map[string]interface{}{runtime.GOOS: 1}}, 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"arch":"this","fallback":{"nested":"this"},"list":[1,2],"os":"this"}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings are %s, want %s", got, want)
+	}
+
+	settings.SetStrictConditionals(true)
+	err = settings.MergeSettings(map[string]interface{}{"dropped": map[string]interface{}{"$os": map[string]interface{}{"plan10": "plan10"}}})
+	if err == nil || !strings.Contains(err.Error(), "no $os entry for "+runtime.GOOS) {
+		t.Errorf("a strict conditional without a match returned %v", err)
+	}
+
+	for conditional, message := range map[string]string{
+		`{"a": {"$os": {"default": 1}, "b": 2}}`: "Conditional section a must only contain $os",
+		`{"a": {"b": {"$arch": "x"}}}`:           "Conditional section a.b.$arch is not a map",
+	} {
+		dotted := NewSettings()
+		if err := dotted.SetPathSeparator("."); err != nil {
+			t.Fatal(err)
+		}
+		if err := dotted.LoadJSON([]byte(conditional)); err == nil || err.Error() != message {
+			t.Errorf("loading %s returned %v, want %q", conditional, err, message)
+		}
+	}
+}
+
+func TestLoadKVPairs(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadKVPairs([]string{
+		"db:host=example.com",
+		"db:port=5432",
+		"debug=true",
+		"tags=[\"a\", \"b\"]",
+		"quoted=\"42\"",
+		"empty=",
+		"raw:={\"a\": 1}",
+		"eq=a=b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"db":{"host":"example.com","port":5432},"debug":true,"empty":"","eq":"a=b","quoted":"42","raw":{"a":1},"tags":["a","b"]}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings are %s, want %s", got, want)
+	}
+
+	// A pair that can't be parsed or set leaves every pair unset.
+	for _, pairs := range [][]string{
+		{"a=1", "missing"},
+		{"a=1", "=1"},
+		{"a=1", "b:=not json"},
+		{"a=1", "b::c=1"},
+		{"a=1", "debug:x=1", "debug:y:=["},
+	} {
+		if err := settings.LoadKVPairs(pairs); err == nil {
+			t.Errorf("LoadKVPairs(%q) succeeded", pairs)
+		}
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("LoadKVPairs(%q) changed the settings to %s", pairs, got)
+		}
+	}
+
+	// With type stability the last pair fails after the first was set on the
+	// snapshot, and nothing is set either.
+	settings.SetTypeStability(true)
+	if err := settings.LoadKVPairs([]string{"db:host=other", "db:port=x"}); err == nil || !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("changing the type of db:port returned %v", err)
+	}
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("a failed pair changed the settings to %s", got)
+	}
+
+	// The separator marking JSON values is the path separator.
+	dotted := NewSettings()
+	if err := dotted.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := dotted.LoadKVPairs([]string{"a.b.=[1]", "host:port=localhost:80"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(dotted.GetJSON()); got != `{"a":{"b":[1]},"host:port":"localhost:80"}` {
+		t.Errorf("settings are %s", got)
+	}
+	if err := dotted.LoadKVPairs([]string{"c.=x"}); err == nil {
+		t.Errorf("c.=x should require JSON")
+	}
+
+	// Numbers are kept exactly with SetPreserveNumbers.
+	preserved := NewSettings()
+	preserved.SetPreserveNumbers(true)
+	if err := preserved.LoadKVPairs([]string{"id=9007199254740993", "ids:=[9007199254740995]"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := preserved.RawGet("id"); got != json.Number("9007199254740993") {
+		t.Errorf("id = %#v, want the json.Number", got)
+	}
+	if got := string(preserved.GetJSON()); got != `{"id":9007199254740993,"ids":[9007199254740995]}` {
+		t.Errorf("settings are %s", got)
+	}
+}
+
+func TestLoadURLValues(t *testing.T) {
+	values, err := url.ParseQuery("db.host=x&db.port=5432&db[my.host]=y&debug=true&tags=a&tags=b" +
+		"&ids[0]=1&ids[1]=2&names[]=solo&servers[0].name=s1&servers[1][name]=s2&quoted=%2242%22&empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := NewSettings()
+	if err := settings.LoadURLValues(values, "."); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"db":      map[string]interface{}{"host": "x", "port": 5432, "my.host": "y"},
+		"debug":   true,
+		"tags":    []interface{}{"a", "b"},
+		"ids":     []interface{}{1, 2},
+		"names":   []interface{}{"solo"},
+		"servers": []interface{}{map[string]interface{}{"name": "s1"}, map[string]interface{}{"name": "s2"}},
+		"quoted":  "42",
+		"empty":   "",
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(settings.GetJSON(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(expected)
+	gotJSON, _ := json.Marshal(got)
+	if string(want) != string(gotJSON) {
+		t.Errorf("Loaded\n%s\nexpected\n%s", gotJSON, want)
+	}
+
+	for _, query := range []string{
+		"a[0]=1&a[2]=3",
+		"a=1&a.b=2",
+		"a[0]=1&a.b=2",
+		"a[=1",
+		"[0]=1",
+		"a[]b=1",
+		"a..b=1",
+	} {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings := NewSettings()
+		if err := settings.LoadURLValues(values, "."); err == nil {
+			t.Errorf("Loading %s should fail", query)
+		}
+	}
+}
+
+func TestURLValuesRoundTrip(t *testing.T) {
+	for _, sep := range []string{".", ":", "__"} {
+		settings := NewSettings()
+		err := settings.LoadJSON([]byte(`{
+			"db": {"host": "x", "port": 5432, "with.dot": 1, "with:colon": 2, "with__underscores": 3},
+			"strings": ["1", "true", "null", "", "plain", "{\"a\": 1}"],
+			"single": [7],
+			"nested": [[1, 2], {"a": [true]}],
+			"empties": {"map": {}, "array": []},
+			"nothing": null,
+			"0": {"1": "numeric keys"}
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := settings.ToURLValues(sep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := NewSettings()
+		if err := loaded.LoadURLValues(values, sep); err != nil {
+			t.Fatalf("With %q: %s\n%s", sep, err, values.Encode())
+		}
+		if got, want := string(loaded.GetJSON()), string(settings.GetJSON()); got != want {
+			t.Errorf("With %q the round trip gave\n%s\nexpected\n%s\nthrough %s", sep, got, want, values.Encode())
+		}
+	}
+
+	settings := NewSettings()
+	if err := settings.MergeSettings(map[string]interface{}{"a[b]": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.ToURLValues("."); err == nil {
+		t.Error("Keys with brackets can't be written")
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"port": 8080, "name": "app"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var logged []string
+	settings.SetLogger(LoggerFunc(func(level LogLevel, format string, args ...interface{}) {
+		if level == LogWarning {
+			logged = append(logged, fmt.Sprintf(format, args...))
+		}
+	}))
+
+	// Nothing is reported outside of development mode.
+	settings.GetString("port", "")
+	if report := settings.MisuseReport(); len(report) != 0 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	settings.SetDevMode(true)
+	for i := 0; i < 3; i++ {
+		if value, err := settings.GetString("port", "default"); value != "default" || err == nil {
+			t.Errorf("GetString should still return its default and an error, got %q, %v", value, err)
+		}
+	}
+	settings.GetInt("missing", 0)
+	settings.GetString("name", "")
+	settings.GetStringAny("", "unset", "name")
+
+	report := settings.MisuseReport()
+	if len(report) != 2 {
+		t.Fatalf("Expected 2 misuses, got %+v", report)
+	}
+	if report[0].Path != "missing" || report[0].Getter != "GetInt" || !report[0].NotFound {
+		t.Errorf("Unexpected misuse %+v", report[0])
+	}
+	if report[1].Path != "port" || report[1].Getter != "GetString" || report[1].NotFound || report[1].Count != 3 {
+		t.Errorf("Unexpected misuse %+v", report[1])
+	}
+	if !strings.Contains(report[1].Caller, "flexiconfig_test.go:") {
+		t.Errorf("The caller should be this test, got %s", report[1].Caller)
+	}
+	if len(logged) != 2 || !strings.Contains(logged[0], `GetString("port")`) {
+		t.Errorf("Each misuse should be logged once, got %q", logged)
+	}
+
+	// Another call site is another misuse.
+	settings.GetString("port", "")
+	if report := settings.MisuseReport(); len(report) != 3 {
+		t.Errorf("Expected 3 misuses, got %+v", report)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"cache": {"dir": "/tmp/cache", "token": null}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := settings.GetOrSet("cache:dir", func() (interface{}, error) {
+		t.Error("compute should not be called for a path that is set")
+		return nil, nil
+	})
+	if err != nil || value != "/tmp/cache" {
+		t.Errorf("Got %v, %v", value, err)
+	}
+
+	// Concurrent callers compute once.
+	var computed int32
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			results[i], err = settings.GetOrSet("cache:size", func() (interface{}, error) {
+				atomic.AddInt32(&computed, 1)
+				time.Sleep(10 * time.Millisecond)
+				return 42, nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if computed != 1 {
+		t.Errorf("compute was called %d times", computed)
+	}
+	for _, result := range results {
+		if !sameValue(result, 42) {
+			t.Errorf("Got %v, expected 42", result)
+		}
+	}
+	if size, _ := settings.GetInt("cache:size", 0); size != 42 {
+		t.Errorf("cache:size is %d, expected 42", size)
+	}
+	if source, _ := settings.SourceOf("cache:size"); source.Name != "GetOrSet" {
+		t.Errorf("cache:size should come from GetOrSet, got %q", source.Name)
+	}
+
+	// Errors store nothing, and the next call computes again.
+	if _, err := settings.GetOrSet("cache:token", func() (interface{}, error) {
+		return nil, errors.New("no token")
+	}); err == nil || err.Error() != "no token" {
+		t.Errorf("Expected the error of compute, got %v", err)
+	}
+	if _, err := settings.RawGet("cache:token"); !errors.Is(err, ErrNullValue) {
+		t.Errorf("cache:token should still be null, got %v", err)
+	}
+	value, err = settings.GetOrSet("cache:token", func() (interface{}, error) {
+		return "secret", nil
+	})
+	if err != nil || value != "secret" {
+		t.Errorf("Got %v, %v", value, err)
+	}
+
+	// Values that can't be set are an error.
+	if _, err := settings.GetOrSet("cache:dir:sub", func() (interface{}, error) {
+		return 1, nil
+	}); err == nil {
+		t.Error("Setting below a string should fail")
+	}
+
+	// The empty path would hand out the settings themselves.
+	if value, err := settings.GetOrSet("", func() (interface{}, error) {
+		t.Error("compute should not be called for the empty path")
+		return nil, nil
+	}); !errors.Is(err, ErrInvalidPath) || value != nil {
+		t.Errorf("GetOrSet of the empty path returned %v, %v", value, err)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "shared", "port": 5432}, "name": "base", "cache": {"size": 10}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	view := settings.Overlay(map[string]interface{}{
+		"db":      map[string]interface{}{"host": "tenant"},
+		"cache":   "off",
+		"debug":   true,
+		"nothing": nil,
+	})
+	if host, err := view.GetString("db:host", ""); err != nil || host != "tenant" {
+		t.Errorf("GetString(db:host) = %q, %v", host, err)
+	}
+	if port, err := view.GetInt("db:port", 0); err != nil || port != 5432 {
+		t.Errorf("GetInt(db:port) = %d, %v", port, err)
+	}
+	if debug, err := view.GetBool("debug", false); err != nil || !debug {
+		t.Errorf("GetBool(debug) = %v, %v", debug, err)
+	}
+	if _, err := view.GetInt("cache:size", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetInt(cache:size) = %v, want the base hidden by the override", err)
+	}
+	if _, err := view.GetString("nothing", ""); !errors.Is(err, ErrNullValue) {
+		t.Errorf("GetString(nothing) = %v, want ErrNullValue", err)
+	}
+	if view.Has("nothing") || !view.Has("name") {
+		t.Errorf("Has(nothing), Has(name) = %v, %v", view.Has("nothing"), view.Has("name"))
+	}
+
+	sub := view.Sub("db")
+	if host, err := sub.GetString("host", ""); err != nil || host != "tenant" {
+		t.Errorf("Sub(db).GetString(host) = %q, %v", host, err)
+	}
+	if keys, err := sub.Keys(""); err != nil || !reflect.DeepEqual(keys, []string{"host", "port"}) {
+		t.Errorf("Sub(db).Keys() = %v, %v", keys, err)
+	}
+	var db struct {
+		Host string
+		Port int
+	}
+	if err := view.Get("db", &db); err != nil || db.Host != "tenant" || db.Port != 5432 {
+		t.Errorf("Get(db) = %+v, %v", db, err)
+	}
+
+	want := `{"cache":"off","db":{"host":"tenant","port":5432},"debug":true,"name":"base","nothing":null}`
+	if got := string(view.GetJSON()); got != want {
+		t.Errorf("GetJSON() = %s, want %s", got, want)
+	}
+	if got := string(sub.GetJSON()); got != `{"host":"tenant","port":5432}` {
+		t.Errorf("Sub(db).GetJSON() = %s", got)
+	}
+	if host, _ := settings.GetString("db:host", ""); host != "shared" {
+		t.Errorf("the base db:host = %q, want it unchanged", host)
+	}
+
+	// The view reads the base when asked, so it sees later changes.
+	if err := settings.RawSet(false, "db:port", 6543); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := view.GetInt("db:port", 0); err != nil || port != 6543 {
+		t.Errorf("GetInt(db:port) after changing the base = %d, %v", port, err)
+	}
+
+	bad := settings.Overlay(map[string]interface{}{"a": map[float64]interface{}{1.5: "x"}})
+	if _, err := bad.GetString("name", ""); err == nil {
+		t.Error("GetString() on a view with invalid overrides succeeded")
+	}
+	if got := string(bad.GetJSON()); got != "null" {
+		t.Errorf("GetJSON() on a view with invalid overrides = %s", got)
+	}
+}
+
+// remoteOverlay is a fetch function for AddRemoteOverlay that returns what
+// the test sends it, one fetch at a time.
+type remoteOverlay struct {
+	calls     chan struct{}
+	responses chan remoteResponse
+}
+
+type remoteResponse struct {
+	settings map[string]interface{}
+	err      error
+}
+
+func newRemoteOverlay() *remoteOverlay {
+	return &remoteOverlay{
+		calls:     make(chan struct{}),
+		responses: make(chan remoteResponse),
+	}
+}
+
+func (this *remoteOverlay) fetch(ctx context.Context) (map[string]interface{}, error) {
+	select {
+	case this.calls <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case response := <-this.responses:
+		return response.settings, response.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// send has the next fetch return settings and err, and waits until they were
+// applied.
+func (this *remoteOverlay) send(settings map[string]interface{}, err error) {
+	this.responses <- remoteResponse{settings, err}
+	<-this.calls
+}
+
+func TestRemoteOverlay(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": 1, "b": {"c": 2, "d": 3}}`)); err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	settings.OnOverlayError(func(err error) {
+		errs = append(errs, err)
+	})
+
+	remote := newRemoteOverlay()
+	settings.AddRemoteOverlay(remote.fetch, time.Millisecond)
+	<-remote.calls
+	defer settings.StopOverlays()
+
+	check := func(step string, want string) {
+		t.Helper()
+		if got := string(settings.GetJSON()); got != want {
+			t.Errorf("%s: settings are %s, want %s", step, got, want)
+		}
+	}
+	source := func(path string) string {
+		source, _ := settings.SourceOf(path)
+		return source.Name
+	}
+
+	// Added and updated keys are set on top of the loaded ones.
+	remote.send(map[string]interface{}{"a": 10, "b": map[string]interface{}{"e": 4}}, nil)
+	check("add", `{"a":10,"b":{"c":2,"d":3,"e":4}}`)
+	if got := source("a"); got != "RemoteOverlay 1" {
+		t.Errorf("a came from %q", got)
+	}
+
+	remote.send(map[string]interface{}{"a": 11, "b": map[string]interface{}{"e": 4}}, nil)
+	check("update", `{"a":11,"b":{"c":2,"d":3,"e":4}}`)
+
+	// A load after the overlay doesn't hide it, and removing a key gives back
+	// what was loaded last rather than what the overlay replaced.
+	if err := settings.LoadJSON([]byte(`{"a": 5, "b": {"c": 6}}`)); err != nil {
+		t.Fatal(err)
+	}
+	check("load", `{"a":11,"b":{"c":6,"d":3,"e":4}}`)
+
+	remote.send(map[string]interface{}{"b": map[string]interface{}{"e": 4}}, nil)
+	check("remove", `{"a":5,"b":{"c":6,"d":3,"e":4}}`)
+	if got := source("a"); got != "LoadJSON" {
+		t.Errorf("a came from %q after the overlay removed it", got)
+	}
+
+	// A key set with RawSet since isn't restored over.
+	if err := settings.RawSet(false, "b:e", 7); err != nil {
+		t.Fatal(err)
+	}
+	remote.send(map[string]interface{}{}, nil)
+	check("raw set", `{"a":5,"b":{"c":6,"d":3,"e":7}}`)
+
+	// A failed fetch keeps the last good overlay.
+	remote.send(map[string]interface{}{"a": 12}, nil)
+	remote.send(nil, errors.New("fetch failed"))
+	check("fetch error", `{"a":12,"b":{"c":6,"d":3,"e":7}}`)
+	if len(errs) != 1 || errs[0].Error() != "fetch failed" {
+		t.Errorf("the error handler got %v", errs)
+	}
+
+	// An overlay that can't be applied in full changes nothing.
+	remote.send(map[string]interface{}{"a": 13, "b": map[string]interface{}{"": 1, "c": 8}}, nil)
+	check("apply error", `{"a":12,"b":{"c":6,"d":3,"e":7}}`)
+	if len(errs) != 2 {
+		t.Errorf("the error handler got %v", errs)
+	}
+
+	// Reload applies the overlay again.
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("reload", `{"a":12,"b":{"c":6,"d":3}}`)
+
+	// Stopping keeps the values applied.
+	settings.StopOverlays()
+	select {
+	case remote.responses <- remoteResponse{map[string]interface{}{"a": 14}, nil}:
+		t.Errorf("an overlay was fetched after StopOverlays")
+	case <-time.After(10 * time.Millisecond):
+	}
+	check("stop", `{"a":12,"b":{"c":6,"d":3}}`)
+}
+
+func TestOverlayDelay(t *testing.T) {
+	cases := []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 1, 2 * time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{time.Second, 100, maxOverlayBackoff},
+		{10 * time.Minute, 0, 10 * time.Minute},
+		{10 * time.Minute, 3, 10 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := overlayDelay(c.interval, c.failures); got != c.want {
+			t.Errorf("overlayDelay(%s, %d) = %s, want %s", c.interval, c.failures, got, c.want)
+		}
+	}
+}
+
+func BenchmarkOverlay(b *testing.B) {
+	for _, size := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("base=%d", size), func(b *testing.B) {
+			base := make(map[string]interface{}, size)
+			for i := 0; i < size; i++ {
+				base[fmt.Sprintf("key%d", i)] = map[string]interface{}{"value": i}
+			}
+			settings := NewSettings()
+			if err := settings.MergeSettings(base); err != nil {
+				b.Fatal(err)
+			}
+			overrides := map[string]interface{}{"key0": map[string]interface{}{"value": "tenant"}}
+
+			// Allocations per view depend on the size of the overrides, not
+			// on the size of the base.
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				view := settings.Overlay(overrides)
+				if _, err := view.GetString("key0:value", ""); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := view.GetInt("key1:value", 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultsLayer(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.SetDefaults(map[string]interface{}{
+		"db":  map[string]interface{}{"port": 5432, "host": "localhost"},
+		"log": map[string]interface{}{"level": "info"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "db"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := settings.GetDefaultsJSON()
+	if err != nil || string(exported) != `{"db":{"host":"localhost","port":5432},"log":{"level":"info"}}` {
+		t.Errorf("GetDefaultsJSON() = %s, %v", exported, err)
+	}
+	want := "db:host   = \"db\"\ndb:port   = 5432 (default)\nlog:level = \"info\" (default)\n"
+	if got := FormatList(settings.List(ListOptions{IncludeDefaults: true}), true); got != want {
+		t.Errorf("FormatList(List) =\n%s\nwant\n%s", got, want)
+	}
+
+	settings.ClearDefaults()
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db"}}` {
+		t.Errorf("GetJSON() after ClearDefaults = %s", got)
+	}
+	if b, err := settings.GetDefaultsJSON(); err != nil || string(b) != "{}" {
+		t.Errorf("GetDefaultsJSON() after ClearDefaults = %s, %v", b, err)
+	}
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db"}}` {
+		t.Errorf("GetJSON() after Reload = %s, want the defaults to stay cleared", got)
+	}
+
+	if err := settings.LoadDefaultsJSON(exported); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db","port":5432},"log":{"level":"info"}}` {
+		t.Errorf("GetJSON() after LoadDefaultsJSON = %s", got)
+	}
+	if source, ok := settings.SourceOf("db:port"); !ok || source.Name != "LoadDefaultsJSON" || !source.Default {
+		t.Errorf("SourceOf(db:port) = %+v, %v", source, ok)
+	}
+
+	// Loading defaults replaces them all.
+	if err := settings.LoadDefaultsJSON([]byte(`{"log": {"level": "warn"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db"},"log":{"level":"warn"}}` {
+		t.Errorf("GetJSON() after replacing the defaults = %s", got)
+	}
+	if err := settings.LoadDefaultsJSON([]byte(`{"log": `)); err == nil {
+		t.Error("LoadDefaultsJSON() with invalid json succeeded")
+	}
+	if b, _ := settings.GetDefaultsJSON(); string(b) != `{"log":{"level":"warn"}}` {
+		t.Errorf("GetDefaultsJSON() after a failed load = %s", b)
+	}
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"limit": 10}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := settings.MergeSettings(map[string]interface{}{"a": []interface{}{1.0, math.Inf(-1)}}); err == nil || !strings.Contains(err.Error(), "a[1] is -Inf") {
+		t.Errorf("MergeSettings(-Inf) = %v", err)
+	}
+	if err := settings.RawSet(false, "ratio", float32(math.NaN())); err == nil || !strings.Contains(err.Error(), "ratio is NaN") {
+		t.Errorf("RawSet(NaN) = %v", err)
+	}
+	if err := settings.Append("list", 1, math.Inf(1)); err == nil {
+		t.Error("Append(+Inf) succeeded")
+	}
+	if got := string(settings.GetJSON()); got != `{"limit":10}` {
+		t.Errorf("GetJSON() = %s, want the settings unchanged", got)
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "key"), []byte("KEY\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLEXICONFIG_TEST_ROOT", "/srv")
+
+	settings := NewSettings()
+	if err := settings.MergeSettings(map[string]interface{}{
+		"db":     map[string]interface{}{"host": "db.local", "key": "@file:" + filepath.Join(dir, "key")},
+		"url":    "@ref:db:host",
+		"root":   "$FLEXICONFIG_TEST_ROOT/app",
+		"token":  "vault:token",
+		"broken": "vault:missing",
+		"loop":   map[string]interface{}{"a": "@ref:loop:b", "b": "@ref:loop:a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	vault := NewResolver("vault", func(path string, raw interface{}) (interface{}, bool, error) {
+		s, ok := raw.(string)
+		if !ok || !strings.HasPrefix(s, "vault:") {
+			return raw, false, nil
+		}
+		if s != "vault:token" {
+			return nil, true, fmt.Errorf("no secret at %s", s)
+		}
+		return "s3cret", true, nil
+	})
+	settings.AddResolver(EnvResolver)
+	settings.AddResolver(ReferenceResolver)
+	settings.EnableFileRefs(true)
+	settings.AddResolver(vault)
+
+	check := func(path, want string) {
+		t.Helper()
+		if got, err := settings.GetString(path, ""); err != nil || got != want {
+			t.Errorf("GetString(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	check("url", "db.local")
+	check("root", "/srv/app")
+	check("db:key", "KEY")
+	check("token", "s3cret")
+	if raw, err := settings.RawGet("token"); err != nil || raw != "vault:token" {
+		t.Errorf("RawGet(token) = %v, %v, want the stored value", raw, err)
+	}
+	var db map[string]string
+	if err := settings.Get("db", &db); err != nil || db["key"] != "KEY" {
+		t.Errorf("Get(db) = %v, %v", db, err)
+	}
+
+	var resolveErr *ResolveError
+	_, err := settings.GetString("broken", "")
+	if !errors.As(err, &resolveErr) || resolveErr.Resolver != "vault" || resolveErr.Path != "broken" {
+		t.Errorf("GetString(broken) = %v, want a ResolveError of the vault resolver", err)
+	}
+	if _, err := settings.GetString("loop:a", ""); err == nil || !strings.Contains(err.Error(), "refers to itself (loop:a -> loop:b -> loop:a)") {
+		t.Errorf("GetString(loop:a) = %v", err)
+	}
+
+	// The value resolved from a reference changes along with its target.
+	if err := settings.RawSet(false, "db:host", "db2.local"); err != nil {
+		t.Fatal(err)
+	}
+	check("url", "db2.local")
+
+	// Resolvers run in order, the first to resolve a value wins.
+	settings.SetResolvers(NewResolver("literal", func(path string, raw interface{}) (interface{}, bool, error) {
+		return raw, path == "root", nil
+	}), EnvResolver)
+	check("root", "$FLEXICONFIG_TEST_ROOT/app")
+	check("db:key", "@file:"+filepath.Join(dir, "key"))
+
+	settings.EnableFileRefs(true)
+	settings.EnableFileRefs(true)
+	var names []string
+	for _, r := range settings.Resolvers() {
+		names = append(names, resolverName(r))
+	}
+	if !reflect.DeepEqual(names, []string{"literal", "env", "file"}) {
+		t.Errorf("Resolvers() = %v", names)
+	}
+	check("db:key", "KEY")
+}
+
+func TestMalformedPaths(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": {"b": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{":", ":a", "a:", "a::b", "::", "a:b:", ":a:b"} {
+		checkInvalid := func(name string, err error) {
+			t.Helper()
+			if !errors.Is(err, ErrInvalidPath) || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), fmt.Sprintf("%q", path)) {
+				t.Errorf("%s(%q) = %v, want ErrInvalidPath naming the path", name, path, err)
+			}
+		}
+
+		_, err := settings.RawGet(path)
+		checkInvalid("RawGet", err)
+		_, err = settings.GetInt(path, 0)
+		checkInvalid("GetInt", err)
+		_, err = settings.Keys(path)
+		checkInvalid("Keys", err)
+		_, err = settings.Sub(path).RawGet("")
+		checkInvalid("Sub().RawGet", err)
+		checkInvalid("RawSet", settings.RawSet(false, path, 1))
+		checkInvalid("Delete", settings.Delete(path))
+		checkInvalid("Append", settings.Append(path, 1))
+		if settings.Has(path) {
+			t.Errorf("Has(%q) = true", path)
+		}
+	}
+
+	// The empty path is the root, but can't be set or deleted.
+	if root, err := settings.RawGet(""); err != nil || !reflect.DeepEqual(root, map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}) {
+		t.Errorf("RawGet(\"\") = %v, %v", root, err)
+	}
+	if keys, err := settings.Keys(""); err != nil || !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("Keys(\"\") = %v, %v", keys, err)
+	}
+	if !settings.Has("") {
+		t.Error("Has(\"\") = false")
+	}
+	if b, err := settings.Sub("").GetInt("a:b", 0); err != nil || b != 1 {
+		t.Errorf("Sub(\"\").GetInt(a:b) = %d, %v", b, err)
+	}
+	for name, err := range map[string]error{
+		"RawSet": settings.RawSet(false, "", 1),
+		"Delete": settings.Delete(""),
+		"Append": settings.Append("", 1),
+	} {
+		if !errors.Is(err, ErrInvalidPath) || err.Error() != "Invalid path: the path is empty" {
+			t.Errorf("%s(\"\") = %v, want ErrInvalidPath", name, err)
+		}
+	}
+	if got := string(settings.GetJSON()); got != `{"a":{"b":1}}` {
+		t.Errorf("GetJSON() = %s, want the settings unchanged", got)
+	}
+}
+
+func TestZeroValueSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "a.json")
+	csvFile := filepath.Join(dir, "c.csv")
+	files := map[string]string{
+		jsonFile: `{"json": 1}`,
+		csvFile:  "name\nx\n",
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dirmap"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call gets a fresh zero value, which is empty but must not panic.
+	calls := map[string]func(s *Settings) error{
+		"SetResolveCacheTTL":        func(s *Settings) error { s.SetResolveCacheTTL(time.Second); return nil },
+		"InvalidateCache":           func(s *Settings) error { s.InvalidateCache("a"); return nil },
+		"SetStrictConditionals":     func(s *Settings) error { s.SetStrictConditionals(true); return nil },
+		"LoadCSVFile":               func(s *Settings) error { return s.LoadCSVFile(csvFile, "rows") },
+		"SetDefault":                func(s *Settings) error { return s.SetDefault("a", 1) },
+		"SetDefaults":               func(s *Settings) error { return s.SetDefaults(map[string]interface{}{"a": 1}) },
+		"Overrides":                 func(s *Settings) error { s.Overrides(); return nil },
+		"PrintOverrides":            func(s *Settings) error { s.PrintOverrides(); return nil },
+		"LoadDirAsMap":              func(s *Settings) error { return s.LoadDirAsMap(filepath.Join(dir, "dirmap"), "files") },
+		"LoadEnv":                   func(s *Settings) error { return s.LoadEnv("FLEXICONFIG_ZERO_") },
+		"ToEnv":                     func(s *Settings) error { _, err := s.ToEnv("", "X_"); return err },
+		"SetProcessEnv":             func(s *Settings) error { return s.SetProcessEnv("", "FLEXICONFIG_ZERO_") },
+		"SetFallbackOnTypeMismatch": func(s *Settings) error { s.SetFallbackOnTypeMismatch(true); return nil },
+		"GetStringAny":              func(s *Settings) error { _, err := s.GetStringAny("", "a"); return err },
+		"GetBoolAny":                func(s *Settings) error { _, err := s.GetBoolAny(false, "a"); return err },
+		"GetIntAny":                 func(s *Settings) error { _, err := s.GetIntAny(0, "a"); return err },
+		"GetFloatAny":               func(s *Settings) error { _, err := s.GetFloatAny(0, "a"); return err },
+		"GetDurationAny":            func(s *Settings) error { _, err := s.GetDurationAny(0, "a"); return err },
+		"EnableFileRefs":            func(s *Settings) error { s.EnableFileRefs(true); return nil },
+		"SetFileRefRoots":           func(s *Settings) error { s.SetFileRefRoots(dir); return nil },
+		"Print":                     func(s *Settings) error { s.Print(); return nil },
+		"String":                    func(s *Settings) error { _ = s.String(); return nil },
+		"GetPrettyJSON":             func(s *Settings) error { s.GetPrettyJSON("", " "); return nil },
+		"GetJSON":                   func(s *Settings) error { s.GetJSON(); return nil },
+		"GetJSONWithOptions": func(s *Settings) error {
+			_, err := s.GetJSONWithOptions(JSONMaterializeComputed)
+			return err
+		},
+		"RegisterComputed": func(s *Settings) error {
+			s.RegisterComputed("a", func(s Settings) (interface{}, error) { return 1, nil })
+			return nil
+		},
+		"LoadJSON":      func(s *Settings) error { return s.LoadJSON([]byte(`{"a": 1}`)) },
+		"LoadJSONFile":  func(s *Settings) error { return s.LoadJSONFile(jsonFile) },
+		"LoadFile":      func(s *Settings) error { return s.LoadFile(jsonFile) },
+		"LoadFileAs":    func(s *Settings) error { return s.LoadFileAs(jsonFile, "json") },
+		"MergeSettings": func(s *Settings) error { return s.MergeSettings(map[string]interface{}{"a": 1}) },
+		"RawGet":        func(s *Settings) error { _, err := s.RawGet("a"); return err },
+		"RawSet":        func(s *Settings) error { return s.RawSet(false, "a:b", 1) },
+		"RawSetMode":    func(s *Settings) error { _, err := s.RawSetMode(SetCreate, "a:b", 1); return err },
+		"Delete":        func(s *Settings) error { return s.Delete("a") },
+		"Append":        func(s *Settings) error { return s.Append("a", 1) },
+		"Get":           func(s *Settings) error { var v interface{}; return s.Get("a", &v) },
+		"GetBool":       func(s *Settings) error { _, err := s.GetBool("a", false); return err },
+		"GetString":     func(s *Settings) error { _, err := s.GetString("a", ""); return err },
+		"GetInt":        func(s *Settings) error { _, err := s.GetInt("a", 0); return err },
+		"GetUint":       func(s *Settings) error { _, err := s.GetUint("a", 0); return err },
+		"GetFloat":      func(s *Settings) error { _, err := s.GetFloat("a", 0); return err },
+		"GetDuration":   func(s *Settings) error { _, err := s.GetDuration("a", 0); return err },
+		"GetAbsPath":    func(s *Settings) error { _, err := s.GetAbsPath("a", ""); return err },
+		"GetRegexp":     func(s *Settings) error { _, err := s.GetRegexp("a", nil); return err },
+		"PreviewFile":   func(s *Settings) error { _, err := s.PreviewFile(jsonFile); return err },
+		"Apply": func(s *Settings) error {
+			preview, err := s.PreviewJSON([]byte(`{"a": 1}`))
+			if err != nil {
+				return err
+			}
+			return s.Apply(preview)
+		},
+		"GetByPointer": func(s *Settings) error { _, err := s.GetByPointer("/a/0"); return err },
+		"ApplyJSONPatch": func(s *Settings) error {
+			return s.ApplyJSONPatch([]byte(`[{"op": "add", "path": "/a", "value": 1}]`))
+		},
+		"LastMergeReport":    func(s *Settings) error { s.LastMergeReport(); return nil },
+		"SetMergeReports":    func(s *Settings) error { s.SetMergeReports(true); return nil },
+		"SetOverrideWarning": func(s *Settings) error { s.SetOverrideWarning(1); return nil },
+		"SetLuaGoStackTrace": func(s *Settings) error { s.SetLuaGoStackTrace(true); return nil },
+		"SetAllowedRoots":    func(s *Settings) error { s.SetAllowedRoots(dir); return nil },
+		"SetOrderedKeys":     func(s *Settings) error { s.SetOrderedKeys(true); return nil },
+		"GetStringExpanded": func(s *Settings) error {
+			_, err := s.GetStringExpanded("a", "", ExpandErrorOnUnset)
+			return err
+		},
+		"BindSection": func(s *Settings) error {
+			return s.BindSection("a", &struct{ A int }{}, BindOptional())
+		},
+		"ProcessIncludes":    func(s *Settings) error { return s.ProcessIncludes("include", dir) },
+		"SetWeaklyTyped":     func(s *Settings) error { s.SetWeaklyTyped(true); return nil },
+		"SetTypeStability":   func(s *Settings) error { s.SetTypeStability(true); return nil },
+		"LoadKVPairs":        func(s *Settings) error { return s.LoadKVPairs([]string{"a=1"}) },
+		"LoadAll":            func(s *Settings) error { return s.LoadAll(jsonFile) },
+		"Reload":             func(s *Settings) error { return s.Reload() },
+		"SetLogger":          func(s *Settings) error { s.SetLogger(nil); return nil },
+		"SetLogValues":       func(s *Settings) error { s.SetLogValues(true); return nil },
+		"SetLuaOutput":       func(s *Settings) error { s.SetLuaOutput(ioutil.Discard); return nil },
+		"SetPreserveNumbers": func(s *Settings) error { s.SetPreserveNumbers(true); return nil },
+		"OnOverlayError":     func(s *Settings) error { s.OnOverlayError(func(error) {}); return nil },
+		"StopOverlays":       func(s *Settings) error { s.StopOverlays(); return nil },
+		"Sources":            func(s *Settings) error { s.Sources(); return nil },
+		"SourceOf":           func(s *Settings) error { s.SourceOf("a"); return nil },
+		"SourcesJSON":        func(s *Settings) error { s.SourcesJSON(); return nil },
+		"MarkSecret":         func(s *Settings) error { s.MarkSecret("a"); return nil },
+		"GetRedactedJSON":    func(s *Settings) error { s.GetRedactedJSON(); return nil },
+		"SetPathSeparator":   func(s *Settings) error { return s.SetPathSeparator(".") },
+		"Stats":              func(s *Settings) error { s.Stats(); return nil },
+		"ResetStats":         func(s *Settings) error { s.ResetStats(); return nil },
+		"SetMetricsHook":     func(s *Settings) error { s.SetMetricsHook(func(LoadStat) {}); return nil },
+		"SetStrictJSON":      func(s *Settings) error { s.SetStrictJSON(true); return nil },
+		"SetMaxDepth":        func(s *Settings) error { s.SetMaxDepth(10); return nil },
+		"ValidateAgainstStruct": func(s *Settings) error {
+			return s.ValidateAgainstStruct(&struct{ A int }{})
+		},
+		"SubWriter":  func(s *Settings) error { return s.SubWriter("w").Set("a", 1) },
+		"SetMaxSize": func(s *Settings) error { s.SetMaxSize(1 << 20); return nil },
+		"GetJSONAt":  func(s *Settings) error { _, err := s.GetJSONAt("a"); return err },
+		"GetJSONFiltered": func(s *Settings) error {
+			_, err := s.GetJSONFiltered([]string{"a"}, []string{"a:b"})
+			return err
+		},
+		"GobEncode": func(s *Settings) error {
+			b, err := s.GobEncode()
+			if err == nil {
+				err = s.GobDecode(b)
+			}
+			return err
+		},
+		"AddRemoteOverlay": func(s *Settings) error {
+			s.AddRemoteOverlay(func(ctx context.Context) (map[string]interface{}, error) {
+				return map[string]interface{}{"a": 1}, nil
+			}, time.Hour)
+			s.StopOverlays()
+			return nil
+		},
+		"Check": func(s *Settings) error {
+			return s.Check(CheckOptions{Struct: &struct{ A int }{}, ReportUnused: true}).Err()
+		},
+		"ResolveExtends": func(s *Settings) error { return s.ResolveExtends("", "") },
+		"SkippedFiles":   func(s *Settings) error { s.SkippedFiles(); return nil },
+		"RequireOneOf": func(s *Settings) error {
+			s.RequireOneOf("a", "b")
+			s.RequireTogether("c", "d")
+			if err := s.RawSet(false, "a", 1); err != nil {
+				return err
+			}
+			return s.Validate()
+		},
+		"LuaModules": func(s *Settings) error {
+			s.RemoveLuaLoader("m")
+			s.LuaModules()
+			return nil
+		},
+		"SetEmptyIsMissing": func(s *Settings) error {
+			s.SetEmptyIsMissing(true)
+			_, err := s.GetString("a", "")
+			return err
+		},
+		"Migrate": func(s *Settings) error {
+			s.RegisterMigration(0, func(m map[string]interface{}) error { return nil })
+			s.SetMigrationHook(func(from, to int) {})
+			return s.Migrate()
+		},
+		"SetSharedLuaState": func(s *Settings) error { s.SetSharedLuaState(true); return nil },
+		"GetFileContents": func(s *Settings) error {
+			_, err := s.GetFileContentsString("a", "")
+			return err
+		},
+		"AddValidator": func(s *Settings) error {
+			s.AddValidator("a", func(path string, value interface{}) error { return nil })
+			return s.RawSet(false, "a", 1)
+		},
+		"List": func(s *Settings) error {
+			FormatList(s.List(ListOptions{IncludeDefaults: true}), true)
+			return nil
+		},
+		"OnReload": func(s *Settings) error {
+			s.OnReload(func(error) {})
+			s.OnChange(func([]Change) {})
+			return s.Reload()
+		},
+		"LoadJSONAt": func(s *Settings) error {
+			return s.LoadJSONAt("a", []byte(`[1]`))
+		},
+		"AddPostLoadHook": func(s *Settings) error {
+			s.RemovePostLoadHook(s.AddPostLoadHook(func(*Settings) error { return nil }))
+			return s.LoadJSON([]byte(`{}`))
+		},
+		"GetKeyed": func(s *Settings) error {
+			_, err := s.GetKeyed("a", "name")
+			return err
+		},
+		"ReloadSource": func(s *Settings) error {
+			if err := s.ReloadSource(0); err == nil {
+				return errors.New("Reloading a source of empty settings should fail")
+			}
+			return nil
+		},
+		"History": func(s *Settings) error {
+			if history := s.History("a"); len(history) != 0 {
+				return fmt.Errorf("Unexpected history %+v", history)
+			}
+			return nil
+		},
+		"ToURLValues": func(s *Settings) error {
+			_, err := s.ToURLValues("")
+			return err
+		},
+		"MisuseReport": func(s *Settings) error {
+			if report := s.MisuseReport(); len(report) != 0 {
+				return fmt.Errorf("Unexpected report %+v", report)
+			}
+			return nil
+		},
+		"GetOrSet": func(s *Settings) error {
+			_, err := s.GetOrSet("a", func() (interface{}, error) {
+				return 1, nil
+			})
+			return err
+		},
+		"Overlay": func(s *Settings) error {
+			_, err := s.Overlay(map[string]interface{}{"a": 1}).GetInt("a", 0)
+			return err
+		},
+		"GetDefaultsJSON": func(s *Settings) error {
+			_, err := s.GetDefaultsJSON()
+			return err
+		},
+		"LoadDefaultsJSON": func(s *Settings) error { return s.LoadDefaultsJSON([]byte(`{"a": 1}`)) },
+		"ClearDefaults": func(s *Settings) error {
+			s.ClearDefaults()
+			return nil
+		},
+		"AddResolver": func(s *Settings) error {
+			s.AddResolver(ReferenceResolver)
+			_, err := s.GetString("a", "")
+			return err
+		},
+		"Keys": func(s *Settings) error {
+			if s.Has("a") || !s.ReadOnly().Has("") {
+				return fmt.Errorf("Has is wrong")
+			}
+			_, err := s.Sub("a").Keys("")
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			var s Settings
+			if err := call(&s); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s on a zero value: %v", name, err)
+			}
+		})
+	}
+
+	// Values set on a zero value must stick.
+	var s Settings
+	if err := s.LoadJSON([]byte(`{"a": {"b": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RawSet(false, "a:c", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetInt("a:b", 0); err != nil || got != 1 {
+		t.Errorf("GetInt(a:b) = %d, %v, want 1", got, err)
+	}
+	if got, err := s.GetString("a:c", ""); err != nil || got != "x" {
+		t.Errorf("GetString(a:c) = %q, %v, want x", got, err)
+	}
+	if sources := s.Sources(); len(sources) != 1 || sources[0].Name != "LoadJSON" {
+		t.Errorf("Sources() = %v, want only LoadJSON", sources)
+	}
+}
+
+func TestLoadURL(t *testing.T) {
+	var requests int32
+	var failures int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/flaky.json":
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"a": 1}`))
+		case "/down.json":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/broken.json":
+			w.Write([]byte(`{"a": `))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	load := func(path string, failing int32, options ...URLOption) (Settings, error) {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, failing)
+		settings := NewSettings()
+		err := settings.LoadURL(context.Background(), server.URL+path, options...)
+		return settings, err
+	}
+	fast := WithBackoff(time.Millisecond, 2*time.Millisecond)
+
+	// Server errors are retried until one attempt succeeds.
+	settings, err := load("/flaky.json", 2, WithRetries(2), fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := settings.GetInt("a", 0); a != 1 || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("a = %d after %d requests", a, atomic.LoadInt32(&requests))
+	}
+	if source, _ := settings.SourceOf("a"); source.Name != server.URL+"/flaky.json" {
+		t.Errorf("a came from %s", source.Name)
+	}
+
+	_, err = load("/down.json", 0, WithRetries(2), fast)
+	var urlErr *URLError
+	if !errors.As(err, &urlErr) || urlErr.Attempts != 3 || urlErr.URL != server.URL+"/down.json" || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("LoadURL(down) = %v after %d requests", err, atomic.LoadInt32(&requests))
+	} else if want := "Could not fetch " + server.URL + "/down.json after 3 attempts: Unexpected status 500 Internal Server Error"; err.Error() != want {
+		t.Errorf("error = %q, want %q", err, want)
+	}
+	_, err = load("/down.json", 0)
+	if !errors.As(err, &urlErr) || urlErr.Attempts != 1 || !strings.HasPrefix(err.Error(), "Could not fetch "+server.URL+"/down.json: ") {
+		t.Errorf("LoadURL(down) without retries = %v", err)
+	}
+
+	// Client errors and configs that can't be parsed aren't retried.
+	for _, path := range []string{"/missing.json", "/broken.json"} {
+		if _, err := load(path, 0, WithRetries(3), fast); err == nil || atomic.LoadInt32(&requests) != 1 {
+			t.Errorf("LoadURL(%s) = %v after %d requests, want 1", path, err, atomic.LoadInt32(&requests))
+		}
+	}
+
+	// The wait doubles up to the maximum: uncapped, 4 retries would wait at
+	// least 50+100+200+400ms.
+	start := time.Now()
+	if _, err := load("/down.json", 0, WithRetries(4), WithBackoff(100*time.Millisecond, 100*time.Millisecond)); err == nil {
+		t.Fatal("LoadURL(down) should fail")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 700*time.Millisecond {
+		t.Errorf("4 retries capped at 100ms took %s", elapsed)
+	}
+	for _, delay := range []time.Duration{0, 1, 2, 3, time.Millisecond, time.Second} {
+		for i := 0; i < 100; i++ {
+			if got := jitter(delay); got < delay/2 || got > delay {
+				t.Fatalf("jitter(%s) = %s", delay, got)
+			}
+		}
+	}
+}
+
+func TestLoadURLCancel(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		if r.URL.Path == "/hang.json" {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	check := func(name string, err error) {
+		t.Helper()
+		var urlErr *URLError
+		if !errors.Is(err, context.Canceled) || !errors.As(err, &urlErr) || urlErr.Attempts != 1 {
+			t.Errorf("%s = %v, want a single canceled attempt", name, err)
+		}
+	}
+
+	// Cancelling stops the wait before a retry.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	settings := NewSettings()
+	start := time.Now()
+	check("cancel while waiting", settings.LoadURL(ctx, server.URL+"/down.json", WithRetries(5), WithBackoff(time.Hour, time.Hour)))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelling took %s", elapsed)
+	}
+
+	// And a fetch in progress.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	check("cancel while fetching", settings.LoadURL(ctx, server.URL+"/hang.json", WithRetries(5), WithBackoff(time.Millisecond, time.Millisecond)))
+
+	// A context canceled already is never retried.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	check("canceled context", settings.LoadURL(ctx, server.URL+"/down.json", WithRetries(5)))
+	if got := string(settings.GetJSON()); got != `{}` {
+		t.Errorf("canceled loads changed the settings to %s", got)
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"server": {"hosts": ["a", {"name": "b"}]},
+		"a/b": 1,
+		"m~n": 2,
+		"~1": 3,
+		"": {"": 4},
+		"0": 5
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ptr  string
+		want interface{}
+	}{
+		{"/server/hosts/0", "a"},
+		{"/server/hosts/1/name", "b"},
+		{"/a~1b", 1.0},
+		{"/m~0n", 2.0},
+		{"/~01", 3.0},
+		{"//", 4.0},
+		{"/0", 5.0},
+	} {
+		if got, err := settings.GetByPointer(test.ptr); err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GetByPointer(%q) = %v, %v, want %v", test.ptr, got, err, test.want)
+		}
+	}
+
+	for _, ptr := range []string{"/missing", "/server/hosts/2", "/server/hosts/01", "/server/hosts/-", "/a~1b/c", "/a/b"} {
+		if _, err := settings.GetByPointer(ptr); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetByPointer(%q) = %v, want ErrNotFound", ptr, err)
+		}
+	}
+	for _, ptr := range []string{"server", "/m~2n", "/m~"} {
+		if _, err := settings.GetByPointer(ptr); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("GetByPointer(%q) = %v, want an invalid pointer error", ptr, err)
+		}
+	}
+
+	if root, err := settings.GetByPointer(""); err != nil || !reflect.DeepEqual(root, settings.settings) {
+		t.Errorf("GetByPointer(\"\") = %v, %v, want the whole tree", root, err)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	base := `{"server": {"hosts": ["a", "b"], "port": 80}, "a/b": {"m~n": 1}}`
+
+	for _, test := range []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{"add key", `[{"op": "add", "path": "/server/tls", "value": true}]`,
+			`{"server": {"hosts": ["a", "b"], "port": 80, "tls": true}, "a/b": {"m~n": 1}}`},
+		{"add to array", `[{"op": "add", "path": "/server/hosts/1", "value": "c"}, {"op": "add", "path": "/server/hosts/-", "value": "d"}]`,
+			`{"server": {"hosts": ["a", "c", "b", "d"], "port": 80}, "a/b": {"m~n": 1}}`},
+		{"remove", `[{"op": "remove", "path": "/server/hosts/0"}, {"op": "remove", "path": "/a~1b/m~0n"}]`,
+			`{"server": {"hosts": ["b"], "port": 80}, "a/b": {}}`},
+		{"replace", `[{"op": "replace", "path": "/server/port", "value": 443}]`,
+			`{"server": {"hosts": ["a", "b"], "port": 443}, "a/b": {"m~n": 1}}`},
+		{"move", `[{"op": "move", "from": "/a~1b/m~0n", "path": "/server/~1new"}]`,
+			`{"server": {"hosts": ["a", "b"], "port": 80, "/new": 1}, "a/b": {}}`},
+		{"copy", `[{"op": "copy", "from": "/server/hosts", "path": "/backup"}, {"op": "add", "path": "/backup/-", "value": "c"}]`,
+			`{"server": {"hosts": ["a", "b"], "port": 80}, "a/b": {"m~n": 1}, "backup": ["a", "b", "c"]}`},
+		{"test", `[{"op": "test", "path": "/server", "value": {"port": 80, "hosts": ["a", "b"]}}, {"op": "remove", "path": "/server"}]`,
+			`{"a/b": {"m~n": 1}}`},
+		{"replace root", `[{"op": "replace", "path": "", "value": {"x": 1}}]`, `{"x": 1}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			settings := NewSettings()
+			if err := settings.LoadJSON([]byte(base)); err != nil {
+				t.Fatal(err)
+			}
+			if err := settings.ApplyJSONPatch([]byte(test.patch)); err != nil {
+				t.Fatal(err)
+			}
+			var want map[string]interface{}
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(settings.settings, want) {
+				t.Errorf("got %s, want %s", settings.GetJSON(), test.want)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name  string
+		patch string
+	}{
+		{"failed test", `[{"op": "add", "path": "/x", "value": 1}, {"op": "test", "path": "/server/port", "value": 81}]`},
+		{"missing remove", `[{"op": "replace", "path": "/server/port", "value": 1}, {"op": "remove", "path": "/missing"}]`},
+		{"index out of range", `[{"op": "add", "path": "/server/hosts/3", "value": "c"}]`},
+		{"move into itself", `[{"op": "move", "from": "/server", "path": "/server/inner"}]`},
+		{"unknown operation", `[{"op": "frobnicate", "path": "/server"}]`},
+		{"missing value", `[{"op": "add", "path": "/x"}]`},
+		{"not an object", `[{"op": "replace", "path": "", "value": [1]}]`},
+		{"not a patch", `{"op": "add", "path": "/x", "value": 1}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			settings := NewSettings()
+			if err := settings.LoadJSON([]byte(base)); err != nil {
+				t.Fatal(err)
+			}
+			before := string(settings.GetJSON())
+			if err := settings.ApplyJSONPatch([]byte(test.patch)); err == nil {
+				t.Errorf("ApplyJSONPatch succeeded")
+			}
+			if after := string(settings.GetJSON()); after != before {
+				t.Errorf("failed patch changed the settings to %s", after)
+			}
+		})
+	}
+
+	// Patches are committed like loads: validated, recorded and hooked.
+	settings := NewSettings()
+	settings.EnableHistory(2)
+	if err := settings.LoadJSON([]byte(base)); err != nil {
+		t.Fatal(err)
+	}
+	settings.AddValidator("server:port", func(path string, value interface{}) error {
+		if port, ok := value.(float64); ok && port < 1024 && port != 80 {
+			return errors.New("privileged port")
+		}
+		return nil
+	})
+	hooked := 0
+	settings.AddPostLoadHook(func(s *Settings) error {
+		hooked++
+		return nil
+	})
+	if err := settings.ApplyJSONPatch([]byte(`[{"op": "replace", "path": "/server/port", "value": 22}]`)); err == nil || !strings.Contains(err.Error(), "privileged port") {
+		t.Errorf("a rejected value returned %v", err)
+	}
+	if port, _ := settings.GetInt("server:port", 0); port != 80 || hooked != 0 {
+		t.Errorf("a rejected patch set the port to %d and ran %d hooks", port, hooked)
+	}
+	if err := settings.ApplyJSONPatch([]byte(`[{"op": "replace", "path": "/server/port", "value": 8080}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if history := settings.History("server:port"); len(history) != 1 || history[0].Old != 80.0 || history[0].Source != "ApplyJSONPatch" {
+		t.Errorf("the history of server:port is %+v", history)
+	}
+	if hooked != 1 {
+		t.Errorf("the post-load hooks ran %d times", hooked)
+	}
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	settings := NewSettings()
+	settings.SetPreserveNumbers(true)
+	if err := settings.LoadJSON([]byte(`{"name": "app", "on": true, "off": null, "big": 12345678901234567890, "ratio": 0.5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.SetDefault("server:port", 8080); err != nil {
+		t.Fatal(err)
+	}
+
+	// A deeply nested map with an array at every level.
+	deep := map[string]interface{}{"leaf": "bottom"}
+	for i := 0; i < DefaultMaxDepth/2-1; i++ {
+		deep = map[string]interface{}{"next": deep, "list": []interface{}{float64(i), "x", map[string]interface{}{"i": int64(i)}}}
+	}
+	if err := settings.RawSet(false, "deep", deep); err != nil {
+		t.Fatal(err)
+	}
+
+	large := make([]interface{}, 100000)
+	for i := range large {
+		large[i] = float64(i)
+	}
+	if err := settings.RawSet(false, "large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.RawSet(false, "typed", map[string]interface{}{"int": 1, "uint8": uint8(2), "float32": float32(1.5), "bytes": []byte("raw")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings must round-trip as part of other values.
+	type checkpoint struct {
+		Step     int
+		Settings Settings
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(checkpoint{Step: 3, Settings: settings}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded checkpoint
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := settings.RawGet("")
+	got, _ := decoded.Settings.RawGet("")
+	if decoded.Step != 3 || !reflect.DeepEqual(got, want) {
+		t.Fatalf("decoded settings differ:\n got %v\nwant %v", got, want)
+	}
+	if !reflect.DeepEqual(decoded.Settings.defaults, settings.defaults) {
+		t.Errorf("decoded defaults = %v, want %v", decoded.Settings.defaults, settings.defaults)
+	}
+
+	// The decoded settings must be fully functional.
+	s := decoded.Settings
+	leaf := "deep" + strings.Repeat(":next", DefaultMaxDepth/2-1) + ":leaf"
+	if got, err := s.GetString(leaf, ""); err != nil || got != "bottom" {
+		t.Errorf("GetString(%s) = %q, %v, want bottom", leaf, got, err)
+	}
+	if got, err := s.GetInt("server:port", 0); err != nil || got != 8080 {
+		t.Errorf("GetInt(server:port) = %d, %v, want 8080", got, err)
+	}
+	if got, err := s.GetUint("big", 0); err != nil || got != 12345678901234567890 {
+		t.Errorf("GetUint(big) = %d, %v, want 12345678901234567890", got, err)
+	}
+	if err := s.LoadJSON([]byte(`{"name": "other", "server": {"host": "localhost"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MergeSettings(map[string]interface{}{"on": false}); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"name": "other", "server:host": "localhost"} {
+		if got, err := s.GetString(path, ""); err != nil || got != want {
+			t.Errorf("GetString(%s) = %q, %v, want %s", path, got, err, want)
+		}
+	}
+	if got, err := s.GetBool("on", true); err != nil || got {
+		t.Errorf("GetBool(on) = %v, %v, want false", got, err)
+	}
+	if name, _ := settings.GetString("name", ""); name != "app" {
+		t.Errorf("changing the decoded settings changed the original")
+	}
+
+	if err := settings.RawSet(false, "bad", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.GobEncode(); err == nil {
+		t.Errorf("GobEncode with an unsupported value succeeded")
+	}
+}
+
+func TestGetJSONFiltered(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{
+		"metrics": {"rate": 1, "debug": {"x": 1}},
+		"features": {"a": true, "b": false},
+		"db": {"host": "h", "password": "p"},
+		"other": 1
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.MarkSecret("db:password")
+
+	for _, test := range []struct {
+		include, exclude []string
+		want             string
+	}{
+		{[]string{"metrics", "features"}, nil, `{"features":{"a":true,"b":false},"metrics":{"debug":{"x":1},"rate":1}}`},
+		{[]string{"metrics"}, []string{"metrics:debug"}, `{"metrics":{"rate":1}}`},
+		{nil, []string{"metrics", "features", "db:host"}, `{"db":{"password":"[redacted]"},"other":1}`},
+		// Exclusion wins over any inclusion, overlapping either way.
+		{[]string{"features", "features:a"}, []string{"features"}, `{}`},
+		{[]string{"metrics:debug:x"}, []string{"metrics"}, `{}`},
+		{[]string{"metrics:debug", "metrics"}, []string{"metrics:debug:x"}, `{"metrics":{"debug":{},"rate":1}}`},
+		// Prefixes can point at a leaf, and use patterns.
+		{[]string{"metrics:rate"}, nil, `{"metrics":{"rate":1}}`},
+		{[]string{"*:rate", "features:b"}, nil, `{"features":{"b":false},"metrics":{"rate":1}}`},
+		{[]string{"metrics:rate:deeper", "missing"}, nil, `{}`},
+	} {
+		got, err := settings.GetJSONFiltered(test.include, test.exclude)
+		if err != nil || string(got) != test.want {
+			t.Errorf("GetJSONFiltered(%q, %q) = %s, %v, want %s", test.include, test.exclude, got, err, test.want)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"metrics":      `{"debug":{"x":1},"rate":1}`,
+		"metrics:rate": `1`,
+		"db":           `{"host":"h","password":"p"}`,
+	} {
+		if got, err := settings.GetJSONAt(path); err != nil || string(got) != want {
+			t.Errorf("GetJSONAt(%s) = %s, %v, want %s", path, got, err, want)
+		}
+	}
+	if _, err := settings.GetJSONAt("metrics:missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetJSONAt of a missing path = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetterAllocs(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": {"b": {"enabled": true, "name": "x"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { settings.GetBool("a:b:enabled", false) }); allocs != 0 {
+		t.Errorf("GetBool allocated %v times, want 0", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { settings.GetString("a:b:name", "") }); allocs != 0 {
+		t.Errorf("GetString allocated %v times, want 0", allocs)
+	}
+
+	// Errors are unchanged.
+	if _, err := settings.GetBool("a:c:enabled", false); err == nil || err.Error() != "Could not find a:c:enabled (missing c)" {
+		t.Errorf("GetBool(a:c:enabled) = %v", err)
+	}
+	if _, err := settings.GetBool("a:b:name", false); err == nil || err.Error() != "a:b:name is a string, not a bool" {
+		t.Errorf("GetBool(a:b:name) = %v", err)
+	}
+}
+
+func BenchmarkGetBool(b *testing.B) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"a": {"b": {"enabled": true}}}`)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		settings.GetBool("a:b:enabled", false)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"server": {"port": 80, "hosts": ["a", "b"], "tls": {"enabled": true}}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var reader Reader = settings.ReadOnly()
+	if _, ok := reader.(*Settings); ok {
+		t.Errorf("ReadOnly returned the settings themselves")
+	}
+
+	server := reader.Sub("server")
+	if port, err := server.GetInt("port", 0); err != nil || port != 80 {
+		t.Errorf("port is %d, %v, want 80", port, err)
+	}
+	if enabled, err := server.Sub("tls").GetBool("enabled", false); err != nil || !enabled {
+		t.Errorf("tls:enabled is %v, %v, want true", enabled, err)
+	}
+	if keys, err := server.Keys(""); err != nil || !reflect.DeepEqual(keys, []string{"hosts", "port", "tls"}) {
+		t.Errorf("Keys returned %v, %v", keys, err)
+	}
+	if !server.Has("tls:enabled") || server.Has("missing") {
+		t.Errorf("Has is wrong")
+	}
+	if got := string(server.Sub("tls").GetJSON()); got != `{"enabled":true}` {
+		t.Errorf("GetJSON returned %s", got)
+	}
+
+	// Changing what a reader returns doesn't change the settings.
+	hosts, _ := server.RawGet("hosts")
+	hosts.([]interface{})[0] = "changed"
+	var tls map[string]interface{}
+	if err := server.Get("tls", &tls); err != nil {
+		t.Fatal(err)
+	}
+	tls["enabled"] = false
+	if host, _ := settings.RawGet("server:hosts"); host.([]interface{})[0] != "a" {
+		t.Errorf("changing RawGet's result changed the settings")
+	}
+	if enabled, _ := settings.GetBool("server:tls:enabled", false); !enabled {
+		t.Errorf("changing Get's result changed the settings")
+	}
+
+	// Changes to the settings are seen through the reader.
+	if err := settings.RawSet(false, "server:port", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := server.GetInt("port", 0); port != 8080 {
+		t.Errorf("port is %d after RawSet, want 8080", port)
+	}
+}
+
+func TestEmptyIsMissing(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"region": "", "zones": [], "tags": {}, "port": 80, "name": "x"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Off by default.
+	if region, err := settings.GetString("region", "us"); err != nil || region != "" {
+		t.Errorf("GetString(region) = %q, %v, want the empty string", region, err)
+	}
+
+	settings.SetEmptyIsMissing(true)
+	if region, err := settings.GetString("region", "us"); !errors.Is(err, ErrNotFound) || region != "us" {
+		t.Errorf("GetString(region) = %q, %v, want the default and ErrNotFound", region, err)
+	}
+	var zones []string
+	if err := settings.Get("zones", &zones); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(zones) = %v, want ErrNotFound", err)
+	}
+	if region, err := settings.GetStringAny("eu", "region", "name"); err != nil || region != "x" {
+		t.Errorf("GetStringAny(region, name) = %q, %v, want x", region, err)
+	}
+	if port, err := settings.GetInt("port", 0); err != nil || port != 80 {
+		t.Errorf("GetInt(port) = %d, %v, want 80", port, err)
+	}
+
+	// The tree is unchanged.
+	if raw, err := settings.RawGet("region"); err != nil || raw != "" {
+		t.Errorf("RawGet(region) = %#v, %v, want the empty string", raw, err)
+	}
+
+	// Empty values count as missing required keys.
+	report := settings.Check(CheckOptions{Required: []string{"region", "tags", "port"}})
+	if len(report.Errors) != 2 || report.Errors[0].Path != "region" || report.Errors[1].Path != "tags" {
+		t.Errorf("Check reported %v, want region and tags missing", report.Errors)
+	}
+	err := settings.ValidateAgainstStruct(&struct {
+		Region string   `required:"true"`
+		Zones  []string `required:"true"`
+		Port   int      `required:"true"`
+	}{})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 2 {
+		t.Errorf("ValidateAgainstStruct returned %v, want region and zones missing", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	settings := NewSettings()
+	settings.EnableHistory(2)
+	if err := settings.LoadJSON([]byte(`{"loglevel": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	hooked := 0
+	settings.AddPostLoadHook(func(s *Settings) error {
+		hooked++
+		return nil
+	})
+
+	fail := true
+	settings.RegisterMigration(0, func(m map[string]interface{}) error {
+		m["log"] = map[string]interface{}{"level": "warn"}
+		delete(m, "loglevel")
+		return nil
+	})
+	settings.RegisterMigration(1, func(m map[string]interface{}) error {
+		if fail {
+			return fmt.Errorf("failed")
+		}
+		m["log"].(map[string]interface{})["format"] = "text"
+		return nil
+	})
+	var ran []int
+	settings.SetMigrationHook(func(from, to int) { ran = append(ran, from) })
+
+	// A failing migration leaves the settings as they were.
+	if err := settings.Migrate(); err == nil || !strings.Contains(err.Error(), "version 1") {
+		t.Errorf("Migrate returned %v, want the error of the second migration", err)
+	}
+	if got := string(settings.GetJSON()); got != `{"loglevel":3}` || len(ran) != 0 {
+		t.Errorf("settings are %s after a failed migration, and %v ran", got, ran)
+	}
+
+	// So does a value the validators reject.
+	fail = false
+	reject := true
+	settings.AddValidator("log:format", func(path string, value interface{}) error {
+		if reject {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	if err := settings.Migrate(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("Migrate returned %v, want the error of the validator", err)
+	}
+	if got := string(settings.GetJSON()); got != `{"loglevel":3}` || len(ran) != 0 || hooked != 0 {
+		t.Errorf("settings are %s after a rejected migration, %v ran and %d hooks", got, ran, hooked)
+	}
+
+	reject = false
+	if err := settings.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"config_version":2,"log":{"format":"text","level":"warn"}}` {
+		t.Errorf("migrated settings are %s", got)
+	}
+	if !reflect.DeepEqual(ran, []int{0, 1}) {
+		t.Errorf("hook reported %v, want 0 and 1", ran)
+	}
+	if history := settings.History("loglevel"); len(history) != 1 || history[0].Old != 3.0 || history[0].Source != "Migrate" {
+		t.Errorf("the history of loglevel is %+v", history)
+	}
+	if hooked != 1 {
+		t.Errorf("the post-load hooks ran %d times", hooked)
+	}
+
+	if err := settings.LoadJSON([]byte(`{"config_version": 3}`)); err == nil {
+		t.Errorf("loading settings newer than the migrations succeeded")
+	}
+}
+
+type fakeLuaEngine struct {
+	runs []*LuaRun
+}
+
+func (this *fakeLuaEngine) RunLua(run *LuaRun) (interface{}, error) {
+	this.runs = append(this.runs, run)
+	run.Warn("fake warning")
+	return map[string]interface{}{"source": run.Source, "code": string(run.Code)}, nil
+}
+
+func TestLuaEngine(t *testing.T) {
+	luaEngineLock.Lock()
+	registered := luaEngine
+	luaEngine = nil
+	luaEngineLock.Unlock()
+	defer RegisterLuaEngine(registered)
+
+	settings := NewSettings()
+	if err := settings.LoadLuaString("return {}"); err != errNoLuaEngine {
+		t.Errorf("loading lua without an engine returned %v, want %v", err, errNoLuaEngine)
+	}
+
+	engine := &fakeLuaEngine{}
+	settings.SetLuaEngine(engine)
+	if err := settings.LoadLuaString("return {}"); err != nil {
+		t.Fatal(err)
+	}
+	if len(engine.runs) != 1 || engine.runs[0].Source != "LoadLuaString" || engine.runs[0].Separator != ":" {
+		t.Errorf("the engine was given %+v", engine.runs)
+	}
+	if got, _ := settings.GetString("code", ""); got != "return {}" {
+		t.Errorf("code = %q", got)
+	}
+	if warnings := settings.LastWarnings(); len(warnings) != 1 || warnings[0] != "fake warning" {
+		t.Errorf("LastWarnings() = %q", warnings)
+	}
+
+	other := &fakeLuaEngine{}
+	RegisterLuaEngine(other)
+	settings.SetLuaEngine(nil)
+	if err := settings.LoadLuaString("return {}"); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.runs) != 1 || len(engine.runs) != 1 {
+		t.Errorf("the registered engine ran %d configs and the settings' engine %d, want 1 and 1", len(other.runs), len(engine.runs))
+	}
+}
+
+func TestProcessIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("conf/base.json", `{"port": 80, "name": "base", "include": ["conf/nested.json"]}`)
+	write("conf/nested.json", `{"nested": true, "name": "nested"}`)
+	write("override.json", `{"port": 8080}`)
+	absolute := write("abs/absolute.json", `{"absolute": true}`)
+
+	// Relative paths, nested ones included, are relative to baseDir, and
+	// later files override earlier ones.
+	settings := NewSettings()
+	if err := settings.MergeSettings(map[string]interface{}{"include": []interface{}{"conf/base.json", "override.json", absolute, "missing.json"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ProcessIncludes("include", dir, IncludeOptional); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"absolute":true,"name":"nested","nested":true,"port":8080}` {
+		t.Errorf("settings are %s", got)
+	}
+	if source, _ := settings.SourceOf("nested"); source.Name != filepath.Join(dir, "conf", "nested.json") {
+		t.Errorf("nested came from %s", source.Name)
+	}
+
+	// Without IncludeOptional a missing file is an error.
+	settings = NewSettings()
+	if err := settings.MergeSettings(map[string]interface{}{"include": []interface{}{"missing.json"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ProcessIncludes("include", dir); !errors.Is(err, os.ErrNotExist) || !strings.HasPrefix(err.Error(), "Could not include ") {
+		t.Errorf("including a missing file = %v", err)
+	}
+
+	// Nothing to include is fine.
+	settings = NewSettings()
+	if err := settings.ProcessIncludes("include", dir); err != nil {
+		t.Errorf("ProcessIncludes without includes = %v", err)
+	}
+
+	write("cycle/a.json", `{"a": 1, "include": ["cycle/b.json"]}`)
+	write("cycle/b.json", `{"b": 1, "include": ["cycle/a.json"]}`)
+	write("cycle/self.json", `{"include": ["./cycle/../cycle/self.json"]}`)
+	write("twice/top.json", `{"include": ["twice/once.json", "twice/../twice/once.json"]}`)
+	write("twice/once.json", `{}`)
+	write("bad/object.json", `{"include": {"a": "b"}}`)
+	write("bad/number.json", `{"include": ["ok.json", 1]}`)
+	for include, message := range map[string]string{
+		"cycle/a.json":    "cycle/a.json: it is included more than once",
+		"cycle/self.json": "self.json: it is included more than once",
+		"twice/top.json":  "once.json: it is included more than once",
+		"bad/object.json": "include is not an array",
+		"bad/number.json": "include[1] is not a string",
+	} {
+		settings := NewSettings()
+		if err := settings.MergeSettings(map[string]interface{}{"include": []interface{}{include}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := settings.ProcessIncludes("include", dir); err == nil || !strings.HasSuffix(err.Error(), message) {
+			t.Errorf("including %s = %v, want an error ending with %q", include, err, message)
+		}
+	}
+
+	// A chain that never ends stops after the maximum number of rounds.
+	for i := 0; i <= maxIncludeRounds; i++ {
+		write(fmt.Sprintf("chain/%d.json", i), fmt.Sprintf(`{"include": ["chain/%d.json"]}`, i+1))
+	}
+	settings = NewSettings()
+	if err := settings.MergeSettings(map[string]interface{}{"include": []interface{}{"chain/0.json"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.ProcessIncludes("include", dir); err == nil || !strings.Contains(err.Error(), "still finding includes") {
+		t.Errorf("an endless chain of includes = %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	settings := NewSettings()
+	var hooked []LoadStat
+	settings.SetMetricsHook(func(stat LoadStat) {
+		hooked = append(hooked, stat)
+	})
+
+	before := time.Now()
+	config := `{"a": 1, "b": {"c": 2, "d": 3}}`
+	if err := settings.LoadJSON([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "app.json")
+	if err := ioutil.WriteFile(path, []byte(`{"e": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(filepath.Dir(path), "broken.json")
+	if err := ioutil.WriteFile(broken, []byte(`{"f": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loadErr := settings.LoadFile(broken)
+	if loadErr == nil {
+		t.Fatal("loading a broken file should fail")
+	}
+
+	stats := settings.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("Stats() = %+v, want 3 loads", stats)
+	}
+	if stat := stats[0]; stat.Source != "LoadJSON" || stat.Bytes != len(config) || stat.Keys != 2 || stat.Err != nil || stat.Content != ContentFresh || stat.Duplicate {
+		t.Errorf("LoadJSON stat = %+v", stat)
+	}
+	if stat := stats[1]; stat.Source != path || stat.Bytes != 11 || stat.Keys != 1 || stat.Err != nil {
+		t.Errorf("LoadFile stat = %+v", stat)
+	}
+	if stat := stats[2]; stat.Keys != 0 || stat.Err == nil || stat.Err.Error() != loadErr.Error() {
+		t.Errorf("failed load stat = %+v, want the error %v", stat, loadErr)
+	}
+	for i, stat := range stats {
+		if stat.Start.Before(before) || stat.Duration < 0 || i > 0 && stat.Start.Before(stats[i-1].Start) {
+			t.Errorf("stat %d started at %s and took %s", i, stat.Start, stat.Duration)
+		}
+	}
+	if !reflect.DeepEqual(hooked, stats) {
+		t.Errorf("the metrics hook got %+v, want %+v", hooked, stats)
+	}
+
+	// The result is a copy, and copies of the settings share the stats.
+	stats[0].Source = "changed"
+	if settings.Stats()[0].Source != "LoadJSON" {
+		t.Error("changing the result of Stats changed the stats")
+	}
+	copied := settings
+	if err := copied.LoadJSON([]byte(`{"f": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Stats()) != 4 || len(hooked) != 4 {
+		t.Errorf("a load through a copy wasn't recorded: %d stats, %d hooked", len(settings.Stats()), len(hooked))
+	}
+
+	settings.ResetStats()
+	if stats := settings.Stats(); len(stats) != 0 {
+		t.Errorf("Stats() after ResetStats = %+v", stats)
+	}
+	settings.SetMetricsHook(nil)
+	if err := settings.LoadJSON([]byte(`{"g": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Stats()) != 1 || len(hooked) != 4 {
+		t.Errorf("after removing the hook: %d stats, %d hooked", len(settings.Stats()), len(hooked))
+	}
+}
+
+type validateDB struct {
+	Host     string        `required:"true"`
+	Port     int           `min:"1" max:"65535"`
+	Mode     string        `oneof:"primary replica"`
+	Timeout  time.Duration `min:"1s" max:"1m"`
+	Password string        `mapstructure:"pass" required:"true"`
+}
+
+type validateConfig struct {
+	Name     string  `required:"true"`
+	Workers  uint8   `min:"1"`
+	Ratio    float64 `min:"0" max:"1"`
+	DB       validateDB
+	Cache    *validateDB
+	Replicas []validateDB
+	Labels   map[string]string
+	Level    int `oneof:"1 2 3"`
+	Bad      int `min:"lots"`
+}
+
+func TestValidateAgainstStruct(t *testing.T) {
+	validate := func(config string) []string {
+		t.Helper()
+		settings := NewSettings()
+		if err := settings.LoadJSON([]byte(config)); err != nil {
+			t.Fatal(err)
+		}
+		err := settings.ValidateAgainstStruct(&validateConfig{})
+		if err == nil {
+			return nil
+		}
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("ValidateAgainstStruct returned %v, want a *ValidationError", err)
+		}
+		if !strings.HasPrefix(err.Error(), "Invalid settings:\n  ") {
+			t.Errorf("Error() = %q", err.Error())
+		}
+		sort.Strings(validationErr.Problems)
+		return validationErr.Problems
+	}
+
+	valid := `{"name": "app", "workers": 4, "ratio": 0.5, "level": 2, "db": {"host": "db", "port": 5432, "mode": "primary", "timeout": "30s", "pass": "x"}, "labels": {"a": "b"}}`
+	if problems := validate(valid); problems != nil {
+		t.Errorf("valid settings have problems %q", problems)
+	}
+	// Keys match ignoring case, and the boundaries themselves are allowed.
+	if problems := validate(`{"NAME": "app", "Workers": 1, "ratio": 1, "db": {"HOST": "db", "port": 65535, "timeout": "1m", "pass": ""}}`); problems != nil {
+		t.Errorf("boundaries have problems %q", problems)
+	}
+
+	problems := validate(`{"workers": 0, "ratio": 1.5, "level": 4, "bad": 1, "db": {"port": 0, "mode": "backup", "timeout": "1ms"}, "cache": {"port": 70000}, "replicas": [{"host": "r", "pass": "x"}, {"port": "x"}], "labels": []}`)
+	want := []string{
+		"Bad has an invalid min tag: strconv.ParseFloat: parsing \"lots\": invalid syntax",
+		"Name is required",
+		"cache:Host is required",
+		"cache:pass is required",
+		"cache:port is 70000, it must be at most 65535",
+		"db:Host is required",
+		"db:pass is required",
+		"db:mode is backup, it must be one of primary replica",
+		"db:port is 0, it must be at least 1",
+		"db:timeout is 1ms, it must be at least 1s",
+		"labels should be a map, not array",
+		"level is 4, it must be one of 1 2 3",
+		"ratio is 1.5, it must be at most 1",
+		"replicas[1]:Host is required",
+		"replicas[1]:pass is required",
+		"workers is 0, it must be at least 1",
+	}
+	want = append(want, "Could not decode replicas[1]:port: '' expected type 'int', got unconvertible type 'string'")
+	if len(problems) != len(want) {
+		t.Errorf("problems =\n%s\nwant\n%s", strings.Join(problems, "\n"), strings.Join(want, "\n"))
+	}
+	for _, message := range want {
+		found := false
+		for _, problem := range problems {
+			found = found || problem == message
+		}
+		if !found {
+			t.Errorf("%q is missing from the problems %q", message, problems)
+		}
+	}
+
+	// Values of the wrong type are reported along with where they are.
+	problems = validate(`{"name": "app", "db": "db", "replicas": {"a": 1}, "workers": 300}`)
+	if len(problems) != 3 || problems[0] != "Could not decode workers: 300 does not fit in uint8" || problems[1] != "db should be a map, not string" || problems[2] != "replicas should be an array, not map" {
+		t.Errorf("problems = %q", problems)
+	}
+
+	settings := NewSettings()
+	if err := settings.ValidateAgainstStruct(42); err == nil || err.Error() != "Cannot validate against int, it is not a struct" {
+		t.Errorf("ValidateAgainstStruct(42) = %v", err)
+	}
+	if err := settings.ValidateAgainstStruct(struct{ Optional *int }{}); err != nil {
+		t.Errorf("ValidateAgainstStruct with only optional fields = %v", err)
+	}
+}
+
+func TestGetAny(t *testing.T) {
+	settings := NewSettings()
+	err := settings.LoadJSON([]byte(`{"new": {"host": "new-host"}, "old": {"host": "old-host", "port": 80, "debug": true, "ratio": 0.5, "timeout": "3s"}, "bad": {"port": "eighty", "timeout": "soon"}, "null": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := settings.GetStringAny("", "missing:host", "new:host", "old:host"); err != nil || got != "new-host" {
+		t.Errorf("GetStringAny = %q, %v, want the first path set", got, err)
+	}
+	if got, err := settings.GetIntAny(0, "new:port", "old:port"); err != nil || got != 80 {
+		t.Errorf("GetIntAny = %d, %v", got, err)
+	}
+	if got, err := settings.GetBoolAny(false, "null", "old:debug"); err != nil || !got {
+		t.Errorf("GetBoolAny = %t, %v, want null skipped", got, err)
+	}
+	if got, err := settings.GetFloatAny(0, "new:ratio", "old:ratio"); err != nil || got != 0.5 {
+		t.Errorf("GetFloatAny = %g, %v", got, err)
+	}
+	if got, err := settings.GetDurationAny(0, "new:timeout", "old:timeout"); err != nil || got != 3*time.Second {
+		t.Errorf("GetDurationAny = %s, %v", got, err)
+	}
+
+	// When every path is missing the error lists each of them and matches
+	// ErrNotFound.
+	got, err := settings.GetStringAny("default", "a", "b:c")
+	if got != "default" || !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetStringAny(missing) = %q, %v, want the default and ErrNotFound", got, err)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "Could not get any of a, b:c (") || !strings.Contains(err.Error(), "b:c") {
+		t.Errorf("GetStringAny(missing) error = %v", err)
+	}
+	if got, err := settings.GetIntAny(7); got != 7 || !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIntAny() = %d, %v, want the default and ErrNotFound", got, err)
+	}
+
+	// A value of the wrong type is an error straight away unless
+	// SetFallbackOnTypeMismatch is set.
+	if got, err := settings.GetIntAny(1, "bad:port", "old:port"); got != 1 || err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetIntAny(bad:port) = %d, %v, want the type error", got, err)
+	}
+	if got, err := settings.GetDurationAny(time.Second, "bad:timeout", "old:timeout"); got != time.Second || err == nil {
+		t.Errorf("GetDurationAny(bad:timeout) = %s, %v, want the parse error", got, err)
+	}
+	settings.SetFallbackOnTypeMismatch(true)
+	if got, err := settings.GetIntAny(1, "bad:port", "old:port"); err != nil || got != 80 {
+		t.Errorf("GetIntAny(bad:port) with fallback = %d, %v", got, err)
+	}
+	if got, err := settings.GetDurationAny(time.Second, "bad:timeout", "old:timeout"); err != nil || got != 3*time.Second {
+		t.Errorf("GetDurationAny(bad:timeout) with fallback = %s, %v", got, err)
+	}
+	got, err = settings.GetStringAny("default", "missing", "old:port")
+	if got != "default" || err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("GetStringAny(missing, old:port) = %q, %v, want an error not matching ErrNotFound", got, err)
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"string": "1m30s", "number": 1000, "bad": "soon", "bool": true, "null": null}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := settings.GetDuration("string", 0); err != nil || got != 90*time.Second {
+		t.Errorf("GetDuration(string) = %s, %v", got, err)
+	}
+	if got, err := settings.GetDuration("number", 0); err != nil || got != 1000 {
+		t.Errorf("GetDuration(number) = %s, %v, want nanoseconds", got, err)
+	}
+	for _, path := range []string{"bad", "bool"} {
+		if got, err := settings.GetDuration(path, time.Second); got != time.Second || err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("GetDuration(%s) = %s, %v, want the default and an error", path, got, err)
+		}
+	}
+	for _, path := range []string{"missing", "null", "string:nested"} {
+		if got, err := settings.GetDuration(path, time.Second); got != time.Second || !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetDuration(%s) = %s, %v, want the default and ErrNotFound", path, got, err)
+		}
+	}
+}
+
+func TestLoadDirAsMap(t *testing.T) {
+	// Lay the directory out like a mounted ConfigMap: the files live in a
+	// timestamped directory reached through the ..data symlink, and each key
+	// is a symlink into ..data.
+	dir := t.TempDir()
+	data := filepath.Join(dir, "..2026_10_15_10_00_00.1")
+	files := map[string]string{
+		"db-host":        "  db.internal\n",
+		"config.json":    `{"pool": 4}`,
+		"broken.json":    `{"pool": `,
+		"list":           `["a", "b"]`,
+		"nested/key":     "nested value",
+		"nested/.hidden": "hidden",
+	}
+	for name, content := range files {
+		path := filepath.Join(data, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Base(data), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db-host", "config.json", "broken.json", "list", "nested"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("hidden"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadDirAsMap(dir, "app:config"); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"app":{"config":{"broken.json":"{\"pool\":","config.json":"{\"pool\": 4}","db-host":"db.internal","list":"[\"a\", \"b\"]"}}}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("LoadDirAsMap = %s, want %s", got, want)
+	}
+
+	settings = NewSettings()
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadDirAsMap(dir, "app.config", DirMapParseJSON, DirMapRecursive); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"app":{"config":{"broken.json":"{\"pool\":","config.json":{"pool":4},"db-host":"db.internal","list":["a","b"],"nested":{"key":"nested value"}}}}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("LoadDirAsMap recursive = %s, want %s", got, want)
+	}
+	if host, err := settings.GetString("app.config.db-host", ""); err != nil || host != "db.internal" {
+		t.Errorf("GetString(app.config.db-host) = %q, %v", host, err)
+	}
+	if source, ok := settings.SourceOf("app.config.nested.key"); !ok || source.Name != dir {
+		t.Errorf("SourceOf(app.config.nested.key) = %v, %v", source, ok)
+	}
+
+	// Without a prefix the keys are at the root.
+	settings = NewSettings()
+	if err := settings.LoadDirAsMap(filepath.Join(dir, "nested"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"key":"nested value"}` {
+		t.Errorf("LoadDirAsMap without prefix = %s", got)
+	}
+
+	if err := settings.LoadDirAsMap(filepath.Join(dir, "missing"), "x"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadDirAsMap(missing) = %v", err)
+	}
+}
+
+func TestMergeKeepExisting(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "db", "replicas": ["a"], "tls": null}, "port": 80, "name": {"first": "x"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := map[string]interface{}{
+		"db": map[string]interface{}{
+			"host":     "localhost",
+			"user":     "app",
+			"replicas": []interface{}{"b", "c"},
+			"tls":      map[string]interface{}{"enabled": true},
+		},
+		"port":  map[string]interface{}{"number": 8080},
+		"name":  "y",
+		"debug": false,
+	}
+	if err := settings.MergeSettingsWithOptions(defaults, MergeKeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"db":{"host":"db","replicas":["a"],"tls":null,"user":"app"},"debug":false,"name":{"first":"x"},"port":80}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("MergeKeepExisting = %s, want %s", got, want)
+	}
+	if source, ok := settings.SourceOf("db:host"); !ok || source.Name != "LoadJSON" {
+		t.Errorf("SourceOf(db:host) = %v, a kept value changed source", source)
+	}
+
+	// The last option wins.
+	if err := settings.LoadJSONWithOptions([]byte(`{"port": 81, "db": {"user": "other"}}`), MergeKeepExisting, MergeReplace); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 81 {
+		t.Errorf("port = %d, want 81 with MergeReplace last", port)
+	}
+	if err := settings.LoadJSONWithOptions([]byte(`{"port": 82, "db": {"user": "ignored", "pool": 4}}`), MergeReplace, MergeKeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"db":{"host":"db","pool":4,"replicas":["a"],"tls":null,"user":"other"},"debug":false,"name":{"first":"x"},"port":81}` {
+		t.Errorf("MergeKeepExisting last = %s", got)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "defaults.json")
+	if err := ioutil.WriteFile(path, []byte(`{"port": 1, "timeout": "5s"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, load := range map[string]func(s *Settings) error{
+		"LoadFileWithOptions":     func(s *Settings) error { return s.LoadFileWithOptions(path, MergeKeepExisting) },
+		"LoadFileAsWithOptions":   func(s *Settings) error { return s.LoadFileAsWithOptions(path, "json", MergeKeepExisting) },
+		"LoadJSONFileWithOptions": func(s *Settings) error { return s.LoadJSONFileWithOptions(path, MergeKeepExisting) },
+	} {
+		settings := NewSettings()
+		if err := settings.LoadJSON([]byte(`{"port": 2}`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := load(&settings); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if got := string(settings.GetJSON()); got != `{"port":2,"timeout":"5s"}` {
+			t.Errorf("%s = %s", name, got)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	settings := NewSettings()
+	settings.MarkSecret("db:password", "*:token")
+	if err := settings.LoadJSON([]byte(`{"db": {"host": "db", "password": "hunter2"}, "api": {"token": {"id": "x"}, "url": "u"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"api":{"token":"[redacted]","url":"u"},"db":{"host":"db","password":"[redacted]"}}`
+	if got := settings.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+	if got := fmt.Sprintf("%v", settings); got != want {
+		t.Errorf("%%v of Settings = %s", got)
+	}
+	if got := fmt.Sprint(&settings); got != want {
+		t.Errorf("%%v of *Settings = %s", got)
+	}
+	if strings.Contains(settings.String(), "hunter2") {
+		t.Error("String() shows a secret")
+	}
+
+	settings.Publish("flexiconfig-test-string")
+	published := expvar.Get("flexiconfig-test-string")
+	if published == nil {
+		t.Fatal("Publish did not register the settings")
+	}
+	if got := published.String(); got != want {
+		t.Errorf("published String() = %s, want %s", got, want)
+	}
+	if err := settings.RawSet(false, "db:host", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := published.String(); !strings.Contains(got, `"host":"other"`) {
+		t.Errorf("published String() = %s, want the current settings", got)
+	}
+	if !json.Valid([]byte(NewSettings().String())) {
+		t.Error("String() of empty settings is not json")
+	}
+}
+
+func TestStringConcurrent(t *testing.T) {
+	settings := NewSettings()
+	settings.MarkSecret("secret")
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			config := fmt.Sprintf(`{"secret": "s%d", "values": {"a%d": %d, "nested": {"b": [%d]}}}`, i, i%10, i, i)
+			if err := settings.LoadJSON([]byte(config)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		got := settings.String()
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+			t.Fatalf("String() = %s: %s", got, err)
+		}
+		if secret, ok := decoded["secret"]; ok && secret != "[redacted]" {
+			t.Fatalf("String() = %s shows a secret", got)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestStructure(t *testing.T) {
+	cyclic := map[string]interface{}{"a": 1}
+	cyclic["self"] = map[string]interface{}{"again": cyclic}
+	list := []interface{}{1, nil}
+	list[1] = list
+	shared := map[string]interface{}{"x": 1}
+
+	settings := NewSettings()
+	for name, merge := range map[string]func() error{
+		"cyclic map":   func() error { return settings.MergeSettings(map[string]interface{}{"c": cyclic}) },
+		"cyclic array": func() error { return settings.MergeSettings(map[string]interface{}{"l": list}) },
+		"RawSet":       func() error { return settings.RawSet(false, "r", cyclic) },
+		"Append":       func() error { return settings.Append("list", list) },
+	} {
+		if err := merge(); err == nil || !strings.Contains(err.Error(), "contains itself") {
+			t.Errorf("%s returned %v", name, err)
+		}
+	}
+	if got := string(settings.GetJSON()); got != `{}` {
+		t.Errorf("rejected values changed the settings to %s", got)
+	}
+
+	if err := settings.MergeSettings(map[string]interface{}{"a": shared, "b": []interface{}{shared, shared}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":{"x":1},"b":[{"x":1},{"x":1}]}` {
+		t.Errorf("settings are %s", got)
+	}
+
+	settings.SetMaxDepth(3)
+	deep := map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{map[string]interface{}{"c": map[string]interface{}{}}}}}
+	err := settings.MergeSettings(deep)
+	if err == nil || !strings.Contains(err.Error(), "Value at a:b[0]:c is nested deeper than the maximum of 3") {
+		t.Errorf("too deep a value returned %v", err)
+	}
+	settings.SetMaxDepth(4)
+	if err := settings.MergeSettings(deep); err != nil {
+		t.Error(err)
+	}
+
+	// Lowering the limit afterwards makes encoding fail rather than panic.
+	settings.SetMaxDepth(3)
+	if _, err := settings.GetJSONWithOptions(); err == nil || !strings.Contains(err.Error(), "nested deeper than the maximum of 3") {
+		t.Errorf("GetJSONWithOptions of too deep settings returned %v", err)
+	}
+	if _, err := settings.GetPrettyJSONWithOptions("", " "); err == nil || !strings.Contains(err.Error(), "nested deeper than the maximum of 3") {
+		t.Errorf("GetPrettyJSONWithOptions of too deep settings returned %v", err)
+	}
+	settings.SetMaxDepth(4)
+
+	// Paths in the errors use the separator of the settings.
+	settings = NewSettings()
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetMaxDepth(3)
+	err = settings.MergeSettings(deep)
+	if err == nil || !strings.Contains(err.Error(), "Value at a.b[0].c is nested deeper than the maximum of 3") {
+		t.Errorf("too deep a value with the separator \".\" returned %v", err)
+	}
+	err = settings.MergeSettings(map[string]interface{}{"c": cyclic})
+	if err == nil || !strings.Contains(err.Error(), "Value at c.self.again contains itself") {
+		t.Errorf("a cyclic value with the separator \".\" returned %v", err)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.json")
+	if err := ioutil.WriteFile(file, []byte(`{"port": 81, "name": "file"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FLEXICONFIG_BUILDER_NAME", "env")
+
+	// Steps run in order, each overriding the ones before, after the options.
+	var order []string
+	builder := New().
+		Configure(func(s *Settings) { order = append(order, "option") }).
+		WithDefaults(map[string]interface{}{"port": 80, "name": "defaults", "debug": false}).
+		WithStep("first", func(s *Settings) error {
+			order = append(order, "first")
+			return nil
+		}).
+		WithFile(file).
+		WithOptionalFile(filepath.Join(dir, "missing.json")).
+		WithEnv("FLEXICONFIG_BUILDER_").
+		WithStep("last", func(s *Settings) error {
+			order = append(order, "last")
+			if name, _ := s.GetString("name", ""); name != "env" {
+				return fmt.Errorf("the last step sees name %q", name)
+			}
+			return nil
+		})
+	settings, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"debug":false,"name":"env","port":81}` {
+		t.Errorf("settings are %s", got)
+	}
+	if !reflect.DeepEqual(order, []string{"option", "first", "last"}) {
+		t.Errorf("the steps ran in the order %v", order)
+	}
+
+	// WithDefaults sets defaults, not settings.
+	if got := settings.Overrides(); !reflect.DeepEqual(got, map[string]interface{}{"name": "env", "port": 81.0}) {
+		t.Errorf("the overrides are %v", got)
+	}
+
+	// Every build is independent.
+	other, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RawSet(false, "port", 1); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 81 {
+		t.Errorf("changing one build changed another, port is %d", port)
+	}
+
+	// The first failing step stops the build.
+	failure := errors.New("step failed")
+	ran := false
+	_, err = New().
+		WithDefaults(map[string]interface{}{"a": 1}).
+		WithFile(filepath.Join(dir, "missing.json")).
+		WithStep("after", func(s *Settings) error {
+			ran = true
+			return nil
+		}).
+		Build()
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) || buildErr.Step != 1 || buildErr.Description != "file "+filepath.Join(dir, "missing.json") || !os.IsNotExist(errors.Unwrap(buildErr)) {
+		t.Errorf("a missing file returned %#v", err)
+	}
+	if ran {
+		t.Error("a step ran after the failed one")
+	}
+
+	settings, err = New().
+		WithDefaults(map[string]interface{}{"a": 1}).
+		WithStep("custom", func(s *Settings) error { return failure }).
+		Build()
+	if !errors.Is(err, failure) || err.Error() != "Step 1 (custom) failed: step failed" {
+		t.Errorf("a failing step returned %v", err)
+	}
+	if a, _ := settings.GetInt("a", 0); a != 1 {
+		t.Errorf("the settings built before the failure should be returned, a is %d", a)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "a", "base.json")
+	override := filepath.Join(dir, "b", "override.json")
+	for path, content := range map[string]string{
+		base:     `{"db": {"host": "h", "port": 1}, "log": "logs/app.log", "data": "data"}`,
+		override: `{"db": {"port": 2}, "data": "../shared"}`,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadAll(base, override); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.MergeSettingsWithOptions(map[string]interface{}{"db": map[string]interface{}{"host": "kept", "user": "u"}}, MergeKeepExisting); err != nil {
+		t.Fatal(err)
+	}
+	source := func(path string) string {
+		source, ok := settings.SourceOf(path)
+		if !ok {
+			return ""
+		}
+		return source.Name
+	}
+	for path, want := range map[string]string{
+		"db:host": base,
+		"db:port": override,
+		"db:user": "MergeSettings",
+		"log":     base,
+		"data":    override,
+		"missing": "",
+	} {
+		if got := source(path); got != want {
+			t.Errorf("SourceOf(%s) = %q, want %q", path, got, want)
+		}
+	}
+	sources := settings.Sources()
+	if len(sources) != 3 || sources[0].Dir != filepath.Dir(base) || sources[1].Dir != filepath.Dir(override) || sources[2].Dir != "" {
+		t.Errorf("the sources are %+v", sources)
+	}
+
+	// Relative paths are relative to the file that set them.
+	for path, want := range map[string]string{
+		"log":  filepath.Join(dir, "a", "logs", "app.log"),
+		"data": filepath.Join(dir, "shared"),
+	} {
+		if got, err := settings.GetAbsPath(path, ""); err != nil || got != want {
+			t.Errorf("GetAbsPath(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	// Values set or removed directly have no source, and paths set by a
+	// source without a directory are relative to the working directory.
+	if err := settings.RawSet(false, "db:port", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.Delete("db:user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadJSON([]byte(`{"log": "other.log"}`)); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"db:port": "",
+		"db:user": "",
+		"db:host": base,
+		"log":     "LoadJSON",
+	} {
+		if got := source(path); got != want {
+			t.Errorf("SourceOf(%s) = %q after changing it, want %q", path, got, want)
+		}
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := settings.GetAbsPath("log", ""); got != filepath.Join(cwd, "other.log") {
+		t.Errorf("GetAbsPath(log) = %q, want it in the working directory", got)
+	}
+	if err := settings.RawSet(false, "log", filepath.Join(dir, "x", "..", "abs.log")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := settings.GetAbsPath("log", ""); got != filepath.Join(dir, "abs.log") {
+		t.Errorf("GetAbsPath(log) = %q for an absolute path", got)
+	}
+
+	// Reload attributes every value again.
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := source("db:port"); got != override {
+		t.Errorf("SourceOf(db:port) = %q after Reload", got)
+	}
+}
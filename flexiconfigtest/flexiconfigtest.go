@@ -0,0 +1,172 @@
+// Package flexiconfigtest helps testing code that uses flexiconfig settings,
+// building settings from literals and asserting what they hold:
+//
+//	settings := flexiconfigtest.FromJSON(t, `{"db": {"port": 5432}}`)
+//	flexiconfigtest.AssertPath(t, settings, "db:port", 5432)
+//	flexiconfigtest.AssertMissing(t, settings, "db:host")
+//
+// Values are compared by their JSON rendering, with the keys of objects
+// sorted, so 5432 matches 5432.0 and a map[string]int matches the object it
+// was loaded from. Everything takes a testing.TB, so it works in benchmarks
+// too.
+package flexiconfigtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+// New returns settings holding m, failing the test if it can't be merged.
+func New(t testing.TB, m map[string]interface{}) flexiconfig.Settings {
+	t.Helper()
+	settings := flexiconfig.NewSettings()
+	if err := settings.MergeSettings(m); err != nil {
+		t.Fatalf("Could not create the settings: %s", err)
+	}
+	return settings
+}
+
+// FromJSON returns settings loaded from the JSON document, failing the test if
+// it can't be loaded.
+func FromJSON(t testing.TB, document string) flexiconfig.Settings {
+	t.Helper()
+	settings := flexiconfig.NewSettings()
+	if err := settings.LoadJSON([]byte(document)); err != nil {
+		t.Fatalf("Could not load the JSON settings: %s", err)
+	}
+	return settings
+}
+
+// AssertPath fails the test unless the value at path equals expected, and
+// returns whether it does. On failure both values are shown as indented JSON
+// with the lines that differ marked.
+func AssertPath(t testing.TB, settings flexiconfig.Settings, path string, expected interface{}) bool {
+	t.Helper()
+	value, err := settings.RawGet(path)
+	if errors.Is(err, flexiconfig.ErrNullValue) {
+		value, err = nil, nil
+	}
+	if err != nil {
+		t.Errorf("Could not get %s: %s", path, err)
+		return false
+	}
+
+	got, err := render(value)
+	if err != nil {
+		t.Errorf("Could not render %s: %s", path, err)
+		return false
+	}
+	want, err := render(expected)
+	if err != nil {
+		t.Errorf("Could not render the value expected at %s: %s", path, err)
+		return false
+	}
+	if got == want {
+		return true
+	}
+
+	if !strings.Contains(got, "\n") && !strings.Contains(want, "\n") {
+		t.Errorf("%s is %s, expected %s", path, got, want)
+	} else {
+		t.Errorf("%s differs from what was expected (-expected +got):\n%s", path, diffLines(want, got))
+	}
+	return false
+}
+
+// AssertMissing fails the test if path is set to anything but null, and
+// returns whether it isn't.
+func AssertMissing(t testing.TB, settings flexiconfig.Settings, path string) bool {
+	t.Helper()
+	value, err := settings.RawGet(path)
+	if errors.Is(err, flexiconfig.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		t.Errorf("Could not get %s: %s", path, err)
+		return false
+	}
+
+	rendered, err := render(value)
+	if err != nil {
+		rendered = fmt.Sprint(value)
+	}
+	t.Errorf("%s should be missing, but is %s", path, rendered)
+	return false
+}
+
+// RequireValid runs Check with opts and stops the test if it reports any
+// error. Warnings are logged.
+func RequireValid(t testing.TB, settings flexiconfig.Settings, opts flexiconfig.CheckOptions) {
+	t.Helper()
+	report := settings.Check(opts)
+	if report.Err() != nil {
+		t.Fatalf("The settings are invalid: %s", report)
+	}
+	for _, warning := range report.Warnings {
+		t.Logf("Warning at %s: %s", warning.Path, warning.Message)
+	}
+}
+
+// render returns value as indented JSON. Objects come out with their keys
+// sorted, and numbers of any type the same way.
+func render(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	// Decoding and encoding again turns every number into a float64 and
+	// every struct and typed map into an object.
+	var canonical interface{}
+	if err := json.Unmarshal(b, &canonical); err != nil {
+		return "", err
+	}
+	b, err = json.MarshalIndent(canonical, "", "  ")
+	return string(b), err
+}
+
+// diffLines returns the lines of want and got, marking those only in want
+// with "-" and those only in got with "+".
+func diffLines(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+
+	// common[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case j == len(b) || i < len(a) && common[i+1][j] >= common[i][j+1]:
+			diff.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return strings.TrimSuffix(diff.String(), "\n")
+}
@@ -0,0 +1,102 @@
+package flexiconfigtest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+// recorder is a testing.TB recording failures instead of failing.
+type recorder struct {
+	testing.TB
+	errors []string
+	fatal  bool
+}
+
+func (this *recorder) Helper() {}
+
+func (this *recorder) Errorf(format string, args ...interface{}) {
+	this.errors = append(this.errors, fmt.Sprintf(format, args...))
+}
+
+func (this *recorder) Fatalf(format string, args ...interface{}) {
+	this.Errorf(format, args...)
+	this.fatal = true
+	runtime.Goexit()
+}
+
+func (this *recorder) Logf(format string, args ...interface{}) {}
+
+// record runs fn with a recorder in its own goroutine, so that Fatalf can stop
+// it.
+func record(fn func(t testing.TB)) *recorder {
+	r := &recorder{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn(r)
+	}()
+	wg.Wait()
+	return r
+}
+
+func TestAssertions(t *testing.T) {
+	settings := New(t, map[string]interface{}{
+		"db":    map[string]int{"port": 5432},
+		"hosts": []string{"a", "b"},
+		"unset": nil,
+	})
+	AssertPath(t, settings, "db:port", 5432)
+	AssertPath(t, settings, "db", map[string]interface{}{"port": 5432.0})
+	AssertPath(t, settings, "hosts", []string{"a", "b"})
+	AssertPath(t, settings, "unset", nil)
+	AssertMissing(t, settings, "db:host")
+	AssertMissing(t, settings, "unset")
+
+	r := record(func(t testing.TB) {
+		if AssertPath(t, settings, "db:port", 5433) {
+			t.Errorf("AssertPath should fail")
+		}
+		AssertPath(t, settings, "hosts", []string{"a", "c"})
+		AssertMissing(t, settings, "db:port")
+		AssertPath(t, settings, "db:host", "x")
+	})
+	expected := []string{
+		"db:port is 5432, expected 5433",
+		"hosts differs from what was expected (-expected +got):\n  [\n    \"a\",\n-   \"c\"\n+   \"b\"\n  ]",
+		"db:port should be missing, but is 5432",
+		"Could not get db:host: Could not find db:host (missing host)",
+	}
+	if strings.Join(r.errors, "\n\n") != strings.Join(expected, "\n\n") {
+		t.Errorf("Failures were\n%s\n\nexpected\n%s", strings.Join(r.errors, "\n\n"), strings.Join(expected, "\n\n"))
+	}
+}
+
+func TestConstructors(t *testing.T) {
+	AssertPath(t, FromJSON(t, `{"a": {"b": true}}`), "a:b", true)
+
+	r := record(func(t testing.TB) {
+		FromJSON(t, `{"a": `)
+		t.Errorf("FromJSON should stop the test")
+	})
+	if !r.fatal || len(r.errors) != 1 || !strings.HasPrefix(r.errors[0], "Could not load the JSON settings") {
+		t.Errorf("Broken JSON failed with %v", r.errors)
+	}
+}
+
+func TestRequireValid(t *testing.T) {
+	settings := FromJSON(t, `{"db": {"port": 5432}}`)
+	RequireValid(t, settings, flexiconfig.CheckOptions{Required: []string{"db:port"}})
+
+	r := record(func(t testing.TB) {
+		RequireValid(t, settings, flexiconfig.CheckOptions{Required: []string{"db:host"}})
+	})
+	if !r.fatal || len(r.errors) != 1 || !strings.Contains(r.errors[0], "db:host") {
+		t.Errorf("RequireValid failed with %v", r.errors)
+	}
+}
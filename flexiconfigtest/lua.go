@@ -0,0 +1,22 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package flexiconfigtest
+
+import (
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+	"github.com/wetdesertrock/flexiconfig/lualoader"
+)
+
+// FromLua returns settings loaded from the lua config code, failing the test
+// if it can't be loaded.
+func FromLua(t testing.TB, code string) flexiconfig.Settings {
+	t.Helper()
+	settings := flexiconfig.NewSettings()
+	if err := lualoader.LoadString(&settings, code, nil); err != nil {
+		t.Fatalf("Could not load the lua settings: %s", err)
+	}
+	return settings
+}
@@ -0,0 +1,12 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package flexiconfigtest
+
+import (
+	"testing"
+)
+
+func TestFromLua(t *testing.T) {
+	AssertPath(t, FromLua(t, `return {a = {b = "lua"}}`), "a:b", "lua")
+}
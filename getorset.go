@@ -0,0 +1,118 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// pendingSets holds the GetOrSet calls computing a value, by path, shared by
+// every copy of a Settings.
+type pendingSets struct {
+	lock  sync.Mutex
+	calls map[string]*pendingSet
+}
+
+type pendingSet struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// GetOrSet returns the value at path if it is set, or else calls compute and
+// sets path to the value it returns, as RawSet with timid set to true would,
+// and returns it. This allows computing a value lazily, once, and keeping it
+// where others can find it. A path set to null counts as unset.
+//
+// Concurrent calls for the same path call compute only once, the others wait
+// for its result. compute is called without holding the lock of the settings,
+// so it can read them; if the path was set meanwhile that value wins and is
+// returned instead. If compute returns an error nothing is set and the error
+// is returned, to every caller waiting for it, and the next call tries again.
+// The value set goes through the validators and kinds like RawSet, and
+// SourceOf reports it as coming from a source called "GetOrSet". The empty
+// path, the settings themselves, is an error matching ErrInvalidPath.
+func (this *Settings) GetOrSet(path string, compute func() (interface{}, error)) (interface{}, error) {
+	path = this.normalizePath(path)
+	if err := this.checkPath(path); err != nil {
+		return nil, err
+	}
+	if value, ok := this.getSet(path); ok {
+		return value, nil
+	}
+
+	pending := this.pendingSets()
+	pending.lock.Lock()
+	if call, ok := pending.calls[path]; ok {
+		pending.lock.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &pendingSet{done: make(chan struct{})}
+	if pending.calls == nil {
+		pending.calls = make(map[string]*pendingSet)
+	}
+	pending.calls[path] = call
+	pending.lock.Unlock()
+
+	// Should compute panic, the callers waiting get this error.
+	call.err = fmt.Errorf("Could not compute %s: it panicked", path)
+	defer func() {
+		pending.lock.Lock()
+		delete(pending.calls, path)
+		pending.lock.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = this.computeAndSet(path, compute)
+	return call.value, call.err
+}
+
+// pendingSets returns the calls of GetOrSet in progress.
+func (this *Settings) pendingSets() *pendingSets {
+	this.lazyInit()
+	return this.pending
+}
+
+// getSet returns the value at path and whether it is set to something other
+// than null.
+func (this Settings) getSet(path string) (interface{}, bool) {
+	this.rlock()
+	defer this.runlock()
+
+	value, err := this.rawGet(path)
+	return value, err == nil
+}
+
+// computeAndSet does the work of GetOrSet for the single caller computing the
+// value at path.
+func (this *Settings) computeAndSet(path string, compute func() (interface{}, error)) (interface{}, error) {
+	// The path may have been set while waiting to compute it.
+	if value, ok := this.getSet(path); ok {
+		return value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	path, value, err = this.prepareSet(path, value)
+	if err != nil {
+		return nil, err
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	existing, err := this.rawGet(path)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNullValue) {
+		return nil, err
+	}
+	if _, err := this.setPrepared("GetOrSet", SetCreate, path, value); err != nil {
+		return nil, err
+	}
+	this.provenance.paths[path] = this.provenance.add(Source{Name: "GetOrSet"})
+	return value, nil
+}
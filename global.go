@@ -0,0 +1,126 @@
+package flexiconfig
+
+import (
+	"sync"
+	"time"
+)
+
+// The package level functions use a default Settings, much like http.Get uses
+// http.DefaultClient. They are meant for small programs that don't want to
+// pass a Settings around. Libraries should still take a Settings explicitly,
+// so that the programs using them decide where their config comes from.
+//
+// Like the methods of Settings they are safe for concurrent use, so loads and
+// reloads may run alongside the getters.
+var (
+	defaultLock     sync.RWMutex
+	defaultSettings = newDefaultSettings()
+)
+
+func newDefaultSettings() *Settings {
+	settings := NewSettings()
+	return &settings
+}
+
+// DefaultSettings returns the Settings used by the package level functions.
+func DefaultSettings() *Settings {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+
+	return defaultSettings
+}
+
+// SetDefaultSettings replaces the Settings used by the package level
+// functions, for instance with one prepared by a test. Passing nil replaces
+// them with empty settings.
+func SetDefaultSettings(settings *Settings) {
+	if settings == nil {
+		settings = newDefaultSettings()
+	}
+	// A zero value must be initialized before other goroutines use it.
+	settings.lazyInit()
+
+	defaultLock.Lock()
+	defaultSettings = settings
+	defaultLock.Unlock()
+}
+
+// LoadFile calls LoadFile on the default settings.
+func LoadFile(path string) error {
+	return DefaultSettings().LoadFile(path)
+}
+
+// LoadFileAs calls LoadFileAs on the default settings.
+func LoadFileAs(path string, format string) error {
+	return DefaultSettings().LoadFileAs(path, format)
+}
+
+// LoadJSON calls LoadJSON on the default settings.
+func LoadJSON(b []byte) error {
+	return DefaultSettings().LoadJSON(b)
+}
+
+// LoadJSONFile calls LoadJSONFile on the default settings.
+func LoadJSONFile(path string) error {
+	return DefaultSettings().LoadJSONFile(path)
+}
+
+// LoadEnv calls LoadEnv on the default settings.
+func LoadEnv(prefix string) error {
+	return DefaultSettings().LoadEnv(prefix)
+}
+
+// MergeSettings calls MergeSettings on the default settings.
+func MergeSettings(newSettings map[string]interface{}) error {
+	return DefaultSettings().MergeSettings(newSettings)
+}
+
+// RawGet calls RawGet on the default settings.
+func RawGet(path string) (interface{}, error) {
+	return DefaultSettings().RawGet(path)
+}
+
+// Get calls Get on the default settings.
+func Get(path string, target interface{}) error {
+	return DefaultSettings().Get(path, target)
+}
+
+// GetBool calls GetBool on the default settings.
+func GetBool(path string, defaultValue bool) (bool, error) {
+	return DefaultSettings().GetBool(path, defaultValue)
+}
+
+// GetString calls GetString on the default settings.
+func GetString(path string, defaultValue string) (string, error) {
+	return DefaultSettings().GetString(path, defaultValue)
+}
+
+// GetStringExpanded calls GetStringExpanded on the default settings.
+func GetStringExpanded(path string, defaultValue string, options ...ExpandOption) (string, error) {
+	return DefaultSettings().GetStringExpanded(path, defaultValue, options...)
+}
+
+// GetInt calls GetInt on the default settings.
+func GetInt(path string, defaultValue int64) (int64, error) {
+	return DefaultSettings().GetInt(path, defaultValue)
+}
+
+// GetUint calls GetUint on the default settings.
+func GetUint(path string, defaultValue uint64) (uint64, error) {
+	return DefaultSettings().GetUint(path, defaultValue)
+}
+
+// GetFloat calls GetFloat on the default settings.
+func GetFloat(path string, defaultValue float64) (float64, error) {
+	return DefaultSettings().GetFloat(path, defaultValue)
+}
+
+// GetDuration calls GetDuration on the default settings.
+func GetDuration(path string, defaultValue time.Duration) (time.Duration, error) {
+	return DefaultSettings().GetDuration(path, defaultValue)
+}
+
+// GetAbsPath calls GetAbsPath on the default settings.
+func GetAbsPath(path string, defaultValue string) (string, error) {
+	return DefaultSettings().GetAbsPath(path, defaultValue)
+}
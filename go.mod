@@ -1,9 +1,12 @@
 module github.com/wetdesertrock/flexiconfig
 
-go 1.12
+go 1.14
 
 require (
+	github.com/hashicorp/hcl/v2 v2.11.1
 	github.com/mitchellh/mapstructure v1.1.2
-	github.com/yuin/gopher-lua v0.0.0-20190514113301-1cd887cd7036
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/yuin/gopher-lua v1.1.1
+	github.com/zclconf/go-cty v1.8.0
 	layeh.com/gopher-json v0.0.0-20190114024228-97fed8db8427
 )
@@ -0,0 +1,283 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// gobVersion is the version of the format written by GobEncode.
+const gobVersion = 1
+
+// gobSettings is what GobEncode writes.
+type gobSettings struct {
+	Version   int
+	Separator string
+	Settings  map[string]gobValue
+	Defaults  map[string]gobValue
+}
+
+// gobValue is a value of the settings tree as written by GobEncode. Spelling
+// out the types, rather than encoding interface{} values, means nothing has to
+// be registered with gob and the format doesn't depend on what is.
+type gobValue struct {
+	Kind   gobKind
+	String string
+	Float  float64
+	Int    int64
+	Uint   uint64
+	Bool   bool
+	Bytes  []byte
+	Array  []gobValue
+	Map    map[string]gobValue
+}
+
+// gobKind is the type of a gobValue. The values are part of the format and
+// must never change.
+type gobKind uint8
+
+const (
+	gobNil gobKind = iota
+	gobString
+	gobBool
+	gobFloat64
+	gobNumber
+	gobBytes
+	gobArray
+	gobMap
+	gobInt
+	gobInt8
+	gobInt16
+	gobInt32
+	gobInt64
+	gobUint
+	gobUint8
+	gobUint16
+	gobUint32
+	gobUint64
+	gobFloat32
+)
+
+// gobIntKinds maps the kinds of the integer and float32 types to their
+// gobKind.
+var gobIntKinds = map[reflect.Kind]gobKind{
+	reflect.Int:     gobInt,
+	reflect.Int8:    gobInt8,
+	reflect.Int16:   gobInt16,
+	reflect.Int32:   gobInt32,
+	reflect.Int64:   gobInt64,
+	reflect.Uint:    gobUint,
+	reflect.Uint8:   gobUint8,
+	reflect.Uint16:  gobUint16,
+	reflect.Uint32:  gobUint32,
+	reflect.Uint64:  gobUint64,
+	reflect.Float32: gobFloat32,
+}
+
+// gobTypes maps the integer and float32 gobKinds back to their types.
+var gobTypes = map[gobKind]reflect.Type{
+	gobInt:     reflect.TypeOf(int(0)),
+	gobInt8:    reflect.TypeOf(int8(0)),
+	gobInt16:   reflect.TypeOf(int16(0)),
+	gobInt32:   reflect.TypeOf(int32(0)),
+	gobInt64:   reflect.TypeOf(int64(0)),
+	gobUint:    reflect.TypeOf(uint(0)),
+	gobUint8:   reflect.TypeOf(uint8(0)),
+	gobUint16:  reflect.TypeOf(uint16(0)),
+	gobUint32:  reflect.TypeOf(uint32(0)),
+	gobUint64:  reflect.TypeOf(uint64(0)),
+	gobFloat32: reflect.TypeOf(float32(0)),
+}
+
+// GobEncode encodes the settings and defaults, along with the path separator,
+// so that Settings can be part of values encoded with encoding/gob. Sources,
+// secrets, lua modules and the other options are not encoded.
+func (this Settings) GobEncode() ([]byte, error) {
+	this.rlock()
+	encoded := gobSettings{Version: gobVersion, Separator: this.separator}
+	var err error
+	if encoded.Settings, err = toGobMap(this.pathSeparator(), "", this.settings); err == nil {
+		encoded.Defaults, err = toGobMap(this.pathSeparator(), "", this.defaults)
+	}
+	this.runlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(encoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode replaces the settings and defaults with those encoded by
+// GobEncode. Everything else, such as the options set, is kept, except that
+// what is known about sources is forgotten.
+func (this *Settings) GobDecode(b []byte) error {
+	var decoded gobSettings
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&decoded); err != nil {
+		return fmt.Errorf("Could not decode settings: %s", err)
+	}
+	if decoded.Version != gobVersion {
+		return fmt.Errorf("Could not decode settings: unknown version %d", decoded.Version)
+	}
+
+	settings, err := fromGobMap(decoded.Settings)
+	if err != nil {
+		return err
+	}
+	defaults, err := fromGobMap(decoded.Defaults)
+	if err != nil {
+		return err
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	if decoded.Separator != "" {
+		this.separator = decoded.Separator
+		this.provenance.separator = decoded.Separator
+	}
+	for key := range this.settings {
+		delete(this.settings, key)
+	}
+	for key, value := range settings {
+		this.settings[key] = value
+	}
+	for key := range this.defaults {
+		delete(this.defaults, key)
+	}
+	for key, value := range defaults {
+		this.defaults[key] = value
+	}
+
+	this.provenance.paths = make(map[string]int)
+	this.changed("")
+	if this.kinds != nil {
+		for known := range this.kinds {
+			delete(this.kinds, known)
+		}
+		this.recordKinds("", this.settings)
+	}
+	if this.order != nil {
+		this.order.sync(this.pathSeparator(), "", this.settings, nil)
+	}
+	return nil
+}
+
+// toGobMap converts the map m, found at path, to gobValues.
+func toGobMap(sep, path string, m map[string]interface{}) (map[string]gobValue, error) {
+	converted := make(map[string]gobValue, len(m))
+	for key, value := range m {
+		var err error
+		if converted[key], err = toGobValue(sep, joinPathWith(sep, path, key), value); err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// toGobValue converts value, found at path, to a gobValue.
+func toGobValue(sep, path string, value interface{}) (gobValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return gobValue{Kind: gobNil}, nil
+	case string:
+		return gobValue{Kind: gobString, String: v}, nil
+	case bool:
+		return gobValue{Kind: gobBool, Bool: v}, nil
+	case float64:
+		return gobValue{Kind: gobFloat64, Float: v}, nil
+	case json.Number:
+		return gobValue{Kind: gobNumber, String: string(v)}, nil
+	case []byte:
+		return gobValue{Kind: gobBytes, Bytes: v}, nil
+	case []interface{}:
+		array := make([]gobValue, len(v))
+		for i, element := range v {
+			var err error
+			if array[i], err = toGobValue(sep, fmt.Sprintf("%s[%d]", path, i), element); err != nil {
+				return gobValue{}, err
+			}
+		}
+		return gobValue{Kind: gobArray, Array: array}, nil
+	case map[string]interface{}:
+		m, err := toGobMap(sep, path, v)
+		return gobValue{Kind: gobMap, Map: m}, err
+	}
+
+	rv := reflect.ValueOf(value)
+	kind, ok := gobIntKinds[rv.Kind()]
+	if !ok {
+		return gobValue{}, fmt.Errorf("Could not encode %s: unsupported type %T", describePath(path), value)
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return gobValue{Kind: kind, Int: rv.Int()}, nil
+	case reflect.Float32:
+		return gobValue{Kind: kind, Float: rv.Float()}, nil
+	default:
+		return gobValue{Kind: kind, Uint: rv.Uint()}, nil
+	}
+}
+
+// fromGobMap converts gobValues back to a map of the settings tree.
+func fromGobMap(m map[string]gobValue) (map[string]interface{}, error) {
+	converted := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		var err error
+		if converted[key], err = fromGobValue(value); err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// fromGobValue converts a gobValue back to a value of the settings tree.
+func fromGobValue(value gobValue) (interface{}, error) {
+	switch value.Kind {
+	case gobNil:
+		return nil, nil
+	case gobString:
+		return value.String, nil
+	case gobBool:
+		return value.Bool, nil
+	case gobFloat64:
+		return value.Float, nil
+	case gobNumber:
+		return json.Number(value.String), nil
+	case gobBytes:
+		if value.Bytes == nil {
+			// gob doesn't tell empty and nil slices apart.
+			return []byte{}, nil
+		}
+		return value.Bytes, nil
+	case gobArray:
+		array := make([]interface{}, len(value.Array))
+		for i, element := range value.Array {
+			var err error
+			if array[i], err = fromGobValue(element); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case gobMap:
+		return fromGobMap(value.Map)
+	}
+
+	t, ok := gobTypes[value.Kind]
+	if !ok {
+		return nil, fmt.Errorf("Could not decode settings: unknown kind %d", value.Kind)
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(value.Int).Convert(t).Interface(), nil
+	case reflect.Float32:
+		return reflect.ValueOf(value.Float).Convert(t).Interface(), nil
+	default:
+		return reflect.ValueOf(value.Uint).Convert(t).Interface(), nil
+	}
+}
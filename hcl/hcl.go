@@ -0,0 +1,172 @@
+// Package hcl loads flexiconfig settings written in HCL, using the native
+// syntax of HCL2. It is a separate package so that only programs using it
+// depend on the HCL library. Importing it also registers the hcl format, so
+// that LoadFile loads files with the .hcl extension.
+//
+// Attributes become values, numbers being float64 as in JSON configs. Blocks
+// become maps nested under their type and then under each of their labels,
+// while blocks repeated with the same type and labels become an array of maps.
+// Expressions are evaluated without any variables or functions.
+package hcl
+
+import (
+	"fmt"
+	"math"
+
+	hcl2 "github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/wetdesertrock/flexiconfig"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func init() {
+	flexiconfig.RegisterFileFormat("hcl", Decode)
+}
+
+// Load decodes the HCL in b and merges it into settings, like MergeSettings.
+func Load(settings *flexiconfig.Settings, b []byte) error {
+	newSettings, err := Decode(b)
+	if err != nil {
+		return fmt.Errorf("Could not load HCL: %s", err)
+	}
+	return settings.MergeSettings(newSettings)
+}
+
+// LoadFile loads the HCL file at path into settings, whatever its extension.
+func LoadFile(settings *flexiconfig.Settings, path string) error {
+	return settings.LoadFileAs(path, "hcl")
+}
+
+// Decode decodes the HCL in b into a settings tree.
+func Decode(b []byte) (map[string]interface{}, error) {
+	file, diags := hclsyntax.ParseConfig(b, "", hcl2.InitialPos)
+	if diags.HasErrors() {
+		return nil, diagnosticsError(diags)
+	}
+	return decodeBody(file.Body.(*hclsyntax.Body))
+}
+
+// decodeBody converts the attributes and blocks of body to a map.
+func decodeBody(body *hclsyntax.Body) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(body.Attributes)+len(body.Blocks))
+	for name, attribute := range body.Attributes {
+		value, diags := attribute.Expr.Value(nil)
+		if diags.HasErrors() {
+			return nil, diagnosticsError(diags)
+		}
+		converted, err := fromCty(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", describeRange(attribute.SrcRange), err)
+		}
+		m[name] = converted
+	}
+
+	for _, block := range body.Blocks {
+		if _, ok := body.Attributes[block.Type]; ok {
+			return nil, fmt.Errorf("%s: %s is both an attribute and a block", describeRange(block.DefRange()), block.Type)
+		}
+		content, err := decodeBody(block.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		parent, key := m, block.Type
+		for _, label := range block.Labels {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				if _, exists := parent[key]; exists {
+					return nil, fmt.Errorf("%s: every %s block must have the same number of labels", describeRange(block.DefRange()), block.Type)
+				}
+				child = make(map[string]interface{})
+				parent[key] = child
+			}
+			parent, key = child, label
+		}
+
+		switch existing := parent[key].(type) {
+		case nil:
+			parent[key] = content
+		case map[string]interface{}:
+			parent[key] = []interface{}{existing, content}
+		case []interface{}:
+			parent[key] = append(existing, content)
+		default:
+			return nil, fmt.Errorf("%s: %s block conflicts with an attribute", describeRange(block.DefRange()), block.Type)
+		}
+	}
+	return m, nil
+}
+
+// fromCty converts the value of an expression to a value of the settings tree.
+func fromCty(value cty.Value) (interface{}, error) {
+	if value.IsNull() {
+		return nil, nil
+	}
+	if !value.IsKnown() {
+		return nil, fmt.Errorf("value is not known")
+	}
+
+	t := value.Type()
+	switch {
+	case t == cty.String:
+		return value.AsString(), nil
+	case t == cty.Bool:
+		return value.True(), nil
+	case t == cty.Number:
+		f, _ := value.AsBigFloat().Float64()
+		if math.IsInf(f, 0) {
+			return nil, fmt.Errorf("number %s does not fit in a float64", value.AsBigFloat().String())
+		}
+		return f, nil
+	case t.IsListType() || t.IsTupleType() || t.IsSetType():
+		array := make([]interface{}, 0, value.LengthInt())
+		for it := value.ElementIterator(); it.Next(); {
+			_, element := it.Element()
+			converted, err := fromCty(element)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, converted)
+		}
+		return array, nil
+	case t.IsMapType() || t.IsObjectType():
+		m := make(map[string]interface{}, value.LengthInt())
+		for it := value.ElementIterator(); it.Next(); {
+			key, element := it.Element()
+			converted, err := fromCty(element)
+			if err != nil {
+				return nil, err
+			}
+			m[key.AsString()] = converted
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t.FriendlyName())
+	}
+}
+
+// diagnosticsError turns the errors among diags into an error, explaining
+// that variables and functions aren't supported.
+func diagnosticsError(diags hcl2.Diagnostics) error {
+	for _, diag := range diags {
+		if diag.Severity != hcl2.DiagError {
+			continue
+		}
+		message := fmt.Sprintf("%s; %s", diag.Summary, diag.Detail)
+		switch diag.Summary {
+		case "Function calls not allowed":
+			message = "functions are not supported in HCL configs"
+		case "Variables not allowed":
+			message = "variables are not supported in HCL configs"
+		}
+		if diag.Subject != nil {
+			return fmt.Errorf("%s: %s", describeRange(*diag.Subject), message)
+		}
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+func describeRange(r hcl2.Range) string {
+	return fmt.Sprintf("line %d, column %d", r.Start.Line, r.Start.Column)
+}
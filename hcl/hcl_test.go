@@ -0,0 +1,104 @@
+package hcl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+const config = `
+name    = "service"
+port    = 8000 + 80
+enabled = true
+tags    = ["a", "b"]
+limits  = { cpu = 0.5, memory = "1G" }
+
+database {
+  host = "db"
+}
+
+listener "http" {
+  port = 80
+}
+
+listener "https" {
+  port = 443
+}
+
+worker {
+  queue = "a"
+}
+
+worker {
+  queue = "b"
+}
+`
+
+func TestDecode(t *testing.T) {
+	got, err := Decode([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"name":     "service",
+		"port":     8080.0,
+		"enabled":  true,
+		"tags":     []interface{}{"a", "b"},
+		"limits":   map[string]interface{}{"cpu": 0.5, "memory": "1G"},
+		"database": map[string]interface{}{"host": "db"},
+		"listener": map[string]interface{}{
+			"http":  map[string]interface{}{"port": 80.0},
+			"https": map[string]interface{}{"port": 443.0},
+		},
+		"worker": []interface{}{
+			map[string]interface{}{"queue": "a"},
+			map[string]interface{}{"queue": "b"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode returned %#v, want %#v", got, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := map[string]string{
+		`a = upper("x")`:        "functions are not supported",
+		`a = b`:                 "variables are not supported",
+		`a = 1` + "\n" + `a {}`: "both an attribute and a block",
+		`a = `:                  "line 1",
+	}
+	for config, want := range tests {
+		if _, err := Decode([]byte(config)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Decode(%q) returned %v, want an error containing %q", config, err, want)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.hcl")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := flexiconfig.NewSettings()
+	if err := settings.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := settings.GetInt("listener:https:port", 0); err != nil || port != 443 {
+		t.Errorf("listener:https:port is %d, %v, want 443", port, err)
+	}
+	if workers, err := settings.RawGet("worker"); err != nil || len(workers.([]interface{})) != 2 {
+		t.Errorf("worker is %#v, %v, want 2 workers", workers, err)
+	}
+}
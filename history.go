@@ -0,0 +1,253 @@
+package flexiconfig
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// DefaultMaxHistory is how many revisions EnableHistory keeps across every
+// path, unless changed with SetMaxHistory.
+const DefaultMaxHistory = 1000
+
+// Revision is a value a path held before it was changed, see EnableHistory.
+type Revision struct {
+	// Time is when the value was replaced or removed.
+	Time time.Time
+	// Old is the value before the change.
+	Old interface{}
+	// Source names what changed it: the source that was merged, or RawSet,
+	// Delete, Append or Reload.
+	Source string
+}
+
+// valueHistory holds the revisions of every path, shared by every copy of a
+// Settings and guarded by their lock.
+type valueHistory struct {
+	depth     int
+	max       int
+	revisions map[string][]historyEntry
+	// queue lists the revisions from oldest to newest, to evict the oldest
+	// once there are more than max. Entries whose revision was already evicted
+	// for being too deep are skipped.
+	queue []historyRef
+	total int
+	added uint64
+}
+
+type historyEntry struct {
+	id       uint64
+	revision Revision
+}
+
+type historyRef struct {
+	path string
+	id   uint64
+}
+
+// EnableHistory makes the settings remember the last depthPerKey values of
+// every leaf path changed by a load, RawSet, Delete, Append or Reload, see
+// History. Paths being added have no previous value, and so no revision. At
+// most DefaultMaxHistory revisions are kept in total, or what SetMaxHistory
+// allows, evicting the oldest first. A depthPerKey of 0 disables the history
+// and forgets it.
+func (this *Settings) EnableHistory(depthPerKey int) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.history.depth = depthPerKey
+	if depthPerKey <= 0 {
+		this.history.forget()
+		return
+	}
+	for path, entries := range this.history.revisions {
+		if len(entries) > depthPerKey {
+			this.history.total -= len(entries) - depthPerKey
+			this.history.revisions[path] = append([]historyEntry(nil), entries[len(entries)-depthPerKey:]...)
+		}
+	}
+	this.history.evict()
+}
+
+// SetMaxHistory sets how many revisions EnableHistory keeps in total, across
+// every path. Zero means DefaultMaxHistory.
+func (this *Settings) SetMaxHistory(max int) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.history.max = max
+	this.history.evict()
+}
+
+// History returns the values path held before its latest changes, oldest
+// first. It is empty unless EnableHistory was called before they changed.
+func (this Settings) History(path string) []Revision {
+	this.rlock()
+	defer this.runlock()
+
+	entries := this.history.revisions[this.normalizePath(path)]
+	revisions := make([]Revision, len(entries))
+	for i, entry := range entries {
+		revisions[i] = entry.revision
+		revisions[i].Old = deepCopy(entry.revision.Old)
+	}
+	return revisions
+}
+
+// forget drops every revision.
+func (this *valueHistory) forget() {
+	this.revisions = nil
+	this.queue = nil
+	this.total = 0
+}
+
+// add records revision for path.
+func (this *valueHistory) add(path string, revision Revision) {
+	if this.revisions == nil {
+		this.revisions = make(map[string][]historyEntry)
+	}
+	this.added++
+	entries := append(this.revisions[path], historyEntry{id: this.added, revision: revision})
+	if len(entries) > this.depth {
+		entries = append([]historyEntry(nil), entries[len(entries)-this.depth:]...)
+	} else {
+		this.total++
+	}
+	this.revisions[path] = entries
+	this.queue = append(this.queue, historyRef{path: path, id: this.added})
+	this.evict()
+}
+
+// evict drops the oldest revisions until there are no more than the maximum.
+func (this *valueHistory) evict() {
+	max := this.max
+	if max <= 0 {
+		max = DefaultMaxHistory
+	}
+	for this.total > max && len(this.queue) > 0 {
+		ref := this.queue[0]
+		this.queue = this.queue[1:]
+		entries := this.revisions[ref.path]
+		if len(entries) == 0 || entries[0].id != ref.id {
+			continue
+		}
+		if len(entries) == 1 {
+			delete(this.revisions, ref.path)
+		} else {
+			this.revisions[ref.path] = entries[1:]
+		}
+		this.total--
+	}
+
+	// Revisions dropped for being too deep leave their entry in the queue,
+	// so clear those out once they pile up.
+	if len(this.queue) > 2*this.total+16 {
+		queue := make([]historyRef, 0, this.total)
+		for _, ref := range this.queue {
+			entries := this.revisions[ref.path]
+			for _, entry := range entries {
+				if entry.id == ref.id {
+					queue = append(queue, ref)
+					break
+				}
+			}
+		}
+		this.queue = queue
+	}
+}
+
+// historyMark holds the values at some paths before they are changed, to be
+// given to recordHistory afterwards.
+type historyMark map[string]markedValue
+
+type markedValue struct {
+	value  interface{}
+	exists bool
+}
+
+// markHistory returns a copy of the values at paths, or nil unless the history
+// is enabled. The caller must hold the write lock.
+func (this Settings) markHistory(paths ...string) historyMark {
+	if this.history.depth <= 0 {
+		return nil
+	}
+	mark := make(historyMark, len(paths))
+	for _, path := range paths {
+		value, exists := this.lookupHistory(path)
+		mark[path] = markedValue{value: deepCopy(value), exists: exists}
+	}
+	return mark
+}
+
+// recordHistory records the revisions of the paths of mark that changed since
+// it was taken, changed by source. The caller must hold the write lock.
+func (this Settings) recordHistory(source string, mark historyMark) {
+	if mark == nil {
+		return
+	}
+	paths := make([]string, 0, len(mark))
+	for path := range mark {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var changes []Change
+	for _, path := range paths {
+		old := mark[path]
+		value, exists := this.lookupHistory(path)
+		oldmap, oldIsMap := old.value.(map[string]interface{})
+		newmap, newIsMap := value.(map[string]interface{})
+		switch {
+		case !old.exists:
+			continue
+		case !exists:
+			changes = append(changes, Change{Path: path, Type: ChangeRemoved, Old: old.value})
+		case oldIsMap && newIsMap:
+			changes = diffMaps(this.pathSeparator(), path, oldmap, newmap, changes)
+		case !sameValue(old.value, value):
+			changes = append(changes, Change{Path: path, Type: ChangeModified, Old: old.value, New: value})
+		}
+	}
+	this.recordChanges(source, changes)
+}
+
+// recordChanges records the revisions of changes, made by source, if the
+// history is enabled. Maps that were replaced or removed as a whole are
+// recorded leaf by leaf. The caller must hold the write lock.
+func (this Settings) recordChanges(source string, changes []Change) {
+	if this.history.depth <= 0 {
+		return
+	}
+	now := time.Now()
+	sep := this.pathSeparator()
+	for _, change := range changes {
+		if change.Type == ChangeAdded {
+			continue
+		}
+		oldmap, ok := change.Old.(map[string]interface{})
+		if !ok || len(oldmap) == 0 {
+			this.history.add(change.Path, Revision{Time: now, Old: deepCopy(change.Old), Source: source})
+			continue
+		}
+
+		leaves := flatten(sep, oldmap)
+		paths := make([]string, 0, len(leaves))
+		for path := range leaves {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			this.history.add(joinPathWith(sep, change.Path, path), Revision{Time: now, Old: deepCopy(leaves[path]), Source: source})
+		}
+	}
+}
+
+// lookupHistory returns the value at path, and whether there is one, null
+// included.
+func (this Settings) lookupHistory(path string) (interface{}, bool) {
+	value, err := this.rawGet(path)
+	if err != nil {
+		return nil, errors.Is(err, ErrNullValue)
+	}
+	return value, true
+}
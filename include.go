@@ -0,0 +1,93 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// maxIncludeRounds caps how many times ProcessIncludes looks for new includes.
+const maxIncludeRounds = 100
+
+// IncludeOption changes how ProcessIncludes loads files.
+type IncludeOption int
+
+const (
+	// IncludeOptional skips included files that don't exist instead of
+	// failing.
+	IncludeOptional IncludeOption = iota
+)
+
+// ProcessIncludes loads the files listed in the array of paths at key, in
+// order, using LoadFile. Relative paths are relative to baseDir. The key is
+// removed before the files are loaded, and if they set it again the files
+// they list are loaded as well, until no more includes are left. Including
+// the same file twice is an error, as is a listed file that doesn't exist
+// unless IncludeOptional is given.
+func (this *Settings) ProcessIncludes(key string, baseDir string, options ...IncludeOption) error {
+	optional := false
+	for _, option := range options {
+		if option == IncludeOptional {
+			optional = true
+		}
+	}
+
+	included := make(map[string]bool)
+	for round := 0; ; round++ {
+		paths, err := this.includes(key)
+		if err != nil || paths == nil {
+			return err
+		}
+		if round == maxIncludeRounds {
+			return fmt.Errorf("Could not process %s: still finding includes after %d rounds", key, maxIncludeRounds)
+		}
+		if err := this.Delete(key); err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if path, err = expandHome(path); err != nil {
+				return fmt.Errorf("Could not include %s: %s", path, err)
+			}
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("Could not include %s: %s", path, err)
+			}
+			if included[abs] {
+				return fmt.Errorf("Could not include %s: it is included more than once", path)
+			}
+			included[abs] = true
+
+			if _, err := os.Stat(path); optional && os.IsNotExist(err) {
+				continue
+			}
+			if err := this.LoadFile(path); err != nil {
+				return fmt.Errorf("Could not include %s: %w", path, err)
+			}
+		}
+	}
+}
+
+// includes returns the paths listed at key, or nil if key isn't set.
+func (this Settings) includes(key string) ([]string, error) {
+	raw, err := this.RawGet(key)
+	if err != nil {
+		return nil, nil
+	}
+
+	array, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not an array", key)
+	}
+	paths := make([]string, len(array))
+	for i, value := range array {
+		if paths[i], ok = value.(string); !ok {
+			return nil, fmt.Errorf("%s[%d] is not a string", key, i)
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,150 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// SetWeaklyTyped makes Get and the getters built on it convert between types
+// more freely: strings such as "42" or "true" are parsed, bools become 0 or 1,
+// and fractional numbers are rounded to the nearest integer when stored in an
+// integer. By default storing 4.7 in an integer is an error, and so is getting
+// a bool or a string with GetInt, GetUint or GetFloat. GetBool and bool fields
+// accept the strings GetBoolLenient does, such as "on" or "no", while
+// GetString never converts.
+func (this *Settings) SetWeaklyTyped(weak bool) {
+	this.weaklyTyped = weak
+}
+
+// getNumber is Get for the numeric getters, which only accept numbers, and
+// strings for GetDuration. Any other type is an error naming it, except that
+// bools and strings are converted when weakly typed.
+func (this Settings) getNumber(path string, target interface{}) error {
+	rawvalue, err := this.getTyped(path)
+	if err != nil {
+		return err
+	}
+	return this.numberValue(path, rawvalue, target)
+}
+
+// numberValue stores rawvalue, found at path, in target as getNumber does.
+func (this Settings) numberValue(path string, rawvalue interface{}, target interface{}) error {
+	want := "a number"
+	_, isDuration := target.(*time.Duration)
+	if isDuration {
+		want = "a duration"
+	}
+	switch rawvalue.(type) {
+	case map[string]interface{}, []interface{}:
+		return typeError(path, rawvalue, want)
+	case bool:
+		if !this.weaklyTyped {
+			return typeError(path, rawvalue, want)
+		}
+	case string:
+		if !this.weaklyTyped && !isDuration {
+			return typeError(path, rawvalue, want)
+		}
+	}
+	return this.decode(path, rawvalue, target)
+}
+
+// integerHook returns a mapstructure decode hook that checks numbers stored in
+// integers. Fractional numbers are an error unless round is set, and so are
+// numbers outside of the range of the target type.
+func integerHook(round bool) mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if !isInteger(to.Kind()) {
+			return data, nil
+		}
+
+		var f float64
+		switch v := reflect.ValueOf(data); v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			f = v.Float()
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("%v is not an integer", data)
+			}
+			if f != math.Trunc(f) {
+				if !round {
+					return nil, fmt.Errorf("%v is not an integer", data)
+				}
+				f = math.Round(f)
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return checkInt(v.Int(), to, data)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return checkUint(v.Uint(), to, data)
+		default:
+			return data, nil
+		}
+
+		bits := float64(to.Bits())
+		switch to.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if f < -math.Pow(2, bits-1) || f >= math.Pow(2, bits-1) {
+				return nil, fmt.Errorf("%v does not fit in %s", data, to)
+			}
+			return reflect.ValueOf(int64(f)).Convert(to).Interface(), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if f < 0 || f >= math.Pow(2, bits) {
+				return nil, fmt.Errorf("%v does not fit in %s", data, to)
+			}
+			return reflect.ValueOf(uint64(f)).Convert(to).Interface(), nil
+		default:
+			return data, nil
+		}
+	}
+}
+
+// checkInt checks that i, the integer in data, fits in the type to.
+func checkInt(i int64, to reflect.Type, data interface{}) (interface{}, error) {
+	switch to.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := uint(to.Bits())
+		if bits < 64 && (i < -1<<(bits-1) || i >= 1<<(bits-1)) {
+			return nil, fmt.Errorf("%v does not fit in %s", data, to)
+		}
+		return reflect.ValueOf(i).Convert(to).Interface(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i < 0 {
+			return nil, fmt.Errorf("%v does not fit in %s", data, to)
+		}
+		return checkUint(uint64(i), to, data)
+	default:
+		return data, nil
+	}
+}
+
+// checkUint checks that u, the unsigned integer in data, fits in the type to.
+func checkUint(u uint64, to reflect.Type, data interface{}) (interface{}, error) {
+	bits := uint(to.Bits())
+	switch to.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if u >= 1<<(bits-1) {
+			return nil, fmt.Errorf("%v does not fit in %s", data, to)
+		}
+		return reflect.ValueOf(int64(u)).Convert(to).Interface(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if bits < 64 && u >= 1<<bits {
+			return nil, fmt.Errorf("%v does not fit in %s", data, to)
+		}
+		return reflect.ValueOf(u).Convert(to).Interface(), nil
+	default:
+		return data, nil
+	}
+}
+
+func isInteger(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	default:
+		return false
+	}
+}
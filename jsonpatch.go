@@ -0,0 +1,320 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// patchOperation is a single operation of a JSON Patch.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// GetByPointer returns the value at the RFC 6901 JSON Pointer ptr, such as
+// "/server/hosts/0". Unlike paths, pointers can reach into arrays and use any
+// key: "~1" stands for "/" and "~0" for "~". The empty pointer returns a copy
+// of the whole tree.
+func (this Settings) GetByPointer(ptr string) (interface{}, error) {
+	tokens, err := parsePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	this.rlock()
+	defer this.runlock()
+
+	if len(tokens) == 0 {
+		return deepCopy(this.settings), nil
+	}
+	return pointerGet(this.settings, tokens, ptr)
+}
+
+// ApplyJSONPatch applies an RFC 6902 JSON Patch, an array of add, remove,
+// replace, move, copy and test operations, to the settings. The patch is
+// applied as a whole or not at all: if any operation fails, including a test,
+// or a validator rejects a value it changes, the settings are left as they
+// were. Otherwise it is committed like a load, recorded in the history and
+// followed by the post-load hooks.
+func (this *Settings) ApplyJSONPatch(patch []byte) error {
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return fmt.Errorf("Invalid JSON Patch: %s", err)
+	}
+
+	this.wlock()
+	err := this.applyJSONPatch(operations)
+	this.wunlock()
+	return this.afterLoad(err)
+}
+
+// applyJSONPatch is ApplyJSONPatch without locking or hooks.
+func (this *Settings) applyJSONPatch(operations []patchOperation) error {
+	var doc interface{} = deepCopy(this.settings)
+	var touched []string
+	for i, operation := range operations {
+		var err error
+		var paths []string
+		if doc, paths, err = this.applyPatchOperation(doc, operation); err != nil {
+			return fmt.Errorf("Could not apply JSON Patch operation %d (%s): %s", i, operation.Op, err)
+		}
+		touched = append(touched, paths...)
+	}
+
+	settings, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Could not apply JSON Patch: the settings must stay an object, not become %s", typeName(doc))
+	}
+	if this.kinds != nil {
+		if err := this.checkMergeKinds("ApplyJSONPatch", nil, settings, "", false); err != nil {
+			return err
+		}
+	}
+	return this.replaceSettings("ApplyJSONPatch", settings, touched)
+}
+
+// applyPatchOperation applies operation to doc and returns the new doc and the
+// paths, up to the first array, of everything it changed.
+func (this Settings) applyPatchOperation(doc interface{}, operation patchOperation) (interface{}, []string, error) {
+	if operation.Path == nil {
+		return nil, nil, fmt.Errorf("missing path")
+	}
+	tokens, err := parsePointer(*operation.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if operation.Value == nil {
+			return nil, nil, fmt.Errorf("missing value")
+		}
+		if err := this.unmarshalJSON(operation.Value, &value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value: %s", err)
+		}
+	case "move", "copy":
+		if operation.From == nil {
+			return nil, nil, fmt.Errorf("missing from")
+		}
+	case "remove":
+	default:
+		return nil, nil, fmt.Errorf("unknown operation")
+	}
+
+	touched := []string{this.pointerPath(tokens)}
+	switch operation.Op {
+	case "add":
+		doc, err = pointerAdd(doc, tokens, value, *operation.Path)
+	case "remove":
+		doc, err = pointerRemove(doc, tokens, *operation.Path)
+	case "replace":
+		if len(tokens) == 0 {
+			doc = value
+		} else if doc, err = pointerRemove(doc, tokens, *operation.Path); err == nil {
+			doc, err = pointerAdd(doc, tokens, value, *operation.Path)
+		}
+	case "move", "copy":
+		var from []string
+		if from, err = parsePointer(*operation.From); err != nil {
+			return nil, nil, err
+		}
+		if value, err = pointerGet(doc, from, *operation.From); err != nil {
+			return nil, nil, err
+		}
+
+		if operation.Op == "copy" {
+			value = deepCopy(value)
+		} else if *operation.Path != *operation.From {
+			if strings.HasPrefix(*operation.Path, *operation.From+"/") {
+				return nil, nil, fmt.Errorf("can't move %s into itself", *operation.From)
+			}
+			if doc, err = pointerRemove(doc, from, *operation.From); err != nil {
+				return nil, nil, err
+			}
+			touched = append(touched, this.pointerPath(from))
+		}
+		doc, err = pointerAdd(doc, tokens, value, *operation.Path)
+	case "test":
+		var existing interface{}
+		if existing, err = pointerGet(doc, tokens, *operation.Path); err == nil && !sameValue(existing, value) {
+			err = fmt.Errorf("%s is %s, not %s", *operation.Path, describeValue(existing), describeValue(value))
+		}
+		touched = nil
+	}
+	return doc, touched, err
+}
+
+// describeValue returns value as JSON for error messages.
+func describeValue(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped tokens.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("Invalid JSON Pointer %q: it must start with /", ptr)
+	}
+
+	tokens := strings.Split(ptr[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] != '~' {
+				continue
+			}
+			if j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1') {
+				return nil, fmt.Errorf("Invalid JSON Pointer %q: ~ must be followed by 0 or 1", ptr)
+			}
+			j++
+		}
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// pointerPath returns the path of the map value tokens lead into, stopping at
+// the first array index.
+func (this Settings) pointerPath(tokens []string) string {
+	path := ""
+	for _, token := range tokens {
+		if _, err := strconv.Atoi(token); err == nil || token == "-" {
+			// This might be an array index, which paths can't express, so
+			// stop at the value that contains it.
+			break
+		}
+		path = this.joinPath(path, token)
+	}
+	return path
+}
+
+// pointerGet returns the value at tokens in doc.
+func pointerGet(doc interface{}, tokens []string, ptr string) (interface{}, error) {
+	node := doc
+	for i, token := range tokens {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			child, ok := container[token]
+			if !ok {
+				return nil, newNotFoundError(ptr, token)
+			}
+			node = child
+		case []interface{}:
+			index, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, newNotFoundError(ptr, token)
+			}
+			node = container[index]
+		default:
+			return nil, newNotFoundError(ptr, strings.Join(tokens[:i+1], "/"))
+		}
+	}
+	return node, nil
+}
+
+// pointerUpdate calls update with the container holding the value at tokens,
+// and the last token, and returns doc with the container replaced by the one
+// update returns.
+func pointerUpdate(doc interface{}, tokens []string, ptr string, update func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+
+	child, err := pointerGet(doc, tokens[:1], ptr)
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerUpdate(child, tokens[1:], ptr, update); err != nil {
+		return nil, err
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(container))
+		container[index] = child
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at tokens in doc, as the add operation of a JSON
+// Patch does, and returns the new doc.
+func pointerAdd(doc interface{}, tokens []string, value interface{}, ptr string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, ptr, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			index, err := arrayIndex(token, len(c)+1)
+			if err != nil {
+				return nil, fmt.Errorf("Could not add %s: %s", ptr, err)
+			}
+			c = append(c, nil)
+			copy(c[index+1:], c[index:])
+			c[index] = value
+			return c, nil
+		default:
+			return nil, fmt.Errorf("Could not add %s: its parent is %s", ptr, typeName(container))
+		}
+	})
+}
+
+// pointerRemove removes the value at tokens from doc and returns the new doc.
+func pointerRemove(doc interface{}, tokens []string, ptr string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Could not remove the whole settings")
+	}
+	return pointerUpdate(doc, tokens, ptr, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, newNotFoundError(ptr, token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, newNotFoundError(ptr, token)
+			}
+			return append(c[:index], c[index+1:]...), nil
+		default:
+			return nil, newNotFoundError(ptr, token)
+		}
+	})
+}
+
+// arrayIndex parses an array index token, which must be below length.
+func arrayIndex(token string, length int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%q is not an array index", token)
+		}
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index >= length {
+		return 0, fmt.Errorf("index %s is out of range", token)
+	}
+	return index, nil
+}
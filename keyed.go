@@ -0,0 +1,80 @@
+package flexiconfig
+
+import "fmt"
+
+// GetKeyed returns the array of objects stored in the path as a map from the
+// value of each object's keyField to the object, such as the servers in
+//
+//	{"servers": [{"name": "primary", "host": "a"}, {"name": "backup", "host": "b"}]}
+//
+// keyed by "name". Every element must be an object whose keyField is a string,
+// and no two elements may have the same one; the error of an element that
+// isn't names its index. The objects returned are copies.
+func (this Settings) GetKeyed(path string, keyField string) (map[string]map[string]interface{}, error) {
+	array, err := this.getObjectArray(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyed := make(map[string]map[string]interface{}, len(array))
+	indexes := make(map[string]int, len(array))
+	for i, element := range array {
+		key, err := this.elementKey(path, i, element, keyField)
+		if err != nil {
+			return nil, err
+		}
+		if previous, ok := indexes[key]; ok {
+			return nil, fmt.Errorf("%s[%d] has the same %s as %s[%d], %q", path, i, keyField, path, previous, key)
+		}
+		indexes[key] = i
+		keyed[key] = deepCopy(element).(map[string]interface{})
+	}
+	return keyed, nil
+}
+
+// GetByKey decodes the object in the array stored in the path whose keyField
+// is keyValue into target, like Get does. Elements are checked as by
+// GetKeyed. If no element matches the error matches ErrNotFound.
+func (this Settings) GetByKey(path string, keyField string, keyValue string, target interface{}) error {
+	keyed, err := this.GetKeyed(path, keyField)
+	if err != nil {
+		return err
+	}
+	element, ok := keyed[keyValue]
+	if !ok {
+		return &notFoundError{fmt.Sprintf("Could not find %s with %s %q", path, keyField, keyValue)}
+	}
+	return this.decode(fmt.Sprintf("%s[%s=%s]", path, keyField, keyValue), element, target)
+}
+
+// getObjectArray returns the array stored in the path.
+func (this Settings) getObjectArray(path string) ([]interface{}, error) {
+	rawvalue, err := this.getTyped(path)
+	if err != nil {
+		return nil, err
+	}
+	array, ok := rawvalue.([]interface{})
+	if !ok {
+		return nil, typeError(path, rawvalue, "an array")
+	}
+	return array, nil
+}
+
+// elementKey returns the keyField of element, the element at index i of the
+// array stored in the path.
+func (this Settings) elementKey(path string, i int, element interface{}, keyField string) (string, error) {
+	elementPath := fmt.Sprintf("%s[%d]", path, i)
+	object, ok := element.(map[string]interface{})
+	if !ok {
+		return "", typeError(elementPath, element, "an object")
+	}
+	value, ok := object[keyField]
+	if !ok || value == nil {
+		return "", fmt.Errorf("%s has no %s", elementPath, keyField)
+	}
+	key, ok := value.(string)
+	if !ok {
+		return "", typeError(this.joinPath(elementPath, keyField), value, "a string")
+	}
+	return key, nil
+}
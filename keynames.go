@@ -0,0 +1,147 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SetKeyNormalizer makes every key loaded from now on renamed by fn, so that
+// the settings use a single convention whatever their sources use, such as
+// SnakeCaseKey turning "maxConnections" into "max_connections". Paths given
+// to getters, RawSet, Append and Delete are normalized the same way, one
+// segment at a time, so "db:maxConn" finds "db:max_conn". Two keys of the same
+// map that normalize to the same key are an error.
+//
+// fn must return keys it already normalized unchanged. Settings loaded
+// before calling SetKeyNormalizer are not renamed.
+func (this *Settings) SetKeyNormalizer(fn func(key string) string) {
+	this.keyNormalizer = fn
+}
+
+// SetKeyDenormalizer renames every key in the JSON output of the settings, such
+// as GetJSON and String, by fn, for example CamelCaseKey to restore the style
+// of configs normalized with SnakeCaseKey. Getters and paths are unaffected.
+func (this *Settings) SetKeyDenormalizer(fn func(key string) string) {
+	this.keyDenormalizer = fn
+}
+
+// SnakeCaseKey returns key in snake_case, splitting it into words where the
+// case changes: "maxConnections" becomes "max_connections" and "HTTPServer"
+// becomes "http_server". It can be given to SetKeyNormalizer.
+func SnakeCaseKey(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && runes[i-1] != '_' && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// LowerCaseKey returns key in lower case, making keys case insensitive. It can
+// be given to SetKeyNormalizer.
+func LowerCaseKey(key string) string {
+	return strings.ToLower(key)
+}
+
+// CamelCaseKey returns the snake_case key in camelCase, "max_connections"
+// becoming "maxConnections". It can be given to SetKeyDenormalizer.
+func CamelCaseKey(key string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range key {
+		switch {
+		case r == '_' && b.Len() > 0:
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeKeys returns value, found at path, with the keys of every map in it
+// renamed by the key normalizer, if there is one.
+func (this Settings) normalizeKeys(path string, value interface{}) (interface{}, error) {
+	if this.keyNormalizer == nil {
+		return value, nil
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		m := make(map[string]interface{}, len(value))
+		originals := make(map[string]string, len(value))
+		for _, key := range keys {
+			normalized := this.keyNormalizer(key)
+			if original, ok := originals[normalized]; ok {
+				return nil, fmt.Errorf("Keys %q and %q in %s both normalize to %q", original, key, describePath(path), normalized)
+			}
+			originals[normalized] = key
+
+			child, err := this.normalizeKeys(this.joinPath(path, normalized), value[key])
+			if err != nil {
+				return nil, err
+			}
+			m[normalized] = child
+		}
+		return m, nil
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, child := range value {
+			var err error
+			if array[i], err = this.normalizeKeys(fmt.Sprintf("%s[%d]", path, i), child); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return value, nil
+}
+
+// normalizePath returns path with every segment renamed by the key
+// normalizer, if there is one.
+func (this Settings) normalizePath(path string) string {
+	if this.keyNormalizer == nil || path == "" {
+		return path
+	}
+	parts := this.splitPath(path)
+	for i, part := range parts {
+		parts[i] = this.keyNormalizer(part)
+	}
+	return strings.Join(parts, this.pathSeparator())
+}
+
+// normalizeOrder returns order, recorded while reading, with its paths and keys
+// renamed by the key normalizer, if there is one.
+func (this Settings) normalizeOrder(order keyOrder) keyOrder {
+	if this.keyNormalizer == nil || order == nil {
+		return order
+	}
+	normalized := make(keyOrder, len(order))
+	for path, keys := range order {
+		path = this.normalizePath(path)
+		for _, key := range keys {
+			key = this.keyNormalizer(key)
+			if !containsKey(normalized[path], key) {
+				normalized[path] = append(normalized[path], key)
+			}
+		}
+	}
+	return normalized
+}
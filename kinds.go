@@ -0,0 +1,158 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// SetTypeStability fixes the kind of every value, one of string, number, bool,
+// array, object or null, once it is set. Loads and RawSet calls that would
+// change the kind of a value then fail, naming the path, both kinds, and where
+// both values come from. Changing a value to or from null is always allowed,
+// as null often means unset. Values already loaded are fixed straight away.
+func (this *Settings) SetTypeStability(stable bool) {
+	this.wlock()
+	defer this.wunlock()
+
+	if !stable {
+		this.kinds = nil
+		return
+	}
+	this.kinds = make(map[string]string)
+	this.recordKinds("", this.settings)
+}
+
+// jsonKind returns the kind of a value of the settings tree.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case float64, float32, json.Number, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// checkKind returns an error if setting path to value, coming from source,
+// changes its kind. The caller must hold the lock.
+func (this Settings) checkKind(source string, path string, value interface{}) error {
+	old, ok := this.kinds[path]
+	kind := jsonKind(value)
+	if !ok || old == kind || old == "null" || kind == "null" {
+		return nil
+	}
+
+	from := ""
+	if previous, ok := this.provenance.lookup(path); ok {
+		from = fmt.Sprintf(" (set by %s)", previous.Name)
+	}
+	return fmt.Errorf("%s would change from %s%s to %s (set by %s)", path, old, from, kind, source)
+}
+
+// checkMergeKinds checks that merging new into existing, at path, doesn't
+// change the kind of any value. The caller must hold the lock.
+func (this Settings) checkMergeKinds(source string, existing, new map[string]interface{}, path string, keepExisting bool) error {
+	for key, value := range new {
+		keypath := this.joinPath(path, key)
+		existingvalue, exists := existing[key]
+		existingmap, _ := existingvalue.(map[string]interface{})
+		newmap, newIsMap := value.(map[string]interface{})
+
+		if !exists || !keepExisting {
+			if err := this.checkKind(source, keypath, value); err != nil {
+				return err
+			}
+		} else if existingmap == nil || !newIsMap {
+			continue
+		}
+
+		if newIsMap {
+			if err := this.checkMergeKinds(source, existingmap, newmap, keypath, keepExisting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSetKinds checks that setting path to value doesn't change the kind of
+// it, or of the maps above it. The caller must hold the lock.
+func (this Settings) checkSetKinds(source string, path string, value interface{}) error {
+	parts := this.splitPath(path)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], this.pathSeparator())
+		if err := this.checkKind(source, parent, map[string]interface{}{}); err != nil {
+			return err
+		}
+	}
+
+	if err := this.checkKind(source, path, value); err != nil {
+		return err
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		existing, _ := this.rawGet(path)
+		existingmap, _ := existing.(map[string]interface{})
+		return this.checkMergeKinds(source, existingmap, m, path, false)
+	}
+	return nil
+}
+
+// recordKinds records the kind of value, found at path, and of everything it
+// contains. The caller must hold the write lock.
+func (this Settings) recordKinds(path string, value interface{}) {
+	if path != "" {
+		this.kinds[path] = jsonKind(value)
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, child := range m {
+			this.recordKinds(this.joinPath(path, key), child)
+		}
+	}
+}
+
+// forgetKinds drops the kinds recorded for path and everything below it. The
+// caller must hold the write lock.
+func (this Settings) forgetKinds(path string) {
+	for known := range this.kinds {
+		if known == path || strings.HasPrefix(known, path+this.pathSeparator()) {
+			delete(this.kinds, known)
+		}
+	}
+}
+
+// recordMergedKinds records the kinds of the values at every path of new after
+// it was merged into current. The caller must hold the write lock.
+func (this Settings) recordMergedKinds(current, new map[string]interface{}, path string) {
+	for key, value := range new {
+		keypath := this.joinPath(path, key)
+		actual := current[key]
+		this.kinds[keypath] = jsonKind(actual)
+
+		newmap, newIsMap := value.(map[string]interface{})
+		actualmap, actualIsMap := actual.(map[string]interface{})
+		if newIsMap && actualIsMap {
+			this.recordMergedKinds(actualmap, newmap, keypath)
+		}
+	}
+}
+
+// recordSetKinds records the kinds after path was set to value. The caller
+// must hold the write lock.
+func (this Settings) recordSetKinds(path string, value interface{}) {
+	parts := this.splitPath(path)
+	for i := 1; i < len(parts); i++ {
+		this.kinds[strings.Join(parts[:i], this.pathSeparator())] = "object"
+	}
+	this.forgetKinds(path)
+	this.recordKinds(path, value)
+}
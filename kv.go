@@ -0,0 +1,85 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LoadKVPairs sets values from "path=value" pairs, as typically passed on the
+// command line with --set db:host=example.com. The value is parsed as JSON if
+// possible, so numbers, booleans, arrays, objects and quoted strings keep
+// their type, and used as a plain string otherwise. "path=" sets an empty
+// string, and ending the path with the path separator, as in "path:=value",
+// requires value to be valid JSON. Numbers are kept as json.Number with
+// SetPreserveNumbers.
+//
+// Every pair is parsed, and checked by the validators of AddValidator, before
+// any is applied, and either every pair is set or none is. Values are set as
+// with RawSet with timid set to false.
+func (this *Settings) LoadKVPairs(pairs []string) error {
+	sep := this.pathSeparator()
+	paths := make([]string, len(pairs))
+	values := make([]interface{}, len(pairs))
+
+	for i, pair := range pairs {
+		split := strings.Index(pair, "=")
+		if split < 0 {
+			return fmt.Errorf("Invalid setting %q at index %d: missing '='", pair, i)
+		}
+		path, raw := pair[:split], pair[split+1:]
+
+		strict := strings.HasSuffix(path, sep)
+		if strict {
+			path = strings.TrimSuffix(path, sep)
+		}
+		if path == "" {
+			return fmt.Errorf("Invalid setting %q at index %d: missing path", pair, i)
+		}
+
+		var value interface{}
+		if strict {
+			if err := this.unmarshalJSON([]byte(raw), &value); err != nil {
+				return fmt.Errorf("Invalid setting %q at index %d: %s", pair, i, err)
+			}
+		} else {
+			value = this.inferValue(raw)
+		}
+
+		var err error
+		if paths[i], values[i], err = this.prepareSet(path, value); err != nil {
+			return fmt.Errorf("Invalid setting %q at index %d: %s", pair, i, err)
+		}
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	// The pairs are set on a snapshot first, so that one that can't be set
+	// leaves the settings as they were.
+	staging := this.snapshot()
+	staging.logger = nil
+	for i, path := range paths {
+		if _, err := staging.setPrepared("LoadKVPairs", SetReplace, path, deepCopy(values[i])); err != nil {
+			return fmt.Errorf("Invalid setting %q at index %d: %s", pairs[i], i, err)
+		}
+	}
+	for i, path := range paths {
+		this.setPrepared("LoadKVPairs", SetReplace, path, values[i])
+	}
+	return nil
+}
+
+// inferValue parses raw as JSON, falling back to raw itself if it isn't valid
+// JSON. An empty raw is an empty string. Numbers are json.Number with
+// SetPreserveNumbers.
+func (this Settings) inferValue(raw string) interface{} {
+	if raw == "" {
+		return ""
+	}
+
+	var value interface{}
+	if err := this.unmarshalJSON([]byte(raw), &value); err != nil {
+		return raw
+	}
+	return value
+}
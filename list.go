@@ -0,0 +1,102 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ListOptions changes what List returns.
+type ListOptions struct {
+	// Prefix only lists the values at or below this path.
+	Prefix string
+	// IncludeDefaults also lists the values that are still their default,
+	// see SetDefault.
+	IncludeDefaults bool
+	// ShowSecrets lists the values marked with MarkSecret rather than
+	// redacting them.
+	ShowSecrets bool
+}
+
+// Entry is a single value listed by List.
+type Entry struct {
+	Path string
+	// Value is the value, or "[redacted]" for secrets.
+	Value interface{}
+	// Rendered is Value as compact JSON.
+	Rendered string
+	// Source is the name of the source that set the value, or "" if unknown,
+	// see SourceOf.
+	Source string
+	// IsDefault is whether the value is still its default.
+	IsDefault bool
+}
+
+// List returns every leaf value of the settings, sorted by path, for instance
+// for a command listing the config. Arrays and empty maps are leaves. Like
+// other output meant to be shown, secrets are redacted and export filters are
+// applied, see AddExportFilter.
+func (this Settings) List(opts ListOptions) []Entry {
+	this.rlock()
+	defer this.runlock()
+
+	sep := this.pathSeparator()
+	defaults := flatten(sep, this.defaults)
+	var entries []Entry
+	for path, value := range flatten(sep, this.settings) {
+		if opts.Prefix != "" && path != opts.Prefix && !strings.HasPrefix(path, opts.Prefix+sep) {
+			continue
+		}
+		def, hasDefault := defaults[path]
+		isDefault := hasDefault && sameValue(def, value)
+		if isDefault && !opts.IncludeDefaults {
+			continue
+		}
+
+		if !opts.ShowSecrets && this.isSecret(path) {
+			value = redactedValue
+		} else {
+			value = this.exportValue(path, deepCopy(value))
+		}
+		entry := Entry{Path: path, Value: value, IsDefault: isDefault}
+		if b, err := json.Marshal(value); err == nil {
+			entry.Rendered = string(b)
+		} else {
+			entry.Rendered = fmt.Sprint(value)
+		}
+		if source, ok := this.provenance.lookup(path); ok {
+			entry.Source = source.Name
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// FormatList formats entries as "path = value" lines, followed by "(default)"
+// for values that are still their default. With aligned set the values are
+// aligned in a column.
+func FormatList(entries []Entry, aligned bool) string {
+	width := 0
+	if aligned {
+		for _, entry := range entries {
+			if len(entry.Path) > width {
+				width = len(entry.Path)
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%-*s = %s", width, entry.Path, entry.Rendered)
+		if entry.IsDefault {
+			b.WriteString(" (default)")
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
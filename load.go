@@ -0,0 +1,723 @@
+package flexiconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loader reads the settings of a single source. Every successful load is
+// recorded so that Reload can read it again.
+type loader struct {
+	source  Source
+	options []MergeOption
+
+	// read returns the settings to merge and the number of bytes read, if
+	// known. It is given the settings being loaded into.
+	read func(this *Settings) (map[string]interface{}, int, error)
+
+	// index is the index of source in the provenance, set once merged.
+	index int
+
+	// params are passed to lua configs, see LoadLuaFileWithParams.
+	params map[string]interface{}
+
+	// prepared and info are what the source read the last time it was
+	// merged, kept so that ReloadSource can merge it again without reading
+	// it. prepared is a copy that nothing else holds, and is never changed.
+	prepared map[string]interface{}
+	info     *readInfo
+}
+
+// fileFormats maps the formats known to LoadFileAs to their loaders. It is
+// guarded by fileFormatsLock once formats can be registered.
+var fileFormats = map[string]func(path string, options []MergeOption) *loader{
+	"json": jsonFileLoader,
+}
+
+// fileDecoders holds the decode functions of the formats added with
+// RegisterFileFormat.
+var fileDecoders = map[string]func(b []byte) (map[string]interface{}, error){}
+
+var fileFormatsLock sync.RWMutex
+
+// RegisterFileFormat adds a config file format, so that LoadFile loads files
+// with the extension .format and LoadFileAs accepts format, by decoding their
+// content with decode. It is meant to be called from the init function of a
+// package providing a format, such as the hcl package, and panics if format
+// is already known.
+func RegisterFileFormat(format string, decode func(b []byte) (map[string]interface{}, error)) {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+
+	fileFormatsLock.Lock()
+	defer fileFormatsLock.Unlock()
+
+	if _, ok := fileFormats[format]; ok {
+		panic(fmt.Sprintf("flexiconfig: file format %s is already registered", format))
+	}
+	fileDecoders[format] = decode
+	fileFormats[format] = func(path string, options []MergeOption) *loader {
+		return &loader{
+			source:  fileSource(path),
+			options: options,
+			read: func(this *Settings) (map[string]interface{}, int, error) {
+				if err := this.allowPath(path); err != nil {
+					return nil, 0, err
+				}
+				content, err := this.readFile(path)
+				if err != nil {
+					return nil, 0, err
+				}
+				this.logf(LogDebug, "Loading %s (%d bytes)", path, len(content))
+
+				newSettings, err := decode(content)
+				if err != nil {
+					return nil, len(content), fmt.Errorf("Could not load %s: %s", path, err)
+				}
+				return newSettings, len(content), nil
+			},
+		}
+	}
+}
+
+// decodeContent decodes content, read from source, in format, which must be
+// known to LoadFileAs.
+func (this *Settings) decodeContent(source, format string, content []byte) (map[string]interface{}, error) {
+	fileFormatsLock.RLock()
+	decode, registered := fileDecoders[format]
+	fileFormatsLock.RUnlock()
+
+	switch {
+	case format == "lua":
+		return this.runLua(source, content, nil)
+	case registered:
+		return decode(content)
+	default:
+		return this.parseJSON(content)
+	}
+}
+
+// fileLoader returns the loader for the file at path, based on its extension.
+func (this Settings) fileLoader(path string, options []MergeOption) (*loader, error) {
+	if path == "-" {
+		return stdinLoader("", options), nil
+	}
+	fileFormatsLock.RLock()
+	defer fileFormatsLock.RUnlock()
+
+	ext := filepath.Ext(path)
+	if newLoader, ok := fileFormats[strings.TrimPrefix(ext, ".")]; ok && ext != "" {
+		return newLoader(path, options), nil
+	}
+	// The marker is read before loading, so the file has to be allowed
+	// before it is peeked at.
+	if err := this.allowPath(path); err != nil {
+		return nil, err
+	}
+	if format := peekFormatMarker(path); format != "" {
+		if err := checkFileFormat(format); err != nil {
+			return nil, fmt.Errorf("Could not load %s: %s", path, err)
+		}
+		return markerLoader(path, options), nil
+	}
+
+	extensions := make([]string, 0, len(fileFormats))
+	for format := range fileFormats {
+		extensions = append(extensions, "."+format)
+	}
+	sort.Strings(extensions)
+	return nil, fmt.Errorf("Unable to determine config file type for path %s (known extensions are %s, name the format on the first line or use LoadFileAs to load it anyway)", path, strings.Join(extensions, ", "))
+}
+
+// formatLoader returns the loader for the file at path, in the given format.
+func formatLoader(path string, format string, options []MergeOption) (*loader, error) {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	fileFormatsLock.RLock()
+	defer fileFormatsLock.RUnlock()
+
+	newLoader, ok := fileFormats[format]
+	if !ok {
+		return nil, checkFileFormat(format)
+	}
+	if path == "-" {
+		return stdinLoader(format, options), nil
+	}
+	return newLoader(path, options), nil
+}
+
+// load reads the settings of l and merges them.
+func (this *Settings) load(l *loader) error {
+	this.lazyInit()
+	staged, info, timer, err := this.stage(l)
+	if err != nil {
+		return err
+	}
+	if info.unchanged {
+		return timer.done(0, nil)
+	}
+
+	this.wlock()
+	err = this.mergeLoad(l, staged, info)
+	this.wunlock()
+
+	if info.duplicate {
+		timer.stat.Duplicate = true
+		return timer.done(0, nil)
+	}
+	return this.afterLoad(timer.done(len(staged), err))
+}
+
+// stage reads and prepares the settings of l without merging them, along with
+// what was learned about the source while reading it. The returned timer is
+// still running, unless staging failed.
+func (this *Settings) stage(l *loader) (map[string]interface{}, *readInfo, *loadTimer, error) {
+	timer := this.startLoad(l.source.Name)
+
+	newSettings, info, err := this.read(l)
+	timer.stat.Bytes = info.size
+	timer.stat.Content = info.content
+	if err == nil {
+		newSettings, err = this.prepareSettings(newSettings)
+	}
+	if err != nil {
+		this.logf(LogDebug, "Rejected settings from %s: %s", l.source.Name, err)
+		return nil, nil, nil, timer.done(0, err)
+	}
+	return newSettings, info, timer, nil
+}
+
+// loadResults is what the latest loads reported. Like the settings it is
+// shared by a Settings and its copies, and guarded by their lock.
+type loadResults struct {
+	// mergeReport is the MergeReport of the latest load.
+	mergeReport *MergeReport
+	// warnings are the warnings of the latest load.
+	warnings []string
+	// skippedFiles lists the files the latest directory or glob load
+	// couldn't load.
+	skippedFiles []*FileError
+}
+
+// readInfo is what a loader learns about its source while reading it.
+type readInfo struct {
+	loadedAt time.Time
+	size     int
+	hash     string
+	modTime  time.Time
+	// order holds the order of the keys read, if keys are ordered.
+	order keyOrder
+	// content tells where the content came from.
+	content ContentStatus
+	// unchanged is whether the content was merged already, by an earlier
+	// load from the same source, so that merging it again can be skipped.
+	unchanged bool
+	// warnings are the warnings the source reported, see LastWarnings.
+	warnings []string
+	// file is the path of the first file read, the config itself for file
+	// loads.
+	file string
+	// duplicate is whether merging was skipped, see SetDeduplicateLoads.
+	duplicate bool
+}
+
+// read reads the settings of l. The loader is given a copy of the settings
+// whose reading field collects the readInfo.
+func (this *Settings) read(l *loader) (map[string]interface{}, *readInfo, error) {
+	info := &readInfo{}
+	if this.order != nil {
+		info.order = make(keyOrder)
+	}
+
+	reader := *this
+	reader.reading = info
+	newSettings, size, err := l.read(&reader)
+	info.order = this.normalizeOrder(info.order)
+	info.size = size
+	info.loadedAt = time.Now().Round(0).Truncate(time.Millisecond)
+	if err == nil && info.hash == "" {
+		info.hash, err = fingerprint(newSettings)
+	}
+	return newSettings, info, err
+}
+
+// readContent records the hash of content, read in one piece by a loader.
+func (this *Settings) readContent(content []byte) {
+	if this.reading != nil {
+		sum := sha256.Sum256(content)
+		this.reading.hash = hex.EncodeToString(sum[:])
+	}
+}
+
+// readFileInfo records the modification time of the file at path, read by a
+// loader.
+func (this *Settings) readFileInfo(path string) {
+	if this.reading == nil {
+		return
+	}
+	if stat, err := os.Stat(path); err == nil {
+		this.reading.modTime = stat.ModTime()
+	}
+}
+
+// SetMaxSize limits how many bytes a single JSON or lua file, URL or stdin
+// load may read, so that a runaway generator can't exhaust memory. Larger
+// sources fail to load. 0 or less means no limit, the default.
+func (this *Settings) SetMaxSize(bytes int64) {
+	this.maxSize = bytes
+}
+
+// readAll reads r, the source called name, up to the size limit.
+func (this Settings) readAll(name string, r io.Reader) ([]byte, error) {
+	if this.maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(r, this.maxSize+1))
+	if err == nil && int64(len(content)) > this.maxSize {
+		err = &sizeError{name: name, maxSize: this.maxSize}
+	}
+	return content, err
+}
+
+// sizeError is returned when a source is larger than the size limit.
+type sizeError struct {
+	name    string
+	maxSize int64
+}
+
+func (this *sizeError) Error() string {
+	return fmt.Sprintf("%s is larger than the maximum size of %d bytes", this.name, this.maxSize)
+}
+
+// readFile reads the file at path for a loader, up to the size limit,
+// recording its hash and modification time.
+func (this *Settings) readFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := this.readAll(path, file)
+	if err != nil {
+		return nil, err
+	}
+	this.readContent(content)
+	this.readFileInfo(path)
+	if this.reading != nil && this.reading.file == "" {
+		this.reading.file = path
+	}
+	return content, nil
+}
+
+// describe copies what was learned while reading into source.
+func (this *readInfo) describe(source *Source) {
+	source.LoadedAt = this.loadedAt
+	source.Size = this.size
+	source.Hash = this.hash
+	source.ModTime = this.modTime
+}
+
+// prepareSettings normalizes newSettings, resolves their conditionals and
+// validates them so that they can be merged.
+func (this Settings) prepareSettings(newSettings map[string]interface{}) (map[string]interface{}, error) {
+	normalized, err := this.normalizeSettings(newSettings)
+	if err != nil {
+		return nil, err
+	}
+	renamed, err := this.normalizeKeys("", normalized)
+	if err != nil {
+		return nil, err
+	}
+	normalized = renamed.(map[string]interface{})
+	if err := this.checkConfigVersion(normalized); err != nil {
+		return nil, err
+	}
+	resolved, err := this.resolveConditionals(normalized)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.checkValidators("", resolved); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// mergeLoad merges the prepared settings read by l and records l, described
+// by info, as where its values came from. The caller must hold the write lock.
+func (this *Settings) mergeLoad(l *loader, prepared map[string]interface{}, info *readInfo) error {
+	source := l.source
+	info.describe(&source)
+
+	var hash string
+	if this.deduplicateLoads {
+		hash = settingsHash(prepared, l.options)
+		if hash != "" && this.hashes.merged(hash) {
+			this.logf(LogDebug, "Skipped %s, the same settings were merged already", l.source.Name)
+			source.Duplicate = true
+			this.provenance.add(source)
+			info.duplicate = true
+			return nil
+		}
+	}
+
+	// Overlays stay on top of whatever is loaded after them, so the load
+	// merges into the settings without them and they are set again after.
+	this.unapplyOverlays()
+	defer this.reapplyOverlays()
+
+	config := newMergeConfig(l.options)
+	config.separator = this.pathSeparator()
+	if this.kinds != nil {
+		if err := this.checkMergeKinds(l.source.Name, this.settings, prepared, "", config.keepExisting); err != nil {
+			return err
+		}
+	}
+	this.logReplaced(l.source, prepared, config)
+	this.results.warnings = info.warnings
+	if this.mergeReports {
+		config.report = &MergeReport{Source: source}
+	}
+
+	l.index = this.provenance.add(source)
+	l.prepared = deepCopy(prepared).(map[string]interface{})
+	l.info = info
+	this.provenance.loads = append(this.provenance.loads, l)
+	config.record = this.provenance.recorder(l.index)
+	keys := make([]string, 0, len(prepared))
+	for key := range prepared {
+		this.changed(key)
+		keys = append(keys, key)
+	}
+	mark := this.markHistory(keys...)
+	if err := mergeMaps(this.settings, prepared, "", config); err != nil {
+		return err
+	}
+	if hash != "" {
+		this.hashes.add(hash, keys)
+	}
+	this.recordHistory(l.source.Name, mark)
+	if config.report != nil {
+		this.finishMergeReport(config.report)
+	}
+	if this.kinds != nil {
+		this.recordMergedKinds(this.settings, prepared, "")
+	}
+	if this.order != nil {
+		this.order.sync(config.separator, "", this.settings, info.order)
+	}
+	return nil
+}
+
+// replaceSettings replaces the settings with replacement, derived from them by
+// the function called source, such as ApplyJSONPatch or Migrate. It commits it
+// the way mergeLoad commits a load: the values that change go through the
+// validators first, then the history records them. The sources of touched,
+// the paths changed, are forgotten, and "" forgets them all. The caller must
+// hold the write lock, and call afterLoad once it is released.
+func (this *Settings) replaceSettings(source string, replacement map[string]interface{}, touched []string) error {
+	sep := this.pathSeparator()
+	changes := diffMaps(sep, "", this.settings, replacement, nil)
+	if len(this.validators) > 0 {
+		for _, change := range changes {
+			if change.Type == ChangeRemoved {
+				continue
+			}
+			if err := this.validateLeaves(this.validators, change.Path, change.New); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key := range this.settings {
+		delete(this.settings, key)
+	}
+	for key, value := range replacement {
+		this.settings[key] = value
+	}
+	for _, path := range touched {
+		if path == "" {
+			this.provenance.paths = make(map[string]int)
+		} else {
+			this.provenance.forget(path)
+		}
+		this.changed(path)
+	}
+	if this.kinds != nil {
+		for known := range this.kinds {
+			delete(this.kinds, known)
+		}
+		this.recordKinds("", this.settings)
+	}
+	if this.order != nil {
+		this.order.sync(sep, "", this.settings, nil)
+	}
+	this.recordChanges(source, changes)
+	return nil
+}
+
+// LoadAll loads every file in paths, in order, like LoadFile does. All of the
+// files are read and merged into a copy of the settings before anything is
+// merged into them, so that either all of them are merged or, if any of them
+// fails to read or to merge, none are and the error names the file that
+// failed. Note that lua configs are run while reading, so a script
+// runs even if a later file fails.
+func (this *Settings) LoadAll(paths ...string) error {
+	paths, err := this.expandPaths(paths)
+	if err != nil {
+		return err
+	}
+	return this.loadAll(paths)
+}
+
+// loadAll is LoadAll for paths that were expanded already.
+func (this *Settings) loadAll(paths []string) error {
+	loaders := make([]*loader, len(paths))
+	for i, path := range paths {
+		l, err := this.fileLoader(path, nil)
+		if err != nil {
+			return err
+		}
+		loaders[i] = l
+	}
+
+	staged := make([]map[string]interface{}, len(loaders))
+	infos := make([]*readInfo, len(loaders))
+	timers := make([]*loadTimer, len(loaders))
+	for i, l := range loaders {
+		var err error
+		if staged[i], infos[i], timers[i], err = this.stage(l); err != nil {
+			return fmt.Errorf("Could not load %s: %w", l.source.Name, err)
+		}
+	}
+
+	var err error
+	this.wlock()
+	// The files are merged into a snapshot first, so that a merge failing
+	// leaves the settings as they were rather than with some files merged.
+	staging := this.snapshot()
+	staging.logger = nil
+	for i, l := range loaders {
+		info := *infos[i]
+		if err = staging.mergeLoad(&loader{source: l.source, options: l.options}, deepCopy(staged[i]).(map[string]interface{}), &info); err != nil {
+			break
+		}
+	}
+	for i, l := range loaders {
+		if err != nil {
+			break
+		}
+		err = this.mergeLoad(l, staged[i], infos[i])
+	}
+	this.wunlock()
+
+	for i, timer := range timers {
+		if infos[i].duplicate {
+			timer.stat.Duplicate = true
+			timer.done(0, err)
+			continue
+		}
+		timer.done(len(staged[i]), err)
+	}
+	return this.afterLoad(err)
+}
+
+// Reload runs every load so far again, in the same order and with the same
+// options, and replaces the settings with the result. Files are read again,
+// while settings that were passed in directly, such as to LoadJSON or
+// MergeSettings, are merged as they were. Like LoadAll nothing changes if any
+// of the loads fails.
+//
+// Values set with RawSet, Delete, Append or a Writer are lost, while remote
+// overlays are applied again on top of the reloaded settings.
+//
+// The post-load hooks are called afterwards, then every function given to
+// OnReload, and those given to OnChange too when settings changed.
+func (this *Settings) Reload() error {
+	return this.reloadMatching(nil)
+}
+
+// SourceID identifies a source by its index in Sources.
+type SourceID int
+
+// ReloadSource is Reload running only the load of the source id again, such
+// as a lua file whose overrides changed. Every other load merges what it read
+// last time, in its place, without being read again. As with Reload, values
+// set with RawSet, Delete, Append or a Writer are lost, and the post-load hooks
+// and the functions given to OnReload and OnChange are called.
+func (this *Settings) ReloadSource(id SourceID) error {
+	this.rlock()
+	found := false
+	for _, l := range this.provenance.loads {
+		found = found || l.index == int(id)
+	}
+	count := len(this.provenance.sources)
+	this.runlock()
+	if !found {
+		if int(id) < 0 || int(id) >= count {
+			return fmt.Errorf("There is no source %d, only %d were loaded", id, count)
+		}
+		return fmt.Errorf("Source %d can't be reloaded, it is an overlay or a skipped duplicate", id)
+	}
+
+	return this.reloadMatching(func(l *loader) bool {
+		return l.index == int(id)
+	})
+}
+
+// ReloadPath is ReloadSource for every source loaded from the file at path.
+func (this *Settings) ReloadPath(path string) error {
+	abs, _ := filepath.Abs(path)
+	matches := func(l *loader) bool {
+		if l.source.Name == path {
+			return true
+		}
+		loaded, err := filepath.Abs(l.source.Name)
+		return err == nil && abs != "" && loaded == abs
+	}
+
+	this.rlock()
+	found := false
+	for _, l := range this.provenance.loads {
+		found = found || matches(l)
+	}
+	this.runlock()
+	if !found {
+		return fmt.Errorf("Nothing was loaded from %s", path)
+	}
+	return this.reloadMatching(matches)
+}
+
+// reloadMatching reloads the loads for which fresh returns true, then calls
+// the hooks like Reload.
+func (this *Settings) reloadMatching(fresh func(l *loader) bool) error {
+	changes, err := this.reload(fresh)
+	err = this.afterLoad(err)
+	this.reloadHooks().reloaded(changes, err)
+	return err
+}
+
+// reload does the work of Reload, returning what changed if anything given to
+// OnChange wants to know. Only the loads for which fresh returns true are run
+// again, the others merge what they read last time; a nil fresh runs them all.
+func (this *Settings) reload(fresh func(l *loader) bool) ([]Change, error) {
+	diff := this.reloadHooks().wantChanges()
+	for {
+		this.rlock()
+		loads := append([]*loader(nil), this.provenance.loads...)
+		cached := make([]map[string]interface{}, len(loads))
+		for i, l := range loads {
+			if fresh != nil && !fresh(l) && l.prepared != nil {
+				cached[i] = l.prepared
+			}
+		}
+		var order keyOrder
+		if this.order != nil {
+			order = make(keyOrder)
+		}
+		this.runlock()
+
+		settings := make(map[string]interface{})
+		paths := make(map[string]int)
+		staged := make([]map[string]interface{}, len(loads))
+		infos := make([]*readInfo, len(loads))
+		timers := make([]*loadTimer, len(loads))
+		for i, l := range loads {
+			if cached[i] != nil {
+				staged[i] = deepCopy(cached[i]).(map[string]interface{})
+				infos[i] = l.info
+			} else {
+				var err error
+				if staged[i], infos[i], timers[i], err = this.stage(l); err != nil {
+					return nil, fmt.Errorf("Could not reload %s: %w", l.source.Name, err)
+				}
+				cached[i] = deepCopy(staged[i]).(map[string]interface{})
+			}
+
+			config := newMergeConfig(l.options)
+			config.separator = this.pathSeparator()
+			index := l.index
+			config.record = func(path string) {
+				paths[path] = index
+			}
+			if err := mergeMaps(settings, staged[i], "", config); err != nil {
+				return nil, fmt.Errorf("Could not reload %s: %w", l.source.Name, err)
+			}
+			if order != nil {
+				order.sync(config.separator, "", settings, infos[i].order)
+			}
+		}
+
+		this.wlock()
+		if len(this.provenance.loads) != len(loads) {
+			// Something was loaded meanwhile, which has to be replayed too.
+			this.wunlock()
+			continue
+		}
+		if this.kinds != nil {
+			if err := this.checkMergeKinds("Reload", nil, settings, "", false); err != nil {
+				this.wunlock()
+				return nil, err
+			}
+		}
+		var old map[string]interface{}
+		if diff || this.history.depth > 0 {
+			// Reloading replaces every top level value rather than changing
+			// it, so a shallow copy keeps the old settings.
+			old = make(map[string]interface{}, len(this.settings))
+			for key, value := range this.settings {
+				old[key] = value
+			}
+		}
+		for key := range this.settings {
+			delete(this.settings, key)
+		}
+		for key, value := range settings {
+			this.settings[key] = value
+		}
+		this.provenance.paths = paths
+		this.results.warnings = nil
+		for i, l := range loads {
+			infos[i].describe(&this.provenance.sources[l.index])
+			this.results.warnings = append(this.results.warnings, infos[i].warnings...)
+			// Snapshots share the loaders, so a copy keeps what was read.
+			reloaded := *l
+			reloaded.prepared, reloaded.info = cached[i], infos[i]
+			this.provenance.loads[i] = &reloaded
+		}
+		if this.kinds != nil {
+			for known := range this.kinds {
+				delete(this.kinds, known)
+			}
+			this.recordKinds("", settings)
+		}
+		if this.order != nil && order != nil {
+			this.order.forget(this.pathSeparator(), "")
+			for path, keys := range order {
+				this.order[path] = keys
+			}
+		}
+		this.changed("")
+		this.reapplyOverlays()
+		var changes []Change
+		if old != nil {
+			changes = diffMaps(this.pathSeparator(), "", old, this.settings, nil)
+			this.recordChanges("Reload", changes)
+		}
+		this.wunlock()
+
+		for i, timer := range timers {
+			if timer != nil {
+				timer.done(len(staged[i]), nil)
+			}
+		}
+		return changes, nil
+	}
+}
@@ -0,0 +1,125 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"os"
+)
+
+// LogLevel is the severity of a log event.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (this LogLevel) String() string {
+	switch this {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(this))
+	}
+}
+
+// Logger receives the events logged while loading and merging settings.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// LoggerFunc adapts an ordinary function to the Logger interface.
+type LoggerFunc func(level LogLevel, format string, args ...interface{})
+
+// Logf calls this(level, format, args...).
+func (this LoggerFunc) Logf(level LogLevel, format string, args ...interface{}) {
+	this(level, format, args...)
+}
+
+// SetLogger sets the logger receiving debug events for every load, every
+// top-level key replaced by a merge, every lua module preloaded, and every
+// rejected set of settings. Nothing is logged without a logger.
+func (this *Settings) SetLogger(logger Logger) {
+	this.logger = logger
+}
+
+// SetLogValues makes the logger include the values replaced by merges rather
+// than just their types. Values marked with MarkSecret are still redacted.
+func (this *Settings) SetLogValues(logValues bool) {
+	this.logValues = logValues
+}
+
+func (this Settings) logf(level LogLevel, format string, args ...interface{}) {
+	if this.logger != nil {
+		this.logger.Logf(level, format, args...)
+	}
+}
+
+// logFileLoad logs the load of the file at path.
+func (this Settings) logFileLoad(path string) {
+	if this.logger == nil {
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		this.logf(LogDebug, "Loading %s (%d bytes)", path, info.Size())
+	} else {
+		this.logf(LogDebug, "Loading %s", path)
+	}
+}
+
+// logReplaced logs the top-level keys of newSettings that replace existing
+// values. Maps merged into maps aren't replaced and aren't logged.
+func (this Settings) logReplaced(source Source, newSettings map[string]interface{}, config mergeConfig) {
+	if this.logger == nil || config.keepExisting {
+		return
+	}
+
+	for key, value := range newSettings {
+		old, exists := this.settings[key]
+		if !exists {
+			continue
+		}
+		_, oldMap := old.(map[string]interface{})
+		_, newMap := value.(map[string]interface{})
+		if oldMap && newMap {
+			continue
+		}
+
+		if this.logValues {
+			this.logf(LogDebug, "%s replaced %s: %v -> %v", source.Name, key, this.redactValue(key, old), this.redactValue(key, value))
+		} else {
+			this.logf(LogDebug, "%s replaced %s: %s -> %s", source.Name, key, typeName(old), typeName(value))
+		}
+	}
+}
+
+// typeName describes the type of a value in the settings tree.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "map"
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// LastWarnings returns the warnings reported by the config of the latest load,
+// such as those of the warn function of lua configs, or by every config for
+// Reload. They are also logged as they are reported.
+func (this Settings) LastWarnings() []string {
+	this.rlock()
+	defer this.runlock()
+
+	return append([]string(nil), this.results.warnings...)
+}
@@ -0,0 +1,572 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func init() {
+	fileFormats["lua"] = luaFileLoader
+}
+
+// LuaEngine runs lua configs. DefaultLuaEngine, running them with gopher-lua,
+// is registered unless flexiconfig is built with the flexiconfig_nolua tag,
+// which leaves gopher-lua out. Lua configs then fail to load until an engine
+// is registered.
+type LuaEngine interface {
+	// RunLua runs the config of run and returns the value it returns,
+	// converted to a settings tree made of maps, arrays, float64, string,
+	// bool and nil.
+	RunLua(run *LuaRun) (interface{}, error)
+}
+
+var (
+	luaEngineLock sync.RWMutex
+	luaEngine     LuaEngine
+)
+
+// errNoLuaEngine is returned when loading a lua config without a LuaEngine.
+var errNoLuaEngine = errors.New("Lua configs need a lua engine, flexiconfig was built with the flexiconfig_nolua tag and none was registered")
+
+// RegisterLuaEngine makes engine run the lua configs of every Settings that
+// wasn't given one with SetLuaEngine, in place of DefaultLuaEngine. It is
+// meant to be called from the init function of the package providing the
+// engine.
+func RegisterLuaEngine(engine LuaEngine) {
+	luaEngineLock.Lock()
+	luaEngine = engine
+	luaEngineLock.Unlock()
+}
+
+// SetLuaEngine makes engine run the lua configs of the settings, rather than
+// the one registered with RegisterLuaEngine. nil goes back to that one.
+func (this *Settings) SetLuaEngine(engine LuaEngine) {
+	this.luaEngine = engine
+}
+
+// luaEngineFor returns the engine running the lua configs of the settings.
+func (this Settings) luaEngineFor() LuaEngine {
+	if this.luaEngine != nil {
+		return this.luaEngine
+	}
+	luaEngineLock.RLock()
+	defer luaEngineLock.RUnlock()
+	return luaEngine
+}
+
+// LuaRun is a lua config for a LuaEngine to run, along with what the settings
+// loading it set up for lua configs.
+type LuaRun struct {
+	// Source names the config in errors: its path or URL, or LoadLuaString.
+	Source string
+	// Code is the lua code of the config.
+	Code []byte
+	// Params are passed to the config, see LoadLuaFileWithParams, unless
+	// nil. They hold nothing but nil, bool, float64, string, and maps and
+	// arrays of those.
+	Params map[string]interface{}
+	// File is the absolute path of the config, which CONFIG_PATH and
+	// CONFIG_DIR are set from, or "" if it wasn't read from a file.
+	File string
+	// Path is the path the value returned is loaded at, "" for the root.
+	Path string
+	// Modules are the modules added with AddLuaLoader, by name.
+	Modules map[string]interface{}
+	// Output is where print and io.write write to, see SetLuaOutput.
+	Output io.Writer
+	// GoStackTrace, StrictGlobals and Shared are set by SetLuaGoStackTrace,
+	// SetLuaStrictGlobals and SetSharedLuaState.
+	GoStackTrace  bool
+	StrictGlobals bool
+	Shared        bool
+	// MaxDepth is how deeply the value returned may nest, see SetMaxDepth.
+	MaxDepth int
+	// Separator is the path separator of the settings.
+	Separator string
+
+	settings *Settings
+	shared   *sharedLuaState
+	output   *bytes.Buffer
+	order    keyOrder
+	warnings []string
+}
+
+// Warn reports a warning of the config, see LastWarnings, and logs it.
+func (this *LuaRun) Warn(message string) {
+	this.warnings = append(this.warnings, message)
+	this.settings.logf(LogWarning, "%s", message)
+}
+
+// OrderKey records that key was added to the map at path, so that the order
+// keys are written in is kept when the settings have ordered keys, see
+// SetOrderedKeys. Keys of maps inside arrays aren't recorded.
+func (this *LuaRun) OrderKey(path, key string) {
+	if this.order != nil {
+		this.order[path] = append(this.order[path], key)
+	}
+}
+
+// Merge merges override into base like loads merge settings, for the config
+// module of lua configs.
+func (this *LuaRun) Merge(base, override map[string]interface{}) error {
+	return mergeMaps(base, override, "", mergeConfig{separator: this.Separator})
+}
+
+// Flatten returns every leaf of m keyed by its full path, joined with sep.
+func (this *LuaRun) Flatten(m map[string]interface{}, sep string) map[string]interface{} {
+	return flatten(sep, m)
+}
+
+// SharedState returns the state kept with SetSharedState by an earlier
+// config, or nil if there is none, see SetSharedLuaState. Configs sharing a
+// state run one at a time.
+func (this *LuaRun) SharedState() io.Closer {
+	if this.shared == nil {
+		return nil
+	}
+	return this.shared.state
+}
+
+// SetSharedState keeps state for the next configs when Shared is set. It is
+// closed when it has to be created again, such as when modules change.
+func (this *LuaRun) SetSharedState(state io.Closer) {
+	if this.shared != nil {
+		this.shared.state = state
+	}
+}
+
+// NewError returns the LuaError of the config failing with err, whose message
+// and traceback are those reported by the interpreter, along with what the
+// config printed.
+func (this *LuaRun) NewError(message, traceback string, err error) *LuaError {
+	luaErr := &LuaError{Err: err, Output: this.output.String(), Source: this.Source, Traceback: traceback, message: message}
+
+	lines := strings.Split(string(this.Code), "\n")
+	if strings.HasPrefix(message, this.Source) {
+		position := message[len(this.Source):]
+		if match := luaErrorPosition.FindStringSubmatch(position); match != nil {
+			luaErr.Line, _ = strconv.Atoi(match[1] + match[2])
+		} else if strings.HasPrefix(position, " at EOF:") {
+			luaErr.Line = len(lines)
+		}
+	}
+	if luaErr.Line > 0 && luaErr.Line <= len(lines) {
+		luaErr.LineText = strings.TrimRight(lines[luaErr.Line-1], "\r")
+	}
+	return luaErr
+}
+
+// LuaError is returned when running a lua config fails.
+type LuaError struct {
+	// Err is the error reported by the lua interpreter.
+	Err error
+	// Output is everything the script printed before failing.
+	Output string
+
+	// Source is the path or URL of the config, or LoadLuaString.
+	Source string
+	// Line is the line of the config the error is on, or 0 if unknown.
+	Line int
+	// LineText is the text of that line.
+	LineText string
+	// Traceback is the lua stack traceback of errors raised while running.
+	Traceback string
+
+	message string
+}
+
+// luaErrorPosition matches the position at the start of lua error messages,
+// "source:3:" for runtime errors and "source line:3(column:7)" for syntax
+// errors.
+var luaErrorPosition = regexp.MustCompile(`^(?::(\d+):| line:(\d+)\(column:\d+\))`)
+
+func (this *LuaError) Error() string {
+	message := this.message
+	if message == "" {
+		message = this.Err.Error()
+	}
+	if strings.TrimSpace(this.LineText) != "" {
+		message += fmt.Sprintf("\n  %d | %s", this.Line, this.LineText)
+	}
+	if this.Traceback != "" {
+		message += "\n" + this.Traceback
+	}
+	if this.Output != "" {
+		message += "\nScript output:\n" + strings.TrimRight(this.Output, "\n")
+	}
+	return message
+}
+
+// Unwrap returns the error reported by the lua interpreter.
+func (this *LuaError) Unwrap() error {
+	return this.Err
+}
+
+// RemoveLuaLoader removes the lua module added under name, if any, from the
+// lua configs loaded from now on.
+func (this *Settings) RemoveLuaLoader(name string) {
+	this.wlock()
+	delete(this.luaModules, name)
+	shared := this.sharedLua
+	this.wunlock()
+
+	shared.reset()
+}
+
+// LuaModules returns the names of the lua modules added with AddLuaLoader,
+// sorted.
+func (this Settings) LuaModules() []string {
+	this.rlock()
+	defer this.runlock()
+
+	names := make([]string, 0, len(this.luaModules))
+	for name := range this.luaModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadLuaString is used to load a config file from a lua string.
+//
+// Deprecated: use lualoader.LoadString.
+func (this *Settings) LoadLuaString(code string) error {
+	return this.LoadLuaStringWithOptions(code)
+}
+
+// LoadLuaStringWithOptions is LoadLuaString using the given merge options.
+//
+// Deprecated: use lualoader.LoadStringWithOptions.
+func (this *Settings) LoadLuaStringWithOptions(code string, options ...MergeOption) error {
+	return this.load(&loader{
+		source:  Source{Name: "LoadLuaString"},
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.logf(LogDebug, "Loading lua string (%d bytes)", len(code))
+			this.readContent([]byte(code))
+			newSettings, err := this.runLua("LoadLuaString", []byte(code), nil)
+			return newSettings, len(code), err
+		},
+	})
+}
+
+// LoadLuaStringWithParams is LoadLuaString passing params to the script, see
+// LoadLuaFileWithParams.
+//
+// Deprecated: use lualoader.LoadString.
+func (this *Settings) LoadLuaStringWithParams(code string, params map[string]interface{}) error {
+	converted, err := this.luaParams(params)
+	if err != nil {
+		return err
+	}
+
+	return this.load(&loader{
+		source: Source{Name: "LoadLuaString"},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.logf(LogDebug, "Loading lua string (%d bytes)", len(code))
+			this.readContent([]byte(code))
+			newSettings, err := this.runLua("LoadLuaString", []byte(code), converted)
+			return newSettings, len(code), err
+		},
+	})
+}
+
+// LoadLuaFile is used to load a lua config file from a specified path.
+// Besides the modules, lua configs can call warn(message) to report a warning,
+// see LastWarnings, and fail(message) to make their load fail with message.
+// The globals CONFIG_PATH and CONFIG_DIR hold the absolute path of the config
+// and of its directory, to find files next to it; they are nil for configs
+// that aren't files, such as those given to LoadLuaString.
+//
+// Deprecated: use lualoader.LoadFile.
+func (this *Settings) LoadLuaFile(path string) error {
+	return this.LoadLuaFileWithOptions(path)
+}
+
+// LoadLuaFileWithOptions is LoadLuaFile using the given merge options.
+//
+// Deprecated: use lualoader.LoadFileWithOptions.
+func (this *Settings) LoadLuaFileWithOptions(path string, options ...MergeOption) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
+	}
+	return this.load(luaFileLoader(path, options))
+}
+
+// LoadLuaFileWithParams is LoadLuaFile passing params to the script, both as
+// its first argument, so that `local params = ...` works, and as the global
+// params. Nested maps and arrays become tables. Params that can't be
+// converted, such as functions, are an error before the script is run.
+//
+// Deprecated: use lualoader.LoadFile.
+func (this *Settings) LoadLuaFileWithParams(path string, params map[string]interface{}) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
+	}
+	converted, err := this.luaParams(params)
+	if err != nil {
+		return err
+	}
+	l := luaFileLoader(path, nil)
+	l.params = converted
+	return this.load(l)
+}
+
+// LoadLuaFileAt loads the lua config file at path like LoadLuaFile, but the
+// value it returns is loaded at target, see LoadJSONAt. This way a config can
+// return a bare list, or any other value.
+//
+// Deprecated: use lualoader.LoadFileAt.
+func (this *Settings) LoadLuaFileAt(path string, target string) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
+	}
+	return this.load(&loader{
+		source: fileSource(path),
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			this.logFileLoad(path)
+			code, err := this.readFile(path)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, err := this.evalLua(path, code, nil, target)
+			if err != nil {
+				return nil, len(code), err
+			}
+			if list, ok := value.([]interface{}); ok && len(list) == 0 && target == "" {
+				// An empty table is no settings, as with LoadLuaFile.
+				value = nil
+			}
+			newSettings, err := this.nestValue(target, value)
+			return newSettings, len(code), err
+		},
+	})
+}
+
+// luaFileLoader returns the loader for the lua config file at path.
+func luaFileLoader(path string, options []MergeOption) *loader {
+	var l *loader
+	l = &loader{
+		source:  fileSource(path),
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			this.logFileLoad(path)
+			code, err := this.readFile(path)
+			if err != nil {
+				return nil, 0, err
+			}
+			newSettings, err := this.runLua(path, code, l.params)
+			return newSettings, len(code), err
+		},
+	}
+	return l
+}
+
+// runLua runs the lua config code, loaded from source, and returns the
+// settings it returns. Unless params is nil it is passed to the script, see
+// LoadLuaFileWithParams.
+func (this *Settings) runLua(source string, code []byte, params map[string]interface{}) (map[string]interface{}, error) {
+	converted, err := this.evalLua(source, code, params, "")
+	if err != nil {
+		return nil, err
+	}
+
+	returned := "table"
+	switch newSettings := converted.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return newSettings, nil
+	case []interface{}:
+		if len(newSettings) == 0 {
+			return nil, nil
+		}
+	case float64:
+		returned = "number"
+	case string:
+		returned = "string"
+	case bool:
+		returned = "boolean"
+	}
+	return nil, fmt.Errorf("Lua config must return a table with string keys, not %s", returned)
+}
+
+// evalLua runs the lua config code with the lua engine like runLua, and
+// returns the value it returns, converted as found at path.
+func (this *Settings) evalLua(source string, code []byte, params map[string]interface{}, path string) (interface{}, error) {
+	engine := this.luaEngineFor()
+	if engine == nil {
+		return nil, errNoLuaEngine
+	}
+
+	this.rlock()
+	modules := make(map[string]interface{}, len(this.luaModules))
+	for name, loader := range this.luaModules {
+		modules[name] = loader
+	}
+	shared := this.sharedLua
+	this.runlock()
+
+	output := &bytes.Buffer{}
+	run := &LuaRun{
+		Source:        source,
+		Code:          code,
+		Params:        params,
+		Path:          path,
+		Modules:       modules,
+		Output:        io.MultiWriter(this.luaOutputWriter(), output),
+		GoStackTrace:  this.luaGoStackTrace,
+		StrictGlobals: this.luaStrictGlobals,
+		Shared:        shared != nil,
+		MaxDepth:      this.depthLimit(),
+		Separator:     this.pathSeparator(),
+		settings:      this,
+		shared:        shared,
+		output:        output,
+	}
+	if this.reading != nil {
+		run.order = this.reading.order
+		if this.reading.file != "" {
+			if abs, err := filepath.Abs(this.reading.file); err == nil {
+				run.File = abs
+			}
+		}
+	}
+	if shared != nil {
+		shared.Lock()
+		defer shared.Unlock()
+	}
+
+	value, err := engine.RunLua(run)
+	if this.reading != nil {
+		this.reading.warnings = run.warnings
+	}
+	return value, err
+}
+
+// SetLuaGoStackTrace makes the tracebacks of lua errors include the Go
+// functions called, which helps debugging custom lua modules.
+func (this *Settings) SetLuaGoStackTrace(include bool) {
+	this.luaGoStackTrace = include
+}
+
+// SetLuaStrictGlobals makes reading a global that was never set an error in
+// lua configs, like strict.lua does, so that a misspelled variable, or a
+// misspelled return such as "retrun {...}", fails the load with the name of
+// the global and its line rather than reading nil. Globals the config sets,
+// even to nil, can be read, as can the standard library, params, CONFIG_PATH
+// and CONFIG_DIR.
+func (this *Settings) SetLuaStrictGlobals(strict bool) {
+	this.luaStrictGlobals = strict
+}
+
+// SetLuaOutput sets where the print and io.write functions of lua configs
+// write to. It defaults to os.Stdout, use ioutil.Discard to silence scripts.
+// Note that writing to io.stdout directly still goes to the process' stdout.
+func (this *Settings) SetLuaOutput(w io.Writer) {
+	this.luaOutput = w
+}
+
+// luaOutputWriter returns where lua configs print to.
+func (this Settings) luaOutputWriter() io.Writer {
+	if this.luaOutput == nil {
+		return os.Stdout
+	}
+	return this.luaOutput
+}
+
+// luaParams converts params to values that a LuaEngine converts faithfully,
+// or returns an error naming the first one it can't convert.
+func (this Settings) luaParams(params map[string]interface{}) (map[string]interface{}, error) {
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	normalized, err := this.normalizeSettings(params)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid lua params: %s", err)
+	}
+	converted, err := luaParam(this.pathSeparator(), "", normalized)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid lua params: %s", err)
+	}
+	return converted.(map[string]interface{}), nil
+}
+
+// luaParam converts the normalized param value, found at path, see luaParams.
+func luaParam(sep, path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, float64, string:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case []byte:
+		return string(v), nil
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			var err error
+			if converted[key], err = luaParam(sep, joinPathWith(sep, path, key), child); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, child := range v {
+			var err error
+			if converted[i], err = luaParam(sep, fmt.Sprintf("%s[%d]", path, i), child); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	case reflect.Float32:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	}
+	return nil, fmt.Errorf("%s can't be converted to lua, it is a %T", describePath(path), value)
+}
+
+// LoadLuaString calls LoadLuaString on the default settings.
+//
+// Deprecated: use lualoader.LoadString with DefaultSettings.
+func LoadLuaString(code string) error {
+	return DefaultSettings().LoadLuaString(code)
+}
+
+// LoadLuaFile calls LoadLuaFile on the default settings.
+//
+// Deprecated: use lualoader.LoadFile with DefaultSettings.
+func LoadLuaFile(path string) error {
+	return DefaultSettings().LoadLuaFile(path)
+}
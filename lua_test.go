@@ -0,0 +1,825 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package flexiconfig
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func BenchmarkLuaLoad(b *testing.B) {
+	benchmarkLuaLoad(b, false)
+}
+
+func BenchmarkLuaLoadShared(b *testing.B) {
+	benchmarkLuaLoad(b, true)
+}
+
+func TestLoadLuaFileAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, code string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadLuaFileAt(write("list.lua", `return {"a", "b"}`), "servers:names"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = settings.Get("servers:names", &names)
+	if err != nil || !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("servers:names is %v (%v), expected [a b]", names, err)
+	}
+
+	if err := settings.LoadLuaFileAt(write("number.lua", `return 8080`), "port"); err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := settings.GetInt("port", 0); port != 8080 {
+		t.Errorf("port is %d, expected 8080", port)
+	}
+
+	if err := settings.LoadLuaFileAt(write("empty.lua", `return {}`), ""); err != nil {
+		t.Error(err)
+	}
+	err = settings.LoadLuaFileAt(write("list.lua", `return {"a", "b"}`), "")
+	if err == nil || !strings.Contains(err.Error(), "give a path") {
+		t.Errorf("Loading a list at the root returned %v", err)
+	}
+}
+
+func TestLuaConfigMerge(t *testing.T) {
+	base := `{server = {host = "localhost", port = 80, tls = {cert = "a.pem"}}, hosts = {"a", "b"}, debug = false}`
+	override := `{server = {port = 443, tls = "off"}, hosts = {"c"}, name = "variant"}`
+
+	merged := NewSettings()
+	err := merged.LoadLuaString(`
+		local config = require("config")
+		local base = ` + base + `
+		local result = config.merge(base, ` + override + `)
+		assert(base.server.port == 80, "merge modified its arguments")
+		return result
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSettings()
+	if err := loaded.LoadLuaString("return " + base); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.LoadLuaString("return " + override); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(merged.GetJSON()), string(loaded.GetJSON()); got != want {
+		t.Errorf("config.merge = %s, want %s", got, want)
+	}
+}
+
+func TestLuaConfigPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.lua")
+	code := `return {data = CONFIG_DIR .. "/data", path = CONFIG_PATH}`
+	if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadLuaFile(path); err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := settings.GetString("data", ""); data != abs+"/data" {
+		t.Errorf("data is %q, expected %q", data, abs+"/data")
+	}
+	if configPath, _ := settings.GetString("path", ""); configPath != filepath.Join(abs, "config.lua") {
+		t.Errorf("path is %q, expected %q", configPath, filepath.Join(abs, "config.lua"))
+	}
+
+	// Strings have no path.
+	if err := settings.LoadLuaString(`return {unset = CONFIG_PATH == nil and CONFIG_DIR == nil}`); err != nil {
+		t.Fatal(err)
+	}
+	if unset, _ := settings.GetBool("unset", false); !unset {
+		t.Error("CONFIG_PATH and CONFIG_DIR should be nil for lua strings")
+	}
+}
+
+func TestLuaLoaders(t *testing.T) {
+	module := func(value string) lua.LGFunction {
+		return func(L *lua.LState) int {
+			L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+				"value": func(L *lua.LState) int {
+					L.Push(lua.LString(value))
+					return 1
+				},
+			}))
+			return 1
+		}
+	}
+	const script = `return {value = require("fake").value()}`
+
+	settings := NewSettings()
+	settings.AddLuaLoader("fake", module("first"))
+	settings.AddLuaLoader("other", module("other"))
+	if got := settings.LuaModules(); !reflect.DeepEqual(got, []string{"fake", "other"}) {
+		t.Errorf("LuaModules returned %v", got)
+	}
+	if err := settings.LoadLuaString(script); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := settings.GetString("value", ""); value != "first" {
+		t.Errorf("value is %q, want first", value)
+	}
+
+	// Replacing a module applies to the next loads.
+	settings.AddLuaLoader("fake", module("second"))
+	if err := settings.LoadLuaString(script); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := settings.GetString("value", ""); value != "second" {
+		t.Errorf("value is %q after replacing the module, want second", value)
+	}
+
+	settings.RemoveLuaLoader("fake")
+	if got := settings.LuaModules(); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("LuaModules returned %v after RemoveLuaLoader", got)
+	}
+	if err := settings.LoadLuaString(script); err == nil {
+		t.Errorf("requiring a removed module succeeded")
+	}
+}
+
+func TestLuaOutput(t *testing.T) {
+	settings := NewSettings()
+	output := &bytes.Buffer{}
+	settings.SetLuaOutput(output)
+
+	err := settings.LoadLuaString(`
+		print("hello", 42)
+		io.write("no", " newline")
+		return {}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := output.String(), "hello\t42\nno newline"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	output.Reset()
+	err = settings.LoadLuaString(`
+		print("about to fail")
+		error("oops")
+	`)
+	luaErr, ok := err.(*LuaError)
+	if !ok {
+		t.Fatalf("err = %v, want a *LuaError", err)
+	}
+	if luaErr.Output != "about to fail\n" {
+		t.Errorf("error output = %q", luaErr.Output)
+	}
+	if output.String() != "about to fail\n" {
+		t.Errorf("output = %q", output.String())
+	}
+}
+
+func TestLuaParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.lua")
+	script := `
+		local args = ...
+		local hosts = {}
+		for i, host in ipairs(params.hosts) do
+			hosts[i] = host .. "." .. args.env
+		end
+		return {
+			env = args.env,
+			debug = params.debug,
+			workers = params.limits.workers * 2,
+			hosts = hosts,
+		}
+	`
+	if err := ioutil.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		params map[string]interface{}
+		want   string
+	}{
+		{
+			map[string]interface{}{"env": "dev", "debug": true, "limits": map[string]int{"workers": 2}, "hosts": []string{"a"}},
+			`{"debug":true,"env":"dev","hosts":["a.dev"],"workers":4}`,
+		},
+		{
+			map[string]interface{}{"env": "prod", "debug": false, "limits": map[string]interface{}{"workers": 8.0}, "hosts": []interface{}{"a", "b"}},
+			`{"debug":false,"env":"prod","hosts":["a.prod","b.prod"],"workers":16}`,
+		},
+	} {
+		settings := NewSettings()
+		if err := settings.LoadLuaFileWithParams(path, test.params); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(settings.GetJSON()); got != test.want {
+			t.Errorf("LoadLuaFileWithParams(%v) = %s, want %s", test.params, got, test.want)
+		}
+
+		settings = NewSettings()
+		if err := settings.LoadLuaStringWithParams(script, test.params); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(settings.GetJSON()); got != test.want {
+			t.Errorf("LoadLuaStringWithParams(%v) = %s, want %s", test.params, got, test.want)
+		}
+	}
+
+	// Params that can't be converted fail before the script runs.
+	var output bytes.Buffer
+	settings := NewSettings()
+	settings.SetLuaOutput(&output)
+	err = settings.LoadLuaStringWithParams(`print("ran") return {}`, map[string]interface{}{"fn": func() {}})
+	if err == nil || !strings.Contains(err.Error(), "fn") || output.Len() != 0 {
+		t.Errorf("LoadLuaStringWithParams with a function = %v, output %q, want an error naming fn before running", err, output.String())
+	}
+}
+
+func TestLuaStrictGlobals(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		settings := NewSettings()
+		settings.SetLuaOutput(ioutil.Discard)
+		settings.SetSharedLuaState(shared)
+		settings.SetLuaStrictGlobals(true)
+
+		err := settings.LoadLuaString("local port = 8080\nreturn {host = hostnmae, port = port}")
+		if err == nil || !strings.Contains(err.Error(), "undefined global hostnmae") || !strings.Contains(err.Error(), "LoadLuaString:2:") {
+			t.Errorf("shared %v: reading a misspelled global = %v", shared, err)
+		}
+		if err := settings.LoadLuaString("retrun {port = 1}"); err == nil || !strings.Contains(err.Error(), "undefined global retrun") {
+			t.Errorf("shared %v: retrun = %v", shared, err)
+		}
+
+		code := `
+			unset = nil
+			function double(n) return n * 2 end
+			return {
+				unset = unset,
+				port = double(4040),
+				name = string.upper("app"),
+				list = require("json").encode({1}),
+				dir = CONFIG_DIR,
+				params = params,
+			}`
+		if err := settings.LoadLuaString(code); err != nil {
+			t.Fatalf("shared %v: %v", shared, err)
+		}
+		if got := string(settings.GetJSON()); got != `{"list":"[1]","name":"APP","port":8080}` {
+			t.Errorf("shared %v: GetJSON() = %s", shared, got)
+		}
+	}
+}
+
+func TestLuaWarnings(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		settings := NewSettings()
+		settings.SetSharedLuaState(shared)
+		code := "warn('old is deprecated, use new')\nlocal x = 1\nwarn('x is ' .. x)\nreturn {a = 1}"
+		if err := settings.LoadLuaString(code); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"LoadLuaString:1: old is deprecated, use new", "LoadLuaString:3: x is 1"}
+		if got := settings.LastWarnings(); !reflect.DeepEqual(got, want) {
+			t.Errorf("LastWarnings = %q, want %q", got, want)
+		}
+
+		err := settings.LoadLuaString("if true then\n  fail('port must be set')\nend\nreturn {a = 2}")
+		var luaErr *LuaError
+		if !errors.As(err, &luaErr) || !strings.HasPrefix(luaErr.Error(), "LoadLuaString:2: port must be set\n") || luaErr.Traceback != "" {
+			t.Errorf("LoadLuaString calling fail = %v, want the message", err)
+		}
+		if got, _ := settings.GetInt("a", 0); got != 1 {
+			t.Errorf("a = %d after a failed load, want 1", got)
+		}
+
+		if err := settings.LoadJSON([]byte(`{"b": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+		if got := settings.LastWarnings(); len(got) != 0 {
+			t.Errorf("LastWarnings after LoadJSON = %q, want none", got)
+		}
+	}
+}
+
+func TestSharedLuaState(t *testing.T) {
+	settings := NewSettings()
+	settings.SetSharedLuaState(true)
+	loads := 0
+	settings.AddLuaLoader("helpers", func(L *lua.LState) int {
+		loads++
+		L.Push(L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"double": func(L *lua.LState) int {
+				L.Push(L.CheckNumber(1) * 2)
+				return 1
+			},
+		}))
+		return 1
+	})
+
+	err := settings.LoadLuaString(`
+		leaked = "first"
+		string.shared = "yes"
+		local helpers = require("helpers")
+		return {first = helpers.double(2), leaked = leaked}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = settings.LoadLuaString(`
+		local helpers = require("helpers")
+		return {second = helpers.double(3), seen = leaked, shared = string.shared}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"first":4,"leaked":"first","second":6,"shared":"yes"}`
+	if got := string(settings.GetJSON()); got != want {
+		t.Errorf("settings are %s, want %s", got, want)
+	}
+	if loads != 1 {
+		t.Errorf("helpers module was loaded %d times, want once", loads)
+	}
+
+	// Errors don't break the state for the next configs.
+	if err := settings.LoadLuaString(`error("boom")`); err == nil {
+		t.Errorf("failing config succeeded")
+	}
+	if err := settings.LoadLuaStringWithParams(`return {third = params.n}`, map[string]interface{}{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadLuaString(`return {params = params}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settings.RawGet("params"); err == nil {
+		t.Errorf("params leaked into the next config")
+	}
+}
+
+func TestFormatMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	settings := NewSettings()
+	if err := settings.LoadFile(write("a.conf", "// flexiconfig: json\n{\"json\": true}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadFile(write("b.conf", "#!flexiconfig:LUA\r\nreturn {lua = true}")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"json", "lua"} {
+		if value, _ := settings.GetBool(path, false); !value {
+			t.Errorf("%s should be loaded", path)
+		}
+	}
+	if err := settings.Reload(); err != nil {
+		t.Error(err)
+	}
+
+	// Line numbers of errors are kept.
+	err = settings.LoadFile(write("c.conf", "-- flexiconfig: lua\nreturn {\n  a = nil + 1,\n}"))
+	var luaErr *LuaError
+	if !errors.As(err, &luaErr) || luaErr.Line != 3 {
+		t.Errorf("Broken lua returned %v, expected an error on line 3", err)
+	}
+
+	err = settings.LoadFile(write("d.conf", "# flexiconfig: yaml\na: 1"))
+	if err == nil || !strings.Contains(err.Error(), "Unknown config file format yaml (known formats are json, lua") {
+		t.Errorf("An unknown format returned %v", err)
+	}
+	err = settings.LoadFile(write("e.conf", "{\"flexiconfig\": \"json\"}"))
+	if err == nil || !strings.Contains(err.Error(), "Unable to determine config file type") {
+		t.Errorf("A file without a marker returned %v", err)
+	}
+}
+
+func TestLoadConvention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config.json", `{"env": "base", "base": true}`)
+	write("config.prod.lua", `return {env = "prod", prod = true}`)
+	write("config.local.json", `{"local": true}`)
+	write("config.staging.json", `{"env": "staging"}`)
+
+	settings := NewSettings()
+	loaded, err := settings.LoadConvention(dir, "config", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(dir, "config.json"),
+		filepath.Join(dir, "config.prod.lua"),
+		filepath.Join(dir, "config.local.json"),
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Errorf("LoadConvention loaded %v, expected %v", loaded, expected)
+	}
+	if env, _ := settings.GetString("env", ""); env != "prod" {
+		t.Errorf("env is %q, expected prod", env)
+	}
+	for _, path := range []string{"base", "prod", "local"} {
+		if value, _ := settings.GetBool(path, false); !value {
+			t.Errorf("%s should be loaded", path)
+		}
+	}
+
+	settings = NewSettings()
+	if loaded, err := settings.LoadConvention(dir, "config", ""); err != nil || len(loaded) != 2 {
+		t.Errorf("LoadConvention without an environment loaded %v (%v)", loaded, err)
+	}
+	if loaded, err := settings.LoadConvention(dir, "other", "prod"); err != nil || len(loaded) != 0 {
+		t.Errorf("LoadConvention without files loaded %v (%v)", loaded, err)
+	}
+
+	write("config.local.lua", `return {}`)
+	settings = NewSettings()
+	_, err = settings.LoadConvention(dir, "config", "prod")
+	if err == nil || !strings.Contains(err.Error(), "only one of them can be loaded") {
+		t.Errorf("Ambiguous files returned %v", err)
+	}
+	if len(settings.Sources()) != 0 {
+		t.Error("Nothing should be loaded when a file is ambiguous")
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"10-base.json":  `{"port": 80, "name": "base"}`,
+		"20-bad.json":   `{"port": `,
+		"30-local.lua":  `return {port = 8080}`,
+		"40-broken.lua": `return {`,
+		"README":        `not a config`,
+		".hidden.json":  `{"hidden": true}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Strict loads stop at the first bad file.
+	strict := NewSettings()
+	if err := strict.LoadDirectory(dir); err == nil {
+		t.Errorf("LoadDirectory succeeded with bad files")
+	}
+	if port, _ := strict.GetInt("port", 0); port != 80 {
+		t.Errorf("port is %d after a strict load, want 80", port)
+	}
+
+	settings := NewSettings()
+	err = settings.LoadDirectory(dir, ContinueOnError)
+	var loadErrors *LoadErrors
+	if !errors.As(err, &loadErrors) || len(loadErrors.Errors) != 2 {
+		t.Fatalf("LoadDirectory with ContinueOnError returned %v, want 2 errors", err)
+	}
+	for i, name := range []string{"20-bad.json", "40-broken.lua"} {
+		if got := loadErrors.Errors[i].Path; got != filepath.Join(dir, name) {
+			t.Errorf("error %d is for %s, want %s", i, got, name)
+		}
+	}
+	if len(loadErrors.Unwrap()) != 2 || len(settings.SkippedFiles()) != 2 {
+		t.Errorf("Unwrap and SkippedFiles don't list both files")
+	}
+	if port, _ := settings.GetInt("port", 0); port != 8080 {
+		t.Errorf("port is %d, want 8080", port)
+	}
+	if _, err := settings.GetBool("hidden", false); err == nil {
+		t.Errorf("dotfile was loaded")
+	}
+
+	globbed := NewSettings()
+	if err := globbed.LoadGlob(filepath.Join(dir, "*.json"), ContinueOnError); err == nil || len(globbed.SkippedFiles()) != 1 {
+		t.Errorf("LoadGlob returned %v, want 1 error", err)
+	}
+	if name, _ := globbed.GetString("name", ""); name != "base" {
+		t.Errorf("name is %q, want base", name)
+	}
+}
+
+func TestLoadFileAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "config")
+	luaPath := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"json": "yes"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(luaPath, []byte(`return {lua = "yes"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := NewSettings()
+	for _, path := range []string{jsonPath, luaPath} {
+		err := settings.LoadFile(path)
+		if err == nil || !strings.Contains(err.Error(), "LoadFileAs") || !strings.Contains(err.Error(), ".json, .lua") {
+			t.Errorf("LoadFile(%s) = %v, want an error suggesting LoadFileAs", path, err)
+		}
+	}
+
+	if err := settings.LoadFileAs(jsonPath, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadFileAs(luaPath, "lua"); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadFileAs(jsonPath, "yaml"); err == nil {
+		t.Errorf("LoadFileAs with an unknown format succeeded")
+	}
+
+	for path, file := range map[string]string{"json": jsonPath, "lua": luaPath} {
+		if got, err := settings.GetString(path, ""); err != nil || got != "yes" {
+			t.Errorf("GetString(%s) = %q, %v, want yes", path, got, err)
+		}
+		source, ok := settings.SourceOf(path)
+		if !ok || source.Name != file || source.Dir != dir {
+			t.Errorf("SourceOf(%s) = %+v, %v, want %s in %s", path, source, ok, file, dir)
+		}
+	}
+}
+
+func TestLuaError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.lua")
+	code := "local x = 1\r\nlocal function f()\r\n  return nil + x\r\nend\r\nprint('before')\r\nreturn {a = f()}\r\n"
+	if err := ioutil.WriteFile(path, []byte(code), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Runtime errors have the source, the line, its text and a traceback.
+	settings := NewSettings()
+	var luaErr *LuaError
+	err := settings.LoadLuaFile(path)
+	if !errors.As(err, &luaErr) {
+		t.Fatalf("LoadLuaFile = %v, want a *LuaError", err)
+	}
+	if luaErr.Source != path || luaErr.Line != 3 || luaErr.LineText != "  return nil + x" || luaErr.Output != "before\n" {
+		t.Errorf("LuaError = %+v", luaErr)
+	}
+	wantTraceback := "stack traceback:\n\t" + path + ":3: in function 'f'\n\t" + path + ":6: in main chunk\n\t[G]: ?"
+	if luaErr.Traceback != wantTraceback {
+		t.Errorf("Traceback = %q, want %q", luaErr.Traceback, wantTraceback)
+	}
+	want := path + ":3: cannot perform add operation between nil and number\n  3 |   return nil + x\n" + wantTraceback + "\nScript output:\nbefore"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) || luaErr.Unwrap() != luaErr.Err {
+		t.Errorf("LuaError doesn't unwrap to the interpreter's error: %#v", luaErr.Err)
+	}
+
+	for code, want := range map[string]LuaError{
+		// Syntax errors have no traceback.
+		"return {\n  a = 1\n  b = 2\n}": {Line: 3, LineText: "  b = 2"},
+		"return {a = ":                  {Line: 1, LineText: "return {a = "},
+		// Errors without a position have no line.
+		"error('plain', 0)": {Traceback: "stack traceback:\n\t[G]: in function 'error'\n\tLoadLuaString:1: in main chunk\n\t[G]: ?"},
+		"\n\nerror('here')": {Line: 3, LineText: "error('here')", Traceback: "stack traceback:\n\t[G]: in function 'error'\n\tLoadLuaString:3: in main chunk\n\t[G]: ?"},
+	} {
+		err := settings.LoadLuaString(code)
+		if !errors.As(err, &luaErr) {
+			t.Errorf("LoadLuaString(%q) = %v, want a *LuaError", code, err)
+			continue
+		}
+		if luaErr.Source != "LoadLuaString" || luaErr.Line != want.Line || luaErr.LineText != want.LineText || luaErr.Traceback != want.Traceback {
+			t.Errorf("LoadLuaString(%q) = %+v, want %+v", code, luaErr, want)
+		}
+		if want.Line == 0 && strings.Contains(err.Error(), " | ") {
+			t.Errorf("LoadLuaString(%q) = %q shows a line", code, err)
+		}
+	}
+}
+
+func TestNumericMapKeys(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"retries": {"500": 3, "503": 5}, "bad": {"abc": 1}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.LoadLuaString(`return {lua = {[404] = "missing", [2.5] = "half"}, ports = {[8080] = true}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	var ints map[int]int
+	if err := settings.Get("retries", &ints); err != nil || !reflect.DeepEqual(ints, map[int]int{500: 3, 503: 5}) {
+		t.Errorf("Get(retries) into map[int]int = %v, %v", ints, err)
+	}
+	var int64s map[int64]int64
+	if err := settings.Get("retries", &int64s); err != nil || !reflect.DeepEqual(int64s, map[int64]int64{500: 3, 503: 5}) {
+		t.Errorf("Get(retries) into map[int64]int64 = %v, %v", int64s, err)
+	}
+	var floats map[float64]string
+	if err := settings.Get("lua", &floats); err != nil || !reflect.DeepEqual(floats, map[float64]string{404: "missing", 2.5: "half"}) {
+		t.Errorf("Get(lua) into map[float64]string = %v, %v", floats, err)
+	}
+
+	// Lua number keys are stored as strings and come back out as numbers.
+	if got, err := settings.GetString("lua:404", ""); err != nil || got != "missing" {
+		t.Errorf("GetString(lua:404) = %q, %v, want missing", got, err)
+	}
+	var ports struct{ Ports map[uint16]bool }
+	if err := settings.Get("", &ports); err != nil || !ports.Ports[8080] {
+		t.Errorf("Get into map[uint16]bool = %v, %v", ports, err)
+	}
+
+	var bad map[int]int
+	if err := settings.Get("bad", &bad); err == nil || !strings.Contains(err.Error(), `"abc"`) {
+		t.Errorf("Get(bad) into map[int]int = %v, want an error naming abc", err)
+	}
+	var small map[int8]int
+	if err := settings.Get("retries", &small); err == nil {
+		t.Errorf("Get(retries) into map[int8]int succeeded")
+	}
+}
+
+func benchmarkLuaLoad(b *testing.B, shared bool) {
+	settings := NewSettings()
+	settings.SetSharedLuaState(shared)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := settings.LoadLuaString(`return {port = 8000 + 80, name = string.upper("x")}`); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLuaNonFiniteFloats(t *testing.T) {
+	settings := NewSettings()
+	if err := settings.LoadJSON([]byte(`{"limit": 10}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// gopher-lua's math.huge is the largest finite float, going past it isn't.
+	err := settings.LoadLuaString("return {limits = {max = math.huge * 2}}")
+	if err == nil || !strings.Contains(err.Error(), "Value at limits:max is +Inf") {
+		t.Errorf("LoadLuaString(math.huge * 2) = %v", err)
+	}
+	if err := settings.LoadLuaString("return {limits = {min = -1/0}}"); err == nil || !strings.Contains(err.Error(), "limits:min is -Inf") {
+		t.Errorf("LoadLuaString(-1/0) = %v", err)
+	}
+	if err := settings.LoadLuaString("return {ratio = 0/0}"); err == nil || !strings.Contains(err.Error(), "ratio is NaN") {
+		t.Errorf("LoadLuaString(0/0) = %v", err)
+	}
+	if got := string(settings.GetJSON()); got != `{"limit":10}` {
+		t.Errorf("GetJSON() = %s, want the settings unchanged", got)
+	}
+
+	if err := settings.LoadLuaString("return {limit = math.huge}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"limit":1.7976931348623157e+308}` {
+		t.Errorf("GetJSON() = %s", got)
+	}
+}
+
+func TestLuaZeroValueSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flexiconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	luaFile := filepath.Join(dir, "b.lua")
+	if err := ioutil.WriteFile(luaFile, []byte(`return {lua = 2}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each call gets a fresh zero value, which is empty but must not panic.
+	calls := map[string]func(s *Settings) error{
+		"LoadLuaString": func(s *Settings) error { return s.LoadLuaString("return {a = 1}") },
+		"LoadLuaFile":   func(s *Settings) error { return s.LoadLuaFile(luaFile) },
+		"LoadAll":       func(s *Settings) error { return s.LoadAll(luaFile) },
+		"LoadLuaStringWithParams": func(s *Settings) error {
+			return s.LoadLuaStringWithParams("return {a = params.a}", map[string]interface{}{"a": 1})
+		},
+		"SetSharedLuaState": func(s *Settings) error {
+			s.SetSharedLuaState(true)
+			return s.LoadLuaString("return {a = 1}")
+		},
+		"AddLuaLoader": func(s *Settings) error { s.AddLuaLoader("m", nil); return nil },
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			var s Settings
+			if err := call(&s); err != nil {
+				t.Errorf("%s on a zero value: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestLuaTableStructure(t *testing.T) {
+	// A table reachable twice is copied twice, a table containing itself is
+	// an error.
+	settings := NewSettings()
+	if err := settings.LoadLuaString(`local shared = {x = 1} return {a = shared, b = {shared, shared}}`); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":{"x":1},"b":[{"x":1},{"x":1}]}` {
+		t.Errorf("settings are %s", got)
+	}
+	if err := settings.RawSet(false, "a:x", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(settings.GetJSON()); got != `{"a":{"x":2},"b":[{"x":1},{"x":1}]}` {
+		t.Errorf("the copies of a shared table share their values: %s", got)
+	}
+
+	for code, message := range map[string]string{
+		`local t = {} t.self = t return t`:                          "Value at self contains itself",
+		`local t = {} t.a = {b = {t}} return t`:                     "Value at a:b[0] contains itself",
+		`local t = {} return {list = {t, {inner = {t, t}}}, t = t}`: "",
+		`local t = {1} t[2] = t return {list = t}`:                  "Value at list[1] contains itself",
+	} {
+		settings := NewSettings()
+		err := settings.LoadLuaString(code)
+		if message == "" {
+			if err != nil {
+				t.Errorf("%s: %s", code, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s returned %v, want %q", code, err, message)
+		}
+	}
+
+	// Tables nested deeper than the maximum depth are rejected, naming the
+	// path with the separator of the settings.
+	settings = NewSettings()
+	if err := settings.SetPathSeparator("."); err != nil {
+		t.Fatal(err)
+	}
+	settings.SetMaxDepth(2)
+	if err := settings.LoadLuaString(`return {a = {b = {c = 1}}}`); err != nil {
+		t.Error(err)
+	}
+	err := settings.LoadLuaString(`return {a = {b = {c = {d = 1}}}}`)
+	if err == nil || !strings.Contains(err.Error(), "Value at a.b.c is nested deeper than the maximum of 2") {
+		t.Errorf("too deep a table returned %v", err)
+	}
+	if _, err := settings.RawGet("a.b.c"); err != nil {
+		t.Errorf("a rejected config changed the settings: %s", err)
+	}
+}
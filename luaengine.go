@@ -0,0 +1,507 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package flexiconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	luajson "layeh.com/gopher-json"
+)
+
+// LuaLoader is the type representing the function signature used to
+// load custom lua modules.
+type LuaLoader func(L *lua.LState) int
+
+func init() {
+	RegisterLuaEngine(DefaultLuaEngine)
+}
+
+// DefaultLuaEngine runs lua configs with gopher-lua. It is registered unless
+// flexiconfig is built with the flexiconfig_nolua tag.
+var DefaultLuaEngine LuaEngine = gopherLua{}
+
+// AddLuaLoader can be used to add a custom lua module to each lua-state that is
+// used. Note that flexiconfig currently creates a new lua instance for every
+// lua config file loaded, so a module applies to every lua config loaded or
+// reloaded after it is added, whenever that is, but not to those already
+// loaded. Adding a module under a name already used replaces it, logging a
+// warning.
+func (this *Settings) AddLuaLoader(name string, loader lua.LGFunction) {
+	this.wlock()
+
+	if _, ok := this.luaModules[name]; ok {
+		this.logf(LogWarning, "Replacing lua module %s", name)
+	}
+	this.luaModules[name] = loader
+	shared := this.sharedLua
+	this.wunlock()
+
+	shared.reset()
+}
+
+// gopherLua is the LuaEngine running lua configs with gopher-lua.
+type gopherLua struct{}
+
+// RunLua runs the config of run in a new lua state, or in the shared one.
+func (this gopherLua) RunLua(run *LuaRun) (interface{}, error) {
+	var L *lua.LState
+	var env *lua.LTable
+	if run.Shared {
+		shared, _ := run.SharedState().(*gopherLuaState)
+		if shared == nil {
+			shared = &gopherLuaState{}
+			state, err := newLuaState(run, shared)
+			if err != nil {
+				return nil, err
+			}
+			shared.L = state
+			run.SetSharedState(shared)
+		}
+		shared.output = run.Output
+		L = shared.L
+		defer L.SetTop(0)
+		env = newLuaEnv(L)
+	} else {
+		state, err := newLuaState(run, run.Output)
+		if err != nil {
+			return nil, err
+		}
+		L = state
+		defer L.Close()
+	}
+
+	var configPath, configDir lua.LValue = lua.LNil, lua.LNil
+	if run.File != "" {
+		configPath, configDir = lua.LString(run.File), lua.LString(filepath.Dir(run.File))
+	}
+
+	calls := &luaConfigCalls{run: run}
+	fn, err := L.Load(bytes.NewReader(run.Code), run.Source)
+	if err == nil {
+		if env != nil {
+			L.SetFEnv(fn, env)
+			env.RawSetString("warn", L.NewFunction(calls.warn))
+			env.RawSetString("fail", L.NewFunction(calls.fail))
+			env.RawSetString("CONFIG_PATH", configPath)
+			env.RawSetString("CONFIG_DIR", configDir)
+		} else {
+			L.SetGlobal("warn", L.NewFunction(calls.warn))
+			L.SetGlobal("fail", L.NewFunction(calls.fail))
+			L.SetGlobal("CONFIG_PATH", configPath)
+			L.SetGlobal("CONFIG_DIR", configDir)
+		}
+		if run.StrictGlobals {
+			globals, fallback := L.G.Global, (*lua.LTable)(nil)
+			if env != nil {
+				globals, fallback = env, L.G.Global
+			}
+			strictLuaGlobals(L, globals, fallback, "params", "CONFIG_PATH", "CONFIG_DIR")
+		}
+		L.Push(fn)
+		nargs := 0
+		if run.Params != nil {
+			table := toLua(L, run.Params)
+			if env != nil {
+				env.RawSetString("params", table)
+			} else {
+				L.SetGlobal("params", table)
+			}
+			L.Push(table)
+			nargs = 1
+		}
+		err = L.PCall(nargs, lua.MultRet, nil)
+	}
+	if err != nil {
+		message, traceback := err.Error(), ""
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			message = strings.TrimSpace(apiErr.Object.String())
+			traceback = apiErr.StackTrace
+		}
+		if calls.failed {
+			traceback = ""
+		}
+		return nil, run.NewError(message, traceback, err)
+	}
+
+	return newLuaConverter(run, true).convert(run.Path, 0, L.Get(-1))
+}
+
+// newLuaState creates a lua state with the modules of run, whose print and
+// io.write functions write to w.
+func newLuaState(run *LuaRun, w io.Writer) (*lua.LState, error) {
+	modules := make(map[string]lua.LGFunction, len(run.Modules))
+	for name, loader := range run.Modules {
+		switch fn := loader.(type) {
+		case lua.LGFunction:
+			modules[name] = fn
+		case func(*lua.LState) int:
+			modules[name] = fn
+		default:
+			return nil, fmt.Errorf("Lua module %s is a %T, not a lua.LGFunction", name, loader)
+		}
+	}
+
+	L := lua.NewState(lua.Options{IncludeGoStackTrace: run.GoStackTrace})
+	luajson.Preload(L)
+	L.PreloadModule("config", luaConfigModule(run))
+	for name, loader := range modules {
+		L.PreloadModule(name, loader)
+	}
+	redirectLuaOutput(L, w)
+	return L, nil
+}
+
+// redirectLuaOutput replaces print and io.write so that they write to w.
+func redirectLuaOutput(L *lua.LState, w io.Writer) {
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		top := L.GetTop()
+		for i := 1; i <= top; i++ {
+			if i > 1 {
+				io.WriteString(w, "\t")
+			}
+			io.WriteString(w, L.ToStringMeta(L.Get(i)).String())
+		}
+		io.WriteString(w, "\n")
+		return 0
+	}))
+
+	if ioTable, ok := L.GetGlobal("io").(*lua.LTable); ok {
+		ioTable.RawSetString("write", L.NewFunction(func(L *lua.LState) int {
+			top := L.GetTop()
+			for i := 1; i <= top; i++ {
+				io.WriteString(w, L.CheckString(i))
+			}
+			L.Push(ioTable.RawGetString("stdout"))
+			return 1
+		}))
+	}
+}
+
+// gopherLuaState is the lua state used by every config of settings with
+// SetSharedLuaState.
+type gopherLuaState struct {
+	L *lua.LState
+	// output is where the config being run prints to.
+	output io.Writer
+}
+
+// Write writes p to the output of the config being run.
+func (this *gopherLuaState) Write(p []byte) (int, error) {
+	return this.output.Write(p)
+}
+
+// Close closes the lua state.
+func (this *gopherLuaState) Close() error {
+	this.L.Close()
+	return nil
+}
+
+// newLuaEnv returns an environment for a config run in the shared state L,
+// which reads globals from L but keeps those set by the config.
+func newLuaEnv(L *lua.LState) *lua.LTable {
+	env := L.NewTable()
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, meta)
+	return env
+}
+
+// strictLuaGlobals makes reading a global of globals that isn't set an error,
+// unless it was declared by setting it, even to nil, or is one of declared.
+// Globals missing from globals are read from fallback first, if not nil.
+func strictLuaGlobals(L *lua.LState, globals *lua.LTable, fallback *lua.LTable, declared ...string) {
+	names := make(map[string]bool, len(declared))
+	for _, name := range declared {
+		names[name] = true
+	}
+
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		key := L.Get(2)
+		if fallback != nil {
+			if value := fallback.RawGet(key); value != lua.LNil {
+				L.Push(value)
+				return 1
+			}
+		}
+		if name, ok := key.(lua.LString); !ok || !names[string(name)] {
+			L.RaiseError("undefined global %s", L.ToStringMeta(key).String())
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+	meta.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		key := L.Get(2)
+		if name, ok := key.(lua.LString); ok {
+			names[string(name)] = true
+		}
+		L.CheckTable(1).RawSet(key, L.Get(3))
+		return 0
+	}))
+	L.SetMetatable(globals, meta)
+}
+
+// luaConfigCalls provides the warn and fail functions of a config while it runs:
+//
+//	warn(message) logs message as a warning, see Settings.LastWarnings
+//	fail(message) stops the config, making its load fail with message
+//
+// Both messages are prefixed with the position of the call in the config.
+type luaConfigCalls struct {
+	run *LuaRun
+	// failed is whether the config called fail.
+	failed bool
+}
+
+func (this *luaConfigCalls) warn(L *lua.LState) int {
+	message := L.CheckString(1)
+	if where := L.Where(1); where != "" {
+		message = where + " " + message
+	} else {
+		message = this.run.Source + ": " + message
+	}
+	this.run.Warn(message)
+	return 0
+}
+
+func (this *luaConfigCalls) fail(L *lua.LState) int {
+	message := L.CheckString(1)
+	this.failed = true
+	L.RaiseError("%s", message)
+	return 0
+}
+
+// luaConverter turns the values returned by lua configs into the types used by
+// the settings tree.
+type luaConverter struct {
+	run      *LuaRun
+	visiting map[*lua.LTable]bool
+	// ordered is whether the order of keys is recorded, see
+	// LuaRun.OrderKey, which it isn't for maps inside arrays, counted by
+	// inArray.
+	ordered bool
+	inArray int
+}
+
+func newLuaConverter(run *LuaRun, ordered bool) *luaConverter {
+	return &luaConverter{run: run, visiting: make(map[*lua.LTable]bool), ordered: ordered}
+}
+
+// convert converts lv, found at path, to a Go value. Tables keyed by the
+// numbers 1 to n become arrays and tables keyed by strings become maps, an
+// empty table is an empty array. Tables keyed by other numbers become maps
+// keyed by the numbers as strings.
+func (this *luaConverter) convert(path string, depth int, lv lua.LValue) (interface{}, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		return this.convertTable(path, depth, v)
+	default:
+		return nil, fmt.Errorf("Cannot use lua %s at %s", lv.Type(), describePath(path))
+	}
+}
+
+func (this *luaConverter) convertTable(path string, depth int, table *lua.LTable) (interface{}, error) {
+	if depth > this.run.MaxDepth {
+		return nil, fmt.Errorf("Value at %s is nested deeper than the maximum of %d", describePath(path), this.run.MaxDepth)
+	}
+	if this.visiting[table] {
+		return nil, fmt.Errorf("Value at %s contains itself", describePath(path))
+	}
+	this.visiting[table] = true
+	defer delete(this.visiting, table)
+
+	key, value := table.Next(lua.LNil)
+	switch key.Type() {
+	case lua.LTNil:
+		return []interface{}{}, nil
+	case lua.LTNumber:
+		if !isLuaArray(table) {
+			return this.convertNumberKeyed(path, depth, table)
+		}
+
+		array := make([]interface{}, 0, table.Len())
+		this.inArray++
+		defer func() { this.inArray-- }()
+		for expected := lua.LNumber(1); key != lua.LNil; expected++ {
+			if key.Type() != lua.LTNumber {
+				return nil, fmt.Errorf("Table at %s mixes number and string keys", describePath(path))
+			}
+			if key != expected {
+				return nil, fmt.Errorf("Table at %s is a sparse array", describePath(path))
+			}
+
+			converted, err := this.convert(fmt.Sprintf("%s[%d]", path, len(array)), depth+1, value)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, converted)
+			key, value = table.Next(key)
+		}
+		return array, nil
+	case lua.LTString:
+		m := make(map[string]interface{})
+		for key != lua.LNil {
+			if key.Type() != lua.LTString {
+				return nil, fmt.Errorf("Table at %s mixes number and string keys", describePath(path))
+			}
+
+			converted, err := this.convert(joinPathWith(this.run.Separator, path, key.String()), depth+1, value)
+			if err != nil {
+				return nil, err
+			}
+			if this.ordered && this.inArray == 0 {
+				this.run.OrderKey(path, key.String())
+			}
+			m[key.String()] = converted
+			key, value = table.Next(key)
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("Table at %s has a %s key", describePath(path), key.Type())
+	}
+}
+
+// isLuaArray reports whether table is keyed by the numbers 1 to n, or has a key
+// that isn't a number at all.
+func isLuaArray(table *lua.LTable) bool {
+	count := 0
+	max := lua.LNumber(0)
+	for key, _ := table.Next(lua.LNil); key != lua.LNil; key, _ = table.Next(key) {
+		n, ok := key.(lua.LNumber)
+		if !ok {
+			return true
+		}
+		if n > max {
+			max = n
+		}
+		if n < 1 || n != lua.LNumber(int64(n)) {
+			return false
+		}
+		count++
+	}
+	return lua.LNumber(count) == max
+}
+
+// convertNumberKeyed converts a table keyed by numbers that isn't an array,
+// such as {[500] = 3, [503] = 5}, to a map keyed by the numbers as strings.
+// Get can turn the keys back into numbers.
+func (this *luaConverter) convertNumberKeyed(path string, depth int, table *lua.LTable) (interface{}, error) {
+	m := make(map[string]interface{})
+	for key, value := table.Next(lua.LNil); key != lua.LNil; key, value = table.Next(key) {
+		if key.Type() != lua.LTNumber {
+			return nil, fmt.Errorf("Table at %s mixes number and string keys", describePath(path))
+		}
+		n := float64(key.(lua.LNumber))
+		name := strconv.FormatFloat(n, 'f', -1, 64)
+
+		converted, err := this.convert(joinPathWith(this.run.Separator, path, name), depth+1, value)
+		if err != nil {
+			return nil, err
+		}
+		if this.ordered && this.inArray == 0 {
+			this.run.OrderKey(path, name)
+		}
+		m[name] = converted
+	}
+	return m, nil
+}
+
+// luaConfigModule returns the loader of the config module, which gives scripts
+// the same merge that is applied to the tables they return:
+//
+//	config.merge(base, override) returns a merged copy of both tables
+//	config.deepcopy(t) returns a copy of t
+//	config.flatten(t [, sep]) returns the leaves of t keyed by their full path
+func luaConfigModule(run *LuaRun) lua.LGFunction {
+	checkMap := func(L *lua.LState, n int) map[string]interface{} {
+		value, err := newLuaConverter(run, false).convert("", 0, L.CheckTable(n))
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			return v
+		case []interface{}:
+			if len(v) == 0 {
+				return make(map[string]interface{})
+			}
+		}
+		L.ArgError(n, "table with string keys expected")
+		return nil
+	}
+
+	return func(L *lua.LState) int {
+		module := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+			"merge": func(L *lua.LState) int {
+				base := checkMap(L, 1)
+				override := checkMap(L, 2)
+				if err := run.Merge(base, override); err != nil {
+					L.RaiseError("%s", err)
+				}
+				L.Push(toLua(L, base))
+				return 1
+			},
+			"deepcopy": func(L *lua.LState) int {
+				value, err := newLuaConverter(run, false).convert("", 0, L.CheckAny(1))
+				if err != nil {
+					L.RaiseError("%s", err)
+				}
+				L.Push(toLua(L, value))
+				return 1
+			},
+			"flatten": func(L *lua.LState) int {
+				m := checkMap(L, 1)
+				sep := L.OptString(2, run.Separator)
+				L.Push(toLua(L, run.Flatten(m, sep)))
+				return 1
+			},
+		})
+		L.Push(module)
+		return 1
+	}
+}
+
+// toLua converts a value of the settings tree to a lua value.
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, child := range v {
+			table.RawSetString(key, toLua(L, child))
+		}
+		return table
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, child := range v {
+			table.Append(toLua(L, child))
+		}
+		return table
+	default:
+		return lua.LString(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,9 @@
+// Package lualoader loads the lua configs of flexiconfig. Its functions are
+// preferred to the deprecated LoadLua methods of Settings, which they call.
+// Configs are run with gopher-lua by Engine, the engine flexiconfig registers
+// by default; Install makes a single Settings use it whatever engine is
+// registered.
+//
+// Building with the flexiconfig_nolua tag leaves the engine, and gopher-lua,
+// out of both packages. Lua configs then fail to load.
+package lualoader
@@ -0,0 +1,67 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package lualoader
+
+import (
+	"github.com/wetdesertrock/flexiconfig"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Engine is the flexiconfig.LuaEngine of the package, running configs with
+// gopher-lua.
+var Engine flexiconfig.LuaEngine = flexiconfig.DefaultLuaEngine
+
+// Install makes settings run their lua configs with Engine, whatever engine
+// is registered, see Settings.SetLuaEngine.
+func Install(settings *flexiconfig.Settings) {
+	settings.SetLuaEngine(Engine)
+}
+
+// LoadFile loads the lua config file at path into settings, see
+// Settings.LoadLuaFileWithParams. params may be nil.
+func LoadFile(settings *flexiconfig.Settings, path string, params map[string]interface{}) error {
+	if params == nil {
+		return settings.LoadLuaFile(path)
+	}
+	return settings.LoadLuaFileWithParams(path, params)
+}
+
+// LoadFileWithOptions loads the lua config file at path into settings using
+// the given merge options, see Settings.LoadLuaFileWithOptions.
+func LoadFileWithOptions(settings *flexiconfig.Settings, path string, options ...flexiconfig.MergeOption) error {
+	return settings.LoadLuaFileWithOptions(path, options...)
+}
+
+// LoadFileAt loads the lua config file at path into settings at target, see
+// Settings.LoadLuaFileAt.
+func LoadFileAt(settings *flexiconfig.Settings, path string, target string) error {
+	return settings.LoadLuaFileAt(path, target)
+}
+
+// LoadString loads the lua config code into settings, see
+// Settings.LoadLuaStringWithParams. params may be nil.
+func LoadString(settings *flexiconfig.Settings, code string, params map[string]interface{}) error {
+	if params == nil {
+		return settings.LoadLuaString(code)
+	}
+	return settings.LoadLuaStringWithParams(code, params)
+}
+
+// LoadStringWithOptions loads the lua config code into settings using the
+// given merge options, see Settings.LoadLuaStringWithOptions.
+func LoadStringWithOptions(settings *flexiconfig.Settings, code string, options ...flexiconfig.MergeOption) error {
+	return settings.LoadLuaStringWithOptions(code, options...)
+}
+
+// AddModule makes the lua module loader available to the lua configs of
+// settings under name, as require(name), see Settings.AddLuaLoader.
+func AddModule(settings *flexiconfig.Settings, name string, loader lua.LGFunction) {
+	settings.AddLuaLoader(name, loader)
+}
+
+// RemoveModule removes the lua module added under name, see
+// Settings.RemoveLuaLoader.
+func RemoveModule(settings *flexiconfig.Settings, name string) {
+	settings.RemoveLuaLoader(name)
+}
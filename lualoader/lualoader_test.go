@@ -0,0 +1,54 @@
+//go:build !flexiconfig_nolua
+// +build !flexiconfig_nolua
+
+package lualoader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lualoader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.lua")
+	if err := ioutil.WriteFile(path, []byte(`return {name = require("name"), port = params.port}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := flexiconfig.NewSettings()
+	AddModule(&settings, "name", func(L *lua.LState) int {
+		L.Push(lua.LString("service"))
+		return 1
+	})
+	if err := LoadFile(&settings, path, map[string]interface{}{"port": 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadString(&settings, `return {enabled = true}`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if name, err := settings.GetString("name", ""); err != nil || name != "service" {
+		t.Errorf("name = %q, %v", name, err)
+	}
+	if port, err := settings.GetInt("port", 0); err != nil || port != 80 {
+		t.Errorf("port = %d, %v", port, err)
+	}
+	if enabled, err := settings.GetBool("enabled", false); err != nil || !enabled {
+		t.Errorf("enabled = %v, %v", enabled, err)
+	}
+
+	RemoveModule(&settings, "name")
+	if err := LoadFile(&settings, path, map[string]interface{}{}); err == nil {
+		t.Error("LoadFile succeeded with the module removed")
+	}
+}
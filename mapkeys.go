@@ -0,0 +1,66 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// mapKeyHook is a mapstructure decode hook converting the string keys of the
+// settings tree to the key type of the map being decoded into, so that
+// {"500": 3} can be stored in a map[int]int. Keys that don't parse as the key
+// type are an error naming the key.
+func mapKeyHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	m, ok := data.(map[string]interface{})
+	if !ok || to.Kind() != reflect.Map || to.Key().Kind() == reflect.String {
+		return data, nil
+	}
+
+	keyType := to.Key()
+	converted := reflect.MakeMapWithSize(reflect.MapOf(keyType, reflect.TypeOf((*interface{})(nil)).Elem()), len(m))
+	for key, value := range m {
+		k, err := parseMapKey(key, keyType)
+		if err != nil {
+			return nil, err
+		}
+		v := reflect.ValueOf(&value).Elem()
+		converted.SetMapIndex(k, v)
+	}
+	return converted.Interface(), nil
+}
+
+// parseMapKey parses key as a value of the basic type t.
+func parseMapKey(key string, t reflect.Type) (reflect.Value, error) {
+	k := reflect.New(t).Elem()
+	var err error
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(key, 10, t.Bits()); err == nil {
+			k.SetInt(i)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		if u, err = strconv.ParseUint(key, 10, t.Bits()); err == nil {
+			k.SetUint(u)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(key, t.Bits()); err == nil {
+			k.SetFloat(f)
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(key); err == nil {
+			k.SetBool(b)
+		}
+	case reflect.Interface:
+		return reflect.ValueOf(key), nil
+	default:
+		return k, fmt.Errorf("Invalid map key %q: keys can't be stored in a map keyed by %s", key, t)
+	}
+	if err != nil {
+		return k, fmt.Errorf("Invalid map key %q: it is not a valid %s", key, t)
+	}
+	return k, nil
+}
@@ -0,0 +1,95 @@
+package flexiconfig
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// formatMarker matches the first line of a file naming its format, see
+// LoadFileWithOptions.
+var formatMarker = regexp.MustCompile(`^\s*(?:#!|#|//|--)\s*flexiconfig\s*:\s*([A-Za-z0-9_.-]+)\s*$`)
+
+// readFormatMarker returns the format named by the marker on the first line
+// of content, or "" if there is none, and content with the marker removed.
+// The line break after the marker is kept, so that line numbers in errors
+// don't change.
+func readFormatMarker(content []byte) (string, []byte) {
+	line := content
+	if end := bytes.IndexByte(content, '\n'); end >= 0 {
+		line = content[:end]
+	}
+	match := formatMarker.FindSubmatch(bytes.TrimSuffix(line, []byte("\r")))
+	if match == nil {
+		return "", content
+	}
+	return strings.ToLower(string(match[1])), content[len(line):]
+}
+
+// peekFormatMarker returns the format named by the marker of the file at
+// path, or "" if it has none or can't be read.
+func peekFormatMarker(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadSlice('\n')
+	if err != nil && len(line) == 0 {
+		return ""
+	}
+	format, _ := readFormatMarker(line)
+	return format
+}
+
+// checkFileFormat returns an error listing the known formats unless format is
+// one of them. The caller must hold fileFormatsLock.
+func checkFileFormat(format string) error {
+	if _, ok := fileFormats[format]; ok {
+		return nil
+	}
+	formats := make([]string, 0, len(fileFormats))
+	for format := range fileFormats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return fmt.Errorf("Unknown config file format %s (known formats are %s)", format, strings.Join(formats, ", "))
+}
+
+// markerLoader returns the loader for the file at path, whose format is
+// named by its marker.
+func markerLoader(path string, options []MergeOption) *loader {
+	return &loader{
+		source:  fileSource(path),
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			content, err := this.readFile(path)
+			if err != nil {
+				return nil, 0, err
+			}
+			this.logf(LogDebug, "Loading %s (%d bytes)", path, len(content))
+
+			format, stripped := readFormatMarker(content)
+			if format == "" {
+				return nil, len(content), fmt.Errorf("Could not load %s: its first line no longer names its format", path)
+			}
+			fileFormatsLock.RLock()
+			err = checkFileFormat(format)
+			fileFormatsLock.RUnlock()
+			if err != nil {
+				return nil, len(content), fmt.Errorf("Could not load %s: %s", path, err)
+			}
+
+			newSettings, err := this.decodeContent(path, format, stripped)
+			return newSettings, len(content), err
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package flexiconfig
+
+// MergeOption changes how new settings are merged into the existing ones. It is
+// accepted by MergeSettingsWithOptions and the Load*WithOptions functions.
+type MergeOption int
+
+const (
+	// MergeReplace is the default behaviour: new values replace existing
+	// ones, and maps are merged recursively.
+	MergeReplace MergeOption = iota
+
+	// MergeKeepExisting only fills in keys that aren't set yet, which allows
+	// loading defaults after the files that must not be overridden by them.
+	// Maps are still merged recursively so missing nested keys get filled,
+	// but a key that already exists is never replaced. This includes arrays,
+	// which are kept as a whole, and keys set to null, which count as set.
+	MergeKeepExisting
+)
+
+// mergeConfig is the combined effect of a set of MergeOptions.
+type mergeConfig struct {
+	keepExisting bool
+	separator    string
+
+	// record, if set, is called with the path of every leaf written.
+	record func(path string)
+
+	// conflict, if set, is called when a map replaces a value that isn't a
+	// map or the other way around. Returning an error stops the merge.
+	conflict func(path string, existing, new interface{}) error
+
+	// report, if set, collects what the merge changed.
+	report *MergeReport
+}
+
+func newMergeConfig(options []MergeOption) mergeConfig {
+	config := mergeConfig{}
+	for _, option := range options {
+		switch option {
+		case MergeReplace:
+			config.keepExisting = false
+		case MergeKeepExisting:
+			config.keepExisting = true
+		}
+	}
+	return config
+}
+
+// SetMode controls what RawSetMode does with the parts of a path that aren't
+// maps.
+type SetMode int
+
+const (
+	// SetReplace creates missing maps and replaces any other value in the
+	// way by a map. It is RawSet with timid set to false.
+	SetReplace SetMode = iota
+
+	// SetCreate creates missing maps but never replaces an existing value
+	// that isn't a map, returning an error instead. It is RawSet with timid
+	// set to true.
+	SetCreate
+
+	// SetExisting neither creates nor replaces anything: every map along the
+	// path must already exist.
+	SetExisting
+)
@@ -0,0 +1,157 @@
+package flexiconfig
+
+import (
+	"fmt"
+)
+
+// ConfigVersionKey is the top-level key holding the version of the settings,
+// which Migrate migrates from. Settings without it are at version 0.
+const ConfigVersionKey = "config_version"
+
+// MigrationFunc changes the settings m, at the version it was registered for,
+// into the next version. It may change m as it likes.
+type MigrationFunc func(m map[string]interface{}) error
+
+// RegisterMigration registers fn to migrate settings from fromVersion to
+// fromVersion+1, replacing any migration already registered for it. The
+// latest version is the one after the highest fromVersion registered, and
+// loading settings whose ConfigVersionKey is higher fails from then on.
+func (this *Settings) RegisterMigration(fromVersion int, fn MigrationFunc) {
+	this.wlock()
+	defer this.wunlock()
+
+	if this.migrations == nil {
+		this.migrations = make(map[int]MigrationFunc)
+	}
+	this.migrations[fromVersion] = fn
+}
+
+// SetMigrationHook sets a function called with the versions of every
+// migration run by Migrate, once they all succeeded.
+func (this *Settings) SetMigrationHook(fn func(fromVersion, toVersion int)) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.migrationHook = fn
+}
+
+// Migrate runs the registered migrations in turn, from the version of the
+// settings to the latest one, updating ConfigVersionKey after each. The
+// migrations run on a copy of the settings, which only replaces them once
+// they all succeeded and the validators accepted the values they changed.
+// They are then recorded in the history, and the post-load hooks run after the
+// migration hook. It is an error for the settings to be newer than the latest
+// version, or for a migration on the way to be missing.
+func (this *Settings) Migrate() error {
+	this.wlock()
+	ran, err := this.migrate()
+	hook := this.migrationHook
+	this.wunlock()
+
+	if err != nil {
+		return err
+	}
+	for _, version := range ran {
+		this.logf(LogInfo, "Migrated the settings from version %d to %d", version, version+1)
+		if hook != nil {
+			hook(version, version+1)
+		}
+	}
+	if len(ran) == 0 {
+		return nil
+	}
+	return this.afterLoad(nil)
+}
+
+// migrate is Migrate without locking, returning the versions migrated from.
+func (this *Settings) migrate() ([]int, error) {
+	version, err := this.configVersion(this.settings)
+	if err != nil {
+		return nil, err
+	}
+	latest := this.latestVersion()
+	if version >= latest {
+		return nil, nil
+	}
+
+	migrated := deepCopy(this.settings).(map[string]interface{})
+	var ran []int
+	for ; version < latest; version++ {
+		fn, ok := this.migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("Could not migrate the settings: there is no migration from version %d", version)
+		}
+		if err := fn(migrated); err != nil {
+			return nil, fmt.Errorf("Could not migrate the settings from version %d: %s", version, err)
+		}
+		migrated[ConfigVersionKey] = float64(version + 1)
+		ran = append(ran, version)
+	}
+
+	migrated, err = this.normalizeSettings(migrated)
+	if err != nil {
+		return nil, fmt.Errorf("Could not migrate the settings: %s", err)
+	}
+
+	var touched []string
+	for key, value := range this.settings {
+		if replaced, ok := migrated[key]; !ok || !sameValue(value, replaced) {
+			touched = append(touched, key)
+		}
+	}
+	for key := range migrated {
+		if _, ok := this.settings[key]; !ok {
+			touched = append(touched, key)
+		}
+	}
+	if err := this.replaceSettings("Migrate", migrated, touched); err != nil {
+		return nil, fmt.Errorf("Could not migrate the settings: %s", err)
+	}
+	return ran, nil
+}
+
+// latestVersion returns the version after the highest one a migration is
+// registered for, or 0 if there is none. The caller must hold the lock.
+func (this Settings) latestVersion() int {
+	latest := 0
+	for version := range this.migrations {
+		if version+1 > latest {
+			latest = version + 1
+		}
+	}
+	return latest
+}
+
+// configVersion returns the version of the settings m.
+func (this Settings) configVersion(m map[string]interface{}) (int, error) {
+	value, ok := m[ConfigVersionKey]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	var version int
+	if err := this.decode(ConfigVersionKey, value, &version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// checkConfigVersion returns an error if the settings m are newer than the
+// registered migrations know about.
+func (this Settings) checkConfigVersion(m map[string]interface{}) error {
+	this.rlock()
+	latest := this.latestVersion()
+	registered := len(this.migrations) > 0
+	this.runlock()
+
+	if !registered {
+		return nil
+	}
+	version, err := this.configVersion(m)
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("The settings are at version %d, newer than the latest version known, %d", version, latest)
+	}
+	return nil
+}
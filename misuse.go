@@ -0,0 +1,121 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Misuse is a call of a typed getter, such as GetString, that returned its
+// default because the path isn't set or holds another type, see SetDevMode.
+type Misuse struct {
+	// Getter is the name of the getter called.
+	Getter string
+	// Path is the path it was called with.
+	Path string
+	// Caller is the file and line of the call, outside of this package.
+	Caller string
+	// NotFound is true if the path isn't set, false if it holds a value the
+	// getter can't return.
+	NotFound bool
+	// Err is the error the first call returned.
+	Err error
+	// Count is how many times the call failed.
+	Count int
+}
+
+// misuseLog collects the Misuses of a Settings and its copies.
+type misuseLog struct {
+	lock   sync.Mutex
+	misuse map[misuseKey]*Misuse
+}
+
+type misuseKey struct {
+	path   string
+	caller string
+}
+
+// settingsPackage prefixes the names of the functions of this package.
+var settingsPackage = reflect.TypeOf(Settings{}).PkgPath() + "."
+
+// SetDevMode makes the typed getters, GetBool, GetBoolLenient, GetString,
+// GetInt, GetUint, GetFloat and GetDuration, report the calls that return
+// their default value because the path isn't set or holds another type, such
+// as GetString on a path holding an int. Each path is logged as a warning once
+// for every place it is got from, and MisuseReport lists them all, so that
+// tests or CI can fail on them. What the getters return doesn't change. The
+// Get*Any functions don't report the paths they fall back from.
+//
+// Finding where a getter was called costs a stack walk, so this is meant for
+// development; otherwise the getters only check whether it is set.
+func (this *Settings) SetDevMode(dev bool) {
+	this.lazyInit()
+	this.devMode = dev
+}
+
+// MisuseReport returns every misuse reported since SetDevMode was set, sorted
+// by path and caller.
+func (this Settings) MisuseReport() []Misuse {
+	if this.misuse == nil {
+		return nil
+	}
+
+	this.misuse.lock.Lock()
+	defer this.misuse.lock.Unlock()
+
+	report := make([]Misuse, 0, len(this.misuse.misuse))
+	for _, misuse := range this.misuse.misuse {
+		report = append(report, *misuse)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Path != report[j].Path {
+			return report[i].Path < report[j].Path
+		}
+		return report[i].Caller < report[j].Caller
+	})
+	return report
+}
+
+// noteMisuse records that getter, called with path, returned err.
+func (this Settings) noteMisuse(getter string, path string, err error) {
+	if this.misuse == nil {
+		return
+	}
+	caller := misuseCaller()
+
+	this.misuse.lock.Lock()
+	key := misuseKey{path: path, caller: caller}
+	if misuse, ok := this.misuse.misuse[key]; ok {
+		misuse.Count++
+		this.misuse.lock.Unlock()
+		return
+	}
+	if this.misuse.misuse == nil {
+		this.misuse.misuse = make(map[misuseKey]*Misuse)
+	}
+	notFound := errors.Is(err, ErrNotFound)
+	this.misuse.misuse[key] = &Misuse{Getter: getter, Path: path, Caller: caller, NotFound: notFound, Err: err, Count: 1}
+	this.misuse.lock.Unlock()
+
+	this.logf(LogWarning, "%s: %s(%q) returned its default: %s", caller, getter, path, err)
+}
+
+// misuseCaller returns the file and line of the first call on the stack from
+// outside of this package. The tests of the package count as outside.
+func misuseCaller() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, settingsPackage) || strings.HasSuffix(frame.File, "_test.go") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
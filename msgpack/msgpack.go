@@ -0,0 +1,116 @@
+// Package msgpack loads and dumps flexiconfig settings as MessagePack. It is a
+// separate package so that only programs using it depend on a msgpack library.
+//
+// Numbers come back as int64 or float64, unsigned integers too large for an
+// int64 as uint64, and binary values as []byte. GetJSON encodes []byte values
+// as base64 strings.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	vmsgpack "github.com/vmihailenco/msgpack/v5"
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+// Load decodes the MessagePack map in b and merges it into settings, like
+// MergeSettings.
+func Load(settings *flexiconfig.Settings, b []byte) error {
+	decoder := vmsgpack.NewDecoder(bytes.NewReader(b))
+	decoded, err := decoder.DecodeInterface()
+	if err != nil {
+		return fmt.Errorf("Could not decode MessagePack: %s", err)
+	}
+	if _, err := decoder.DecodeInterface(); err == nil {
+		return fmt.Errorf("Could not decode MessagePack: unexpected data after the top-level value")
+	}
+
+	newSettings, ok := fromMsgpack(decoded).(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("MessagePack config must be a map with string keys, not %T", decoded)
+	}
+	return settings.MergeSettings(newSettings)
+}
+
+// Dump encodes every value of settings as a MessagePack map.
+func Dump(settings flexiconfig.Settings) ([]byte, error) {
+	tree, err := settings.RawGet("")
+	if err != nil {
+		return nil, err
+	}
+	return vmsgpack.Marshal(toMsgpack(tree))
+}
+
+// fromMsgpack converts the maps and numbers decoded by the msgpack library to
+// the forms used in the settings tree.
+func fromMsgpack(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = fromMsgpack(child)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			m[fmt.Sprint(key)] = fromMsgpack(child)
+		}
+		return m
+	case []interface{}:
+		for i, child := range v {
+			v[i] = fromMsgpack(child)
+		}
+		return v
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return v
+	case float32:
+		return float64(v)
+	default:
+		return value
+	}
+}
+
+// toMsgpack converts values the msgpack library would encode as something
+// else, such as json.Number, to plain numbers.
+func toMsgpack(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = toMsgpack(child)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = toMsgpack(child)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return string(v)
+	default:
+		return value
+	}
+}
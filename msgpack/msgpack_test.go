@@ -0,0 +1,82 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/wetdesertrock/flexiconfig"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tree := map[string]interface{}{
+		"name":    "service",
+		"enabled": true,
+		"unset":   nil,
+		"port":    int64(8080),
+		"big":     int64(math.MaxInt64),
+		"huge":    uint64(math.MaxUint64),
+		"ratio":   0.25,
+		"key":     []byte{0, 1, 2, 255},
+		"servers": []interface{}{
+			map[string]interface{}{
+				"host": "a",
+				"tags": []interface{}{"x", int64(-1)},
+			},
+			map[string]interface{}{
+				"host":   "b",
+				"nested": []interface{}{map[string]interface{}{"deep": []interface{}{}}},
+			},
+		},
+		"empty": map[string]interface{}{},
+	}
+
+	settings := flexiconfig.NewSettings()
+	if err := settings.MergeSettings(tree); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Dump(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := flexiconfig.NewSettings()
+	if err := Load(&loaded, b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.RawGet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tree) {
+		t.Errorf("round trip returned %#v, want %#v", got, tree)
+	}
+
+	// Binary values are base64 encoded in JSON.
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(loaded.GetJSON(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["key"] != "AAEC/w==" {
+		t.Errorf("key in JSON = %v, want AAEC/w==", decoded["key"])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	array, err := Dump(flexiconfig.NewSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string][]byte{
+		"truncated": array[:0],
+		"trailing":  append(append([]byte(nil), array...), array...),
+		"not a map": {0x91, 0x01},
+	} {
+		settings := flexiconfig.NewSettings()
+		if err := Load(&settings, b); err == nil {
+			t.Errorf("Load of %s data succeeded", name)
+		}
+	}
+}
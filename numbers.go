@@ -0,0 +1,68 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// SetPreserveNumbers makes LoadJSON and the JSON file loaders keep numbers as
+// json.Number instead of converting them to float64, so that integers above
+// 2^53, such as 64-bit IDs, are kept exactly. The getters, Get, and GetJSON
+// all handle json.Number values transparently. RawGet returns them as is.
+func (this *Settings) SetPreserveNumbers(preserve bool) {
+	this.preserveNumbers = preserve
+}
+
+// unmarshalJSON is json.Unmarshal, but decodes numbers as json.Number if
+// numbers are preserved and checks for duplicate keys in strict mode.
+func (this Settings) unmarshalJSON(b []byte, v interface{}) error {
+	if this.strictJSON {
+		if err := checkDuplicateKeys(this.pathSeparator(), b); err != nil {
+			return err
+		}
+	}
+
+	if !this.preserveNumbers {
+		return json.Unmarshal(b, v)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("Unexpected data after the top-level JSON value")
+	}
+	return nil
+}
+
+// jsonNumberHook is a mapstructure decode hook converting json.Number values
+// into the kind of number the target expects.
+func jsonNumberHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	number, ok := data.(json.Number)
+	if !ok {
+		return data, nil
+	}
+
+	switch to.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, err := number.Int64(); err == nil {
+			return i, nil
+		}
+		return number.Float64()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+			return u, nil
+		}
+		return number.Float64()
+	case reflect.Float32, reflect.Float64:
+		return number.Float64()
+	default:
+		return data, nil
+	}
+}
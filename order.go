@@ -0,0 +1,260 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// SetOrderedKeys makes the settings remember the order keys were added in, so
+// that GetJSON, GetPrettyJSON and Print emit them in that order rather than
+// sorted. Keys keep the position they were first added at when a later load
+// overrides them, while new keys go at the end. JSON and lua configs add their
+// keys in the order they are written in, other sources such as MergeSettings
+// or LoadEnv add theirs sorted. Maps inside arrays are always emitted sorted.
+//
+// Keys already set are ordered as they are emitted now, so it is best called
+// before loading anything. Ordered keys make every change to the settings
+// somewhat slower, which is why they are off by default.
+func (this *Settings) SetOrderedKeys(ordered bool) {
+	this.wlock()
+	defer this.wunlock()
+
+	if !ordered {
+		this.order = nil
+		return
+	}
+	this.order = make(keyOrder)
+	this.order.sync(this.pathSeparator(), "", this.settings, nil)
+}
+
+// keyOrder holds the keys of every map in the settings in the order they were
+// added, keyed by the path of the map.
+type keyOrder map[string][]string
+
+// orderKeys returns the keys of m ordered as in existing, then as in source,
+// and then sorted.
+func orderKeys(m map[string]interface{}, existing, source []string) []string {
+	keys := make([]string, 0, len(m))
+	seen := make(map[string]bool, len(m))
+	for _, ordered := range [][]string{existing, source} {
+		for _, key := range ordered {
+			if _, ok := m[key]; ok && !seen[key] {
+				keys = append(keys, key)
+				seen[key] = true
+			}
+		}
+	}
+
+	rest := make([]string, 0, len(m)-len(keys))
+	for key := range m {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// sync updates the order of the map m found at path, and of every map in it,
+// to hold exactly their current keys. New keys are added as orderKeys does.
+func (this keyOrder) sync(sep, path string, m map[string]interface{}, source keyOrder) {
+	synced := make(keyOrder)
+	this.collect(sep, path, m, source, synced)
+	this.forget(sep, path)
+	for p, keys := range synced {
+		this[p] = keys
+	}
+}
+
+// collect adds the order of m, found at path, and of every map in it to
+// synced.
+func (this keyOrder) collect(sep, path string, m map[string]interface{}, source, synced keyOrder) {
+	keys := orderKeys(m, this[path], source[path])
+	synced[path] = keys
+	for _, key := range keys {
+		if child, ok := m[key].(map[string]interface{}); ok {
+			this.collect(sep, joinPathWith(sep, path, key), child, source, synced)
+		}
+	}
+}
+
+// set updates the order after the value at the path made of parts was set in
+// root.
+func (this keyOrder) set(sep string, parts []string, root map[string]interface{}) {
+	path := ""
+	var value interface{} = root
+	for _, part := range parts {
+		m := value.(map[string]interface{})
+		if keys := this[path]; !containsKey(keys, part) {
+			this[path] = append(keys, part)
+		}
+		path = joinPathWith(sep, path, part)
+		value = m[part]
+	}
+
+	if m, ok := value.(map[string]interface{}); ok {
+		this.sync(sep, path, m, nil)
+	} else {
+		this.forget(sep, path)
+	}
+}
+
+// remove updates the order after the value at the path made of parts was
+// deleted.
+func (this keyOrder) remove(sep string, parts []string) {
+	parent := strings.Join(parts[:len(parts)-1], sep)
+	key := parts[len(parts)-1]
+	keys := make([]string, 0, len(this[parent]))
+	for _, existing := range this[parent] {
+		if existing != key {
+			keys = append(keys, existing)
+		}
+	}
+	this[parent] = keys
+	this.forget(sep, joinPathWith(sep, parent, key))
+}
+
+// forget drops the order of the map at path and of every map in it.
+func (this keyOrder) forget(sep, path string) {
+	prefix := path + sep
+	for p := range this {
+		if path == "" || p == path || strings.HasPrefix(p, prefix) {
+			delete(this, p)
+		}
+	}
+}
+
+// copy returns a copy of the order, or nil if keys aren't ordered.
+func (this keyOrder) copy() keyOrder {
+	if this == nil {
+		return nil
+	}
+	copied := make(keyOrder, len(this))
+	for path, keys := range this {
+		copied[path] = append([]string(nil), keys...)
+	}
+	return copied
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, existing := range keys {
+		if existing == key {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonKeyOrder records the order of the keys of every object in the JSON b,
+// which must be valid, in order. Objects inside arrays are skipped.
+func jsonKeyOrder(sep string, b []byte, order keyOrder) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	readJSONKeyOrder(sep, "", decoder, order, true)
+}
+
+// readJSONKeyOrder reads the next value from decoder and records its order if
+// it is an object and record is true.
+func readJSONKeyOrder(sep, path string, decoder *json.Decoder, order keyOrder, record bool) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key := token.(string)
+			if record && !containsKey(order[path], key) {
+				order[path] = append(order[path], key)
+			}
+			if err := readJSONKeyOrder(sep, joinPathWith(sep, path, key), decoder, order, record); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for decoder.More() {
+			if err := readJSONKeyOrder(sep, path, decoder, order, false); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+
+	// Read the closing delimiter.
+	_, err = decoder.Token()
+	return err
+}
+
+// orderedJSON marshals the settings value found at path with the keys of every
+// map in the order recorded for it, renamed by rename unless it is nil.
+type orderedJSON struct {
+	sep    string
+	path   string
+	value  interface{}
+	order  keyOrder
+	rename func(key string) string
+}
+
+func (this orderedJSON) MarshalJSON() ([]byte, error) {
+	m, ok := this.value.(map[string]interface{})
+	if array, isArray := this.value.([]interface{}); isArray && this.rename != nil {
+		// Keys of maps in arrays are renamed too, though they have no order.
+		items := make([]orderedJSON, len(array))
+		for i, item := range array {
+			items[i] = orderedJSON{sep: this.sep, path: this.path, value: item, rename: this.rename}
+		}
+		return json.Marshal(items)
+	}
+	if !ok {
+		return json.Marshal(this.value)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range orderKeys(m, this.order[this.path], nil) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name := key
+		if this.rename != nil {
+			name = this.rename(key)
+		}
+		b, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte(':')
+
+		child := orderedJSON{sep: this.sep, path: joinPathWith(this.sep, this.path, key), value: m[key], order: this.order, rename: this.rename}
+		if b, err = json.Marshal(child); err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// jsonValue returns what to marshal to emit settings, a copy of the settings
+// tree, in the recorded order of keys if there is one and with keys renamed by
+// the key denormalizer. The caller must hold the lock.
+func (this Settings) jsonValue(settings map[string]interface{}) interface{} {
+	return this.jsonValueAt("", settings)
+}
+
+// jsonValueAt is jsonValue for the value found at path.
+func (this Settings) jsonValueAt(path string, value interface{}) interface{} {
+	if this.order == nil && this.keyDenormalizer == nil {
+		return value
+	}
+	return orderedJSON{sep: this.pathSeparator(), path: path, value: value, order: this.order.copy(), rename: this.keyDenormalizer}
+}
@@ -0,0 +1,293 @@
+package flexiconfig
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// maxOverlayBackoff caps how long a failing overlay waits between fetches,
+// unless the polling interval itself is longer.
+const maxOverlayBackoff = 5 * time.Minute
+
+// overlays holds the state shared by every remote overlay of a Settings.
+type overlays struct {
+	lock    sync.Mutex
+	added   int
+	cancels []context.CancelFunc
+	running sync.WaitGroup
+	onError func(err error)
+	applied []*overlay
+}
+
+// overlay is a single remote overlay applied on top of the settings.
+type overlay struct {
+	source int
+	// current maps every leaf path set by the overlay to its value.
+	current map[string]interface{}
+	// shadowed maps every leaf path set by the overlay to the value it
+	// replaced.
+	shadowed map[string]shadowedValue
+}
+
+// shadowedValue is a value hidden by an overlay, restored once the overlay
+// stops setting it.
+type shadowedValue struct {
+	exists bool
+	value  interface{}
+	source int
+	known  bool
+}
+
+// AddRemoteOverlay starts a goroutine that calls fetch every interval and
+// applies the returned settings on top of the loaded ones. Keys added or
+// changed since the previous fetch are set, and keys that are no longer
+// returned get their previous value back, all in one atomic update.
+//
+// When fetch fails the last good overlay is kept, the error is passed to the
+// OnOverlayError handler, and the next attempt is delayed with exponential
+// backoff. Values set by an overlay are attributed to a Source with Overlay
+// set. StopOverlays stops every overlay.
+func (this *Settings) AddRemoteOverlay(fetch func(ctx context.Context) (map[string]interface{}, error), interval time.Duration) {
+	manager := this.overlayManager()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	manager.lock.Lock()
+	manager.added++
+	name := fmt.Sprintf("RemoteOverlay %d", manager.added)
+	manager.cancels = append(manager.cancels, cancel)
+	manager.running.Add(1)
+	manager.lock.Unlock()
+
+	this.wlock()
+	index := this.provenance.add(Source{Name: name, Overlay: true})
+	this.wunlock()
+
+	o := &overlay{
+		source:   index,
+		current:  make(map[string]interface{}),
+		shadowed: make(map[string]shadowedValue),
+	}
+	manager.lock.Lock()
+	manager.applied = append(manager.applied, o)
+	manager.lock.Unlock()
+
+	go func() {
+		defer manager.running.Done()
+
+		failures := 0
+		for {
+			newSettings, err := fetch(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err == nil {
+				err = this.applyOverlay(o, newSettings)
+			}
+			if err != nil {
+				failures++
+				manager.reportError(err)
+			} else {
+				failures = 0
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(overlayDelay(interval, failures)):
+			}
+		}
+	}()
+}
+
+// OnOverlayError sets the function called whenever fetching or applying a
+// remote overlay fails.
+func (this *Settings) OnOverlayError(handler func(err error)) {
+	manager := this.overlayManager()
+	manager.lock.Lock()
+	manager.onError = handler
+	manager.lock.Unlock()
+}
+
+// StopOverlays stops every remote overlay and waits for them to finish. The
+// values they applied are kept.
+func (this *Settings) StopOverlays() {
+	if this.overlays == nil {
+		return
+	}
+
+	this.overlays.lock.Lock()
+	for _, cancel := range this.overlays.cancels {
+		cancel()
+	}
+	this.overlays.cancels = nil
+	this.overlays.lock.Unlock()
+
+	this.overlays.running.Wait()
+}
+
+func (this *Settings) overlayManager() *overlays {
+	if this.overlays == nil {
+		this.overlays = &overlays{}
+	}
+	return this.overlays
+}
+
+func (this *overlays) reportError(err error) {
+	this.lock.Lock()
+	onError := this.onError
+	this.lock.Unlock()
+
+	if onError != nil {
+		onError(err)
+	}
+}
+
+// overlayDelay returns how long to wait before the next fetch after the given
+// number of consecutive failures.
+func overlayDelay(interval time.Duration, failures int) time.Duration {
+	limit := maxOverlayBackoff
+	if interval > limit {
+		limit = interval
+	}
+
+	delay := interval
+	for i := 0; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// applyOverlay replaces the values of o with newSettings. Nothing changes if
+// any of them can't be set.
+func (this *Settings) applyOverlay(o *overlay, newSettings map[string]interface{}) error {
+	newSettings, err := this.prepareSettings(newSettings)
+	if err != nil {
+		return err
+	}
+	next := flatten(this.pathSeparator(), newSettings)
+
+	this.wlock()
+	defer this.wunlock()
+
+	for path := range next {
+		if err := this.checkPath(path); err != nil {
+			return err
+		}
+	}
+
+	for path := range o.current {
+		if _, ok := next[path]; !ok {
+			this.restore(o, path)
+		}
+	}
+
+	for path, value := range next {
+		if current, ok := o.current[path]; ok && reflect.DeepEqual(current, value) {
+			continue
+		}
+
+		if _, ok := o.shadowed[path]; !ok {
+			this.shadow(o, path)
+		}
+		this.rawSet(SetReplace, path, deepCopy(value))
+		this.provenance.paths[path] = o.source
+	}
+
+	o.current = next
+	return nil
+}
+
+// flatten returns every leaf of m keyed by its full path. Arrays and empty
+// maps are leaves.
+func flatten(sep string, m map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	flattenInto(sep, flat, "", m)
+	return flat
+}
+
+func flattenInto(sep string, flat map[string]interface{}, path string, m map[string]interface{}) {
+	for key, value := range m {
+		if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+			flattenInto(sep, flat, joinPathWith(sep, path, key), child)
+		} else {
+			flat[joinPathWith(sep, path, key)] = value
+		}
+	}
+}
+
+// unapplyOverlays gives the paths set by every overlay their shadowed values
+// back, newest overlay first, so that a load merges into the settings as they
+// are without overlays. reapplyOverlays sets them again afterwards. The
+// caller must hold the write lock.
+func (this *Settings) unapplyOverlays() {
+	applied := this.appliedOverlays()
+	for i := len(applied) - 1; i >= 0; i-- {
+		for path := range applied[i].current {
+			this.restore(applied[i], path)
+		}
+	}
+}
+
+// reapplyOverlays sets the values of every overlay again after the settings
+// were replaced by Reload or merged into by a load. The caller must hold the
+// write lock.
+func (this *Settings) reapplyOverlays() {
+	for _, o := range this.appliedOverlays() {
+		o.shadowed = make(map[string]shadowedValue)
+		for path, value := range o.current {
+			this.shadow(o, path)
+			this.rawSet(SetReplace, path, deepCopy(value))
+			this.provenance.paths[path] = o.source
+		}
+	}
+}
+
+// appliedOverlays returns every overlay added so far, oldest first.
+func (this *Settings) appliedOverlays() []*overlay {
+	if this.overlays == nil {
+		return nil
+	}
+
+	this.overlays.lock.Lock()
+	defer this.overlays.lock.Unlock()
+	return this.overlays.applied
+}
+
+// shadow remembers the value at path before o replaces it. The caller must
+// hold the write lock.
+func (this *Settings) shadow(o *overlay, path string) {
+	shadowed := shadowedValue{}
+	var err error
+	shadowed.value, err = this.rawGet(path)
+	shadowed.exists = err == nil
+	shadowed.source, shadowed.known = this.provenance.paths[path]
+	o.shadowed[path] = shadowed
+}
+
+// restore gives path the value o shadowed back, unless something else, such
+// as RawSet, replaced the value of o since. The caller must hold the write
+// lock.
+func (this *Settings) restore(o *overlay, path string) {
+	shadowed, ok := o.shadowed[path]
+	delete(o.shadowed, path)
+	value, err := this.rawGet(path)
+	if !ok || err != nil || !reflect.DeepEqual(value, o.current[path]) {
+		return
+	}
+
+	if shadowed.exists {
+		this.rawSet(SetReplace, path, shadowed.value)
+	} else {
+		this.delete(path)
+	}
+	if shadowed.known {
+		this.provenance.paths[path] = shadowed.source
+	}
+}
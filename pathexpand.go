@@ -0,0 +1,54 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SetExpandPathEnv makes the file loaders expand $VAR and ${VAR} in the paths
+// they are given, as GetStringExpanded does, so that a path read from the
+// environment such as "$HOME/app.json" works. Windows style %VAR% isn't
+// expanded. Variables that aren't set expand to nothing.
+//
+// Whether or not this is set, a leading "~/" is replaced by the home directory
+// of the user and paths are cleaned. This happens before anything is read, so
+// SetAllowedRoots checks the expanded path.
+func (this *Settings) SetExpandPathEnv(expand bool) {
+	this.expandPathEnv = expand
+}
+
+// expandPath returns path as the file loaders use it: with a leading ~
+// replaced by the home directory, environment variables expanded if
+// SetExpandPathEnv was set, and cleaned.
+func (this Settings) expandPath(path string) (string, error) {
+	if this.expandPathEnv {
+		expanded, err := expandEnv(path, false)
+		if err != nil {
+			return "", fmt.Errorf("Could not expand %s: %s", path, err)
+		}
+		path = expanded
+	}
+
+	expanded, err := expandHome(path)
+	if err != nil {
+		return "", fmt.Errorf("Could not expand ~ in %s: %s", path, err)
+	}
+	path = expanded
+
+	if path == "" {
+		return path, nil
+	}
+	return filepath.Clean(path), nil
+}
+
+// expandPaths is expandPath for every path of paths.
+func (this Settings) expandPaths(paths []string) ([]string, error) {
+	expanded := make([]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if expanded[i], err = this.expandPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,70 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"sort"
+)
+
+// pathValidator is a validator added with AddValidator.
+type pathValidator struct {
+	pattern string
+	fn      func(path string, value interface{}) error
+}
+
+// AddValidator makes fn check every value loaded at or below the paths
+// matching pattern, before it is merged. Patterns are those of MarkSecret. fn
+// is called with the path of every leaf value matching, that is any value but
+// a map, and returning an error rejects the whole load, leaving the settings
+// as they were. This covers every loader, MergeSettings, SetDefaults, RawSet,
+// LoadKVPairs, ApplyJSONPatch and Migrate, but not the values already set when
+// it is called. ApplyJSONPatch and Migrate call fn with the settings locked, so
+// fn must not use them.
+func (this *Settings) AddValidator(pattern string, fn func(path string, value interface{}) error) {
+	this.wlock()
+	defer this.wunlock()
+
+	this.validators = append(this.validators, pathValidator{pattern, fn})
+}
+
+// checkValidators runs the validators on every leaf of value, to be set at path.
+func (this Settings) checkValidators(path string, value interface{}) error {
+	this.rlock()
+	validators := this.validators
+	this.runlock()
+
+	if len(validators) == 0 {
+		return nil
+	}
+	return this.validateLeaves(validators, path, value)
+}
+
+func (this Settings) validateLeaves(validators []pathValidator, path string, value interface{}) error {
+	if m, ok := value.(map[string]interface{}); ok {
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := this.validateLeaves(validators, this.joinPath(path, key), m[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sep := this.pathSeparator()
+	for _, validator := range validators {
+		if !matchPathPrefix(sep, validator.pattern, path) {
+			continue
+		}
+		if err := validator.fn(path, value); err != nil {
+			shown := value
+			if this.isSecret(path) {
+				shown = redactedValue
+			}
+			return fmt.Errorf("Invalid value %v for %s: %s", shown, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package flexiconfig
+
+import "sync"
+
+// HookID identifies a hook added with AddPostLoadHook, to remove it with
+// RemovePostLoadHook.
+type HookID int
+
+// postLoadHooks holds the hooks added with AddPostLoadHook, shared by every
+// copy of a Settings.
+type postLoadHooks struct {
+	lock  sync.Mutex
+	added HookID
+	hooks []postLoadHook
+}
+
+type postLoadHook struct {
+	id HookID
+	fn func(s *Settings) error
+}
+
+// AddPostLoadHook adds fn to the functions called after every successful load,
+// including MergeSettings, SetDefaults, LoadAll, Apply and Reload, in the
+// order they were added. They are called once the settings are unlocked, so
+// they can change them, for example to derive values from what was loaded.
+// Loads that change nothing, as when a URL is unchanged, don't call them.
+//
+// An error returned by fn is returned by the load, and the remaining hooks
+// aren't called, but what was loaded stays merged. Hooks shouldn't load
+// settings themselves, as that would call the hooks again.
+func (this *Settings) AddPostLoadHook(fn func(s *Settings) error) HookID {
+	hooks := this.postLoadHooks()
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+
+	hooks.added++
+	hooks.hooks = append(hooks.hooks, postLoadHook{id: hooks.added, fn: fn})
+	return hooks.added
+}
+
+// RemovePostLoadHook removes the hook added by AddPostLoadHook as id. Removing
+// it again does nothing.
+func (this *Settings) RemovePostLoadHook(id HookID) {
+	hooks := this.postLoadHooks()
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+
+	for i, hook := range hooks.hooks {
+		if hook.id == id {
+			hooks.hooks = append(hooks.hooks[:i:i], hooks.hooks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (this *Settings) postLoadHooks() *postLoadHooks {
+	this.lazyInit()
+	return this.postLoad
+}
+
+// afterLoad calls the post-load hooks after a load that returned err, and
+// returns the error of the load or else of the first hook that failed. The
+// settings must not be locked.
+func (this *Settings) afterLoad(err error) error {
+	if err != nil {
+		return err
+	}
+
+	hooks := this.postLoadHooks()
+	hooks.lock.Lock()
+	fns := make([]func(s *Settings) error, len(hooks.hooks))
+	for i, hook := range hooks.hooks {
+		fns[i] = hook.fn
+	}
+	hooks.lock.Unlock()
+
+	for _, fn := range fns {
+		if err := fn(this); err != nil {
+			return err
+		}
+	}
+	return nil
+}
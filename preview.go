@@ -0,0 +1,194 @@
+package flexiconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ChangeType tells how a value differs between two sets of settings.
+type ChangeType int
+
+const (
+	// ChangeAdded is a value that wasn't set before.
+	ChangeAdded ChangeType = iota
+	// ChangeRemoved is a value that is no longer set.
+	ChangeRemoved
+	// ChangeModified is a value that was set to something else.
+	ChangeModified
+)
+
+func (this ChangeType) String() string {
+	switch this {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(this))
+	}
+}
+
+// Change is a single difference between two sets of settings. Maps that were
+// added or removed as a whole are a single change, other maps are compared key
+// by key.
+type Change struct {
+	Path string
+	Type ChangeType
+	// Old is the previous value, nil if it was added.
+	Old interface{}
+	// New is the new value, nil if it was removed.
+	New interface{}
+}
+
+// Preview is the result of a load that wasn't applied yet.
+type Preview struct {
+	// Changes lists what applying the preview would change, sorted by path.
+	Changes []Change
+
+	l        *loader
+	prepared map[string]interface{}
+	info     *readInfo
+	base     string
+}
+
+// ErrPreviewOutdated is returned by Apply when the settings changed since the
+// preview was made.
+var ErrPreviewOutdated = errors.New("Settings changed since the preview was made")
+
+// PreviewJSON works out what LoadJSONWithOptions would change without changing
+// anything. The returned Preview can be applied later with Apply.
+func (this *Settings) PreviewJSON(b []byte, options ...MergeOption) (*Preview, error) {
+	b = append([]byte(nil), b...)
+
+	return this.preview(&loader{
+		source:  Source{Name: "LoadJSON"},
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			this.readContent(b)
+			newSettings, err := this.parseJSON(b)
+			return newSettings, len(b), err
+		},
+	})
+}
+
+// PreviewFile works out what LoadFileWithOptions would change without
+// changing anything. The file is read once, applying the preview doesn't read
+// it again.
+func (this *Settings) PreviewFile(path string, options ...MergeOption) (*Preview, error) {
+	l, err := this.fileLoader(path, options)
+	if err != nil {
+		return nil, err
+	}
+	return this.preview(l)
+}
+
+// preview reads the settings of l and merges them into a snapshot.
+func (this *Settings) preview(l *loader) (*Preview, error) {
+	this.lazyInit()
+
+	newSettings, info, err := this.read(l)
+	if err == nil {
+		newSettings, err = this.prepareSettings(newSettings)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	this.rlock()
+	snapshot := this.snapshot()
+	base, err := fingerprint(this.settings)
+	this.runlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Go through the same merge as a load, only without logging about it.
+	snapshot.logger = nil
+	before := deepCopy(snapshot.settings).(map[string]interface{})
+	if err := snapshot.mergeLoad(&loader{source: l.source, options: l.options}, deepCopy(newSettings).(map[string]interface{}), info); err != nil {
+		return nil, err
+	}
+
+	return &Preview{
+		Changes:  diffMaps(this.pathSeparator(), "", before, snapshot.settings, nil),
+		l:        l,
+		prepared: newSettings,
+		info:     info,
+		base:     base,
+	}, nil
+}
+
+// Apply merges the settings of a preview, leaving the settings exactly as
+// previewed. If they changed since the preview was made nothing is merged and
+// ErrPreviewOutdated is returned. Reload reads the previewed source again.
+func (this *Settings) Apply(preview *Preview) error {
+	this.wlock()
+	err := this.apply(preview)
+	this.wunlock()
+	return this.afterLoad(err)
+}
+
+// apply is Apply without locking or calling the post-load hooks.
+func (this *Settings) apply(preview *Preview) error {
+	base, err := fingerprint(this.settings)
+	if err != nil {
+		return err
+	}
+	if base != preview.base {
+		return ErrPreviewOutdated
+	}
+
+	l := &loader{source: preview.l.source, options: preview.l.options, read: preview.l.read}
+	return this.mergeLoad(l, deepCopy(preview.prepared).(map[string]interface{}), preview.info)
+}
+
+// fingerprint returns a hash of the settings in m.
+func fingerprint(m map[string]interface{}) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// diffMaps appends the changes from old to new, both found at path, to changes
+// in path order.
+func diffMaps(sep string, path string, old, new map[string]interface{}, changes []Change) []Change {
+	keys := make([]string, 0, len(old)+len(new))
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keypath := joinPathWith(sep, path, key)
+		oldvalue, inOld := old[key]
+		newvalue, inNew := new[key]
+
+		oldmap, oldIsMap := oldvalue.(map[string]interface{})
+		newmap, newIsMap := newvalue.(map[string]interface{})
+		switch {
+		case !inOld:
+			changes = append(changes, Change{Path: keypath, Type: ChangeAdded, New: newvalue})
+		case !inNew:
+			changes = append(changes, Change{Path: keypath, Type: ChangeRemoved, Old: oldvalue})
+		case oldIsMap && newIsMap:
+			changes = diffMaps(sep, keypath, oldmap, newmap, changes)
+		case !sameValue(oldvalue, newvalue):
+			changes = append(changes, Change{Path: keypath, Type: ChangeModified, Old: oldvalue, New: newvalue})
+		}
+	}
+	return changes
+}
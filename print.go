@@ -0,0 +1,178 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ANSI escape codes used by Fprint with PrintOptions.Color.
+const (
+	colorKey     = "\x1b[34m"
+	colorString  = "\x1b[32m"
+	colorNumber  = "\x1b[36m"
+	colorLiteral = "\x1b[35m"
+	colorReset   = "\x1b[0m"
+)
+
+// PrintOptions changes how Fprint prints the settings. The zero value prints
+// them like Print does.
+type PrintOptions struct {
+	// Indent is written once per level of nesting, two spaces if empty.
+	Indent string
+	// MaxDepth limits how many levels of maps and arrays are printed. Those
+	// deeper are summarized with their size, such as "{...} (12 keys)". 0 or
+	// less prints everything.
+	MaxDepth int
+	// Color highlights keys, strings, numbers and other values with ANSI
+	// escape codes, for terminals.
+	Color bool
+	// ShowSecrets prints the values marked with MarkSecret rather than
+	// redacting them.
+	ShowSecrets bool
+	// Sorted prints keys sorted even when SetOrderedKeys recorded their order.
+	Sorted bool
+}
+
+// Fprint writes the settings to w as indented JSON, as changed by opts. Unless
+// opts.MaxDepth summarizes part of them, the output is valid JSON as long as
+// opts.Color is off.
+func (this Settings) Fprint(w io.Writer, opts PrintOptions) error {
+	if opts.Indent == "" {
+		opts.Indent = "  "
+	}
+
+	snapshot := this.capture()
+	p := printer{settings: snapshot, opts: opts}
+	err := checkStructure(snapshot.pathSeparator(), "", snapshot.settings, snapshot.depthLimit())
+	if err == nil {
+		err = p.value("", true, snapshot.settings, 0)
+	}
+	if err != nil {
+		return err
+	}
+	p.buf.WriteByte('\n')
+	_, err = w.Write(p.buf.Bytes())
+	return err
+}
+
+// printer writes the settings for Fprint.
+type printer struct {
+	settings Settings
+	opts     PrintOptions
+	buf      bytes.Buffer
+}
+
+// value writes v, found at path, nested depth levels deep. Inside arrays
+// inTree is false, as paths, and so secrets and the order of keys, don't reach
+// there.
+func (this *printer) value(path string, inTree bool, v interface{}, depth int) error {
+	if _, isMap := v.(map[string]interface{}); inTree && !isMap && len(this.settings.exportFilters) > 0 {
+		v = this.settings.exportValue(path, deepCopy(v))
+		inTree = false
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			this.buf.WriteString("{}")
+			return nil
+		}
+		if this.opts.MaxDepth > 0 && depth >= this.opts.MaxDepth {
+			fmt.Fprintf(&this.buf, "{...} (%s)", plural(len(v), "key"))
+			return nil
+		}
+
+		this.buf.WriteString("{\n")
+		for i, key := range this.keys(path, inTree, v) {
+			if i > 0 {
+				this.buf.WriteString(",\n")
+			}
+			this.indent(depth + 1)
+			if err := this.scalar(key, colorKey); err != nil {
+				return err
+			}
+			this.buf.WriteString(": ")
+
+			child := this.settings.joinPath(path, key)
+			if inTree && !this.opts.ShowSecrets && this.settings.isSecret(child) {
+				if err := this.scalar(redactedValue, colorString); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := this.value(child, inTree, v[key], depth+1); err != nil {
+				return err
+			}
+		}
+		this.buf.WriteByte('\n')
+		this.indent(depth)
+		this.buf.WriteByte('}')
+	case []interface{}:
+		if len(v) == 0 {
+			this.buf.WriteString("[]")
+			return nil
+		}
+		if this.opts.MaxDepth > 0 && depth >= this.opts.MaxDepth {
+			fmt.Fprintf(&this.buf, "[...] (%s)", plural(len(v), "item"))
+			return nil
+		}
+
+		this.buf.WriteString("[\n")
+		for i, child := range v {
+			if i > 0 {
+				this.buf.WriteString(",\n")
+			}
+			this.indent(depth + 1)
+			if err := this.value(path, false, child, depth+1); err != nil {
+				return err
+			}
+		}
+		this.buf.WriteByte('\n')
+		this.indent(depth)
+		this.buf.WriteByte(']')
+	case string:
+		return this.scalar(v, colorString)
+	case bool, nil:
+		return this.scalar(v, colorLiteral)
+	default:
+		return this.scalar(v, colorNumber)
+	}
+	return nil
+}
+
+// keys returns the keys of m, found at path, in the order to print them.
+func (this *printer) keys(path string, inTree bool, m map[string]interface{}) []string {
+	if inTree && !this.opts.Sorted && this.settings.order != nil {
+		return orderKeys(m, this.settings.order[path], nil)
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scalar writes v as JSON, in color if enabled.
+func (this *printer) scalar(v interface{}, color string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if this.opts.Color {
+		this.buf.WriteString(color)
+	}
+	this.buf.Write(b)
+	if this.opts.Color {
+		this.buf.WriteString(colorReset)
+	}
+	return nil
+}
+
+func (this *printer) indent(depth int) {
+	this.buf.WriteString(strings.Repeat(this.opts.Indent, depth))
+}
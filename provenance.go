@@ -0,0 +1,177 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source describes a single load that contributed values to the settings.
+type Source struct {
+	// Name identifies the source. For file loads this is the path as given,
+	// for everything else it is the name of the loading function.
+	Name string
+
+	// Dir is the absolute directory of a file based source. It is empty for
+	// sources that don't come from a file.
+	Dir string
+
+	// Overlay is true for remote overlays added with AddRemoteOverlay, whose
+	// values can change at any time.
+	Overlay bool
+
+	// LoadedAt is when the source was last read, to the millisecond. Reload
+	// updates it, along with the size, hash and modification time.
+	LoadedAt time.Time
+
+	// Size is the number of bytes read, or 0 if that isn't known.
+	Size int
+
+	// Hash is the hex encoded SHA-256 of the content read. For sources that
+	// aren't read in one piece, such as LoadEnv, it is the hash of the JSON of
+	// the settings read instead.
+	Hash string
+
+	// ModTime is the modification time of a file based source when it was
+	// read. It is zero for sources that don't come from a single file.
+	ModTime time.Time
+
+	// Duplicate is true for a load that was skipped as it would have merged
+	// the same settings as an earlier one, see SetDeduplicateLoads.
+	Duplicate bool
+
+	// Default is true for the defaults set by SetDefault, SetDefaults and
+	// LoadDefaultsJSON.
+	Default bool
+}
+
+// provenance keeps track of which source set each leaf of the settings.
+type provenance struct {
+	sources   []Source
+	paths     map[string]int
+	separator string
+
+	// loads lists every successful load, in order, for Reload.
+	loads []*loader
+}
+
+func newProvenance() *provenance {
+	return &provenance{paths: make(map[string]int), separator: DefaultPathSeparator}
+}
+
+// copy returns a copy that can be changed independently.
+func (this *provenance) copy() *provenance {
+	copied := *this
+	copied.sources = append([]Source(nil), this.sources...)
+	copied.paths = make(map[string]int, len(this.paths))
+	for path, index := range this.paths {
+		copied.paths[path] = index
+	}
+	copied.loads = append([]*loader(nil), this.loads...)
+	return &copied
+}
+
+// add registers a new source and returns its index.
+func (this *provenance) add(source Source) int {
+	this.sources = append(this.sources, source)
+	return len(this.sources) - 1
+}
+
+// recorder returns a function that attributes paths to the source at index.
+func (this *provenance) recorder(index int) func(path string) {
+	return func(path string) {
+		this.paths[path] = index
+	}
+}
+
+// forget drops what is known about path, its children, and its parents. It is
+// used when a value is set directly rather than through a source.
+func (this *provenance) forget(path string) {
+	for known := range this.paths {
+		if known == path || strings.HasPrefix(known, path+this.separator) || strings.HasPrefix(path, known+this.separator) {
+			delete(this.paths, known)
+		}
+	}
+}
+
+// lookup finds the source that set path, or the closest of its parents.
+func (this *provenance) lookup(path string) (Source, bool) {
+	for {
+		if index, ok := this.paths[path]; ok {
+			return this.sources[index], true
+		}
+		split := strings.LastIndex(path, this.separator)
+		if split < 0 {
+			return Source{}, false
+		}
+		path = path[:split]
+	}
+}
+
+// fileSource describes a load from the file at path.
+func fileSource(path string) Source {
+	source := Source{Name: path}
+	if abs, err := filepath.Abs(path); err == nil {
+		source.Dir = filepath.Dir(abs)
+	}
+	return source
+}
+
+// Sources returns every source loaded so far, in load order.
+func (this Settings) Sources() []Source {
+	this.rlock()
+	defer this.runlock()
+
+	sources := make([]Source, len(this.provenance.sources))
+	copy(sources, this.provenance.sources)
+	return sources
+}
+
+// sourceJSON is how SourcesJSON encodes a Source, with millisecond times and
+// leaving out what isn't known.
+type sourceJSON struct {
+	Name      string `json:"name"`
+	Dir       string `json:"dir,omitempty"`
+	Overlay   bool   `json:"overlay,omitempty"`
+	LoadedAt  string `json:"loadedAt,omitempty"`
+	Size      int    `json:"size,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	ModTime   string `json:"modTime,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Default   bool   `json:"default,omitempty"`
+}
+
+// sourceTimeFormat formats the times of SourcesJSON.
+const sourceTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// SourcesJSON returns Sources as a JSON array, to be kept alongside the config
+// for instance in bug reports.
+func (this Settings) SourcesJSON() []byte {
+	sources := this.Sources()
+	encoded := make([]sourceJSON, len(sources))
+	for i, source := range sources {
+		encoded[i] = sourceJSON{Name: source.Name, Dir: source.Dir, Overlay: source.Overlay, Size: source.Size, Hash: source.Hash, Duplicate: source.Duplicate, Default: source.Default}
+		if !source.LoadedAt.IsZero() {
+			encoded[i].LoadedAt = source.LoadedAt.Format(sourceTimeFormat)
+		}
+		if !source.ModTime.IsZero() {
+			encoded[i].ModTime = source.ModTime.Format(sourceTimeFormat)
+		}
+	}
+
+	b, err := json.MarshalIndent(encoded, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// SourceOf returns the source that set the value at path. Values set with
+// RawSet have no source.
+func (this Settings) SourceOf(path string) (Source, bool) {
+	this.rlock()
+	defer this.runlock()
+
+	return this.provenance.lookup(path)
+}
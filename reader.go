@@ -0,0 +1,159 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reader allows reading the settings, and nothing else. Settings implements
+// it, while ReadOnly returns a Reader that can't be converted back to
+// something able to change them, to hand to code that mustn't.
+type Reader interface {
+	RawGet(path string) (interface{}, error)
+	Get(path string, target interface{}) error
+	GetString(path string, defaultValue string) (string, error)
+	GetInt(path string, defaultValue int64) (int64, error)
+	GetBool(path string, defaultValue bool) (bool, error)
+	GetFloat(path string, defaultValue float64) (float64, error)
+	GetDuration(path string, defaultValue time.Duration) (time.Duration, error)
+	Has(path string) bool
+	Keys(path string) ([]string, error)
+	Sub(path string) Reader
+	GetJSON() []byte
+}
+
+// Has returns whether a value is set at path. An empty path is the root,
+// which is always set.
+func (this Settings) Has(path string) bool {
+	if path == "" {
+		return true
+	}
+	this.rlock()
+	value, err := this.rawGet(path)
+	fn := this.computed[path]
+	this.runlock()
+
+	return err == nil || computes(fn, value, err)
+}
+
+// Keys returns the keys of the map at path, sorted, or of the root if path is
+// empty. It returns an error if the path isn't defined or isn't a map.
+func (this Settings) Keys(path string) ([]string, error) {
+	this.rlock()
+	defer this.runlock()
+
+	var value interface{} = this.settings
+	if path != "" {
+		var err error
+		if value, err = this.rawGet(path); err != nil {
+			return nil, err
+		}
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map", path)
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Sub returns a read-only view of the settings below path, whose paths are
+// all relative to it, like ReadOnly.
+func (this Settings) Sub(path string) Reader {
+	return readOnly{settings: this, prefix: path}
+}
+
+// ReadOnly returns a view of the settings that can only read them. Changes
+// made to the settings are seen through it, while the maps and arrays it
+// returns are copies, so changing them doesn't change the settings.
+func (this Settings) ReadOnly() Reader {
+	return readOnly{settings: this}
+}
+
+// readOnly is the Reader returned by ReadOnly and Sub. It has no method that
+// could change the settings.
+type readOnly struct {
+	settings Settings
+	prefix   string
+}
+
+// fullPath returns path prefixed by the prefix of the view.
+func (this readOnly) fullPath(path string) string {
+	return prefixedPath(this.settings.pathSeparator(), this.prefix, path)
+}
+
+// prefixedPath returns path below prefix, or prefix itself if path is empty,
+// as the views of ReadOnly and Overlay address their settings.
+func prefixedPath(sep, prefix, path string) string {
+	if path == "" {
+		return prefix
+	}
+	return joinPathWith(sep, prefix, path)
+}
+
+func (this readOnly) RawGet(path string) (interface{}, error) {
+	value, err := this.settings.RawGet(this.fullPath(path))
+	return deepCopy(value), err
+}
+
+func (this readOnly) Get(path string, target interface{}) error {
+	full := this.fullPath(path)
+	value, err := this.settings.getTyped(full)
+	if err != nil {
+		return err
+	}
+	return this.settings.decode(full, deepCopy(value), target)
+}
+
+func (this readOnly) GetString(path string, defaultValue string) (string, error) {
+	return this.settings.GetString(this.fullPath(path), defaultValue)
+}
+
+func (this readOnly) GetInt(path string, defaultValue int64) (int64, error) {
+	return this.settings.GetInt(this.fullPath(path), defaultValue)
+}
+
+func (this readOnly) GetBool(path string, defaultValue bool) (bool, error) {
+	return this.settings.GetBool(this.fullPath(path), defaultValue)
+}
+
+func (this readOnly) GetFloat(path string, defaultValue float64) (float64, error) {
+	return this.settings.GetFloat(this.fullPath(path), defaultValue)
+}
+
+func (this readOnly) GetDuration(path string, defaultValue time.Duration) (time.Duration, error) {
+	return this.settings.GetDuration(this.fullPath(path), defaultValue)
+}
+
+func (this readOnly) Has(path string) bool {
+	return this.settings.Has(this.fullPath(path))
+}
+
+func (this readOnly) Keys(path string) ([]string, error) {
+	return this.settings.Keys(this.fullPath(path))
+}
+
+func (this readOnly) Sub(path string) Reader {
+	return readOnly{settings: this.settings, prefix: this.fullPath(path)}
+}
+
+// GetJSON returns the json representation of the settings below the prefix,
+// or null if nothing is set there.
+func (this readOnly) GetJSON() []byte {
+	if this.prefix == "" {
+		return this.settings.GetJSON()
+	}
+	b, err := this.settings.GetJSONAt(this.prefix)
+	if err != nil {
+		return []byte("null")
+	}
+	return b
+}
+
+var _ Reader = Settings{}
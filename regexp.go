@@ -0,0 +1,75 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sync"
+)
+
+// regexpCache holds the regular expressions compiled by GetRegexp, keyed by
+// path.
+type regexpCache struct {
+	lock     sync.Mutex
+	compiled map[string]*regexp.Regexp
+}
+
+func newRegexpCache() *regexpCache {
+	return &regexpCache{compiled: make(map[string]*regexp.Regexp)}
+}
+
+// compile returns the compiled pattern found at path, reusing the previous
+// result if the pattern didn't change.
+func (this *regexpCache) compile(path, pattern string) (*regexp.Regexp, error) {
+	if this == nil {
+		return regexp.Compile(pattern)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if re, ok := this.compiled[path]; ok && re.String() == pattern {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	this.compiled[path] = re
+	return re, nil
+}
+
+// GetRegexp returns the regular expression stored as a string in the path. The
+// syntax is that of the regexp package, flags are set inline, for instance
+// "(?i)^/api/" to ignore case. Compiled expressions are cached so calling it
+// repeatedly is cheap.
+// If the the path isn't defined it will return the defaultValue and an error.
+func (this Settings) GetRegexp(path string, defaultValue *regexp.Regexp) (*regexp.Regexp, error) {
+	pattern, err := this.GetString(path, "")
+	if err != nil {
+		return defaultValue, err
+	}
+
+	re, err := this.regexps.compile(path, pattern)
+	if err != nil {
+		return defaultValue, fmt.Errorf("%s is not a valid regular expression: %s", path, err)
+	}
+	return re, nil
+}
+
+var regexpType = reflect.TypeOf(regexp.Regexp{})
+
+// regexpHook is a mapstructure decode hook compiling strings stored in
+// *regexp.Regexp fields.
+func regexpHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	pattern, ok := data.(string)
+	if !ok || to != regexpType {
+		return data, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid regular expression: %s", pattern, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,118 @@
+package flexiconfig
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// reloadHooks holds what is called after Reload, shared by every copy of a
+// Settings.
+type reloadHooks struct {
+	lock     sync.Mutex
+	onReload []func(err error)
+	onChange []func(changes []Change)
+	// signals is whether ReloadOnSignal is running.
+	signals bool
+}
+
+// OnReload adds a function called after every Reload, with the error it
+// returned or nil. Functions are called in the order they were added, from the
+// goroutine that reloaded, after the settings are unlocked.
+func (this *Settings) OnReload(fn func(err error)) {
+	hooks := this.reloadHooks()
+	hooks.lock.Lock()
+	hooks.onReload = append(hooks.onReload, fn)
+	hooks.lock.Unlock()
+}
+
+// OnChange adds a function called after a Reload that changed the settings,
+// with every change sorted by path, compared like the Changes of a Preview.
+func (this *Settings) OnChange(fn func(changes []Change)) {
+	hooks := this.reloadHooks()
+	hooks.lock.Lock()
+	hooks.onChange = append(hooks.onChange, fn)
+	hooks.lock.Unlock()
+}
+
+// ReloadOnSignal calls Reload whenever the process receives one of sigs, or
+// SIGHUP if none are given, until ctx is cancelled. It returns once the signal
+// handler is installed; failed reloads are logged and reported to the
+// functions given to OnReload.
+//
+// Only one ReloadOnSignal can run for the same settings, a second call returns
+// an error until the context of the first is cancelled.
+func (this *Settings) ReloadOnSignal(ctx context.Context, sigs ...os.Signal) error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	hooks := this.reloadHooks()
+	hooks.lock.Lock()
+	if hooks.signals {
+		hooks.lock.Unlock()
+		return errors.New("ReloadOnSignal is already running")
+	}
+	hooks.signals = true
+	hooks.lock.Unlock()
+
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, sigs...)
+
+	go func() {
+		defer func() {
+			signal.Stop(received)
+			hooks.lock.Lock()
+			hooks.signals = false
+			hooks.lock.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-received:
+				this.logf(LogInfo, "Reloading on %s", sig)
+				if err := this.Reload(); err != nil {
+					this.logf(LogWarning, "Could not reload on %s: %s", sig, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (this *Settings) reloadHooks() *reloadHooks {
+	this.lazyInit()
+	return this.reloads
+}
+
+// wantChanges returns whether anything was given to OnChange.
+func (this *reloadHooks) wantChanges() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.onChange) > 0
+}
+
+// reloaded calls the hooks after a reload that returned err, and changed the
+// settings by changes.
+func (this *reloadHooks) reloaded(changes []Change, err error) {
+	this.lock.Lock()
+	var onReload []func(error)
+	onReload = append(onReload, this.onReload...)
+	var onChange []func([]Change)
+	if err == nil && len(changes) > 0 {
+		onChange = append(onChange, this.onChange...)
+	}
+	this.lock.Unlock()
+
+	for _, fn := range onReload {
+		fn(err)
+	}
+	for _, fn := range onChange {
+		fn(changes)
+	}
+}
@@ -0,0 +1,81 @@
+package flexiconfig
+
+import (
+	"sort"
+)
+
+// MergeReport describes what a single load changed.
+type MergeReport struct {
+	Source Source
+	// Added lists the paths of values that weren't set before.
+	Added []string
+	// Overridden lists the paths of values that were set to something else.
+	Overridden []string
+	// Replaced lists the paths where a map replaced a value that isn't a map,
+	// or the other way around.
+	Replaced []string
+}
+
+// SetMergeReports makes every load collect a MergeReport, available from
+// LastMergeReport and logged at debug level. It is off by default, as it
+// compares every merged value with the one it replaces.
+func (this *Settings) SetMergeReports(enabled bool) {
+	this.mergeReports = enabled
+}
+
+// SetOverrideWarning makes loads that override more than n existing values
+// log a warning, which often means that files are loaded in the wrong order.
+// It requires merge reports, see SetMergeReports. 0 disables the warning.
+func (this *Settings) SetOverrideWarning(n int) {
+	this.overrideWarning = n
+}
+
+// LastMergeReport returns the MergeReport of the latest load, and false if
+// there is none because merge reports are disabled or nothing was loaded.
+func (this Settings) LastMergeReport() (MergeReport, bool) {
+	this.rlock()
+	defer this.runlock()
+
+	if this.results.mergeReport == nil {
+		return MergeReport{}, false
+	}
+	return *this.results.mergeReport, true
+}
+
+// added, overridden and replaced record a change made by a merge.
+func (this *MergeReport) added(path string) {
+	if this != nil {
+		this.Added = append(this.Added, path)
+	}
+}
+
+func (this *MergeReport) overridden(path string, old, new interface{}) {
+	if this != nil && !sameValue(old, new) {
+		this.Overridden = append(this.Overridden, path)
+	}
+}
+
+func (this *MergeReport) replaced(path string) {
+	if this != nil {
+		this.Replaced = append(this.Replaced, path)
+	}
+}
+
+// finishMergeReport keeps and logs report. The caller must hold the write
+// lock.
+func (this *Settings) finishMergeReport(report *MergeReport) {
+	sort.Strings(report.Added)
+	sort.Strings(report.Overridden)
+	sort.Strings(report.Replaced)
+	this.results.mergeReport = report
+
+	name := report.Source.Name
+	this.logf(LogDebug, "%s added %d values, overrode %d and replaced %d", name, len(report.Added), len(report.Overridden), len(report.Replaced))
+	for _, path := range report.Overridden {
+		this.logf(LogDebug, "%s overrode %s", name, path)
+	}
+
+	if this.overrideWarning > 0 && len(report.Overridden) > this.overrideWarning {
+		this.logf(LogWarning, "%s overrode %d existing values, more than %d, check the order settings are loaded in", name, len(report.Overridden), this.overrideWarning)
+	}
+}
@@ -0,0 +1,222 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReferencePrefix marks a string value as a reference to the value at another
+// path, such as "@ref:db:host", see ReferenceResolver.
+const ReferencePrefix = "@ref:"
+
+// Resolver transforms the values stored in the settings into the values the
+// getters return, see AddResolver.
+type Resolver interface {
+	// Resolve returns what raw, found at path, resolves to and true, or false
+	// to leave raw to the next resolver.
+	Resolve(path string, raw interface{}) (interface{}, bool, error)
+}
+
+// The resolvers provided by the package.
+var (
+	// EnvResolver expands the environment variables in strings containing a
+	// $, as GetStringExpanded does.
+	EnvResolver Resolver = envResolver{}
+	// FileRefResolver replaces file references by the content of the file,
+	// see EnableFileRefs.
+	FileRefResolver Resolver = fileRefResolver{}
+	// ReferenceResolver replaces a string starting with ReferencePrefix by
+	// the value at the path that follows, itself resolved. A value ending up
+	// referring to itself is an error. It only resolves values of the
+	// settings it was added to, calling Resolve directly resolves nothing.
+	ReferenceResolver Resolver = referenceResolver{}
+)
+
+// ResolveError is returned by the getters when a resolver fails.
+type ResolveError struct {
+	// Resolver is the name of the resolver, see NewResolver.
+	Resolver string
+	// Path is the path of the value it failed to resolve.
+	Path string
+	Err  error
+}
+
+func (this *ResolveError) Error() string {
+	return fmt.Sprintf("Could not resolve %s with the %s resolver: %s", this.Path, this.Resolver, this.Err)
+}
+
+func (this *ResolveError) Unwrap() error {
+	return this.Err
+}
+
+// NewResolver returns a Resolver called name, which ResolveError reports,
+// calling fn.
+func NewResolver(name string, fn func(path string, raw interface{}) (interface{}, bool, error)) Resolver {
+	return &funcResolver{name: name, fn: fn}
+}
+
+type funcResolver struct {
+	name string
+	fn   func(path string, raw interface{}) (interface{}, bool, error)
+}
+
+func (this *funcResolver) Resolve(path string, raw interface{}) (interface{}, bool, error) {
+	return this.fn(path, raw)
+}
+
+func (this *funcResolver) Name() string {
+	return this.name
+}
+
+// resolverName returns the name of r: what its Name method returns if it has
+// one, its type otherwise.
+func resolverName(r Resolver) string {
+	if named, ok := r.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", r)
+}
+
+// settingsResolver is a Resolver needing the settings it resolves a value of.
+type settingsResolver interface {
+	resolveIn(s Settings, path string, raw interface{}) (interface{}, bool, error)
+}
+
+// AddResolver adds r to the end of the resolvers run by Get and the typed
+// getters on the values they return. Every value is passed to each resolver
+// in order until one resolves it, starting with the value at the path got: a
+// map or array no resolver resolves is copied with each of its elements
+// resolved the same way. RawGet and the functions serializing the settings
+// return the values as stored.
+//
+// Resolved values are cached along with file references, see
+// SetResolveCacheTTL, so a resolver reading something outside of the settings,
+// such as the environment, only sees it change once the cache is invalidated.
+func (this *Settings) AddResolver(r Resolver) {
+	this.SetResolvers(append(this.Resolvers(), r)...)
+}
+
+// SetResolvers replaces the resolvers, see AddResolver, by resolvers, which
+// allows reordering or removing them. EnableFileRefs adds or removes
+// FileRefResolver.
+func (this *Settings) SetResolvers(resolvers ...Resolver) {
+	this.resolvers = append([]Resolver(nil), resolvers...)
+	this.InvalidateCache("")
+}
+
+// Resolvers returns the resolvers, in the order they run.
+func (this Settings) Resolvers() []Resolver {
+	return append([]Resolver(nil), this.resolvers...)
+}
+
+// resolve returns value, found at path, with the resolvers run on it and, if
+// none resolves it, on its elements. Maps and arrays are copied rather than
+// modified.
+func (this Settings) resolve(path string, value interface{}) (interface{}, error) {
+	for _, r := range this.resolvers {
+		var resolved interface{}
+		var ok bool
+		var err error
+		if inSettings, needsSettings := r.(settingsResolver); needsSettings {
+			resolved, ok, err = inSettings.resolveIn(this, path, value)
+		} else {
+			resolved, ok, err = r.Resolve(path, value)
+		}
+		if err != nil {
+			return nil, &ResolveError{Resolver: resolverName(r), Path: path, Err: err}
+		}
+		if ok {
+			return resolved, nil
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			resolved, err := this.resolve(this.joinPath(path, key), child)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = resolved
+		}
+		return m, nil
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, child := range v {
+			resolved, err := this.resolve(fmt.Sprintf("%s[%d]", path, i), child)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = resolved
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+type envResolver struct{}
+
+func (this envResolver) Name() string {
+	return "env"
+}
+
+func (this envResolver) Resolve(path string, raw interface{}) (interface{}, bool, error) {
+	s, ok := raw.(string)
+	if !ok || !strings.Contains(s, "$") {
+		return raw, false, nil
+	}
+	expanded, err := expandEnv(s, false)
+	return expanded, true, err
+}
+
+type fileRefResolver struct{}
+
+func (this fileRefResolver) Name() string {
+	return "file"
+}
+
+func (this fileRefResolver) Resolve(path string, raw interface{}) (interface{}, bool, error) {
+	return this.resolveIn(Settings{}, path, raw)
+}
+
+func (this fileRefResolver) resolveIn(s Settings, path string, raw interface{}) (interface{}, bool, error) {
+	value, ok := raw.(string)
+	if !ok || !isFileRef(value) {
+		return raw, false, nil
+	}
+	resolved, err := s.resolveFileRef(path, value)
+	return resolved, true, err
+}
+
+type referenceResolver struct{}
+
+func (this referenceResolver) Name() string {
+	return "reference"
+}
+
+func (this referenceResolver) Resolve(path string, raw interface{}) (interface{}, bool, error) {
+	return raw, false, nil
+}
+
+func (this referenceResolver) resolveIn(s Settings, path string, raw interface{}) (interface{}, bool, error) {
+	value, ok := raw.(string)
+	if !ok || !strings.HasPrefix(value, ReferencePrefix) {
+		return raw, false, nil
+	}
+	target := value[len(ReferencePrefix):]
+	for i, resolving := range s.resolving {
+		if resolving == target {
+			cycle := strings.Join(s.resolving[i:], " -> ")
+			return nil, true, fmt.Errorf("it refers to itself (%s -> %s -> %s)", cycle, path, target)
+		}
+	}
+
+	// The value at path must be resolved again whenever the one at target
+	// changes.
+	s.resolved.depend(s.normalizePath(path), s.normalizePath(target))
+	s.resolving = append(append([]string(nil), s.resolving...), path)
+	resolved, err := s.getResolved(target)
+	return resolved, true, err
+}
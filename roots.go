@@ -0,0 +1,68 @@
+package flexiconfig
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathNotAllowed is matched by the errors returned when reading a file
+// outside of the roots set with SetAllowedRoots, use
+// errors.Is(err, ErrPathNotAllowed) to tell them apart from other errors.
+var ErrPathNotAllowed = errors.New("Path not allowed")
+
+// pathNotAllowedError is returned when reading a file outside of the allowed
+// roots.
+type pathNotAllowedError struct {
+	path string
+}
+
+func (this *pathNotAllowedError) Error() string {
+	return fmt.Sprintf("%s is outside of the allowed roots", this.path)
+}
+
+func (this *pathNotAllowedError) Is(target error) bool {
+	return target == ErrPathNotAllowed
+}
+
+// SetAllowedRoots restricts every file read to files inside the given
+// directories. This covers the file loaders, LoadDirAsMap, LoadCSVFile,
+// ProcessIncludes and file references. Symlinks are resolved before checking,
+// so they can't lead outside of the roots. Lua configs are still trusted code:
+// the files they read themselves, with io.open or require, are not checked.
+// With no roots set any file can be read.
+func (this *Settings) SetAllowedRoots(dirs ...string) {
+	this.allowedRoots = dirs
+}
+
+// allowPath returns an error if path is outside of the allowed roots.
+func (this Settings) allowPath(path string) error {
+	if len(this.allowedRoots) == 0 {
+		return nil
+	}
+
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	for _, root := range this.allowedRoots {
+		root, err := resolvePath(root)
+		if err != nil {
+			continue
+		}
+		if resolved == root || strings.HasPrefix(resolved, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return &pathNotAllowedError{resolved}
+}
+
+// resolvePath returns the absolute path of path with every symlink resolved.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
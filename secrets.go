@@ -0,0 +1,84 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// redactedValue replaces secret values in redacted output.
+const redactedValue = "[redacted]"
+
+// MarkSecret marks the values at the given path patterns as secret, hiding
+// them, and everything below them, from redacted output such as String,
+// GetRedactedJSON and Print. Each segment of a pattern is matched using
+// path.Match, so "*:password" marks the password key of every top-level
+// section. Secret values are still returned as usual by the getters.
+func (this *Settings) MarkSecret(patterns ...string) {
+	this.secrets = append(this.secrets, patterns...)
+}
+
+// isSecret returns whether the value at p matches one of the secret patterns,
+// either directly or through one of its parents.
+func (this Settings) isSecret(p string) bool {
+	for _, pattern := range this.secrets {
+		if matchPathPrefix(this.pathSeparator(), pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPathPrefix returns whether pattern matches p or one of its parents,
+// both being separated by sep.
+func matchPathPrefix(sep, pattern, p string) bool {
+	patternParts := strings.Split(pattern, sep)
+	parts := strings.Split(p, sep)
+	if len(parts) < len(patternParts) {
+		return false
+	}
+
+	for i, patternPart := range patternParts {
+		if matched, err := path.Match(patternPart, parts[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// redactedCopy returns a deep copy of the settings with every secret value
+// replaced and the export filters applied. The caller must hold the read
+// lock.
+func (this Settings) redactedCopy() map[string]interface{} {
+	redacted := make(map[string]interface{}, len(this.settings))
+	for key, value := range this.settings {
+		redacted[key] = this.redactValue(key, value)
+	}
+	return redacted
+}
+
+func (this Settings) redactValue(p string, value interface{}) interface{} {
+	if this.isSecret(p) {
+		return redactedValue
+	}
+
+	if m, ok := value.(map[string]interface{}); ok {
+		redacted := make(map[string]interface{}, len(m))
+		for key, child := range m {
+			redacted[key] = this.redactValue(this.joinPath(p, key), child)
+		}
+		return redacted
+	}
+	return this.exportValue(p, deepCopy(value))
+}
+
+// GetRedactedJSON returns the json representation of the current config with
+// every value marked with MarkSecret redacted.
+func (this Settings) GetRedactedJSON() []byte {
+	snapshot := this.capture()
+	b, err := json.Marshal(snapshot.jsonValue(snapshot.redactedCopy()))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package flexiconfig
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultPathSeparator separates the keys of a path unless SetPathSeparator is
+// used.
+const DefaultPathSeparator = ":"
+
+// SetPathSeparator changes the string separating the keys of a path, for
+// instance to "." so that keys such as "localhost:8080" can be used. Every
+// function taking a path respects it, including secret patterns and the Writer
+// prefixes. It must be called before anything is loaded, so that no path can
+// be read two ways, and returns an error otherwise or if sep is empty.
+func (this *Settings) SetPathSeparator(sep string) error {
+	if sep == "" {
+		return errors.New("Path separator can't be empty")
+	}
+
+	this.wlock()
+	defer this.wunlock()
+
+	if len(this.settings) > 0 || len(this.provenance.sources) > 0 {
+		return errors.New("Path separator must be set before loading any settings")
+	}
+	this.separator = sep
+	this.provenance.separator = sep
+	return nil
+}
+
+// pathSeparator returns the separator in use.
+func (this Settings) pathSeparator() string {
+	if this.separator == "" {
+		return DefaultPathSeparator
+	}
+	return this.separator
+}
+
+// checkPath returns an error matching ErrInvalidPath if path is empty or has
+// an empty key, such as ":a", "a:" or "a::b".
+func (this Settings) checkPath(path string) error {
+	sep := this.pathSeparator()
+	if path == "" || strings.HasPrefix(path, sep) || strings.HasSuffix(path, sep) || strings.Contains(path, sep+sep) {
+		return &invalidPathError{path}
+	}
+	return nil
+}
+
+// splitPath splits path into its keys.
+func (this Settings) splitPath(path string) []string {
+	return strings.Split(path, this.pathSeparator())
+}
+
+// joinPath appends key to path.
+func (this Settings) joinPath(path, key string) string {
+	return joinPathWith(this.pathSeparator(), path, key)
+}
+
+// joinPathWith appends key to path using the separator sep.
+func joinPathWith(sep, path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + sep + key
+}
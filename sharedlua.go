@@ -0,0 +1,52 @@
+package flexiconfig
+
+import (
+	"io"
+	"sync"
+)
+
+// SetSharedLuaState makes lua configs run in a single lua state owned by the
+// settings, rather than in a new one for every config. Modules, including
+// those added with AddLuaLoader, are then only loaded the first time they are
+// required and shared by every later config, which saves repeating expensive
+// setup. Globals aren't shared: each config runs with its own environment, in
+// which globals of the shared state can be read while the globals it sets
+// stay. Tables of the shared state, such as string, are still shared with
+// later configs if a config changes them. Configs then run one at a time.
+//
+// The state is created again when lua modules are added or removed. Turning
+// it off closes the state.
+func (this *Settings) SetSharedLuaState(shared bool) {
+	this.wlock()
+	old := this.sharedLua
+	this.sharedLua = nil
+	if shared {
+		this.sharedLua = &sharedLuaState{}
+	}
+	this.wunlock()
+
+	old.reset()
+}
+
+// sharedLuaState holds the state kept by the LuaEngine for every config with
+// SetSharedLuaState, see LuaRun.SharedState. Its lock is held while a config
+// runs.
+type sharedLuaState struct {
+	sync.Mutex
+	state io.Closer
+}
+
+// reset closes the shared state, if any, so that the next config creates it
+// again.
+func (this *sharedLuaState) reset() {
+	if this == nil {
+		return
+	}
+	this.Lock()
+	defer this.Unlock()
+
+	if this.state != nil {
+		this.state.Close()
+		this.state = nil
+	}
+}
@@ -0,0 +1,122 @@
+package flexiconfig
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// LoadStat describes a single load, see Stats.
+type LoadStat struct {
+	// Source is the name of the source loaded, see Source.
+	Source string
+
+	// Start is when the load started and Duration how long it took,
+	// including reading, parsing or running the config and merging it.
+	Start    time.Time
+	Duration time.Duration
+
+	// Bytes is the size of the config read, if known.
+	Bytes int
+
+	// Keys is the number of top-level keys merged.
+	Keys int
+
+	// Content tells whether the config was read from its source, or came
+	// from a cache, see WithHTTPCache.
+	Content ContentStatus
+
+	// Duplicate is true if nothing was merged as an earlier load merged the
+	// same settings, see SetDeduplicateLoads.
+	Duplicate bool
+
+	// Err is the error the load failed with, if any.
+	Err error
+}
+
+// loadStats collects the LoadStats of a Settings and its copies.
+type loadStats struct {
+	lock  sync.Mutex
+	stats []LoadStat
+	hook  func(LoadStat)
+}
+
+// Stats returns a LoadStat for every load since the settings were created or
+// ResetStats was called, in load order.
+func (this Settings) Stats() []LoadStat {
+	if this.stats == nil {
+		return nil
+	}
+
+	this.stats.lock.Lock()
+	defer this.stats.lock.Unlock()
+
+	stats := make([]LoadStat, len(this.stats.stats))
+	copy(stats, this.stats.stats)
+	return stats
+}
+
+// ResetStats forgets the LoadStats collected so far.
+func (this Settings) ResetStats() {
+	if this.stats == nil {
+		return
+	}
+
+	this.stats.lock.Lock()
+	this.stats.stats = nil
+	this.stats.lock.Unlock()
+}
+
+// SetMetricsHook sets a function called with the LoadStat of every load as it
+// finishes, for instance to forward them to a metrics system. It is called on
+// the goroutine doing the load.
+func (this *Settings) SetMetricsHook(hook func(LoadStat)) {
+	this.lazyInit()
+
+	this.stats.lock.Lock()
+	this.stats.hook = hook
+	this.stats.lock.Unlock()
+}
+
+// loadTimer measures a single load.
+type loadTimer struct {
+	stats *loadStats
+	stat  LoadStat
+}
+
+// startLoad starts measuring a load from the source called name.
+func (this Settings) startLoad(name string) *loadTimer {
+	return &loadTimer{
+		stats: this.stats,
+		stat:  LoadStat{Source: name, Start: time.Now()},
+	}
+}
+
+// done records the load, which merged keys top-level keys, and returns err.
+func (this *loadTimer) done(keys int, err error) error {
+	if this.stats == nil {
+		return err
+	}
+
+	this.stat.Duration = time.Since(this.stat.Start)
+	this.stat.Keys = keys
+	this.stat.Err = err
+
+	this.stats.lock.Lock()
+	this.stats.stats = append(this.stats.stats, this.stat)
+	hook := this.stats.hook
+	this.stats.lock.Unlock()
+
+	if hook != nil {
+		hook(this.stat)
+	}
+	return err
+}
+
+// fileSize returns the size of the file at path, or 0 if it can't be read.
+func fileSize(path string) int {
+	if info, err := os.Stat(path); err == nil {
+		return int(info.Size())
+	}
+	return 0
+}
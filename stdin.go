@@ -0,0 +1,101 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdin is where LoadStdin reads from. It can only be read once per process,
+// whichever Settings reads it.
+var stdin = struct {
+	sync.Mutex
+	r    io.Reader
+	read bool
+}{r: os.Stdin}
+
+// LoadStdin reads all of stdin and loads it in the given format, "json", "lua"
+// or a registered one, for programs that get their config piped in. An empty
+// format takes it from a marker on the first line, as LoadFile does, or else
+// guesses it: input starting with "{" is JSON, anything else lua.
+// LoadFile("-") and LoadFileAs("-", format) do the same. SetMaxSize limits how
+// much is read.
+//
+// Stdin can only be read once, so loading it again fails, while Reload merges
+// what was read the first time again.
+func (this *Settings) LoadStdin(format string) error {
+	return this.LoadStdinWithOptions(format)
+}
+
+// LoadStdinWithOptions is LoadStdin using the given merge options.
+func (this *Settings) LoadStdinWithOptions(format string, options ...MergeOption) error {
+	if format != "" {
+		l, err := formatLoader("-", format, options)
+		if err != nil {
+			return err
+		}
+		return this.load(l)
+	}
+	return this.load(stdinLoader("", options))
+}
+
+// stdinLoader returns the loader for stdin in format, or a guessed format if
+// it is empty.
+func stdinLoader(format string, options []MergeOption) *loader {
+	var content []byte
+	return &loader{
+		source:  Source{Name: "stdin"},
+		options: options,
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if content == nil {
+				var err error
+				if content, err = this.readStdin(); err != nil {
+					return nil, 0, err
+				}
+			}
+			this.logf(LogDebug, "Loading stdin (%d bytes)", len(content))
+			this.readContent(content)
+
+			guessed, decoded := format, content
+			if guessed == "" {
+				if guessed, decoded = readFormatMarker(content); guessed != "" {
+					fileFormatsLock.RLock()
+					err := checkFileFormat(guessed)
+					fileFormatsLock.RUnlock()
+					if err != nil {
+						return nil, len(content), fmt.Errorf("Could not load stdin: %s", err)
+					}
+				} else if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+					guessed = "json"
+				} else {
+					guessed = "lua"
+				}
+			}
+
+			newSettings, err := this.decodeContent("stdin", guessed, decoded)
+			return newSettings, len(content), err
+		},
+	}
+}
+
+// readStdin reads all of stdin, unless it was read before.
+func (this Settings) readStdin() ([]byte, error) {
+	stdin.Lock()
+	defer stdin.Unlock()
+
+	if stdin.read {
+		return nil, fmt.Errorf("Could not read stdin: it was already read, so it can only be loaded once")
+	}
+	stdin.read = true
+
+	content, err := this.readAll("stdin", stdin.r)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read stdin: %s", err)
+	}
+	if content == nil {
+		content = []byte{}
+	}
+	return content, nil
+}
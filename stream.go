@@ -0,0 +1,132 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LoadJSONStreamArray loads the JSON file at path like LoadJSONFile, except
+// for the array at its top-level key arrayKey, whose elements are passed to fn
+// one at a time, in order, rather than being stored in the settings. This
+// keeps huge arrays, such as thousands of routing rules, from being held in
+// memory as a whole; fn can decode each element into its own structures.
+//
+// Every other top-level key is merged as usual once the whole file was read.
+// If fn returns an error, or an element isn't valid JSON, nothing is merged
+// and the error names the index of the element. A file without arrayKey
+// merges without calling fn. As the file isn't read whole, SetMaxSize doesn't
+// limit it. Reload streams the array again.
+func (this *Settings) LoadJSONStreamArray(path string, arrayKey string, fn func(index int, elem json.RawMessage) error) error {
+	path, err := this.expandPath(path)
+	if err != nil {
+		return err
+	}
+
+	return this.load(&loader{
+		source: fileSource(path),
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			if err := this.allowPath(path); err != nil {
+				return nil, 0, err
+			}
+			this.logFileLoad(path)
+			file, err := os.Open(path)
+			if err != nil {
+				return nil, 0, err
+			}
+			defer file.Close()
+			this.readFileInfo(path)
+
+			decoder := json.NewDecoder(file)
+			newSettings, err := this.streamJSON(decoder, arrayKey, fn)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Could not load %s: %s", path, err)
+			}
+			return newSettings, int(decoder.InputOffset()), nil
+		},
+	})
+}
+
+// streamJSON reads the JSON object from decoder, passing the elements of the
+// array at arrayKey to fn, and returns the rest of the object.
+func (this *Settings) streamJSON(decoder *json.Decoder, arrayKey string, fn func(index int, elem json.RawMessage) error) (map[string]interface{}, error) {
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('{') {
+		return nil, fmt.Errorf("Expected an object, found %v", token)
+	}
+
+	newSettings := make(map[string]interface{})
+	seen := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+		if seen[key] && this.strictJSON {
+			return nil, fmt.Errorf("Duplicate key %s", key)
+		}
+		seen[key] = true
+
+		if key == arrayKey {
+			if err := streamJSONArray(decoder, key, fn); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := this.unmarshalJSON(raw, &value); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		newSettings[key] = value
+
+		if this.reading != nil && this.reading.order != nil {
+			order := this.reading.order
+			if !containsKey(order[""], key) {
+				order[""] = append(order[""], key)
+			}
+			valueDecoder := json.NewDecoder(bytes.NewReader(raw))
+			valueDecoder.UseNumber()
+			readJSONKeyOrder(this.pathSeparator(), key, valueDecoder, order, true)
+		}
+	}
+
+	// Read the closing brace.
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return newSettings, nil
+}
+
+// streamJSONArray passes the elements of the array at the top-level key from
+// decoder to fn.
+func streamJSONArray(decoder *json.Decoder, key string, fn func(index int, elem json.RawMessage) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("%s is not an array", key)
+	}
+
+	for index := 0; decoder.More(); index++ {
+		var elem json.RawMessage
+		if err := decoder.Decode(&elem); err != nil {
+			return fmt.Errorf("Element %d of %s: %s", index, key, err)
+		}
+		if err := fn(index, elem); err != nil {
+			return fmt.Errorf("Element %d of %s: %s", index, key, err)
+		}
+	}
+
+	// Read the closing bracket.
+	_, err = decoder.Token()
+	return err
+}
@@ -0,0 +1,100 @@
+package flexiconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SetStrictJSON makes the JSON loaders reject documents in which an object
+// contains the same key more than once, instead of silently keeping the last
+// one. Lua configs are never checked since lua tables can't hold duplicates.
+func (this *Settings) SetStrictJSON(strict bool) {
+	this.strictJSON = strict
+}
+
+// jsonFrame is an object or array being walked by checkDuplicateKeys.
+type jsonFrame struct {
+	object  bool
+	seen    map[string]bool
+	wantKey bool
+	key     string
+	index   int
+}
+
+// checkDuplicateKeys returns an error naming the first key that appears twice
+// in the same object, along with its approximate position. Paths in the error
+// are joined with sep.
+func checkDuplicateKeys(sep string, b []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	var stack []*jsonFrame
+
+	// valueDone moves the innermost object or array past a completed value.
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := stack[len(stack)-1]; top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].wantKey {
+			top := stack[len(stack)-1]
+			if delim, ok := token.(json.Delim); ok && delim == '}' {
+				stack = stack[:len(stack)-1]
+				valueDone()
+				continue
+			}
+
+			key := token.(string)
+			if top.seen[key] {
+				offset := decoder.InputOffset()
+				line := bytes.Count(b[:offset], []byte("\n")) + 1
+				return fmt.Errorf("Duplicate key %s on line %d (offset %d)", jsonFramePath(sep, stack, key), line, offset)
+			}
+			top.seen[key] = true
+			top.key = key
+			top.wantKey = false
+			continue
+		}
+
+		// Anything else is a value, or the end of an array.
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &jsonFrame{object: true, seen: make(map[string]bool), wantKey: true})
+		case json.Delim('['):
+			stack = append(stack, &jsonFrame{})
+		case json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+// jsonFramePath describes where key is found.
+func jsonFramePath(sep string, stack []*jsonFrame, key string) string {
+	path := ""
+	for _, frame := range stack[:len(stack)-1] {
+		if frame.object {
+			path = joinPathWith(sep, path, frame.key)
+		} else {
+			path = fmt.Sprintf("%s[%d]", path, frame.index)
+		}
+	}
+	return joinPathWith(sep, path, key)
+}
@@ -0,0 +1,250 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// DefaultMaxDepth is the deepest nesting of maps and arrays accepted unless
+// changed with SetMaxDepth.
+const DefaultMaxDepth = 1000
+
+// SetMaxDepth sets how deeply maps and arrays may be nested in loaded
+// settings. Anything nested deeper is rejected when loaded or merged. A depth
+// of 0 or less restores DefaultMaxDepth.
+func (this *Settings) SetMaxDepth(depth int) {
+	this.maxDepth = depth
+}
+
+// SetMaxKeys limits how many keys the settings of a single load, or of a
+// single MergeSettings, may have, counting the keys of nested maps too. A load
+// with more is rejected before anything is merged. 0 or less, the default,
+// removes the limit.
+func (this *Settings) SetMaxKeys(keys int) {
+	this.maxKeys = keys
+}
+
+// SetMaxValueBytes limits how long, in bytes, a single string in loaded
+// settings may be. A load with a longer one is rejected. 0 or less, the
+// default, removes the limit.
+func (this *Settings) SetMaxValueBytes(bytes int) {
+	this.maxValueBytes = bytes
+}
+
+// checkLimits makes sure value, found at path, has no more keys and no longer
+// strings than the limits set with SetMaxKeys and SetMaxValueBytes. It must
+// have been normalized.
+func (this Settings) checkLimits(path string, value interface{}) error {
+	if this.maxKeys <= 0 && this.maxValueBytes <= 0 {
+		return nil
+	}
+	keys := 0
+	return this.checkLimitsValue(path, value, &keys)
+}
+
+func (this Settings) checkLimitsValue(path string, value interface{}, keys *int) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		*keys += len(v)
+		if this.maxKeys > 0 && *keys > this.maxKeys {
+			return fmt.Errorf("Settings have more than the maximum of %d keys, reached at %s", this.maxKeys, describePath(path))
+		}
+		for key, child := range v {
+			if err := this.checkLimitsValue(this.joinPath(path, key), child, keys); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := this.checkLimitsValue(fmt.Sprintf("%s[%d]", path, i), child, keys); err != nil {
+				return err
+			}
+		}
+	case string:
+		if this.maxValueBytes > 0 && len(v) > this.maxValueBytes {
+			return fmt.Errorf("Value at %s is %d bytes long, more than the maximum of %d", describePath(path), len(v), this.maxValueBytes)
+		}
+	}
+	return nil
+}
+
+// depthLimit returns the effective maximum nesting depth.
+func (this Settings) depthLimit() int {
+	if this.maxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return this.maxDepth
+}
+
+// checkStructure makes sure value contains no cycles and isn't nested deeper
+// than maxDepth, so that it can be safely walked and serialized.
+func checkStructure(sep, path string, value interface{}, maxDepth int) error {
+	return checkStructureValue(sep, path, value, 0, maxDepth, make(map[uintptr]bool))
+}
+
+func checkStructureValue(sep, path string, value interface{}, depth, maxDepth int, visiting map[uintptr]bool) error {
+	var pointer uintptr
+	switch v := value.(type) {
+	case map[string]interface{}:
+		pointer = reflect.ValueOf(v).Pointer()
+	case []interface{}:
+		if len(v) == 0 {
+			return nil
+		}
+		pointer = reflect.ValueOf(v).Pointer()
+	default:
+		return nil
+	}
+
+	if depth > maxDepth {
+		return fmt.Errorf("Value at %s is nested deeper than the maximum of %d", describePath(path), maxDepth)
+	}
+	if visiting[pointer] {
+		return fmt.Errorf("Value at %s contains itself", describePath(path))
+	}
+	visiting[pointer] = true
+	defer delete(visiting, pointer)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if err := checkStructureValue(sep, joinPathWith(sep, path, key), child, depth+1, maxDepth, visiting); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if err := checkStructureValue(sep, fmt.Sprintf("%s[%d]", path, i), child, depth+1, maxDepth, visiting); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// describePath returns path in a form suitable for error messages.
+func describePath(path string) string {
+	if path == "" {
+		return "the root"
+	}
+	return path
+}
+
+// deepCopy returns a copy of value that shares no maps or arrays with it.
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			m[key] = deepCopy(child)
+		}
+		return m
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, child := range v {
+			array[i] = deepCopy(child)
+		}
+		return array
+	default:
+		return value
+	}
+}
+
+// normalize returns a copy of value in which every map is converted to a
+// map[string]interface{} and every slice or array to a []interface{}, the
+// forms used throughout the settings tree. Map keys are converted to strings
+// if they are strings or integers, anything else is an error. Byte slices
+// are kept as they are. NaN and infinite floats are an error, so that the
+// settings can always be written as JSON.
+func normalize(sep, path string, value interface{}, maxDepth int) (interface{}, error) {
+	return normalizeValue(sep, path, value, 0, maxDepth)
+}
+
+func normalizeValue(sep, path string, value interface{}, depth, maxDepth int) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, json.Number, []byte:
+		return value, nil
+	case float64:
+		if err := checkFinite(path, v); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if err := checkFinite(path, v.Float()); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case reflect.Map:
+		if depth > maxDepth {
+			return nil, fmt.Errorf("Value at %s is nested deeper than the maximum of %d", describePath(path), maxDepth)
+		}
+
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := stringifyKey(iter.Key())
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key in %s: %s", describePath(path), err)
+			}
+			if _, ok := m[key]; ok {
+				return nil, fmt.Errorf("Invalid key in %s: more than one key converts to %q", describePath(path), key)
+			}
+
+			if m[key], err = normalizeValue(sep, joinPathWith(sep, path, key), iter.Value().Interface(), depth+1, maxDepth); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Slice, reflect.Array:
+		if depth > maxDepth {
+			return nil, fmt.Errorf("Value at %s is nested deeper than the maximum of %d", describePath(path), maxDepth)
+		}
+
+		array := make([]interface{}, v.Len())
+		for i := range array {
+			var err error
+			if array[i], err = normalizeValue(sep, fmt.Sprintf("%s[%d]", path, i), v.Index(i).Interface(), depth+1, maxDepth); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+// checkFinite returns an error if f, found at path, is NaN or infinite, which
+// JSON can't represent.
+func checkFinite(path string, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("Value at %s is %v, which can't be written as JSON", describePath(path), f)
+	}
+	return nil
+}
+
+// stringifyKey converts a map key to a string.
+func stringifyKey(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.Interface {
+		key = key.Elem()
+	}
+
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	case reflect.Invalid:
+		return "", fmt.Errorf("nil key")
+	default:
+		return "", fmt.Errorf("%v of type %s can't be used as a key", key.Interface(), key.Type())
+	}
+}
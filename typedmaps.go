@@ -0,0 +1,85 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// GetDurationMap returns the map stored in the path with every value parsed
+// as GetDuration does, such as {"read": "50ms", "write": "200ms"}. The error
+// of a value that isn't a duration names its key, the first one in sorted
+// order if there are several. The map returned is always a new one.
+// If the the path isn't defined it will return the defaultValue as is and an
+// error.
+func (this Settings) GetDurationMap(path string, defaultValue map[string]time.Duration) (map[string]time.Duration, error) {
+	m, keys, err := this.getMap(path)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	durations := make(map[string]time.Duration, len(m))
+	for _, key := range keys {
+		var target time.Duration
+		if err := this.decode(this.joinPath(path, key), m[key], &target); err != nil {
+			return defaultValue, err
+		}
+		durations[key] = target
+	}
+	return durations, nil
+}
+
+// GetIntMap is GetDurationMap for values parsed as GetInt does.
+func (this Settings) GetIntMap(path string, defaultValue map[string]int64) (map[string]int64, error) {
+	m, keys, err := this.getMap(path)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	ints := make(map[string]int64, len(m))
+	for _, key := range keys {
+		var target int64
+		if err := this.decode(this.joinPath(path, key), m[key], &target); err != nil {
+			return defaultValue, err
+		}
+		ints[key] = target
+	}
+	return ints, nil
+}
+
+// GetFloatMap is GetDurationMap for values parsed as GetFloat does.
+func (this Settings) GetFloatMap(path string, defaultValue map[string]float64) (map[string]float64, error) {
+	m, keys, err := this.getMap(path)
+	if err != nil {
+		return defaultValue, err
+	}
+
+	floats := make(map[string]float64, len(m))
+	for _, key := range keys {
+		var target float64
+		if err := this.decode(this.joinPath(path, key), m[key], &target); err != nil {
+			return defaultValue, err
+		}
+		floats[key] = target
+	}
+	return floats, nil
+}
+
+// getMap returns the map stored in the path along with its keys, sorted.
+func (this Settings) getMap(path string) (map[string]interface{}, []string, error) {
+	rawvalue, err := this.getTyped(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, ok := rawvalue.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a map", path)
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return m, keys, nil
+}
@@ -0,0 +1,237 @@
+package flexiconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// URLOption changes how LoadURL fetches a config.
+type URLOption func(config *urlConfig)
+
+type urlConfig struct {
+	retries    int
+	initial    time.Duration
+	maxBackoff time.Duration
+	// httpCache and cacheFile are set by WithHTTPCache and WithCacheFile.
+	httpCache bool
+	cacheFile string
+	// read reads the body of the response.
+	read func(name string, r io.Reader) ([]byte, error)
+}
+
+// WithRetries makes LoadURL try up to n more times when fetching fails with a
+// connection error or a 5xx status. Other statuses and parse errors are never
+// retried.
+func WithRetries(n int) URLOption {
+	return func(config *urlConfig) {
+		config.retries = n
+	}
+}
+
+// WithBackoff sets how long LoadURL waits before its first retry, doubling up
+// to max for every further retry. Each wait is randomly shortened by up to
+// half, so that many processes starting at once don't retry in lockstep. The
+// default is 100ms up to 10s.
+func WithBackoff(initial, max time.Duration) URLOption {
+	return func(config *urlConfig) {
+		config.initial = initial
+		config.maxBackoff = max
+	}
+}
+
+// URLError is returned when LoadURL can't fetch a config.
+type URLError struct {
+	URL string
+	// Attempts is how many times fetching was tried.
+	Attempts int
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (this *URLError) Error() string {
+	if this.Attempts == 1 {
+		return fmt.Sprintf("Could not fetch %s: %s", this.URL, this.Err)
+	}
+	return fmt.Sprintf("Could not fetch %s after %d attempts: %s", this.URL, this.Attempts, this.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (this *URLError) Unwrap() error {
+	return this.Err
+}
+
+// statusError is an HTTP response with a status other than 200.
+type statusError struct {
+	code   int
+	status string
+}
+
+// urlResponse is what fetching a URL got.
+type urlResponse struct {
+	body         []byte
+	etag         string
+	lastModified string
+	// notModified is whether the server answered 304 to a conditional
+	// request, with no body.
+	notModified bool
+}
+
+func (this *statusError) Error() string {
+	return fmt.Sprintf("Unexpected status %s", this.status)
+}
+
+// LoadURL fetches a config over HTTP and loads it. URLs whose path ends in .lua
+// are run as lua configs, everything else is parsed as JSON. Cancelling ctx
+// stops the fetch and any retries. Reload fetches the URL again using the
+// same ctx and options. The Content of the LoadStat tells whether the config
+// was fetched or came from a cache, see WithHTTPCache.
+func (this *Settings) LoadURL(ctx context.Context, rawurl string, options ...URLOption) error {
+	config := urlConfig{initial: 100 * time.Millisecond, maxBackoff: 10 * time.Second}
+	for _, option := range options {
+		option(&config)
+	}
+
+	return this.load(&loader{
+		source: Source{Name: rawurl},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			config := config
+			config.read = this.readAll
+			var cached *urlCacheEntry
+			if config.httpCache {
+				cached = this.urls.get(this, rawurl, config.cacheFile)
+			}
+
+			response, err := fetchURL(ctx, rawurl, config, cached)
+			var body []byte
+			status := ContentFresh
+			switch {
+			case err != nil && cached != nil && config.cacheFile != "":
+				this.logf(LogWarning, "%s, using the copy cached in %s at %s", err, config.cacheFile, cached.SavedAt.Format(time.RFC3339))
+				body, status = cached.Body, ContentCached
+			case err != nil:
+				return nil, 0, err
+			case response.notModified:
+				this.logf(LogDebug, "%s is unchanged", rawurl)
+				body, status = cached.Body, ContentUnchanged
+			default:
+				body = response.body
+			}
+			this.logf(LogDebug, "Loading %s (%d bytes)", rawurl, len(body))
+			this.readContent(body)
+			if this.reading != nil {
+				this.reading.content = status
+				this.reading.unchanged = status == ContentUnchanged && cached.loaded
+			}
+
+			var newSettings map[string]interface{}
+			if isLuaURL(rawurl) {
+				newSettings, err = this.runLua(rawurl, body, nil)
+			} else {
+				newSettings, err = this.parseJSON(body)
+			}
+			if err == nil && config.httpCache && status == ContentFresh {
+				this.urls.put(this, &urlCacheEntry{
+					URL:          rawurl,
+					ETag:         response.etag,
+					LastModified: response.lastModified,
+					SavedAt:      time.Now(),
+					Body:         body,
+				}, config.cacheFile)
+			}
+			return newSettings, len(body), err
+		},
+	})
+}
+
+// isLuaURL reports whether the path of rawurl ends in .lua.
+func isLuaURL(rawurl string) bool {
+	parsed, err := url.Parse(rawurl)
+	return err == nil && path.Ext(parsed.Path) == ".lua"
+}
+
+// fetchURL gets the body at rawurl, retrying as configured. Unless cached is
+// nil the request is conditional on the content having changed since cached.
+func fetchURL(ctx context.Context, rawurl string, config urlConfig, cached *urlCacheEntry) (*urlResponse, error) {
+	delay := config.initial
+	for attempt := 1; ; attempt++ {
+		response, retry, err := fetchURLOnce(ctx, rawurl, config.read, cached)
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			retry = false
+		}
+		if !retry || attempt > config.retries {
+			return nil, &URLError{URL: rawurl, Attempts: attempt, Err: err}
+		}
+
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &URLError{URL: rawurl, Attempts: attempt, Err: ctx.Err()}
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > config.maxBackoff {
+			delay = config.maxBackoff
+		}
+	}
+}
+
+// fetchURLOnce gets the body at rawurl, read with read, and whether a failure
+// is worth retrying. Unless cached is nil the request is conditional.
+func fetchURLOnce(ctx context.Context, rawurl string, read func(name string, r io.Reader) ([]byte, error), cached *urlCacheEntry) (*urlResponse, bool, error) {
+	request, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if cached != nil && cached.ETag != "" {
+		request.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached != nil && cached.LastModified != "" {
+		request.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, true, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		return &urlResponse{notModified: true}, false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, response.StatusCode >= 500, &statusError{code: response.StatusCode, status: response.Status}
+	}
+
+	body, err := read(rawurl, response.Body)
+	if err != nil {
+		var tooLarge *sizeError
+		return nil, !errors.As(err, &tooLarge), err
+	}
+	return &urlResponse{
+		body:         body,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+	}, false, nil
+}
+
+// jitter returns a random duration between half of delay and delay.
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -0,0 +1,153 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ContentStatus tells where the content of a load came from, see LoadStat.
+type ContentStatus int
+
+const (
+	// ContentFresh is content read from its source, as every load but those
+	// of LoadURL with WithHTTPCache does.
+	ContentFresh ContentStatus = iota
+	// ContentUnchanged is content the server reported unchanged since it was
+	// last fetched, which was used again.
+	ContentUnchanged
+	// ContentCached is content read from the cache file of WithCacheFile, as
+	// the server couldn't be reached.
+	ContentCached
+)
+
+func (this ContentStatus) String() string {
+	switch this {
+	case ContentFresh:
+		return "fresh"
+	case ContentUnchanged:
+		return "unchanged"
+	case ContentCached:
+		return "cached"
+	default:
+		return fmt.Sprintf("ContentStatus(%d)", int(this))
+	}
+}
+
+// WithHTTPCache makes LoadURL remember the ETag and Last-Modified headers of
+// the config it fetched, and send them with the next request for the same URL,
+// as with Reload or a later LoadURL. When the server answers that the config
+// didn't change, the content fetched before is used again, and LoadURL
+// doesn't merge it again.
+func WithHTTPCache() URLOption {
+	return func(config *urlConfig) {
+		config.httpCache = true
+	}
+}
+
+// WithCacheFile is WithHTTPCache also saving the latest config fetched to the
+// file at path, so that LoadURL can use it when the server can't be reached,
+// logging a warning saying how old it is. The file is replaced atomically.
+// Each URL needs its own cache file.
+func WithCacheFile(path string) URLOption {
+	return func(config *urlConfig) {
+		config.httpCache = true
+		config.cacheFile = path
+	}
+}
+
+// urlCacheEntry is the latest config fetched from a URL, as saved in a cache
+// file.
+type urlCacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SavedAt      time.Time `json:"saved_at"`
+	Body         []byte    `json:"body"`
+
+	// loaded is whether the entry was fetched by these settings, rather than
+	// read from a cache file.
+	loaded bool
+}
+
+// urlCache holds the latest config fetched from every URL loaded with
+// WithHTTPCache.
+type urlCache struct {
+	lock    sync.Mutex
+	entries map[string]*urlCacheEntry
+}
+
+// get returns the entry of rawurl, read from the file at path if there is none
+// in memory and path isn't empty, or nil.
+func (this *urlCache) get(settings *Settings, rawurl, path string) *urlCacheEntry {
+	this.lock.Lock()
+	entry := this.entries[rawurl]
+	this.lock.Unlock()
+
+	if entry != nil || path == "" {
+		return entry
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			settings.logf(LogWarning, "Could not read the cache file of %s: %s", rawurl, err)
+		}
+		return nil
+	}
+	entry = &urlCacheEntry{}
+	if err := json.Unmarshal(b, entry); err != nil || entry.URL != rawurl {
+		settings.logf(LogWarning, "Ignoring cache file %s, it isn't a cache of %s", path, rawurl)
+		return nil
+	}
+	return entry
+}
+
+// put records entry as the latest config fetched from its URL, saving it to
+// the file at path unless path is empty.
+func (this *urlCache) put(settings *Settings, entry *urlCacheEntry, path string) {
+	entry.loaded = true
+
+	this.lock.Lock()
+	if this.entries == nil {
+		this.entries = make(map[string]*urlCacheEntry)
+	}
+	this.entries[entry.URL] = entry
+	this.lock.Unlock()
+
+	if path == "" {
+		return
+	}
+	if err := writeFileAtomic(path, entry); err != nil {
+		settings.logf(LogWarning, "Could not save the cache file of %s: %s", entry.URL, err)
+	}
+}
+
+// writeFileAtomic writes value as JSON to a temporary file next to path, which
+// then replaces path.
+func writeFileAtomic(path string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,316 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadURLValues loads settings from query string style values, such as
+// ?db.host=x&db.port=5432, where sep separates the keys of a path, "." if
+// empty. A key can also be given in brackets, db[host], which allows keys
+// containing sep, db[my.host], and a number in brackets is the index of an
+// array, tags[0]=a&tags[1]=b. Repeating a key, tags=a&tags=b, or ending it
+// with [], tags[]=a, makes an array of the values as well.
+//
+// Values are parsed like those of LoadKVPairs: as JSON if possible, so
+// numbers, booleans and quoted strings keep their type, and as plain strings
+// otherwise. The values are merged like any other load.
+func (this *Settings) LoadURLValues(v url.Values, sep string) error {
+	if sep == "" {
+		sep = "."
+	}
+	copied := make(url.Values, len(v))
+	for key, values := range v {
+		copied[key] = append([]string(nil), values...)
+	}
+
+	return this.load(&loader{
+		source: Source{Name: "LoadURLValues"},
+		read: func(this *Settings) (map[string]interface{}, int, error) {
+			newSettings, err := this.urlValuesMap(copied, sep)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Could not load the URL values: %s", err)
+			}
+			return newSettings, 0, nil
+		},
+	})
+}
+
+// ToURLValues flattens the settings into values LoadURLValues loads back, sep
+// separating the keys of a path, "." if empty. Keys containing sep are written
+// in brackets, and arrays with the index of each element, tags[0]=a. Strings
+// that would be read back as something else, such as "42", are written as
+// quoted JSON, and so are empty maps and arrays. Keys that can't be written,
+// being empty or containing brackets, are an error.
+func (this Settings) ToURLValues(sep string) (url.Values, error) {
+	if sep == "" {
+		sep = "."
+	}
+	this.rlock()
+	defer this.runlock()
+
+	values := make(url.Values)
+	for key, value := range this.settings {
+		name, err := urlKey(key, sep, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := this.flattenURLValue(values, name, value, sep); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// urlKeyPart is a part of a key of LoadURLValues: a key of a map, the index
+// of an array or, for [], the end of an array of all the values.
+type urlKeyPart struct {
+	name   string
+	index  int
+	isName bool
+	append bool
+}
+
+// parseURLKey splits key into its parts.
+func parseURLKey(key string, sep string) ([]urlKeyPart, error) {
+	var parts []urlKeyPart
+	rest := key
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("%q has a [ without a ]", key)
+			}
+			inside := rest[1:end]
+			rest = rest[end+1:]
+			if inside == "" {
+				if rest != "" {
+					return nil, fmt.Errorf("%q has [] before its end", key)
+				}
+				parts = append(parts, urlKeyPart{append: true})
+			} else if index, err := strconv.Atoi(inside); err == nil && index >= 0 && !strings.HasPrefix(inside, "+") {
+				parts = append(parts, urlKeyPart{index: index})
+			} else {
+				parts = append(parts, urlKeyPart{name: inside, isName: true})
+			}
+			continue
+		case len(parts) > 0 && strings.HasPrefix(rest, sep):
+			rest = rest[len(sep):]
+		case len(parts) > 0:
+			return nil, fmt.Errorf("%q needs %s or [ after ]", key, sep)
+		}
+
+		end := len(rest)
+		if i := strings.Index(rest, sep); i >= 0 {
+			end = i
+		}
+		if i := strings.Index(rest, "["); i >= 0 && i < end {
+			end = i
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("%q has an empty key", key)
+		}
+		parts = append(parts, urlKeyPart{name: rest[:end], isName: true})
+		rest = rest[end:]
+	}
+	if len(parts) == 0 || !parts[0].isName {
+		return nil, fmt.Errorf("%q must start with a key", key)
+	}
+	return parts, nil
+}
+
+// urlArray holds the elements of an array while its keys are read, by index.
+type urlArray map[int]interface{}
+
+// urlValuesMap returns the settings given by v.
+func (this Settings) urlValuesMap(v url.Values, sep string) (map[string]interface{}, error) {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	root := make(map[string]interface{})
+	for _, key := range keys {
+		parts, err := parseURLKey(key, sep)
+		if err != nil {
+			return nil, err
+		}
+
+		raw := v[key]
+		var value interface{}
+		last := parts[len(parts)-1]
+		switch {
+		case last.append || len(raw) > 1:
+			if last.append {
+				parts = parts[:len(parts)-1]
+			}
+			array := make([]interface{}, len(raw))
+			for i, s := range raw {
+				array[i] = this.inferValue(s)
+			}
+			value = array
+		case len(raw) == 1:
+			value = this.inferValue(raw[0])
+		default:
+			value = ""
+		}
+
+		if err := setURLValue(root, parts, value, key); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := finishURLValue(sep, "", root)
+	if err != nil {
+		return nil, err
+	}
+	return settings.(map[string]interface{}), nil
+}
+
+// setURLValue sets value at parts below container, a map or a urlArray,
+// creating what is missing. key is the key being set, for errors.
+func setURLValue(container interface{}, parts []urlKeyPart, value interface{}, key string) error {
+	part := parts[0]
+	var existing interface{}
+	var exists bool
+	switch c := container.(type) {
+	case map[string]interface{}:
+		if !part.isName {
+			return fmt.Errorf("%q uses an index where there is a map", key)
+		}
+		existing, exists = c[part.name]
+	case urlArray:
+		if part.isName {
+			return fmt.Errorf("%q uses a key where there is an array", key)
+		}
+		existing, exists = c[part.index]
+	}
+
+	var child interface{}
+	switch {
+	case len(parts) == 1:
+		if exists {
+			return fmt.Errorf("%q sets a value that is set by another key", key)
+		}
+		child = value
+	case exists:
+		child = existing
+		_, isMap := existing.(map[string]interface{})
+		_, isArray := existing.(urlArray)
+		if !isMap && !isArray {
+			return fmt.Errorf("%q sets a value below one that is set by another key", key)
+		}
+	case parts[1].isName:
+		child = make(map[string]interface{})
+	default:
+		child = make(urlArray)
+	}
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[part.name] = child
+	case urlArray:
+		c[part.index] = child
+	}
+	if len(parts) == 1 {
+		return nil
+	}
+	return setURLValue(child, parts[1:], value, key)
+}
+
+// finishURLValue turns the urlArrays of value, found at path, into arrays. An
+// array missing an element is an error.
+func finishURLValue(sep string, path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			finished, err := finishURLValue(sep, joinPathWith(sep, path, key), child)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = finished
+		}
+		return v, nil
+	case urlArray:
+		array := make([]interface{}, len(v))
+		for i := range array {
+			child, ok := v[i]
+			if !ok {
+				return nil, fmt.Errorf("%s has no element %d", path, i)
+			}
+			finished, err := finishURLValue(sep, fmt.Sprintf("%s[%d]", path, i), child)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = finished
+		}
+		return array, nil
+	default:
+		return value, nil
+	}
+}
+
+// urlKey returns how key is written in a key of ToURLValues, in brackets if it
+// contains sep. first is whether it starts the key.
+func urlKey(key string, sep string, first bool) (string, error) {
+	if key == "" || strings.ContainsAny(key, "[]") {
+		return "", fmt.Errorf("The key %q can't be written in URL values", key)
+	}
+	if strings.Contains(key, sep) {
+		return "[" + key + "]", nil
+	}
+	if first {
+		return key, nil
+	}
+	return sep + key, nil
+}
+
+// flattenURLValue adds value, found at the key name, to values.
+func (this Settings) flattenURLValue(values url.Values, name string, value interface{}, sep string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			values.Set(name, "{}")
+			return nil
+		}
+		for key, child := range v {
+			part, err := urlKey(key, sep, false)
+			if err != nil {
+				return err
+			}
+			if err := this.flattenURLValue(values, name+part, child, sep); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if len(v) == 0 {
+			values.Set(name, "[]")
+			return nil
+		}
+		for i, child := range v {
+			if err := this.flattenURLValue(values, fmt.Sprintf("%s[%d]", name, i), child, sep); err != nil {
+				return err
+			}
+		}
+		return nil
+	case string:
+		if inferred, ok := this.inferValue(v).(string); ok && inferred == v {
+			values.Set(name, v)
+			return nil
+		}
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Could not write %s: %s", name, err)
+	}
+	values.Set(name, string(b))
+	return nil
+}
@@ -0,0 +1,197 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError lists every problem found when validating the settings.
+type ValidationError struct {
+	Problems []string
+}
+
+func (this *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid settings:\n  %s", strings.Join(this.Problems, "\n  "))
+}
+
+// ValidateAgainstStruct checks the settings against the struct v, or the
+// struct v points to, before decoding them with Get. Fields are matched to
+// keys the way Get does, using the mapstructure tag or the field name ignoring
+// case, and every value must be decodable into its field. The following tags
+// add constraints:
+//
+//	required:"true"  the key must be set, unless it is in an optional parent
+//	min:"1" max:"10" bounds for numbers, and durations such as "1s"
+//	oneof:"a b c"    the value must be one of the space separated choices
+//
+// Pointer fields are optional by default. The contents of map fields aren't
+// validated. Every problem found is returned at once as a *ValidationError.
+func (this Settings) ValidateAgainstStruct(v interface{}) error {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return fmt.Errorf("Cannot validate against %T, it is not a struct", v)
+	}
+
+	this.rlock()
+	defer this.runlock()
+
+	var problems []Problem
+	this.validateStruct("", t, this.settings, &problems)
+	if len(problems) > 0 {
+		return newValidationError(problems)
+	}
+	return nil
+}
+
+// newValidationError returns a *ValidationError listing the messages of
+// problems.
+func newValidationError(problems []Problem) *ValidationError {
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Message
+	}
+	return &ValidationError{messages}
+}
+
+// addProblem adds a problem with the value at path to problems.
+func addProblem(problems *[]Problem, path, category string, format string, args ...interface{}) {
+	*problems = append(*problems, Problem{Path: path, Category: category, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateValue checks value, found at path, against the type t.
+func (this Settings) validateValue(path string, t reflect.Type, field *reflect.StructField, value interface{}, problems *[]Problem) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && t != regexpType && t != reflect.TypeOf(time.Time{}):
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			addProblem(problems, path, CategorySchema, "%s should be a map, not %s", describePath(path), typeName(value))
+			return
+		}
+		this.validateStruct(path, t, m, problems)
+	case t.Kind() == reflect.Map:
+		if _, ok := value.(map[string]interface{}); !ok {
+			addProblem(problems, path, CategorySchema, "%s should be a map, not %s", describePath(path), typeName(value))
+		}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		array, ok := value.([]interface{})
+		if !ok {
+			addProblem(problems, path, CategorySchema, "%s should be an array, not %s", describePath(path), typeName(value))
+			return
+		}
+		for i, element := range array {
+			this.validateValue(fmt.Sprintf("%s[%d]", path, i), t.Elem(), nil, element, problems)
+		}
+	default:
+		target := reflect.New(t)
+		if err := this.decode(path, value, target.Interface()); err != nil {
+			addProblem(problems, path, CategorySchema, "%s", err)
+			return
+		}
+		if field != nil {
+			this.validateConstraints(path, *field, target.Elem(), problems)
+		}
+	}
+}
+
+// validateStruct checks every field of the struct type t against m.
+func (this Settings) validateStruct(path string, t reflect.Type, m map[string]interface{}, problems *[]Problem) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, squash, skip := decodedName(field)
+		if skip {
+			continue
+		}
+		if squash {
+			this.validateStruct(path, field.Type, m, problems)
+			continue
+		}
+
+		key, ok := fieldKey(m, name)
+		if !ok || this.emptyIsMissing && isEmpty(m[key]) {
+			if field.Tag.Get("required") == "true" {
+				required := this.joinPath(path, name)
+				addProblem(problems, required, CategoryRequired, "%s is required", required)
+			}
+			continue
+		}
+		this.validateValue(this.joinPath(path, key), field.Type, &field, m[key], problems)
+	}
+}
+
+// validateConstraints checks the min, max and oneof tags of field against the
+// decoded value.
+func (this Settings) validateConstraints(path string, field reflect.StructField, value reflect.Value, problems *[]Problem) {
+	if choices, ok := field.Tag.Lookup("oneof"); ok {
+		found := false
+		for _, choice := range strings.Fields(choices) {
+			found = found || fmt.Sprint(value.Interface()) == choice
+		}
+		if !found {
+			addProblem(problems, path, CategorySchema, "%s is %v, it must be one of %s", path, value.Interface(), choices)
+		}
+	}
+
+	number, ok := numericValue(value)
+	if !ok {
+		return
+	}
+	for _, bound := range []string{"min", "max"} {
+		tag, ok := field.Tag.Lookup(bound)
+		if !ok {
+			continue
+		}
+		limit, err := parseBound(value.Type(), tag)
+		if err != nil {
+			addProblem(problems, path, CategorySchema, "%s has an invalid %s tag: %s", field.Name, bound, err)
+		} else if bound == "min" && number < limit || bound == "max" && number > limit {
+			addProblem(problems, path, CategorySchema, "%s is %v, it must be at %s %s", path, value.Interface(), map[string]string{"min": "least", "max": "most"}[bound], tag)
+		}
+	}
+}
+
+// fieldKey finds the key of m for a field named name, ignoring case like
+// mapstructure does.
+func fieldKey(m map[string]interface{}, name string) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// numericValue returns value as a float64 if it is a number.
+func numericValue(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// parseBound parses a min or max tag for a field of type t.
+func parseBound(t reflect.Type, tag string) (float64, error) {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(tag)
+		return float64(d), err
+	}
+	return strconv.ParseFloat(tag, 64)
+}
@@ -0,0 +1,305 @@
+package flexiconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// View is a read-only view of settings with some of their values overridden,
+// as returned by Overlay.
+type View struct {
+	base      Settings
+	overrides map[string]interface{}
+	prefix    string
+	// err is why the overrides couldn't be used, returned by every getter.
+	err error
+}
+
+// Overlay returns a read-only view of the settings in which the values of
+// overrides replace theirs, merged as a load would merge them, such as the
+// settings of one tenant on top of those shared by all. The view copies
+// overrides but not the settings: values that aren't overridden are read from
+// the settings when asked for, so a view costs memory in proportion to its
+// overrides only, and changes made to the settings later are seen through it.
+// Getting a map that is overridden in part, and GetJSON, merge a copy of it.
+//
+// overrides are checked and normalized like MergeSettings does. If they can't
+// be, every getter of the view returns why, and GetJSON returns null.
+func (this Settings) Overlay(overrides map[string]interface{}) View {
+	this.lazyInit()
+	view := View{base: this}
+	normalized, err := this.normalizeSettings(overrides)
+	if err == nil {
+		var renamed interface{}
+		if renamed, err = this.normalizeKeys("", normalized); err == nil {
+			normalized = renamed.(map[string]interface{})
+			err = this.checkValidators("", normalized)
+		}
+	}
+	if err != nil {
+		view.err = fmt.Errorf("Could not overlay the settings: %s", err)
+		return view
+	}
+	view.overrides = normalized
+	return view
+}
+
+// fullPath returns path prefixed by the prefix of the view.
+func (this View) fullPath(path string) string {
+	return prefixedPath(this.base.pathSeparator(), this.prefix, path)
+}
+
+// overridden returns the value the overrides set at path, and whether they
+// set path or one of its parents. A parent set to something other than a map
+// hides whatever the settings have below it, making path not found.
+func (this View) overridden(path string) (interface{}, bool, error) {
+	if path == "" {
+		return this.overrides, len(this.overrides) > 0, nil
+	}
+
+	sep := this.base.pathSeparator()
+	node := this.overrides
+	rest := path
+	for {
+		part := rest
+		i := strings.Index(rest, sep)
+		if i >= 0 {
+			part = rest[:i]
+		}
+		value, ok := node[part]
+		if !ok {
+			return nil, false, nil
+		}
+		if i < 0 {
+			if value == nil {
+				return nil, true, &nullValueError{path}
+			}
+			return value, true, nil
+		}
+
+		rest = rest[i+len(sep):]
+		if node, ok = value.(map[string]interface{}); !ok {
+			missing := rest
+			if j := strings.Index(rest, sep); j >= 0 {
+				missing = rest[:j]
+			}
+			return nil, true, newNotFoundError(path, missing)
+		}
+	}
+}
+
+// get returns the value at path, which includes the prefix, resolved like the
+// getters of the settings do, see AddResolver.
+func (this View) get(path string) (interface{}, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	path = this.base.normalizePath(path)
+	value, overridden, err := this.overridden(path)
+	if !overridden {
+		return this.base.getResolved(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	override, ok := value.(map[string]interface{})
+	if !ok {
+		return this.base.resolve(path, value)
+	}
+
+	this.base.rlock()
+	var base interface{} = this.base.settings
+	if path != "" {
+		base, _ = this.base.rawGet(path)
+	}
+	merged, ok := deepCopy(base).(map[string]interface{})
+	this.base.runlock()
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+
+	copied := deepCopy(override).(map[string]interface{})
+	if err := mergeMaps(merged, copied, path, mergeConfig{separator: this.base.pathSeparator()}); err != nil {
+		return nil, err
+	}
+	return this.base.resolve(path, merged)
+}
+
+// getTyped is get for the typed getters, see Settings.getTyped.
+func (this View) getTyped(path string) (interface{}, error) {
+	value, err := this.get(path)
+	if err == nil && this.base.emptyIsMissing && isEmpty(value) {
+		return nil, &notFoundError{fmt.Sprintf("%s is empty", path)}
+	}
+	return value, err
+}
+
+// RawGet returns a copy of the value at path, with the overrides merged into
+// maps, like Settings.RawGet.
+func (this View) RawGet(path string) (interface{}, error) {
+	value, err := this.get(this.fullPath(path))
+	return deepCopy(value), err
+}
+
+// Get stores the value at path in target, like Settings.Get.
+func (this View) Get(path string, target interface{}) error {
+	full := this.fullPath(path)
+	value, err := this.getTyped(full)
+	if err != nil {
+		return err
+	}
+	return this.base.decode(full, deepCopy(value), target)
+}
+
+// GetString returns the string at path, or the defaultValue and an error.
+func (this View) GetString(path string, defaultValue string) (string, error) {
+	full := this.fullPath(path)
+	rawvalue, err := this.getTyped(full)
+	if err != nil {
+		return defaultValue, err
+	}
+	value, ok := rawvalue.(string)
+	if !ok {
+		return defaultValue, typeError(full, rawvalue, "a string")
+	}
+	return value, nil
+}
+
+// GetInt returns the integer at path, or the defaultValue and an error.
+func (this View) GetInt(path string, defaultValue int64) (int64, error) {
+	var target int64
+	if err := this.getNumber(path, &target); err != nil {
+		return defaultValue, err
+	}
+	return target, nil
+}
+
+// GetUint returns the unsigned integer at path, or the defaultValue and an
+// error.
+func (this View) GetUint(path string, defaultValue uint64) (uint64, error) {
+	var target uint64
+	if err := this.getNumber(path, &target); err != nil {
+		return defaultValue, err
+	}
+	return target, nil
+}
+
+// GetFloat returns the number at path, or the defaultValue and an error.
+func (this View) GetFloat(path string, defaultValue float64) (float64, error) {
+	var target float64
+	if err := this.getNumber(path, &target); err != nil {
+		return defaultValue, err
+	}
+	return target, nil
+}
+
+// GetDuration returns the duration at path, or the defaultValue and an error.
+func (this View) GetDuration(path string, defaultValue time.Duration) (time.Duration, error) {
+	var target time.Duration
+	if err := this.getNumber(path, &target); err != nil {
+		return defaultValue, err
+	}
+	return target, nil
+}
+
+// getNumber is Settings.getNumber for the view.
+func (this View) getNumber(path string, target interface{}) error {
+	full := this.fullPath(path)
+	rawvalue, err := this.getTyped(full)
+	if err != nil {
+		return err
+	}
+	return this.base.numberValue(full, rawvalue, target)
+}
+
+// GetBool returns the bool at path, or the defaultValue and an error. Weakly
+// typed settings make it GetBoolLenient.
+func (this View) GetBool(path string, defaultValue bool) (bool, error) {
+	if this.base.weaklyTyped {
+		return this.GetBoolLenient(path, defaultValue)
+	}
+	full := this.fullPath(path)
+	rawvalue, err := this.getTyped(full)
+	if err != nil {
+		return defaultValue, err
+	}
+	value, ok := rawvalue.(bool)
+	if !ok {
+		return defaultValue, typeError(full, rawvalue, "a bool")
+	}
+	return value, nil
+}
+
+// GetBoolLenient returns the bool at path, also accepting the strings
+// Settings.GetBoolLenient does, such as "on" or "no".
+func (this View) GetBoolLenient(path string, defaultValue bool) (bool, error) {
+	full := this.fullPath(path)
+	rawvalue, err := this.getTyped(full)
+	if err != nil {
+		return defaultValue, err
+	}
+	return lenientBoolValue(full, rawvalue, defaultValue)
+}
+
+// Has returns whether a value is set at path, by the overrides or the
+// settings. The root is set unless the overrides couldn't be used.
+func (this View) Has(path string) bool {
+	full := this.fullPath(path)
+	if full == "" {
+		return this.err == nil
+	}
+	_, err := this.get(full)
+	return err == nil
+}
+
+// Keys returns the sorted keys of the map at path, those of the overrides
+// included.
+func (this View) Keys(path string) ([]string, error) {
+	full := this.fullPath(path)
+	value, err := this.get(full)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map", full)
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Sub returns the view below path, whose paths are all relative to it.
+func (this View) Sub(path string) Reader {
+	sub := this
+	sub.prefix = this.fullPath(path)
+	return sub
+}
+
+// GetJSON returns the json representation of the settings below the prefix
+// with the overrides merged, or null if nothing is set there.
+func (this View) GetJSON() []byte {
+	value, err := this.get(this.prefix)
+	if err != nil {
+		return []byte("null")
+	}
+
+	this.base.rlock()
+	encoded := this.base.jsonValueAt(this.prefix, value)
+	this.base.runlock()
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return []byte("null")
+	}
+	return b
+}
+
+var _ Reader = View{}
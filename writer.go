@@ -0,0 +1,80 @@
+package flexiconfig
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Writer allows changing the settings below a fixed prefix, and nothing else.
+// It is meant to be handed to components that need to record values of their
+// own without being able to touch the rest of the settings.
+type Writer struct {
+	settings *Settings
+	prefix   string
+}
+
+// SubWriter returns a Writer whose paths are all relative to prefix.
+func (this *Settings) SubWriter(prefix string) Writer {
+	return Writer{settings: this, prefix: prefix}
+}
+
+// Prefix returns the path all of the writer's paths are relative to.
+func (this Writer) Prefix() string {
+	return this.prefix
+}
+
+// Set sets the value at path below the prefix, like RawSet with timid set to
+// false.
+func (this Writer) Set(path string, value interface{}) error {
+	full, err := this.fullPath(path)
+	if err != nil {
+		return err
+	}
+	return this.settings.RawSet(false, full, value)
+}
+
+// Delete removes the value at path below the prefix.
+func (this Writer) Delete(path string) error {
+	full, err := this.fullPath(path)
+	if err != nil {
+		return err
+	}
+	return this.settings.Delete(full)
+}
+
+// Append adds values to the array at path below the prefix.
+func (this Writer) Append(path string, values ...interface{}) error {
+	full, err := this.fullPath(path)
+	if err != nil {
+		return err
+	}
+	return this.settings.Append(full, values...)
+}
+
+// fullPath validates path and prefixes it. Neither the prefix nor the path may
+// be empty or contain empty, "." or ".." segments.
+func (this Writer) fullPath(path string) (string, error) {
+	sep := this.settings.pathSeparator()
+	if err := checkWriterPath(sep, this.prefix); err != nil {
+		return "", fmt.Errorf("Invalid writer prefix %q: %s", this.prefix, err)
+	}
+	if err := checkWriterPath(sep, path); err != nil {
+		return "", fmt.Errorf("Invalid path %q: %s", path, err)
+	}
+	return this.prefix + sep + path, nil
+}
+
+func checkWriterPath(sep, path string) error {
+	if path == "" {
+		return fmt.Errorf("path is empty")
+	}
+	for _, part := range strings.Split(path, sep) {
+		switch part {
+		case "":
+			return fmt.Errorf("path has an empty segment")
+		case ".", "..":
+			return fmt.Errorf("path may not contain %q", part)
+		}
+	}
+	return nil
+}